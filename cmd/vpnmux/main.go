@@ -9,6 +9,7 @@ import (
 
 	"github.com/pricec/vpnmux/pkg/api"
 	"github.com/pricec/vpnmux/pkg/config"
+	"github.com/pricec/vpnmux/pkg/logging"
 )
 
 func main() {
@@ -17,6 +18,16 @@ func main() {
 		log.Fatalf("error reading configuration: %v", err)
 	}
 
+	level, err := logging.ParseLevel(cfg.LogLevel)
+	if err != nil {
+		log.Fatalf("error reading configuration: %v", err)
+	}
+	logger, err := logging.New(os.Stderr, cfg.LogFormat, level)
+	if err != nil {
+		log.Fatalf("error reading configuration: %v", err)
+	}
+	logging.SetDefault(logger)
+
 	ctx, cancel := context.WithCancel(context.Background())
 	sigCh := make(chan os.Signal, 1)
 	doneCh := make(chan struct{})
@@ -34,12 +45,12 @@ func main() {
 		Config: cfg,
 	})
 	if err != nil {
-		log.Fatalf("error setting up API server: %v", err)
+		logging.Fatal(ctx, "error setting up API server", "err", err)
 	}
 	defer func() {
 		err := server.Close(ctx)
 		if err != nil {
-			log.Printf("error closing server: %v", err)
+			logging.Error(ctx, "error closing server", "err", err)
 		}
 	}()
 
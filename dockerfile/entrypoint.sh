@@ -6,4 +6,12 @@ iptables -t filter -A FORWARD -i eth0 -o !tun0 -j DROP
 GATEWAY_IP=$(ip route show default | sed -E 's/.*via ([0-9.]+) dev.*/\1/')
 ip route add ${LOCAL_SUBNET_CIDR} via ${GATEWAY_IP}
 
-openvpn $@
+if [ -n "${LOCAL_SUBNET6_CIDR}" ]; then
+    ip6tables -t nat -A POSTROUTING -o tun0 -j MASQUERADE
+    ip6tables -t filter -A FORWARD -i eth0 ! -o tun0 -j DROP
+
+    GATEWAY6_IP=$(ip -6 route show default | sed -E 's/.*via ([0-9a-f:]+) dev.*/\1/')
+    ip -6 route add ${LOCAL_SUBNET6_CIDR} via ${GATEWAY6_IP}
+fi
+
+openvpn --script-security 2 --up /up.sh --up-restart --config $@
@@ -0,0 +1,7 @@
+#!/bin/sh
+
+# Record the DNS servers pushed by the OpenVPN server so that vpnmux can
+# forward queries to them.
+mkdir -p /run/vpnmux
+env | sed -n -E 's/^foreign_option_[0-9]+=dhcp-option DNS6? ([^ ]+).*$/\1/p' > /run/vpnmux/dns.tmp
+mv /run/vpnmux/dns.tmp /run/vpnmux/dns
@@ -4,10 +4,12 @@ go 1.16
 
 require (
 	github.com/caarlos0/env/v6 v6.9.1
-	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/eclipse/paho.mqtt.golang v1.4.1
 	github.com/google/uuid v1.3.0
 	github.com/gorilla/mux v1.8.0
 	github.com/hashicorp/go-multierror v1.1.1
+	github.com/prometheus/client_golang v1.12.2
 	github.com/stretchr/testify v1.7.1
+	golang.org/x/net v0.0.0-20211112202133-69e39bad7dc2
 	modernc.org/sqlite v1.17.1
 )
@@ -0,0 +1,121 @@
+package api
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/pricec/vpnmux/pkg/audit"
+	"github.com/pricec/vpnmux/pkg/logging"
+)
+
+// RequestIDHeader carries the ID of a request, which is logged with every
+// line, including each host command, logged on the request's behalf.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds the length of IDs supplied by clients.
+const maxRequestIDLength = 128
+
+// requestID adopts the request's ID from its header if present, or else
+// generates one, and returns it in the response's header. The request's
+// actor is taken from actorHeader, set by an authenticating proxy, if it
+// is configured and the request comes from one of proxies (or any address
+// if none are given), or else is the client's address. Each request is
+// logged once handled.
+func requestID(actorHeader string, proxies []*net.IPNet) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(RequestIDHeader)
+			if id == "" || len(id) > maxRequestIDLength {
+				id = uuid.New().String()
+			}
+			w.Header().Set(RequestIDHeader, id)
+
+			var actor string
+			if actorHeader != "" && trusted(proxies, remoteHost(r)) {
+				actor = r.Header.Get(actorHeader)
+			}
+			if actor == "" {
+				actor = remoteHost(r)
+			}
+
+			ctx := logging.With(r.Context(), "request_id", id)
+			ctx = audit.NewContext(ctx, audit.Origin{RequestID: id, Actor: actor})
+			start := time.Now()
+			rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+			next.ServeHTTP(rec, r.WithContext(ctx))
+
+			// Reads, e.g. metrics scrapes, would drown out the changes.
+			log := logging.Info
+			if r.Method == http.MethodGet {
+				log = logging.Debug
+			}
+			log(ctx, "handled request",
+				"method", r.Method,
+				"path", r.URL.Path,
+				"actor", actor,
+				"code", rec.code,
+				"duration", time.Since(start),
+			)
+		})
+	}
+}
+
+// parseProxies parses the addresses of trusted proxies, each an IP address
+// or a subnet in CIDR notation.
+func parseProxies(addresses []string) ([]*net.IPNet, error) {
+	var result []*net.IPNet
+	for _, address := range addresses {
+		address = strings.TrimSpace(address)
+		if address == "" {
+			continue
+		}
+		if !strings.Contains(address, "/") {
+			ip := net.ParseIP(address)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy address %q", address)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			result = append(result, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, subnet, err := net.ParseCIDR(address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy subnet %q: %w", address, err)
+		}
+		result = append(result, subnet)
+	}
+	return result, nil
+}
+
+// trusted returns true iff host is one of proxies, or no proxies are given.
+func trusted(proxies []*net.IPNet, host string) bool {
+	if len(proxies) == 0 {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, proxy := range proxies {
+		if proxy.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
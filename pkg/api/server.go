@@ -4,13 +4,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/pricec/vpnmux/pkg/api/v1"
 	"github.com/pricec/vpnmux/pkg/config"
+	"github.com/pricec/vpnmux/pkg/logging"
+	"github.com/pricec/vpnmux/pkg/metrics"
 )
 
 type HealthHandler struct{}
@@ -29,9 +30,18 @@ type ServerOptions struct {
 }
 
 func NewServer(ctx context.Context, opts ServerOptions) (*Server, error) {
+	proxies, err := parseProxies(opts.Config.AuditTrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
 	r := mux.NewRouter()
+	r.Use(requestID(opts.Config.AuditActorHeader, proxies), instrument)
 	r.Handle("/healthz", HealthHandler{}).Methods("GET")
+	r.Handle("/metrics", metrics.Handler()).Methods("GET")
 	v1.RegisterHandlers(ctx, r.PathPrefix("/v1").Subrouter(), opts.Config)
+	r.PathPrefix("/ui/").Handler(uiHandler()).Methods("GET")
+	r.Handle("/", http.RedirectHandler("/ui/", http.StatusFound)).Methods("GET")
 
 	s := &Server{
 		server: &http.Server{
@@ -48,7 +58,7 @@ func NewServer(ctx context.Context, opts ServerOptions) (*Server, error) {
 func (s *Server) start() {
 	err := s.server.ListenAndServe()
 	if err != nil && !errors.Is(err, http.ErrServerClosed) {
-		log.Printf("error stopping server: %v", err)
+		logging.Error(context.Background(), "error stopping server", "err", err)
 	}
 }
 
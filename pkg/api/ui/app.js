@@ -0,0 +1,313 @@
+// The UI drives the v1 API of the server it is served from. Paths are
+// relative, so that it also works behind a proxy which mounts vpnmux under
+// a prefix.
+"use strict";
+
+const API = "../v1";
+
+const state = {
+  credentials: [],
+  configs: [],
+  networks: [],
+  clients: [],
+  // Network ID of each client, or "" if it is not assigned.
+  assignments: {},
+  // Tunnel state of each network.
+  tunnels: {},
+};
+
+// A version, if given, is sent in If-Match, so that the request fails with
+// 412 if the resource has changed since it was loaded.
+async function api(method, path, body, version) {
+  const opts = { method, headers: {} };
+  if (version !== undefined) {
+    opts.headers["If-Match"] = `"${version}"`;
+  }
+  if (body !== undefined) {
+    opts.headers["Content-Type"] = "application/json";
+    opts.body = JSON.stringify(body);
+  }
+
+  const resp = await fetch(API + path, opts);
+  const text = await resp.text();
+  let data = null;
+  try {
+    data = text ? JSON.parse(text) : null;
+  } catch (e) {
+    data = null;
+  }
+  if (!resp.ok) {
+    let message = (data && data.description) || resp.statusText;
+    if (data && data.fields) {
+      message += ": " + data.fields.map((f) => `${f.field} ${f.message}`).join(", ");
+    }
+    if (data && data.dependents) {
+      message = "In use by " + data.dependents.map((d) => `${d.resource} ${d.name || d.id || ""}`.trim()).join(", ");
+    }
+    const err = new Error(message);
+    err.status = resp.status;
+    throw err;
+  }
+  return data;
+}
+
+function showError(err) {
+  const el = document.getElementById("error");
+  if (!err) {
+    el.hidden = true;
+    return;
+  }
+  el.textContent = err.message || String(err);
+  el.hidden = false;
+}
+
+function el(tag, attrs, ...children) {
+  const node = document.createElement(tag);
+  for (const [key, value] of Object.entries(attrs || {})) {
+    if (key.startsWith("on")) {
+      node.addEventListener(key.slice(2), value);
+    } else if (value !== undefined && value !== null && value !== false) {
+      node.setAttribute(key, value === true ? "" : value);
+    }
+  }
+  for (const child of children) {
+    node.append(child instanceof Node ? child : document.createTextNode(child));
+  }
+  return node;
+}
+
+function name(list, id) {
+  const item = list.find((i) => i.id === id);
+  return item ? item.name : id;
+}
+
+async function load() {
+  const [credentials, configs, networks, clients] = await Promise.all([
+    api("GET", "/credential"),
+    api("GET", "/config"),
+    api("GET", "/network"),
+    api("GET", "/client"),
+  ]);
+  state.credentials = credentials || [];
+  state.configs = configs || [];
+  state.networks = networks || [];
+  state.clients = clients || [];
+
+  const tunnels = await Promise.all(
+    state.networks.map((n) => api("GET", `/network/${n.id}/state`).catch(() => ({ state: "unknown" })))
+  );
+  state.tunnels = {};
+  state.networks.forEach((n, i) => (state.tunnels[n.id] = tunnels[i].state));
+
+  const assignments = await Promise.all(
+    state.clients.map((c) =>
+      api("GET", `/client/${c.id}/network`).catch((err) => {
+        if (err.status === 404) {
+          return null;
+        }
+        throw err;
+      })
+    )
+  );
+  state.assignments = {};
+  state.clients.forEach((c, i) => (state.assignments[c.id] = assignments[i] ? assignments[i].network_id : ""));
+}
+
+function renderClients() {
+  const body = document.getElementById("clients");
+  body.replaceChildren(
+    ...state.clients.map((c) => {
+      const select = el(
+        "select",
+        { onchange: (e) => assign(c.id, e.target.value) },
+        el("option", { value: "", selected: state.assignments[c.id] === "" }, "none"),
+        ...state.networks.map((n) => el("option", { value: n.id, selected: state.assignments[c.id] === n.id }, n.name))
+      );
+      return el(
+        "tr",
+        {
+          draggable: "true",
+          ondragstart: (e) => e.dataTransfer.setData("text/plain", c.id),
+        },
+        el("td", {}, c.name),
+        el("td", {}, c.address || ""),
+        el("td", {}, c.mac || ""),
+        el("td", {}, select)
+      );
+    })
+  );
+}
+
+function renderNetworks() {
+  const body = document.getElementById("networks");
+  body.replaceChildren(
+    ...state.networks.map((n) => {
+      const tunnel = state.tunnels[n.id] || "unknown";
+      const count = state.clients.filter((c) => state.assignments[c.id] === n.id).length;
+      const row = el(
+        "tr",
+        {
+          ondragover: (e) => {
+            e.preventDefault();
+            row.classList.add("drop");
+          },
+          ondragleave: () => row.classList.remove("drop"),
+          ondrop: (e) => {
+            e.preventDefault();
+            row.classList.remove("drop");
+            assign(e.dataTransfer.getData("text/plain"), n.id);
+          },
+        },
+        el("td", {}, n.name),
+        el("td", {}, el("span", { class: `badge ${tunnel}` }, tunnel)),
+        el("td", {}, name(state.configs, n.config_id)),
+        el("td", {}, n.ipv6 ? "yes" : "no"),
+        el("td", {}, String(count)),
+        el("td", {}, el("button", { onclick: () => remove("network", n) }, "Delete"))
+      );
+      return row;
+    })
+  );
+}
+
+function renderConfigs() {
+  document.getElementById("configs").replaceChildren(
+    ...state.configs.map((c) =>
+      el(
+        "tr",
+        {},
+        el("td", {}, c.name),
+        el("td", {}, c.host),
+        el("td", {}, el("button", { onclick: () => remove("config", c) }, "Delete"))
+      )
+    )
+  );
+  for (const select of document.querySelectorAll("select.configs")) {
+    const value = select.value;
+    select.replaceChildren(...state.configs.map((c) => el("option", { value: c.id, selected: c.id === value }, c.name)));
+  }
+}
+
+function renderCredentials() {
+  document.getElementById("credentials").replaceChildren(
+    ...state.credentials.map((c) =>
+      el("tr", {}, el("td", {}, c.name), el("td", {}, el("button", { onclick: () => remove("credential", c) }, "Delete")))
+    )
+  );
+  for (const select of document.querySelectorAll("select.credentials")) {
+    const value = select.value;
+    select.replaceChildren(
+      ...state.credentials.map((c) => el("option", { value: c.id, selected: c.id === value }, c.name))
+    );
+  }
+}
+
+function render() {
+  renderClients();
+  renderNetworks();
+  renderConfigs();
+  renderCredentials();
+}
+
+async function refresh() {
+  try {
+    await load();
+    render();
+  } catch (err) {
+    showError(err);
+  }
+}
+
+// Assigning a client which is already assigned replaces its assignment.
+async function assign(clientID, networkID) {
+  if (!clientID || state.assignments[clientID] === networkID) {
+    return;
+  }
+  try {
+    if (state.assignments[clientID] !== "") {
+      await api("DELETE", `/client/${clientID}/network`);
+    }
+    if (networkID !== "") {
+      await api("POST", `/client/${clientID}/network/${networkID}`);
+    }
+    showError(null);
+  } catch (err) {
+    showError(err);
+  }
+  await refresh();
+}
+
+async function remove(kind, item) {
+  if (!confirm(`Delete ${kind} ${item.name}?`)) {
+    return;
+  }
+  try {
+    await api("DELETE", `/${kind}/${item.id}`, undefined, item.version);
+    showError(null);
+  } catch (err) {
+    showError(err);
+  }
+  await refresh();
+}
+
+function onSubmit(id, path, build) {
+  const form = document.getElementById(id);
+  form.addEventListener("submit", async (e) => {
+    e.preventDefault();
+    try {
+      await api("POST", path, build(new FormData(form)));
+      form.reset();
+      showError(null);
+    } catch (err) {
+      showError(err);
+    }
+    await refresh();
+  });
+}
+
+onSubmit("credential-form", "/credential", (data) => ({
+  name: data.get("name"),
+  value: data.get("value"),
+}));
+
+onSubmit("config-form", "/config", (data) => ({
+  name: data.get("name"),
+  host: data.get("host"),
+  user_cred: data.get("user_cred"),
+  pass_cred: data.get("pass_cred"),
+  ca_cred: data.get("ca_cred"),
+  ovpn_cred: data.get("ovpn_cred"),
+}));
+
+onSubmit("network-form", "/network", (data) => ({
+  name: data.get("name"),
+  config_id: data.get("config_id"),
+  ipv6: data.get("ipv6") === "on",
+}));
+
+// Changes made elsewhere, and tunnel state changes, are picked up from the
+// event stream; bursts of events cause a single refresh.
+function subscribe() {
+  const live = document.getElementById("live");
+  const source = new EventSource(API + "/events");
+  let timer = null;
+  const changed = () => {
+    clearTimeout(timer);
+    timer = setTimeout(refresh, 250);
+  };
+
+  source.onopen = () => {
+    live.className = "badge up";
+    live.textContent = "live";
+  };
+  source.onerror = () => {
+    live.className = "badge down";
+    live.textContent = "offline";
+  };
+  for (const type of ["create", "update", "delete", "network_state", "reset"]) {
+    source.addEventListener(type, changed);
+  }
+}
+
+refresh();
+subscribe();
@@ -0,0 +1,204 @@
+package v1
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pricec/vpnmux/pkg/audit"
+	"github.com/pricec/vpnmux/pkg/database"
+)
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+func parseAuditQuery(r *http.Request) (database.AuditFilter, error) {
+	query := r.URL.Query()
+	filter := database.AuditFilter{
+		Kind:       query.Get("kind"),
+		RequestID:  query.Get("request_id"),
+		Actor:      query.Get("actor"),
+		Resource:   query.Get("resource"),
+		ResourceID: query.Get("resource_id"),
+		Limit:      defaultAuditLimit,
+	}
+
+	var err error
+	if s := query.Get("from"); s != "" {
+		if filter.From, err = time.Parse(time.RFC3339, s); err != nil {
+			return filter, fmt.Errorf("invalid from: %w", err)
+		}
+	}
+	if s := query.Get("to"); s != "" {
+		if filter.To, err = time.Parse(time.RFC3339, s); err != nil {
+			return filter, fmt.Errorf("invalid to: %w", err)
+		}
+	}
+	if s := query.Get("before"); s != "" {
+		if filter.Before, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return filter, fmt.Errorf("invalid before: %w", err)
+		}
+	}
+	if s := query.Get("limit"); s != "" {
+		if filter.Limit, err = strconv.Atoi(s); err != nil {
+			return filter, fmt.Errorf("invalid limit: %w", err)
+		}
+		if filter.Limit < 1 || filter.Limit > maxAuditLimit {
+			return filter, fmt.Errorf("limit must be between 1 and %d", maxAuditLimit)
+		}
+	}
+	return filter, nil
+}
+
+func (m *Manager) ListAudit(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseAuditQuery(r)
+	if err != nil {
+		check(w, r, nil, err, errQuery(err))
+		return
+	}
+
+	entries, err := m.db.Audit.Query(r.Context(), filter)
+	check(w, r, entries, err, errorFor(err))
+}
+
+// responseBuffer is a ResponseWriter which keeps the response in memory.
+type responseBuffer struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (b *responseBuffer) Header() http.Header {
+	if b.header == nil {
+		b.header = make(http.Header)
+	}
+	return b.header
+}
+
+func (b *responseBuffer) WriteHeader(code int) {
+	if b.code == 0 {
+		b.code = code
+	}
+}
+
+func (b *responseBuffer) Write(p []byte) (int, error) {
+	b.WriteHeader(http.StatusOK)
+	return b.body.Write(p)
+}
+
+// teeWriter copies the response into a buffer as it is written.
+type teeWriter struct {
+	http.ResponseWriter
+	buf responseBuffer
+}
+
+func (w *teeWriter) WriteHeader(code int) {
+	w.buf.WriteHeader(code)
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *teeWriter) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	return w.ResponseWriter.Write(p)
+}
+
+// state returns the representation of the resource at path, as served by
+// its GET route, or nothing if it cannot be read.
+func (m *Manager) state(r *http.Request, path string) json.RawMessage {
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, path, nil)
+	if err != nil {
+		return nil
+	}
+	var buf responseBuffer
+	m.router.ServeHTTP(&buf, req)
+	if buf.code != http.StatusOK {
+		return nil
+	}
+	return buf.body.Bytes()
+}
+
+// recordMutations records every create, update and delete made via the API
+// in the audit log, with the state of the resource before and after, and
+// publishes those which succeed as events. The resource is named after the
+// fixed segments of the route, e.g. changes to /client/{id}/network are
+// recorded as of resource "client/network".
+func (m *Manager) recordMutations(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := mux.CurrentRoute(r)
+		if r.Method == http.MethodGet || route == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		segments := strings.Split(strings.TrimPrefix(template, "/v1/"), "/")
+		var resource []string
+		for _, segment := range segments {
+			if !strings.HasPrefix(segment, "{") {
+				resource = append(resource, segment)
+			}
+		}
+		last := segments[len(segments)-1]
+
+		// Changes made by POSTing to an item (e.g. assigning a client's
+		// network) are read back from its parent (the client's network).
+		path := r.URL.Path
+		action := "update"
+		switch {
+		case r.Method == http.MethodDelete:
+			action = "delete"
+		case r.Method == http.MethodPost && !strings.HasPrefix(last, "{"):
+			action = "create"
+		case r.Method == http.MethodPost:
+			path = path[:strings.LastIndex(path, "/")]
+		}
+
+		e := &database.AuditEntry{
+			Action:     action,
+			Resource:   strings.Join(resource, "/"),
+			ResourceID: mux.Vars(r)["id"],
+			Path:       r.URL.Path,
+		}
+		if action != "create" {
+			e.Before = m.state(r, path)
+		}
+
+		tee := &teeWriter{ResponseWriter: w}
+		next.ServeHTTP(tee, r)
+		e.Code = tee.buf.code
+		if e.Code == 0 {
+			e.Code = http.StatusOK
+		}
+
+		if e.Code < http.StatusBadRequest {
+			switch action {
+			case "create":
+				e.After = tee.buf.body.Bytes()
+				var created struct {
+					ID string `json:"id"`
+				}
+				if json.Unmarshal(e.After, &created) == nil {
+					e.ResourceID = created.ID
+				}
+			case "update":
+				e.After = m.state(r, path)
+			}
+		}
+		m.audit.Mutation(r.Context(), e)
+
+		if e.Code < http.StatusBadRequest {
+			m.events.Publish(r.Context(), action, e.Resource, e.ResourceID, audit.Redact(e.After))
+		}
+	})
+}
@@ -1,119 +1,194 @@
 package v1
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
+	"mime"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/pricec/vpnmux/pkg/database"
+	"github.com/pricec/vpnmux/pkg/inventory"
+	"github.com/pricec/vpnmux/pkg/lease"
 )
 
 func (m *Manager) ListClients(w http.ResponseWriter, r *http.Request) {
-	creds, err := m.db.Clients.List(r.Context())
-	check(w, creds, err, ErrorDatabase)
+	opts, err := parseListQuery(r)
+	if err != nil {
+		check(w, r, nil, err, errQuery(err))
+		return
+	}
+
+	clients, page, err := m.db.Clients.Query(r.Context(), opts)
+	if err == nil {
+		setPageHeaders(w, r, page)
+	}
+	check(w, r, clients, err, errorFor(err))
 }
 
 func (m *Manager) CreateClient(w http.ResponseWriter, r *http.Request) {
 	c := &database.Client{}
 	if err := json.NewDecoder(r.Body).Decode(c); err != nil {
-		check(w, nil, err, errDecode(err))
+		check(w, r, nil, err, errDecode(err))
 		return
 	}
 
 	cfg, err := m.rec.Clients.Create(r.Context(), c)
-	check(w, cfg, err, ErrorDatabase)
+	check(w, r, cfg, err, errorFor(err))
 }
 
 func (m *Manager) GetClient(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
 
-	var alt Error
 	client, _, err := m.rec.Clients.Get(r.Context(), id)
-	switch err {
-	case database.ErrNotFound:
-		alt = ErrorNotFound
-	default:
-		alt = ErrorDatabase
-	}
-	check(w, client, err, alt)
+	check(w, r, client, err, errorFor(err))
 }
 
 func (m *Manager) UpdateClient(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
 	c := &database.Client{}
 	if err := json.NewDecoder(r.Body).Decode(c); err != nil {
-		check(w, nil, err, errDecode(err))
+		check(w, r, nil, err, errDecode(err))
 		return
 	}
 	c.ID = id
 
-	var alt Error
-	client, err := m.rec.Clients.Update(r.Context(), c)
-	switch err {
-	case database.ErrNotFound:
-		alt = ErrorNotFound
-	default:
-		alt = ErrorDatabase
-	}
-	check(w, client, err, alt)
+	client, err := m.rec.Clients.Update(ifMatch(r, "client", id), c)
+	check(w, r, client, err, errorFor(err))
 }
 
 func (m *Manager) DeleteClient(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
 
-	var alt Error
-	err := m.rec.Clients.Delete(r.Context(), id)
-	switch err {
-	case database.ErrNotFound:
-		alt = ErrorNotFound
+	err := m.rec.Clients.Delete(ifMatch(r, "client", id), id)
+	check(w, r, ErrorOK, err, errorFor(err))
+}
+
+// ImportClients creates clients from a list of hosts, given in the format
+// named by the format query parameter: csv (the default, or text/csv),
+// leases (a dnsmasq or ISC dhcpd lease file) or json (application/json),
+// e.g. hosts returned by DiscoverClients. The network query parameter
+// assigns the hosts which don't name a network.
+func (m *Manager) ImportClients(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format == "" {
+		format = "csv"
+		if t, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err == nil && t == "application/json" {
+			format = "json"
+		}
+	}
+
+	body, err := readBody(w, r)
+	if err != nil {
+		check(w, r, nil, err, errBody(err))
+		return
+	}
+
+	var hosts []inventory.Host
+	switch format {
+	case "csv":
+		hosts, err = inventory.ParseCSV(bytes.NewReader(body))
+	case "leases":
+		var leases []lease.Lease
+		if leases, err = lease.Parse(body); err == nil {
+			hosts = inventory.FromLeases(leases, time.Now())
+		}
+	case "json":
+		err = json.Unmarshal(body, &hosts)
 	default:
-		alt = ErrorDatabase
+		err = fmt.Errorf("format must be csv, leases or json")
+		check(w, r, nil, err, errQuery(err))
+		return
 	}
-	check(w, ErrorOK, err, alt)
+	if err != nil {
+		check(w, r, nil, err, errDecode(err))
+		return
+	}
+
+	if network := query.Get("network"); network != "" {
+		for i := range hosts {
+			if hosts[i].Network == "" {
+				hosts[i].Network = network
+			}
+		}
+	}
+
+	results, err := m.rec.ImportClients(r.Context(), hosts)
+	check(w, r, results, err, errorFor(err))
+}
+
+// DiscoverClients lists the hosts on the LAN which are not clients, in the
+// form accepted by ImportClients.
+func (m *Manager) DiscoverClients(w http.ResponseWriter, r *http.Request) {
+	hosts, err := m.rec.Clients.Discover(r.Context())
+	check(w, r, hosts, err, errorFor(err))
 }
 
 func (m *Manager) GetClientNetwork(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
 
-	var alt Error
 	cn, _, err := m.rec.ClientNetworks.Get(r.Context(), id)
-	switch err {
-	case database.ErrNotFound:
-		alt = ErrorNotFound
-	default:
-		alt = ErrorDatabase
-	}
-	check(w, cn, err, alt)
+	check(w, r, cn, err, errorFor(err))
 }
 
 func (m *Manager) SetClientNetwork(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
 	network := mux.Vars(r)["network"]
 
-	var alt Error
 	cn, err := m.rec.ClientNetworks.Create(r.Context(), &database.ClientNetwork{
 		ClientID:  id,
 		NetworkID: network,
 	})
-	switch err {
-	case database.ErrNotFound:
-		alt = ErrorNotFound
-	default:
-		alt = ErrorDatabase
-	}
-	check(w, cn, err, alt)
+	check(w, r, cn, err, errorFor(err))
 }
 
 func (m *Manager) UnsetClientNetwork(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
 
-	var alt Error
-	err := m.rec.ClientNetworks.Delete(r.Context(), id)
-	switch err {
-	case database.ErrNotFound:
-		alt = ErrorNotFound
-	default:
-		alt = ErrorDatabase
+	err := m.rec.ClientNetworks.Delete(ifMatch(r, "client/network", id), id)
+	check(w, r, ErrorOK, err, errorFor(err))
+}
+
+// parseUsageQuery parses the from, to and step query parameters of a usage
+// request. By default, the last day is returned in hourly buckets.
+func parseUsageQuery(r *http.Request) (from, to time.Time, step time.Duration, err error) {
+	query := r.URL.Query()
+
+	to = time.Now()
+	if s := query.Get("to"); s != "" {
+		if to, err = time.Parse(time.RFC3339, s); err != nil {
+			return from, to, step, fmt.Errorf("invalid to: %w", err)
+		}
 	}
-	check(w, ErrorOK, err, alt)
+
+	from = to.Add(-24 * time.Hour)
+	if s := query.Get("from"); s != "" {
+		if from, err = time.Parse(time.RFC3339, s); err != nil {
+			return from, to, step, fmt.Errorf("invalid from: %w", err)
+		}
+	}
+
+	step = time.Hour
+	if s := query.Get("step"); s != "" {
+		if step, err = time.ParseDuration(s); err != nil {
+			return from, to, step, fmt.Errorf("invalid step: %w", err)
+		}
+	}
+	return from, to, step, nil
+}
+
+func (m *Manager) GetClientUsage(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	from, to, step, err := parseUsageQuery(r)
+	if err != nil {
+		check(w, r, nil, err, errQuery(err))
+		return
+	}
+
+	usage, err := m.rec.Clients.Usage(r.Context(), id, from, to, step)
+	check(w, r, usage, err, errorFor(err))
 }
@@ -9,65 +9,53 @@ import (
 )
 
 func (m *Manager) ListConfigs(w http.ResponseWriter, r *http.Request) {
-	creds, err := m.db.Configs.List(r.Context())
-	check(w, creds, err, ErrorDatabase)
+	opts, err := parseListQuery(r)
+	if err != nil {
+		check(w, r, nil, err, errQuery(err))
+		return
+	}
+
+	configs, page, err := m.db.Configs.Query(r.Context(), opts)
+	if err == nil {
+		setPageHeaders(w, r, page)
+	}
+	check(w, r, configs, err, errorFor(err))
 }
 
 func (m *Manager) CreateConfig(w http.ResponseWriter, r *http.Request) {
 	c := &database.Config{}
 	if err := json.NewDecoder(r.Body).Decode(c); err != nil {
-		check(w, nil, err, errDecode(err))
+		check(w, r, nil, err, errDecode(err))
 		return
 	}
 
 	cfg, err := m.rec.Configs.Create(r.Context(), c)
-	check(w, cfg, err, ErrorDatabase)
+	check(w, r, cfg, err, errorFor(err))
 }
 
 func (m *Manager) GetConfig(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
 
-	var alt Error
 	cfg, _, err := m.rec.Configs.Get(r.Context(), id)
-	switch err {
-	case database.ErrNotFound:
-		alt = ErrorNotFound
-	default:
-		alt = ErrorDatabase
-	}
-	check(w, cfg, err, alt)
+	check(w, r, cfg, err, errorFor(err))
 }
 
 func (m *Manager) UpdateConfig(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
 	c := &database.Config{}
 	if err := json.NewDecoder(r.Body).Decode(c); err != nil {
-		check(w, nil, err, errDecode(err))
+		check(w, r, nil, err, errDecode(err))
 		return
 	}
 	c.ID = id
 
-	var alt Error
-	cfg, err := m.rec.Configs.Update(r.Context(), c)
-	switch err {
-	case database.ErrNotFound:
-		alt = ErrorNotFound
-	default:
-		alt = ErrorDatabase
-	}
-	check(w, cfg, err, alt)
+	cfg, err := m.rec.Configs.Update(ifMatch(r, "config", id), c)
+	check(w, r, cfg, err, errorFor(err))
 }
 
 func (m *Manager) DeleteConfig(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
 
-	var alt Error
-	err := m.rec.Configs.Delete(r.Context(), id)
-	switch err {
-	case database.ErrNotFound:
-		alt = ErrorNotFound
-	default:
-		alt = ErrorDatabase
-	}
-	check(w, ErrorOK, err, alt)
+	err := m.rec.Configs.Delete(ifMatch(r, "config", id), id)
+	check(w, r, ErrorOK, err, errorFor(err))
 }
@@ -9,64 +9,52 @@ import (
 )
 
 func (m *Manager) ListCredentials(w http.ResponseWriter, r *http.Request) {
-	creds, err := m.db.Credentials.List(r.Context())
-	check(w, creds, err, ErrorDatabase)
+	opts, err := parseListQuery(r)
+	if err != nil {
+		check(w, r, nil, err, errQuery(err))
+		return
+	}
+
+	creds, page, err := m.db.Credentials.Query(r.Context(), opts)
+	if err == nil {
+		setPageHeaders(w, r, page)
+	}
+	check(w, r, creds, err, errorFor(err))
 }
 
 func (m *Manager) CreateCredential(w http.ResponseWriter, r *http.Request) {
 	c := &database.Credential{}
 	if err := json.NewDecoder(r.Body).Decode(c); err != nil {
-		check(w, nil, err, errDecode(err))
+		check(w, r, nil, err, errDecode(err))
 		return
 	}
 	cred, err := m.db.Credentials.Put(r.Context(), c.Name, c.Value)
-	check(w, cred, err, ErrorDatabase)
+	check(w, r, cred, err, errorFor(err))
 }
 
 func (m *Manager) GetCredential(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
 
-	var alt Error
 	cred, err := m.db.Credentials.Get(r.Context(), id)
-	switch err {
-	case database.ErrNotFound:
-		alt = ErrorNotFound
-	default:
-		alt = ErrorDatabase
-	}
-	check(w, cred, err, alt)
+	check(w, r, cred, err, errorFor(err))
 }
 
 func (m *Manager) UpdateCredential(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
 	c := &database.Credential{}
 	if err := json.NewDecoder(r.Body).Decode(c); err != nil {
-		check(w, nil, err, errDecode(err))
+		check(w, r, nil, err, errDecode(err))
 		return
 	}
 	c.ID = id
 
-	var alt Error
-	err := m.db.Credentials.Update(r.Context(), c)
-	switch err {
-	case database.ErrNotFound:
-		alt = ErrorNotFound
-	default:
-		alt = ErrorDatabase
-	}
-	check(w, ErrorOK, err, alt)
+	err := m.db.Credentials.Update(ifMatch(r, "credential", id), c)
+	check(w, r, ErrorOK, err, errorFor(err))
 }
 
 func (m *Manager) DeleteCredential(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
 
-	var alt Error
-	err := m.db.Credentials.Delete(r.Context(), id)
-	switch err {
-	case database.ErrNotFound:
-		alt = ErrorNotFound
-	default:
-		alt = ErrorDatabase
-	}
-	check(w, ErrorOK, err, alt)
+	err := m.db.Credentials.Delete(ifMatch(r, "credential", id), id)
+	check(w, r, ErrorOK, err, errorFor(err))
 }
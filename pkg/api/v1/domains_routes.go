@@ -0,0 +1,64 @@
+package v1
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/pricec/vpnmux/pkg/database"
+	"github.com/pricec/vpnmux/pkg/dns"
+)
+
+func (m *Manager) ListDomainRoutes(w http.ResponseWriter, r *http.Request) {
+	routes, err := m.db.DomainRoutes.List(r.Context())
+	check(w, r, routes, err, errorFor(err))
+}
+
+func (m *Manager) CreateDomainRoute(w http.ResponseWriter, r *http.Request) {
+	d := &database.DomainRoute{}
+	if err := json.NewDecoder(r.Body).Decode(d); err != nil {
+		check(w, r, nil, err, errDecode(err))
+		return
+	}
+
+	if !dns.ValidDomainPattern(d.Domain) {
+		check(w, r, nil, fmt.Errorf("invalid domain %q", d.Domain), ErrorInvalidDomain)
+		return
+	}
+
+	route, err := m.rec.DomainRoutes.Create(r.Context(), d)
+	check(w, r, route, err, errorFor(err))
+}
+
+func (m *Manager) GetDomainRoute(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	route, err := m.rec.DomainRoutes.Get(r.Context(), id)
+	check(w, r, route, err, errorFor(err))
+}
+
+func (m *Manager) UpdateDomainRoute(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	d := &database.DomainRoute{}
+	if err := json.NewDecoder(r.Body).Decode(d); err != nil {
+		check(w, r, nil, err, errDecode(err))
+		return
+	}
+	d.ID = id
+
+	if !dns.ValidDomainPattern(d.Domain) {
+		check(w, r, nil, fmt.Errorf("invalid domain %q", d.Domain), ErrorInvalidDomain)
+		return
+	}
+
+	route, err := m.rec.DomainRoutes.Update(ifMatch(r, "domain", id), d)
+	check(w, r, route, err, errorFor(err))
+}
+
+func (m *Manager) DeleteDomainRoute(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	err := m.rec.DomainRoutes.Delete(ifMatch(r, "domain", id), id)
+	check(w, r, ErrorOK, err, errorFor(err))
+}
@@ -0,0 +1,92 @@
+package v1
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pricec/vpnmux/pkg/database"
+	"github.com/pricec/vpnmux/pkg/logging"
+)
+
+// eventKeepalive is the interval at which a comment is sent on an idle
+// event stream, so that proxies do not time it out.
+const eventKeepalive = 30 * time.Second
+
+// writeEvent writes an event in the server-sent events format.
+func writeEvent(w http.ResponseWriter, e *database.Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+	return err
+}
+
+// StreamEvents streams events as server-sent events. A client reconnecting
+// with the Last-Event-ID header (or the last_event_id query parameter)
+// first receives the events it missed.
+func (m *Manager) StreamEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		check(w, r, nil, fmt.Errorf("streaming unsupported"), Error{Code: http.StatusInternalServerError, Description: "streaming unsupported"})
+		return
+	}
+
+	s := r.Header.Get("Last-Event-ID")
+	if s == "" {
+		s = r.URL.Query().Get("last_event_id")
+	}
+	var lastID int64
+	if s != "" {
+		var err error
+		if lastID, err = strconv.ParseInt(s, 10, 64); err != nil {
+			err = fmt.Errorf("invalid last event ID: %w", err)
+			check(w, r, nil, err, errQuery(err))
+			return
+		}
+	}
+
+	missed, ch, cancel, err := m.events.Subscribe(r.Context(), lastID)
+	if err != nil {
+		check(w, r, nil, err, Error{Code: http.StatusServiceUnavailable, Description: "event stream unavailable"})
+		return
+	}
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	for _, e := range missed {
+		if err := writeEvent(w, e); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(eventKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case e, ok := <-ch:
+			// The subscription ends if the stream falls behind or the
+			// server stops; the client resumes from its last event.
+			if !ok {
+				return
+			}
+			if err := writeEvent(w, e); err != nil {
+				logging.Debug(r.Context(), "error writing event", "err", err)
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
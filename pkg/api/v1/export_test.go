@@ -0,0 +1,12 @@
+package v1
+
+import "github.com/pricec/vpnmux/pkg/database"
+
+// ErrorFor exposes errorFor to the tests.
+var ErrorFor = errorFor
+
+// NewManager returns a manager of db without a reconciler, for the tests of
+// routes which only use the database.
+func NewManager(db *database.Database) *Manager {
+	return &Manager{db: db}
+}
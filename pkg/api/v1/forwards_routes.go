@@ -0,0 +1,52 @@
+package v1
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/pricec/vpnmux/pkg/database"
+)
+
+func (m *Manager) ListPortForwards(w http.ResponseWriter, r *http.Request) {
+	forwards, err := m.db.PortForwards.List(r.Context())
+	check(w, r, forwards, err, errorFor(err))
+}
+
+func (m *Manager) CreatePortForward(w http.ResponseWriter, r *http.Request) {
+	f := &database.PortForward{}
+	if err := json.NewDecoder(r.Body).Decode(f); err != nil {
+		check(w, r, nil, err, errDecode(err))
+		return
+	}
+
+	forward, err := m.rec.PortForwards.Create(r.Context(), f)
+	check(w, r, forward, err, errorFor(err))
+}
+
+func (m *Manager) GetPortForward(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	forward, err := m.rec.PortForwards.Get(r.Context(), id)
+	check(w, r, forward, err, errorFor(err))
+}
+
+func (m *Manager) UpdatePortForward(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	f := &database.PortForward{}
+	if err := json.NewDecoder(r.Body).Decode(f); err != nil {
+		check(w, r, nil, err, errDecode(err))
+		return
+	}
+	f.ID = id
+
+	forward, err := m.rec.PortForwards.Update(ifMatch(r, "forward", id), f)
+	check(w, r, forward, err, errorFor(err))
+}
+
+func (m *Manager) DeletePortForward(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	err := m.rec.PortForwards.Delete(ifMatch(r, "forward", id), id)
+	check(w, r, ErrorOK, err, errorFor(err))
+}
@@ -0,0 +1,77 @@
+package v1
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/pricec/vpnmux/pkg/database"
+)
+
+func (m *Manager) ListClientGroups(w http.ResponseWriter, r *http.Request) {
+	groups, err := m.db.ClientGroups.List(r.Context())
+	check(w, r, groups, err, errorFor(err))
+}
+
+func (m *Manager) CreateClientGroup(w http.ResponseWriter, r *http.Request) {
+	g := &database.ClientGroup{}
+	if err := json.NewDecoder(r.Body).Decode(g); err != nil {
+		check(w, r, nil, err, errDecode(err))
+		return
+	}
+
+	group, err := m.rec.ClientGroups.Create(r.Context(), g)
+	check(w, r, group, err, errorFor(err))
+}
+
+func (m *Manager) GetClientGroup(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	group, err := m.rec.ClientGroups.Get(r.Context(), id)
+	check(w, r, group, err, errorFor(err))
+}
+
+func (m *Manager) UpdateClientGroup(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	g := &database.ClientGroup{}
+	if err := json.NewDecoder(r.Body).Decode(g); err != nil {
+		check(w, r, nil, err, errDecode(err))
+		return
+	}
+	g.ID = id
+
+	group, err := m.rec.ClientGroups.Update(ifMatch(r, "group", id), g)
+	check(w, r, group, err, errorFor(err))
+}
+
+func (m *Manager) DeleteClientGroup(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	err := m.rec.ClientGroups.Delete(ifMatch(r, "group", id), id)
+	check(w, r, ErrorOK, err, errorFor(err))
+}
+
+func (m *Manager) GetClientGroupNetwork(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	gn, err := m.rec.ClientGroups.GetNetwork(r.Context(), id)
+	check(w, r, gn, err, errorFor(err))
+}
+
+func (m *Manager) SetClientGroupNetwork(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	network := mux.Vars(r)["network"]
+
+	gn, err := m.rec.ClientGroups.SetNetwork(r.Context(), &database.ClientGroupNetwork{
+		GroupID:   id,
+		NetworkID: network,
+	})
+	check(w, r, gn, err, errorFor(err))
+}
+
+func (m *Manager) UnsetClientGroupNetwork(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	err := m.rec.ClientGroups.UnsetNetwork(ifMatch(r, "group/network", id), id)
+	check(w, r, ErrorOK, err, errorFor(err))
+}
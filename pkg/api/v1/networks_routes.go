@@ -9,64 +9,83 @@ import (
 )
 
 func (m *Manager) ListNetworks(w http.ResponseWriter, r *http.Request) {
-	creds, err := m.db.Networks.List(r.Context())
-	check(w, creds, err, ErrorDatabase)
+	opts, err := parseListQuery(r)
+	if err != nil {
+		check(w, r, nil, err, errQuery(err))
+		return
+	}
+
+	networks, page, err := m.db.Networks.Query(r.Context(), opts)
+	if err == nil {
+		setPageHeaders(w, r, page)
+	}
+	check(w, r, networks, err, errorFor(err))
 }
 
 func (m *Manager) CreateNetwork(w http.ResponseWriter, r *http.Request) {
 	n := &database.Network{}
 	if err := json.NewDecoder(r.Body).Decode(n); err != nil {
-		check(w, nil, err, errDecode(err))
+		check(w, r, nil, err, errDecode(err))
 		return
 	}
 	net, err := m.rec.CreateNetwork(r.Context(), n)
-	check(w, net, err, ErrorDatabase)
+	check(w, r, net, err, errorFor(err))
 }
 
 func (m *Manager) GetNetwork(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
 
-	var alt Error
 	net, _, err := m.rec.Networks.Get(r.Context(), id)
-	switch err {
-	case database.ErrNotFound:
-		alt = ErrorNotFound
-	default:
-		alt = ErrorDatabase
-	}
-	check(w, net, err, alt)
+	check(w, r, net, err, errorFor(err))
 }
 
 func (m *Manager) UpdateNetwork(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
 	net := &database.Network{}
 	if err := json.NewDecoder(r.Body).Decode(net); err != nil {
-		check(w, nil, err, errDecode(err))
+		check(w, r, nil, err, errDecode(err))
 		return
 	}
 	net.ID = id
 
-	var alt Error
-	net, err := m.rec.Networks.Update(r.Context(), net)
-	switch err {
-	case database.ErrNotFound:
-		alt = ErrorNotFound
-	default:
-		alt = ErrorDatabase
-	}
-	check(w, net, err, alt)
+	net, err := m.rec.Networks.Update(ifMatch(r, "network", id), net)
+	check(w, r, net, err, errorFor(err))
 }
 
 func (m *Manager) DeleteNetwork(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
 
-	var alt Error
-	err := m.rec.Networks.Delete(r.Context(), id)
-	switch err {
-	case database.ErrNotFound:
-		alt = ErrorNotFound
-	default:
-		alt = ErrorDatabase
+	err := m.rec.Networks.Delete(ifMatch(r, "network", id), id)
+	check(w, r, ErrorOK, err, errorFor(err))
+}
+
+func (m *Manager) GetNetworkDNS(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	status, err := m.rec.Networks.Forwarder(r.Context(), id)
+	check(w, r, status, err, errorFor(err))
+}
+
+func (m *Manager) GetNetworkShaping(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	status, err := m.rec.Shaping.Status(r.Context(), id)
+	check(w, r, status, err, errorFor(err))
+}
+
+// NetworkState is the state of a network's tunnel, or "unknown" if it has
+// not been sampled yet.
+type NetworkState struct {
+	State string `json:"state"`
+}
+
+func (m *Manager) GetNetworkState(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	_, err := m.db.Networks.Get(r.Context(), id)
+	state := NetworkState{State: m.rec.TunnelState(id)}
+	if state.State == "" {
+		state.State = "unknown"
 	}
-	check(w, ErrorOK, err, alt)
+	check(w, r, state, err, errorFor(err))
 }
@@ -0,0 +1,416 @@
+package v1
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pricec/vpnmux/pkg/logging"
+)
+
+//go:embed openapi.json
+var openAPIDocument []byte
+
+// maxBodySize is the largest request body which is accepted.
+const maxBodySize = 1 << 20
+
+// schema is the subset of an OpenAPI schema object with which request
+// bodies are validated.
+type schema struct {
+	Ref                  string             `json:"$ref"`
+	Type                 string             `json:"type"`
+	Format               string             `json:"format"`
+	Pattern              string             `json:"pattern"`
+	Enum                 []interface{}      `json:"enum"`
+	Required             []string           `json:"required"`
+	Properties           map[string]*schema `json:"properties"`
+	AdditionalProperties *bool              `json:"additionalProperties"`
+	Items                *schema            `json:"items"`
+	MinLength            *int               `json:"minLength"`
+	Minimum              *float64           `json:"minimum"`
+	Maximum              *float64           `json:"maximum"`
+}
+
+type operation struct {
+	RequestBody *struct {
+		Content map[string]struct {
+			Schema *schema `json:"schema"`
+		} `json:"content"`
+	} `json:"requestBody"`
+}
+
+type openAPI struct {
+	Servers []struct {
+		URL string `json:"url"`
+	} `json:"servers"`
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Schemas map[string]*schema `json:"schemas"`
+	} `json:"components"`
+}
+
+// spec is the parsed OpenAPI document: the schema of the request body of
+// each operation, by method and path relative to the server URL, and the
+// schemas they refer to.
+var spec = mustParseOpenAPI(openAPIDocument)
+
+type openAPISpec struct {
+	prefix string
+	bodies map[string]*schema
+	// The media types of the request body of each operation.
+	media   map[string]map[string]bool
+	schemas map[string]*schema
+}
+
+func mustParseOpenAPI(doc []byte) *openAPISpec {
+	var api openAPI
+	if err := json.Unmarshal(doc, &api); err != nil {
+		panic(fmt.Sprintf("error parsing OpenAPI document: %v", err))
+	}
+
+	s := &openAPISpec{
+		bodies:  make(map[string]*schema),
+		media:   make(map[string]map[string]bool),
+		schemas: api.Components.Schemas,
+	}
+	if len(api.Servers) > 0 {
+		s.prefix = api.Servers[0].URL
+	}
+	for path, item := range api.Paths {
+		for method, raw := range item {
+			if method == "parameters" {
+				continue
+			}
+			var op operation
+			if err := json.Unmarshal(raw, &op); err != nil {
+				panic(fmt.Sprintf("error parsing OpenAPI operation %s %s: %v", method, path, err))
+			}
+			if op.RequestBody != nil {
+				key := strings.ToUpper(method) + " " + path
+				s.bodies[key] = op.RequestBody.Content["application/json"].Schema
+				s.media[key] = make(map[string]bool)
+				for t := range op.RequestBody.Content {
+					s.media[key][t] = true
+				}
+			}
+		}
+	}
+	return s
+}
+
+// operation returns the key of a request's operation in bodies and media.
+func (s *openAPISpec) operation(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return ""
+	}
+	template, err := route.GetPathTemplate()
+	if err != nil {
+		return ""
+	}
+	return r.Method + " " + strings.TrimPrefix(template, s.prefix)
+}
+
+// FieldError describes an invalid field of a request body.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// validateRequests rejects request bodies which do not match the schema of
+// their operation in the OpenAPI document, listing every invalid field.
+// Bodies of other media types than JSON are rejected, unless the operation
+// accepts them (e.g. imported CSV files), in which case they are left to
+// their handlers.
+func validateRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		op := spec.operation(r)
+		media, ok := spec.media[op]
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if t := mediaType(r); t != "application/json" {
+			if media[t] {
+				next.ServeHTTP(w, r)
+				return
+			}
+			err := fmt.Errorf("unsupported media type %q", r.Header.Get("Content-Type"))
+			check(w, r, nil, err, errMediaType(err))
+			return
+		}
+		s := spec.bodies[op]
+		if s == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := readBody(w, r)
+		if err != nil {
+			check(w, r, nil, err, errBody(err))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		var v interface{}
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.UseNumber()
+		if err := decoder.Decode(&v); err != nil {
+			check(w, r, nil, err, errDecode(err))
+			return
+		}
+
+		if fields := spec.validate("", s, v); len(fields) > 0 {
+			alt := Error{
+				Code:        http.StatusUnprocessableEntity,
+				Reason:      ReasonInvalid,
+				Description: "invalid request body",
+				Fields:      fields,
+			}
+			check(w, r, nil, fmt.Errorf("invalid request body: %s %s", fields[0].Field, fields[0].Message), alt)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// validate returns the errors of a value and its fields, named from path.
+// Null values are treated as absent, as they are when decoded.
+func (s *openAPISpec) validate(path string, sch *schema, v interface{}) []FieldError {
+	if sch == nil || v == nil {
+		return nil
+	}
+	if sch.Ref != "" {
+		return s.validate(path, s.schemas[strings.TrimPrefix(sch.Ref, "#/components/schemas/")], v)
+	}
+
+	invalid := func(format string, args ...interface{}) []FieldError {
+		return []FieldError{{Field: path, Message: fmt.Sprintf(format, args...)}}
+	}
+
+	switch sch.Type {
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return invalid("must be an object")
+		}
+		return s.validateObject(path, sch, obj)
+	case "array":
+		items, ok := v.([]interface{})
+		if !ok {
+			return invalid("must be an array")
+		}
+		var errs []FieldError
+		for i, item := range items {
+			errs = append(errs, s.validate(fmt.Sprintf("%s[%d]", path, i), sch.Items, item)...)
+		}
+		return errs
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return invalid("must be a boolean")
+		}
+		return nil
+	case "integer", "number":
+		n, ok := v.(json.Number)
+		if !ok {
+			return invalid("must be a number")
+		}
+		if _, err := n.Int64(); err != nil && sch.Type == "integer" {
+			return invalid("must be an integer")
+		}
+		f, _ := n.Float64()
+		if sch.Minimum != nil && f < *sch.Minimum {
+			return invalid("must be at least %v", *sch.Minimum)
+		}
+		if sch.Maximum != nil && f > *sch.Maximum {
+			return invalid("must be at most %v", *sch.Maximum)
+		}
+		return nil
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			return invalid("must be a string")
+		}
+		return validateString(path, sch, str)
+	}
+	return nil
+}
+
+func (s *openAPISpec) validateObject(path string, sch *schema, obj map[string]interface{}) []FieldError {
+	field := func(name string) string {
+		if path == "" {
+			return name
+		}
+		return path + "." + name
+	}
+
+	var errs []FieldError
+	for _, name := range sch.Required {
+		if v, ok := obj[name]; !ok || v == nil {
+			errs = append(errs, FieldError{Field: field(name), Message: "is required"})
+		}
+	}
+
+	names := make([]string, 0, len(obj))
+	for name := range obj {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		prop, ok := sch.Properties[name]
+		if !ok {
+			if sch.AdditionalProperties != nil && !*sch.AdditionalProperties {
+				errs = append(errs, FieldError{Field: field(name), Message: "is not a known field"})
+			}
+			continue
+		}
+		errs = append(errs, s.validate(field(name), prop, obj[name])...)
+	}
+	return errs
+}
+
+var hostnamePattern = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*\.?$`)
+
+// mediaType returns the media type of the body of r, which is JSON if
+// none is given, or the empty string if it cannot be parsed.
+func mediaType(r *http.Request) string {
+	header := r.Header.Get("Content-Type")
+	if header == "" {
+		return "application/json"
+	}
+	t, _, err := mime.ParseMediaType(header)
+	if err != nil {
+		return ""
+	}
+	return t
+}
+
+// errBodyTooLarge is returned by readBody for bodies larger than
+// maxBodySize.
+var errBodyTooLarge = fmt.Errorf("request body is larger than %d bytes", maxBodySize)
+
+// readBody reads the body of r, failing with errBodyTooLarge rather than
+// cutting it short if it is larger than maxBodySize.
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil && len(body) == maxBodySize {
+		return nil, errBodyTooLarge
+	}
+	return body, err
+}
+
+// errBody is the response to a request whose body could not be read.
+func errBody(err error) Error {
+	if err == errBodyTooLarge {
+		return Error{
+			Code:        http.StatusRequestEntityTooLarge,
+			Reason:      ReasonTooLarge,
+			Description: err.Error(),
+		}
+	}
+	return errDecode(err)
+}
+
+// errMediaType is the response to a request whose body is of a media type
+// its operation doesn't accept.
+func errMediaType(err error) Error {
+	return Error{
+		Code:        http.StatusUnsupportedMediaType,
+		Reason:      ReasonMediaType,
+		Description: err.Error(),
+	}
+}
+
+// formats checks the formats of strings; an empty string satisfies every
+// format, since the API treats it as absent.
+var formats = map[string]struct {
+	valid       func(string) bool
+	description string
+}{
+	"ipv4": {
+		func(s string) bool {
+			ip := net.ParseIP(s)
+			return ip != nil && ip.To4() != nil && !strings.Contains(s, ":")
+		},
+		"an IPv4 address",
+	},
+	"ipv6": {
+		func(s string) bool { return net.ParseIP(s) != nil && strings.Contains(s, ":") },
+		"an IPv6 address",
+	},
+	"mac": {
+		func(s string) bool { _, err := net.ParseMAC(s); return err == nil },
+		"a MAC address",
+	},
+	"cidr": {
+		func(s string) bool { _, _, err := net.ParseCIDR(s); return err == nil },
+		"a subnet in CIDR notation",
+	},
+	"ip-or-cidr": {
+		func(s string) bool { _, _, err := net.ParseCIDR(s); return err == nil || net.ParseIP(s) != nil },
+		"an IP address or a subnet in CIDR notation",
+	},
+	"host": {
+		func(s string) bool { return net.ParseIP(s) != nil || hostnamePattern.MatchString(s) },
+		"a hostname or IP address",
+	},
+	"uri": {
+		func(s string) bool { u, err := url.Parse(s); return err == nil && u.IsAbs() && u.Host != "" },
+		"an absolute URL",
+	},
+	"date-time": {
+		func(s string) bool { _, err := time.Parse(time.RFC3339, s); return err == nil },
+		"an RFC3339 timestamp",
+	},
+}
+
+func validateString(path string, sch *schema, s string) []FieldError {
+	invalid := func(format string, args ...interface{}) []FieldError {
+		return []FieldError{{Field: path, Message: fmt.Sprintf(format, args...)}}
+	}
+
+	if sch.MinLength != nil && len(s) < *sch.MinLength {
+		if *sch.MinLength == 1 {
+			return invalid("must not be empty")
+		}
+		return invalid("must be at least %d characters", *sch.MinLength)
+	}
+	if len(sch.Enum) > 0 {
+		var values []string
+		for _, value := range sch.Enum {
+			if value == s {
+				return nil
+			}
+			values = append(values, fmt.Sprintf("%q", value))
+		}
+		return invalid("must be one of %s", strings.Join(values, ", "))
+	}
+	if sch.Pattern != "" {
+		if ok, err := regexp.MatchString(sch.Pattern, s); err != nil || !ok {
+			return invalid("must match %s", sch.Pattern)
+		}
+	}
+	if f, ok := formats[sch.Format]; ok && s != "" && !f.valid(s) {
+		return invalid("must be %s", f.description)
+	}
+	return nil
+}
+
+// GetOpenAPI serves the OpenAPI document of the v1 API.
+func (m *Manager) GetOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(openAPIDocument); err != nil {
+		logging.Error(r.Context(), "error writing response", "err", err)
+	}
+}
@@ -0,0 +1,147 @@
+package v1_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/pricec/vpnmux/pkg/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func newRouter() *mux.Router {
+	r := mux.NewRouter()
+	v1.RegisterRoutes(r.PathPrefix("/v1").Subrouter(), &v1.Manager{})
+	return r
+}
+
+func TestOpenAPIDescribesRoutes(t *testing.T) {
+	r := newRouter()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/v1/openapi.json", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	var doc struct {
+		Servers []struct {
+			URL string `json:"url"`
+		} `json:"servers"`
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &doc))
+	require.Len(t, doc.Servers, 1)
+	require.Equal(t, "/v1", doc.Servers[0].URL)
+
+	count := 0
+	err := r.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		methods, err := route.GetMethods()
+		if err != nil {
+			// The /v1 prefix itself has no methods.
+			return nil
+		}
+		template, err := route.GetPathTemplate()
+		require.Nil(t, err)
+		path := strings.TrimPrefix(template, "/v1")
+
+		item, ok := doc.Paths[path]
+		require.True(t, ok, "path %s is not described", path)
+		for _, method := range methods {
+			_, ok := item[strings.ToLower(method)]
+			require.True(t, ok, "operation %s %s is not described", method, path)
+			count++
+		}
+		return nil
+	})
+	require.Nil(t, err)
+	require.NotZero(t, count)
+}
+
+func TestValidateRequests(t *testing.T) {
+	r := newRouter()
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		fields []v1.FieldError
+	}{
+		{
+			method: "POST",
+			path:   "/v1/client",
+			body:   `{"name":"","address":"x","adress":1}`,
+			fields: []v1.FieldError{
+				{Field: "address", Message: "must be an IPv4 address"},
+				{Field: "adress", Message: "is not a known field"},
+				{Field: "name", Message: "must not be empty"},
+			},
+		},
+		{
+			method: "POST",
+			path:   "/v1/config",
+			body:   `{"name":"c","host":"not a host","user_cred":"u","pass_cred":"p","ca_cred":"ca"}`,
+			fields: []v1.FieldError{
+				{Field: "ovpn_cred", Message: "is required"},
+				{Field: "host", Message: "must be a hostname or IP address"},
+			},
+		},
+		{
+			method: "PATCH",
+			path:   "/v1/network/n1",
+			body:   `{"ipv6":"yes"}`,
+			fields: []v1.FieldError{
+				{Field: "name", Message: "is required"},
+				{Field: "ipv6", Message: "must be a boolean"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.method+" "+test.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(test.method, test.path, strings.NewReader(test.body)))
+			require.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+			var resp v1.Error
+			require.Nil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			require.Equal(t, v1.ReasonInvalid, resp.Reason)
+			require.Equal(t, "invalid request body", resp.Description)
+			require.Equal(t, test.fields, resp.Fields)
+		})
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/v1/client", strings.NewReader(`{"name":`)))
+	require.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestValidateRequestsMediaType(t *testing.T) {
+	r := newRouter()
+
+	for _, contentType := range []string{"application/x-www-form-urlencoded", "text/csv", "bogus/"} {
+		req := httptest.NewRequest("POST", "/v1/client", strings.NewReader(`{"name":"","address":"x"}`))
+		req.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		require.Equal(t, http.StatusUnsupportedMediaType, w.Code, contentType)
+
+		var resp v1.Error
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		require.Equal(t, v1.ReasonMediaType, resp.Reason)
+	}
+
+	body := `{"name":"` + strings.Repeat("a", 1<<20) + `"}`
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/v1/client", strings.NewReader(body)))
+	require.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	csv := "name,address\n" + strings.Repeat("laptop,192.168.1.15\n", 1<<16)
+	req := httptest.NewRequest("POST", "/v1/client/import", strings.NewReader(csv))
+	req.Header.Set("Content-Type", "text/csv")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+}
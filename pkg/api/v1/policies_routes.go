@@ -0,0 +1,52 @@
+package v1
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/pricec/vpnmux/pkg/database"
+)
+
+func (m *Manager) ListPolicies(w http.ResponseWriter, r *http.Request) {
+	policies, err := m.db.Policies.List(r.Context())
+	check(w, r, policies, err, errorFor(err))
+}
+
+func (m *Manager) CreatePolicy(w http.ResponseWriter, r *http.Request) {
+	p := &database.Policy{}
+	if err := json.NewDecoder(r.Body).Decode(p); err != nil {
+		check(w, r, nil, err, errDecode(err))
+		return
+	}
+
+	policy, err := m.rec.Policies.Create(r.Context(), p)
+	check(w, r, policy, err, errorFor(err))
+}
+
+func (m *Manager) GetPolicy(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	policy, err := m.rec.Policies.Get(r.Context(), id)
+	check(w, r, policy, err, errorFor(err))
+}
+
+func (m *Manager) UpdatePolicy(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	p := &database.Policy{}
+	if err := json.NewDecoder(r.Body).Decode(p); err != nil {
+		check(w, r, nil, err, errDecode(err))
+		return
+	}
+	p.ID = id
+
+	policy, err := m.rec.Policies.Update(ifMatch(r, "policy", id), p)
+	check(w, r, policy, err, errorFor(err))
+}
+
+func (m *Manager) DeletePolicy(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	err := m.rec.Policies.Delete(ifMatch(r, "policy", id), id)
+	check(w, r, ErrorOK, err, errorFor(err))
+}
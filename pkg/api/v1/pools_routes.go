@@ -0,0 +1,61 @@
+package v1
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/pricec/vpnmux/pkg/database"
+)
+
+func (m *Manager) ListPools(w http.ResponseWriter, r *http.Request) {
+	pools, err := m.db.Pools.List(r.Context())
+	check(w, r, pools, err, errorFor(err))
+}
+
+func (m *Manager) CreatePool(w http.ResponseWriter, r *http.Request) {
+	p := &database.NetworkPool{}
+	if err := json.NewDecoder(r.Body).Decode(p); err != nil {
+		check(w, r, nil, err, errDecode(err))
+		return
+	}
+
+	pool, err := m.rec.Pools.Create(r.Context(), p)
+	check(w, r, pool, err, errorFor(err))
+}
+
+func (m *Manager) GetPool(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	pool, err := m.rec.Pools.Get(r.Context(), id)
+	check(w, r, pool, err, errorFor(err))
+}
+
+func (m *Manager) UpdatePool(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	p := &database.NetworkPool{}
+	if err := json.NewDecoder(r.Body).Decode(p); err != nil {
+		check(w, r, nil, err, errDecode(err))
+		return
+	}
+	p.ID = id
+
+	pool, err := m.rec.Pools.Update(ifMatch(r, "pool", id), p)
+	check(w, r, pool, err, errorFor(err))
+}
+
+func (m *Manager) DeletePool(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	err := m.rec.Pools.Delete(ifMatch(r, "pool", id), id)
+	check(w, r, ErrorOK, err, errorFor(err))
+}
+
+// GetPoolState returns the health of each network of a pool, and the share
+// of the pool's new connections it receives.
+func (m *Manager) GetPoolState(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	state, err := m.rec.Pools.State(r.Context(), id)
+	check(w, r, state, err, errorFor(err))
+}
@@ -2,42 +2,127 @@ package v1
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/pricec/vpnmux/pkg/audit"
 	"github.com/pricec/vpnmux/pkg/config"
 	"github.com/pricec/vpnmux/pkg/database"
+	"github.com/pricec/vpnmux/pkg/events"
+	"github.com/pricec/vpnmux/pkg/logging"
+	"github.com/pricec/vpnmux/pkg/metrics"
+	"github.com/pricec/vpnmux/pkg/mqtt"
+	"github.com/pricec/vpnmux/pkg/network"
 	"github.com/pricec/vpnmux/pkg/reconciler"
+	"github.com/pricec/vpnmux/pkg/webhook"
 )
 
 func RegisterHandlers(ctx context.Context, r *mux.Router, cfg *config.Config) {
 	db, err := database.New(ctx, cfg.DBPath)
 	if err != nil {
-		log.Panicf("error opening database: %v", err)
+		logging.Fatal(ctx, "error opening database", "err", err)
+	}
+
+	recorder := audit.NewRecorder(ctx, db.Audit, cfg.AuditRetention)
+	network.OnCommand(recorder.Command)
+	broker := events.NewBroker(ctx, db.Events, cfg.EventBuffer)
+	_, err = webhook.NewDispatcher(ctx, db.Webhooks, broker, webhook.Options{
+		Timeout:      cfg.WebhookTimeout,
+		MaxAttempts:  cfg.WebhookMaxAttempts,
+		Backoff:      cfg.WebhookBackoff,
+		MaxBackoff:   cfg.WebhookMaxBackoff,
+		Retention:    cfg.WebhookRetention,
+		PollInterval: time.Second,
+	})
+	if err != nil {
+		logging.Fatal(ctx, "error starting webhook dispatcher", "err", err)
+	}
+
+	markBase, err := network.ParseMark(cfg.MarkBase)
+	if err != nil {
+		logging.Fatal(ctx, "error parsing mark base", "err", err)
 	}
 
 	rec, err := reconciler.New(ctx, reconciler.Options{
 		DB: db,
 		Network: reconciler.NetworkReconcilerOptions{
-			VPNImage:        cfg.VPNImage,
-			LocalSubnetCIDR: cfg.LocalSubnetCIDR,
+			VPNImage:         cfg.VPNImage,
+			LocalSubnetCIDR:  cfg.LocalSubnetCIDR,
+			LocalSubnet6CIDR: cfg.LocalSubnet6CIDR,
+			IPv6Prefix:       cfg.IPv6Prefix,
+			MarkBase:         markBase,
+			RouteTableMin:    cfg.RouteTableMin,
+			RouteTableMax:    cfg.RouteTableMax,
+			RTTablesFile:     cfg.RTTablesFile,
+			Forwarder: reconciler.ForwarderOptions{
+				Enabled:   cfg.DNSForwarder,
+				Port:      cfg.DNSForwarderPort,
+				CacheSize: cfg.DNSForwarderCacheSize,
+				Upstreams: cfg.DNSForwarderUpstreams,
+			},
 		},
 		Forwarding: reconciler.ForwardingOptions{
 			LANInterface: cfg.LANInterface,
 			WANInterface: cfg.WANInterface,
 			DNSMark:      cfg.DNSMark,
+			WANMark:      cfg.WANMark,
+			BlockIPv6:    cfg.BlockIPv6,
+		},
+		Clients: reconciler.ClientOptions{
+			LeaseFile:       cfg.LeaseFile,
+			ResolveInterval: cfg.ClientResolveInterval,
 		},
+		ReconcileInterval: cfg.ReconcileInterval,
+		MonitorInterval:   cfg.MonitorInterval,
+		Events:            broker,
 	})
 	if err != nil {
-		log.Panicf("error creating reconciler: %v", err)
+		logging.Fatal(ctx, "error creating reconciler", "err", err)
 	}
 
+	if cfg.MQTTBroker != "" {
+		_, err := mqtt.New(ctx, mqtt.Options{
+			Broker:          cfg.MQTTBroker,
+			Username:        cfg.MQTTUsername,
+			Password:        cfg.MQTTPassword,
+			ClientID:        cfg.MQTTClientID,
+			TopicPrefix:     cfg.MQTTTopicPrefix,
+			DiscoveryPrefix: cfg.MQTTDiscoveryPrefix,
+			Interval:        cfg.MonitorInterval,
+			DB:              db,
+			ClientNetworks:  rec.ClientNetworks,
+			TunnelState:     rec.TunnelState,
+			Events:          broker,
+		})
+		if err != nil {
+			logging.Fatal(ctx, "error starting MQTT bridge", "err", err)
+		}
+	}
+
+	metrics.Registry.MustRegister(metrics.NewDatabaseCollector(db))
+
 	mgr := &Manager{
-		db:  db,
-		rec: rec,
+		router: r,
+		db:     db,
+		rec:    rec,
+		audit:  recorder,
+		events: broker,
 	}
+	r.Use(mgr.recordMutations)
+	RegisterRoutes(r, mgr)
+}
+
+// RegisterRoutes registers the routes of the v1 API, each of which is
+// described by the OpenAPI document served at /openapi.json.
+func RegisterRoutes(r *mux.Router, mgr *Manager) {
+	r.Use(validateRequests)
 
 	// TODO: PATCH routes are currently disabled because of the cascading
 	// impact of changes (credential -> config -> network).
@@ -59,12 +144,18 @@ func RegisterHandlers(ctx context.Context, r *mux.Router, cfg *config.Config) {
 	r.HandleFunc("/network/{id}", mgr.GetNetwork).Methods("GET")
 	r.HandleFunc("/network/{id}", mgr.UpdateNetwork).Methods("PATCH")
 	r.HandleFunc("/network/{id}", mgr.DeleteNetwork).Methods("DELETE")
+	r.HandleFunc("/network/{id}/dns", mgr.GetNetworkDNS).Methods("GET")
+	r.HandleFunc("/network/{id}/shaping", mgr.GetNetworkShaping).Methods("GET")
+	r.HandleFunc("/network/{id}/state", mgr.GetNetworkState).Methods("GET")
 
 	r.HandleFunc("/client", mgr.ListClients).Methods("GET")
 	r.HandleFunc("/client", mgr.CreateClient).Methods("POST")
+	r.HandleFunc("/client/import", mgr.ImportClients).Methods("POST")
+	r.HandleFunc("/client/discover", mgr.DiscoverClients).Methods("GET")
 	r.HandleFunc("/client/{id}", mgr.GetClient).Methods("GET")
 	r.HandleFunc("/client/{id}", mgr.UpdateClient).Methods("PATCH")
 	r.HandleFunc("/client/{id}", mgr.DeleteClient).Methods("DELETE")
+	r.HandleFunc("/client/{id}/usage", mgr.GetClientUsage).Methods("GET")
 
 	r.HandleFunc("/client/{id}/network", mgr.GetClientNetwork).Methods("GET")
 	r.HandleFunc("/client/{id}/network", mgr.UnsetClientNetwork).Methods("DELETE")
@@ -73,60 +164,280 @@ func RegisterHandlers(ctx context.Context, r *mux.Router, cfg *config.Config) {
 	r.HandleFunc("/dns", mgr.GetDNS).Methods("GET")
 	r.HandleFunc("/dns/{network}", mgr.SetDNS).Methods("POST")
 	r.HandleFunc("/dns", mgr.UnsetDNS).Methods("DELETE")
+
+	r.HandleFunc("/domain", mgr.ListDomainRoutes).Methods("GET")
+	r.HandleFunc("/domain", mgr.CreateDomainRoute).Methods("POST")
+	r.HandleFunc("/domain/{id}", mgr.GetDomainRoute).Methods("GET")
+	r.HandleFunc("/domain/{id}", mgr.UpdateDomainRoute).Methods("PATCH")
+	r.HandleFunc("/domain/{id}", mgr.DeleteDomainRoute).Methods("DELETE")
+
+	r.HandleFunc("/policy", mgr.ListPolicies).Methods("GET")
+	r.HandleFunc("/policy", mgr.CreatePolicy).Methods("POST")
+	r.HandleFunc("/policy/{id}", mgr.GetPolicy).Methods("GET")
+	r.HandleFunc("/policy/{id}", mgr.UpdatePolicy).Methods("PATCH")
+	r.HandleFunc("/policy/{id}", mgr.DeletePolicy).Methods("DELETE")
+
+	r.HandleFunc("/group", mgr.ListClientGroups).Methods("GET")
+	r.HandleFunc("/group", mgr.CreateClientGroup).Methods("POST")
+	r.HandleFunc("/group/{id}", mgr.GetClientGroup).Methods("GET")
+	r.HandleFunc("/group/{id}", mgr.UpdateClientGroup).Methods("PATCH")
+	r.HandleFunc("/group/{id}", mgr.DeleteClientGroup).Methods("DELETE")
+
+	r.HandleFunc("/group/{id}/network", mgr.GetClientGroupNetwork).Methods("GET")
+	r.HandleFunc("/group/{id}/network", mgr.UnsetClientGroupNetwork).Methods("DELETE")
+	r.HandleFunc("/group/{id}/network/{network}", mgr.SetClientGroupNetwork).Methods("POST")
+
+	r.HandleFunc("/forward", mgr.ListPortForwards).Methods("GET")
+	r.HandleFunc("/forward", mgr.CreatePortForward).Methods("POST")
+	r.HandleFunc("/forward/{id}", mgr.GetPortForward).Methods("GET")
+	r.HandleFunc("/forward/{id}", mgr.UpdatePortForward).Methods("PATCH")
+	r.HandleFunc("/forward/{id}", mgr.DeletePortForward).Methods("DELETE")
+
+	r.HandleFunc("/schedule", mgr.ListSchedules).Methods("GET")
+	r.HandleFunc("/schedule", mgr.CreateSchedule).Methods("POST")
+	r.HandleFunc("/schedule/{id}", mgr.GetSchedule).Methods("GET")
+	r.HandleFunc("/schedule/{id}", mgr.UpdateSchedule).Methods("PATCH")
+	r.HandleFunc("/schedule/{id}", mgr.DeleteSchedule).Methods("DELETE")
+	r.HandleFunc("/schedule/{id}/state", mgr.GetScheduleState).Methods("GET")
+	r.HandleFunc("/pool", mgr.ListPools).Methods("GET")
+	r.HandleFunc("/pool", mgr.CreatePool).Methods("POST")
+	r.HandleFunc("/pool/{id}", mgr.GetPool).Methods("GET")
+	r.HandleFunc("/pool/{id}", mgr.UpdatePool).Methods("PATCH")
+	r.HandleFunc("/pool/{id}", mgr.DeletePool).Methods("DELETE")
+	r.HandleFunc("/pool/{id}/state", mgr.GetPoolState).Methods("GET")
+
+	r.HandleFunc("/webhook", mgr.ListWebhooks).Methods("GET")
+	r.HandleFunc("/webhook", mgr.CreateWebhook).Methods("POST")
+	r.HandleFunc("/webhook/{id}", mgr.GetWebhook).Methods("GET")
+	r.HandleFunc("/webhook/{id}", mgr.UpdateWebhook).Methods("PATCH")
+	r.HandleFunc("/webhook/{id}", mgr.DeleteWebhook).Methods("DELETE")
+	r.HandleFunc("/webhook/{id}/delivery", mgr.ListWebhookDeliveries).Methods("GET")
+
+	r.HandleFunc("/audit", mgr.ListAudit).Methods("GET")
+	r.HandleFunc("/events", mgr.StreamEvents).Methods("GET")
+	r.HandleFunc("/openapi.json", mgr.GetOpenAPI).Methods("GET")
 }
 
 type Manager struct {
-	db  *database.Database
-	rec *reconciler.Reconciler
+	router *mux.Router
+	db     *database.Database
+	rec    *reconciler.Reconciler
+	audit  *audit.Recorder
+	events *events.Broker
 }
 
+// Error is the body of an unsuccessful response. Reason classifies the
+// failure for programs, which should not parse the description.
 type Error struct {
-	Code        int    `json:"code"`
-	Description string `json:"description"`
+	Code        int          `json:"code"`
+	Reason      string       `json:"reason,omitempty"`
+	Description string       `json:"description"`
+	Fields      []FieldError `json:"fields,omitempty"`
+	// The resources which prevent the deletion of one which is in use.
+	Dependents []database.Dependent `json:"dependents,omitempty"`
 }
 
+// Reasons of unsuccessful responses.
+const (
+	ReasonBadRequest    = "bad_request"
+	ReasonNotFound      = "not_found"
+	ReasonInUse         = "in_use"
+	ReasonConflict      = "conflict"
+	ReasonVersion       = "version_mismatch"
+	ReasonTooLarge      = "too_large"
+	ReasonMediaType     = "unsupported_media_type"
+	ReasonInvalid       = "invalid"
+	ReasonCommandFailed = "host_command_failed"
+	ReasonUnavailable   = "runtime_unavailable"
+	ReasonInternal      = "internal"
+)
+
 var (
-	ErrorOK       = Error{Code: http.StatusOK, Description: "OK"}
-	ErrorNotFound = Error{Code: http.StatusNotFound, Description: "Resource not found"}
-	ErrorDatabase = Error{Code: http.StatusInternalServerError, Description: "database error"}
+	ErrorOK          = Error{Code: http.StatusOK, Description: "OK"}
+	ErrorNotFound    = Error{Code: http.StatusNotFound, Reason: ReasonNotFound, Description: "Resource not found"}
+	ErrorDatabase    = Error{Code: http.StatusInternalServerError, Reason: ReasonInternal, Description: "database error"}
+	ErrorInUse       = Error{Code: http.StatusConflict, Reason: ReasonInUse, Description: "Resource is in use"}
+	ErrorVersion     = Error{Code: http.StatusPreconditionFailed, Reason: ReasonVersion, Description: "Resource has changed; its version doesn't match If-Match"}
+	ErrorUnavailable = Error{Code: http.StatusServiceUnavailable, Reason: ReasonUnavailable, Description: "container runtime unavailable"}
+
+	ErrorInvalidDomain = Error{Code: http.StatusUnprocessableEntity, Reason: ReasonInvalid, Description: "invalid domain; expected a name or a wildcard of the form *.example.com"}
 )
 
+// errorFor returns the response to a request which failed with err:
+// missing resources are 404, those in use or duplicated 409, those whose
+// version doesn't match If-Match 412, invalid ones 422, failed host
+// commands 502 and an unreachable container runtime 503.
+func errorFor(err error) Error {
+	var inUse *database.InUseError
+	switch {
+	case errors.Is(err, database.ErrNotFound):
+		return ErrorNotFound
+	case errors.As(err, &inUse):
+		e := ErrorInUse
+		e.Description = err.Error()
+		e.Dependents = inUse.Dependents
+		return e
+	case errors.Is(err, database.ErrInUse):
+		return ErrorInUse
+	case errors.Is(err, database.ErrVersionMismatch):
+		return ErrorVersion
+	case errors.Is(err, database.ErrConflict):
+		return Error{
+			Code:        http.StatusConflict,
+			Reason:      ReasonConflict,
+			Description: err.Error(),
+		}
+	case errors.Is(err, database.ErrInvalidReference),
+		errors.Is(err, reconciler.ErrInvalid),
+		errors.Is(err, webhook.ErrInvalid):
+		return errInvalid(err)
+	case errors.Is(err, database.ErrInvalidQuery):
+		return errQuery(err)
+	case errors.Is(err, network.ErrUnavailable):
+		return ErrorUnavailable
+	case errors.Is(err, network.ErrCommandFailed):
+		return Error{
+			Code:        http.StatusBadGateway,
+			Reason:      ReasonCommandFailed,
+			Description: err.Error(),
+		}
+	}
+	return ErrorDatabase
+}
+
+func errInvalid(err error) Error {
+	return Error{
+		Code:        http.StatusUnprocessableEntity,
+		Reason:      ReasonInvalid,
+		Description: err.Error(),
+	}
+}
+
 func errDecode(err error) Error {
 	return Error{
 		Code:        http.StatusBadRequest,
+		Reason:      ReasonBadRequest,
 		Description: err.Error(),
 	}
 }
 
+// errQuery is the response to a request with invalid query parameters.
+func errQuery(err error) Error {
+	return errDecode(err)
+}
+
 // if err is not nil, log it and respond with alt. Otherwise, respond
-// with result.
-func check(w http.ResponseWriter, result interface{}, err error, alt Error) {
+// with result, tagged with the ETag of its version if it is a resource,
+// or of its content if it is the response to a GET request, e.g. a list.
+func check(w http.ResponseWriter, r *http.Request, result interface{}, err error, alt Error) {
 	if err != nil {
-		log.Printf("error: %v", err)
+		logging.Error(r.Context(), "error handling request", "code", alt.Code, "err", err)
 		w.WriteHeader(alt.Code)
 		if err := json.NewEncoder(w).Encode(alt); err != nil {
-			log.Printf("error encoding response: %v", err)
+			logging.Error(r.Context(), "error encoding response", "err", err)
 		}
 		return
 	}
 
-	if err := json.NewEncoder(w).Encode(result); err != nil {
-		log.Printf("error encoding response: %v", err)
+	body, err := json.Marshal(result)
+	if err != nil {
+		logging.Error(r.Context(), "error encoding response", "err", err)
 		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
+	body = append(body, '\n')
+
+	if v, ok := result.(versioned); ok && v.ETag() != "" {
+		w.Header().Set("ETag", v.ETag())
+	} else if r.Method == http.MethodGet {
+		sum := sha256.Sum256(body)
+		w.Header().Set("ETag", fmt.Sprintf("W/\"%x\"", sum[:8]))
+	}
+	w.Write(body)
+}
+
+// versioned is implemented by resources, which embed database.Meta.
+type versioned interface {
+	ETag() string
+}
+
+// ifMatch returns the context of r, in which the resource of the given kind
+// and ID is only updated or deleted if its version is one listed by the
+// If-Match header of r, if there is one. The versions are the strong
+// entity tags returned in the ETag header; weak tags never match, and "*"
+// matches any version.
+func ifMatch(r *http.Request, resource, id string) context.Context {
+	values := r.Header.Values("If-Match")
+	if len(values) == 0 {
+		return r.Context()
+	}
+
+	var versions []int64
+	for _, tag := range strings.Split(strings.Join(values, ","), ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return r.Context()
+		}
+		if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+			continue
+		}
+		if v, err := strconv.ParseInt(tag[1:len(tag)-1], 10, 64); err == nil {
+			versions = append(versions, v)
+		}
+	}
+	return database.ExpectVersion(r.Context(), resource, id, versions...)
+}
+
+const maxListLimit = 1000
+
+// parseListQuery returns the options of a list request: filters, sort,
+// cursor and page size.
+func parseListQuery(r *http.Request) (database.ListOptions, error) {
+	query := r.URL.Query()
+	opts := database.ListOptions{
+		Name:      query.Get("name"),
+		NetworkID: query.Get("network_id"),
+		Address:   query.Get("address"),
+		Sort:      query.Get("sort"),
+		Cursor:    query.Get("cursor"),
+	}
+	if s := query.Get("limit"); s != "" {
+		var err error
+		if opts.Limit, err = strconv.Atoi(s); err != nil || opts.Limit < 1 || opts.Limit > maxListLimit {
+			return opts, fmt.Errorf("limit must be between 1 and %d", maxListLimit)
+		}
+	}
+	return opts, nil
+}
+
+// setPageHeaders describes a page of a list in the headers of the
+// response: the number of resources in every page, and the cursor and
+// link of the next page, if there is one.
+func setPageHeaders(w http.ResponseWriter, r *http.Request, page *database.Page) {
+	w.Header().Set("X-Total-Count", strconv.Itoa(page.Total))
+	if page.Next == "" {
+		return
+	}
+	w.Header().Set("X-Next-Cursor", page.Next)
+
+	next := *r.URL
+	query := next.Query()
+	query.Set("cursor", page.Next)
+	next.RawQuery = query.Encode()
+	w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", next.RequestURI()))
 }
 
 func (m *Manager) GetDNS(w http.ResponseWriter, r *http.Request) {
 	route, err := m.rec.DNS.Get(r.Context())
-	check(w, route, err, ErrorDatabase)
+	check(w, r, route, err, errorFor(err))
 }
 
 func (m *Manager) SetDNS(w http.ResponseWriter, r *http.Request) {
 	route, err := m.rec.DNS.Create(r.Context(), mux.Vars(r)["network"])
-	check(w, route, err, ErrorDatabase)
+	check(w, r, route, err, errorFor(err))
 }
 
 func (m *Manager) UnsetDNS(w http.ResponseWriter, r *http.Request) {
-	err := m.rec.DNS.Delete(r.Context())
-	check(w, ErrorOK, err, ErrorDatabase)
+	err := m.rec.DNS.Delete(ifMatch(r, "dns", "0"))
+	check(w, r, ErrorOK, err, errorFor(err))
 }
@@ -0,0 +1,147 @@
+package v1_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/pricec/vpnmux/pkg/api/v1"
+	"github.com/pricec/vpnmux/pkg/database"
+	"github.com/pricec/vpnmux/pkg/network"
+	"github.com/pricec/vpnmux/pkg/reconciler"
+	"github.com/pricec/vpnmux/pkg/webhook"
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrorFor(t *testing.T) {
+	dependents := []database.Dependent{{Resource: "network", ID: "n1", Name: "vpn"}}
+
+	tests := []struct {
+		err    error
+		code   int
+		reason string
+	}{
+		{database.ErrNotFound, http.StatusNotFound, v1.ReasonNotFound},
+		{fmt.Errorf("network n1: %w", database.ErrNotFound), http.StatusNotFound, v1.ReasonNotFound},
+		{database.ErrInUse, http.StatusConflict, v1.ReasonInUse},
+		{&database.InUseError{Dependents: dependents}, http.StatusConflict, v1.ReasonInUse},
+		{fmt.Errorf("%w: port 80", database.ErrConflict), http.StatusConflict, v1.ReasonConflict},
+		{database.ErrVersionMismatch, http.StatusPreconditionFailed, v1.ReasonVersion},
+		{fmt.Errorf("%w: malformed cursor", database.ErrInvalidQuery), http.StatusBadRequest, v1.ReasonBadRequest},
+		{fmt.Errorf("%w: config", database.ErrInvalidReference), http.StatusUnprocessableEntity, v1.ReasonInvalid},
+		{fmt.Errorf("%w: bad address", reconciler.ErrInvalid), http.StatusUnprocessableEntity, v1.ReasonInvalid},
+		{fmt.Errorf("%w: bad url", webhook.ErrInvalid), http.StatusUnprocessableEntity, v1.ReasonInvalid},
+		{
+			fmt.Errorf("ipset add: %w", &network.CommandError{Args: []string{"ipset"}, ExitCode: 1, Err: errors.New("exit status 1")}),
+			http.StatusBadGateway,
+			v1.ReasonCommandFailed,
+		},
+		{
+			fmt.Errorf("running container: %w", &network.CommandError{Args: []string{"docker"}, ExitCode: -1, Err: &exec.Error{Name: "docker", Err: exec.ErrNotFound}}),
+			http.StatusServiceUnavailable,
+			v1.ReasonUnavailable,
+		},
+		{errors.New("disk I/O error"), http.StatusInternalServerError, v1.ReasonInternal},
+	}
+
+	for _, test := range tests {
+		t.Run(test.err.Error(), func(t *testing.T) {
+			e := v1.ErrorFor(test.err)
+			require.Equal(t, test.code, e.Code)
+			require.Equal(t, test.reason, e.Reason)
+		})
+	}
+
+	e := v1.ErrorFor(fmt.Errorf("deleting config: %w", &database.InUseError{Dependents: dependents}))
+	require.Equal(t, dependents, e.Dependents)
+}
+
+func TestPreconditions(t *testing.T) {
+	dir, err := os.MkdirTemp("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	db, err := database.New(context.Background(), filepath.Join(dir, "vpnmux.db"))
+	require.Nil(t, err)
+
+	r := mux.NewRouter()
+	v1.RegisterRoutes(r.PathPrefix("/v1").Subrouter(), v1.NewManager(db))
+	serve := func(method, path, ifMatch, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve("POST", "/v1/webhook", "", `{"name": "hook", "url": "http://example.com/hook", "secret": "s3cret"}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.Equal(t, `"1"`, w.Header().Get("ETag"))
+	var wh database.Webhook
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &wh))
+	require.Equal(t, int64(1), wh.Version)
+	path := "/v1/webhook/" + wh.ID
+
+	w = serve("GET", path, "", "")
+	require.Equal(t, `"1"`, w.Header().Get("ETag"))
+	w = serve("GET", "/v1/webhook", "", "")
+	require.True(t, strings.HasPrefix(w.Header().Get("ETag"), `W/"`))
+
+	// The body of a response may be sent back, with its version.
+	body, err := json.Marshal(wh)
+	require.Nil(t, err)
+	w = serve("PATCH", path, `"1"`, string(body))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.Equal(t, `"2"`, w.Header().Get("ETag"))
+
+	for _, ifMatch := range []string{`"1"`, `W/"2"`, `"3", "4"`, `bogus`} {
+		w = serve("DELETE", path, ifMatch, "")
+		require.Equal(t, http.StatusPreconditionFailed, w.Code, ifMatch)
+		var e v1.Error
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), &e))
+		require.Equal(t, v1.ReasonVersion, e.Reason)
+	}
+
+	w = serve("DELETE", path, `"1", "2"`, "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = serve("DELETE", path, "*", "")
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestImportClientsRejectsInvalidBodies(t *testing.T) {
+	r := mux.NewRouter()
+	v1.RegisterRoutes(r.PathPrefix("/v1").Subrouter(), v1.NewManager(nil))
+	for _, tc := range []struct {
+		path        string
+		contentType string
+		body        string
+		code        int
+		reason      string
+	}{
+		{"/v1/client/import?format=xml", "", "<hosts/>", http.StatusBadRequest, v1.ReasonBadRequest},
+		{"/v1/client/import", "text/csv", "name,hostname\nlaptop,laptop.lan\n", http.StatusBadRequest, v1.ReasonBadRequest},
+		{"/v1/client/import?format=leases", "text/plain", "soon aa:bb:cc:dd:ee:01 192.168.0.10 laptop\n", http.StatusBadRequest, v1.ReasonBadRequest},
+		{"/v1/client/import", "application/json", `[{"name": "laptop", "ip": "192.168.0.10"}]`, http.StatusUnprocessableEntity, v1.ReasonInvalid},
+	} {
+		req := httptest.NewRequest("POST", tc.path, strings.NewReader(tc.body))
+		if tc.contentType != "" {
+			req.Header.Set("Content-Type", tc.contentType)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		require.Equal(t, tc.code, w.Code, tc.body)
+		var e v1.Error
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), &e))
+		require.Equal(t, tc.reason, e.Reason, tc.body)
+	}
+}
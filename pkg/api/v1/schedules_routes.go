@@ -0,0 +1,61 @@
+package v1
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/pricec/vpnmux/pkg/database"
+)
+
+func (m *Manager) ListSchedules(w http.ResponseWriter, r *http.Request) {
+	schedules, err := m.db.Schedules.List(r.Context())
+	check(w, r, schedules, err, errorFor(err))
+}
+
+func (m *Manager) CreateSchedule(w http.ResponseWriter, r *http.Request) {
+	s := &database.Schedule{}
+	if err := json.NewDecoder(r.Body).Decode(s); err != nil {
+		check(w, r, nil, err, errDecode(err))
+		return
+	}
+
+	schedule, err := m.rec.Schedules.Create(r.Context(), s)
+	check(w, r, schedule, err, errorFor(err))
+}
+
+func (m *Manager) GetSchedule(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	schedule, err := m.rec.Schedules.Get(r.Context(), id)
+	check(w, r, schedule, err, errorFor(err))
+}
+
+func (m *Manager) UpdateSchedule(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	s := &database.Schedule{}
+	if err := json.NewDecoder(r.Body).Decode(s); err != nil {
+		check(w, r, nil, err, errDecode(err))
+		return
+	}
+	s.ID = id
+
+	schedule, err := m.rec.Schedules.Update(ifMatch(r, "schedule", id), s)
+	check(w, r, schedule, err, errorFor(err))
+}
+
+func (m *Manager) DeleteSchedule(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	err := m.rec.Schedules.Delete(ifMatch(r, "schedule", id), id)
+	check(w, r, ErrorOK, err, errorFor(err))
+}
+
+// GetScheduleState returns the network to which a schedule assigns its
+// client now, and when that may next change.
+func (m *Manager) GetScheduleState(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	state, err := m.rec.Schedules.State(r.Context(), id)
+	check(w, r, state, err, errorFor(err))
+}
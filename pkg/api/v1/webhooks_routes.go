@@ -0,0 +1,108 @@
+package v1
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/pricec/vpnmux/pkg/database"
+	"github.com/pricec/vpnmux/pkg/webhook"
+)
+
+const (
+	defaultDeliveryLimit = 50
+	maxDeliveryLimit     = 1000
+)
+
+// hideSecret returns a webhook without its secret, which is never returned.
+func hideSecret(w *database.Webhook) *database.Webhook {
+	if w == nil {
+		return nil
+	}
+	hidden := *w
+	hidden.Secret = ""
+	return &hidden
+}
+
+func (m *Manager) ListWebhooks(w http.ResponseWriter, r *http.Request) {
+	webhooks, err := m.db.Webhooks.List(r.Context())
+	for i, wh := range webhooks {
+		webhooks[i] = hideSecret(wh)
+	}
+	check(w, r, webhooks, err, errorFor(err))
+}
+
+func (m *Manager) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	wh := &database.Webhook{}
+	if err := json.NewDecoder(r.Body).Decode(wh); err != nil {
+		check(w, r, nil, err, errDecode(err))
+		return
+	}
+	if err := webhook.ValidateNew(wh); err != nil {
+		check(w, r, nil, err, errorFor(err))
+		return
+	}
+
+	result, err := m.db.Webhooks.Put(r.Context(), wh)
+	check(w, r, hideSecret(result), err, errorFor(err))
+}
+
+func (m *Manager) GetWebhook(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	wh, err := m.db.Webhooks.Get(r.Context(), id)
+	check(w, r, hideSecret(wh), err, errorFor(err))
+}
+
+// UpdateWebhook replaces a webhook; its secret is kept unless a new one is
+// given.
+func (m *Manager) UpdateWebhook(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	wh := &database.Webhook{}
+	if err := json.NewDecoder(r.Body).Decode(wh); err != nil {
+		check(w, r, nil, err, errDecode(err))
+		return
+	}
+	wh.ID = id
+
+	err := webhook.Validate(wh)
+	if err == nil {
+		err = m.db.Webhooks.Update(ifMatch(r, "webhook", id), wh)
+	}
+	if err == nil {
+		wh, err = m.db.Webhooks.Get(r.Context(), id)
+	}
+	check(w, r, hideSecret(wh), err, errorFor(err))
+}
+
+func (m *Manager) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	err := m.db.Webhooks.Delete(ifMatch(r, "webhook", id), id)
+	check(w, r, ErrorOK, err, errorFor(err))
+}
+
+// ListWebhookDeliveries returns the most recent deliveries to a webhook,
+// newest first.
+func (m *Manager) ListWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	limit := defaultDeliveryLimit
+	if s := r.URL.Query().Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 || limit > maxDeliveryLimit {
+			err = fmt.Errorf("limit must be between 1 and %d", maxDeliveryLimit)
+			check(w, r, nil, err, errQuery(err))
+			return
+		}
+	}
+
+	_, err := m.db.Webhooks.Get(r.Context(), id)
+	var deliveries []*database.WebhookDelivery
+	if err == nil {
+		deliveries, err = m.db.Webhooks.Deliveries(r.Context(), id, limit)
+	}
+	check(w, r, deliveries, err, errorFor(err))
+}
@@ -0,0 +1,215 @@
+// Package audit records who changed what: mutations made via the API and
+// the host commands executed by vpnmux, whether on behalf of an API
+// request or a reconcile pass. The commands of the periodic loops which
+// only read the host's state are not recorded.
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/pricec/vpnmux/pkg/database"
+	"github.com/pricec/vpnmux/pkg/logging"
+	"github.com/pricec/vpnmux/pkg/network"
+)
+
+// Origin identifies the API request on whose behalf something was done.
+type Origin struct {
+	RequestID string
+	Actor     string
+}
+
+type contextKey struct{}
+
+// NewContext returns a context carrying the given origin.
+func NewContext(ctx context.Context, o Origin) context.Context {
+	return context.WithValue(ctx, contextKey{}, o)
+}
+
+// FromContext returns the origin carried by ctx, if any.
+func FromContext(ctx context.Context) Origin {
+	o, _ := ctx.Value(contextKey{}).(Origin)
+	return o
+}
+
+// Redacted is recorded in place of secrets, i.e. credential values and
+// webhook secrets.
+const Redacted = "REDACTED"
+
+var secretKeys = map[string]bool{
+	"value":  true,
+	"secret": true,
+}
+
+// Redact returns the given JSON with its secrets replaced by Redacted. If
+// it cannot be parsed, nothing is returned, lest a secret be recorded.
+func Redact(raw json.RawMessage) json.RawMessage {
+	if len(raw) == 0 {
+		return nil
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return nil
+	}
+	redacted, err := json.Marshal(redact(v))
+	if err != nil {
+		return nil
+	}
+	return redacted
+}
+
+func redact(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if secretKeys[key] {
+				v[key] = Redacted
+			} else {
+				v[key] = redact(value)
+			}
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = redact(value)
+		}
+	}
+	return v
+}
+
+// recordBatch is the most entries written in one transaction.
+const recordBatch = 256
+
+// Recorder appends entries to the audit log in the background, so that
+// the commands it records are not slowed by the database, and prunes
+// entries older than its retention.
+type Recorder struct {
+	db        *database.AuditDatabase
+	retention time.Duration
+	entries   chan *database.AuditEntry
+	done      chan struct{}
+}
+
+// NewRecorder returns a recorder which runs until ctx is done. If
+// retention is zero, entries are kept forever.
+func NewRecorder(ctx context.Context, db *database.AuditDatabase, retention time.Duration) *Recorder {
+	r := &Recorder{
+		db:        db,
+		retention: retention,
+		entries:   make(chan *database.AuditEntry, recordBatch),
+		done:      make(chan struct{}),
+	}
+	go r.run(ctx)
+	return r
+}
+
+func (r *Recorder) run(ctx context.Context) {
+	defer close(r.done)
+
+	// Entries are written even once ctx is done, until the queue is empty.
+	write := context.Background()
+
+	prune := time.NewTicker(time.Hour)
+	defer prune.Stop()
+	r.prune(ctx)
+
+	for {
+		select {
+		case <-ctx.Done():
+			r.flush(write)
+			return
+		case <-prune.C:
+			r.prune(ctx)
+		case e := <-r.entries:
+			batch := []*database.AuditEntry{e}
+		drain:
+			for len(batch) < recordBatch {
+				select {
+				case e := <-r.entries:
+					batch = append(batch, e)
+				default:
+					break drain
+				}
+			}
+			r.append(write, batch)
+		}
+	}
+}
+
+// flush writes the entries still queued.
+func (r *Recorder) flush(ctx context.Context) {
+	var batch []*database.AuditEntry
+	for {
+		select {
+		case e := <-r.entries:
+			batch = append(batch, e)
+		default:
+			if len(batch) > 0 {
+				r.append(ctx, batch)
+			}
+			return
+		}
+	}
+}
+
+func (r *Recorder) append(ctx context.Context, batch []*database.AuditEntry) {
+	if err := r.db.Append(ctx, batch...); err != nil {
+		logging.Error(ctx, "error appending to audit log", "entries", len(batch), "err", err)
+	}
+}
+
+func (r *Recorder) prune(ctx context.Context) {
+	if r.retention == 0 {
+		return
+	}
+	if err := r.db.Prune(ctx, time.Now().Add(-r.retention)); err != nil {
+		logging.Error(ctx, "error pruning audit log", "err", err)
+	}
+}
+
+// record queues the given entry, attributing it to the origin carried by
+// ctx. Entries recorded after the recorder stopped are logged instead.
+func (r *Recorder) record(ctx context.Context, e *database.AuditEntry) {
+	o := FromContext(ctx)
+	e.Time = time.Now()
+	e.RequestID = o.RequestID
+	e.Actor = o.Actor
+
+	select {
+	case r.entries <- e:
+	case <-r.done:
+		logging.Warn(ctx, "audit log stopped; dropping entry", "kind", e.Kind, "path", e.Path, "command", e.Command)
+	}
+}
+
+// Command records a host command and its exit code; it may be registered
+// with network.OnCommand. Commands which only read the host's state are
+// only recorded if they have an origin, lest the checks of the periodic
+// loops bury the changes.
+func (r *Recorder) Command(ctx context.Context, args []string, exitCode int) {
+	if FromContext(ctx) == (Origin{}) && network.ReadOnly(args) {
+		return
+	}
+	r.record(ctx, &database.AuditEntry{
+		Kind:     database.AuditKindCommand,
+		Command:  strings.Join(args, " "),
+		ExitCode: &exitCode,
+	})
+}
+
+// Mutation records a change made via the API. Secrets are redacted from
+// the resource's state before and after the change.
+func (r *Recorder) Mutation(ctx context.Context, e *database.AuditEntry) {
+	e.Kind = database.AuditKindMutation
+	e.Before = Redact(e.Before)
+	e.After = Redact(e.After)
+	r.record(ctx, e)
+}
+
+// Wait blocks until the recorder has stopped and written every entry
+// queued before then.
+func (r *Recorder) Wait() {
+	<-r.done
+}
@@ -0,0 +1,63 @@
+package audit_test
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/pricec/vpnmux/pkg/audit"
+	"github.com/pricec/vpnmux/pkg/database"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedact(t *testing.T) {
+	redacted := audit.Redact(json.RawMessage(`[{"id":"a","name":"user","value":"hunter2"},{"nested":{"value":1}},{"url":"http://hook","secret":"s3cret"}]`))
+	require.JSONEq(t, `[{"id":"a","name":"user","value":"REDACTED"},{"nested":{"value":"REDACTED"}},{"url":"http://hook","secret":"REDACTED"}]`, string(redacted))
+
+	require.Nil(t, audit.Redact(nil))
+	require.Nil(t, audit.Redact(json.RawMessage(`{"value":`)))
+}
+
+func TestRecorder(t *testing.T) {
+	f, err := os.CreateTemp("", "")
+	require.Nil(t, err)
+	f.Close()
+	defer os.Remove(f.Name())
+
+	db, err := database.New(context.Background(), f.Name())
+	require.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	recorder := audit.NewRecorder(ctx, db.Audit, 0)
+
+	reqCtx := audit.NewContext(context.Background(), audit.Origin{RequestID: "r1", Actor: "alice"})
+	recorder.Mutation(reqCtx, &database.AuditEntry{
+		Action:   "create",
+		Resource: "credential",
+		After:    json.RawMessage(`{"id":"c1","value":"hunter2"}`),
+	})
+	recorder.Command(reqCtx, []string{"ip", "rule", "show"}, 0)
+	recorder.Command(context.Background(), []string{"docker", "rm", "-f", "c1"}, -1)
+	recorder.Command(context.Background(), []string{"iptables", "-t", "filter", "-C", "FORWARD", "-j", "DROP"}, 0)
+
+	cancel()
+	recorder.Wait()
+
+	entries, err := db.Audit.Query(context.Background(), database.AuditFilter{RequestID: "r1"})
+	require.Nil(t, err)
+	require.Equal(t, 2, len(entries))
+	require.Equal(t, "ip rule show", entries[0].Command)
+	require.Equal(t, 0, *entries[0].ExitCode)
+	require.Equal(t, database.AuditKindMutation, entries[1].Kind)
+	require.Equal(t, "alice", entries[1].Actor)
+	require.JSONEq(t, `{"id":"c1","value":"REDACTED"}`, string(entries[1].After))
+
+	// Reads without an origin are not recorded.
+	entries, err = db.Audit.Query(context.Background(), database.AuditFilter{Kind: database.AuditKindCommand})
+	require.Nil(t, err)
+	require.Equal(t, 2, len(entries))
+	require.Equal(t, -1, *entries[0].ExitCode)
+	require.Equal(t, "", entries[0].Actor)
+	require.Equal(t, "ip rule show", entries[1].Command)
+}
@@ -12,9 +12,51 @@ type Config struct {
 	LocalSubnetCIDR string        `env:"VPNMUX_SUBNET_CIDR,notEmpty"`
 	ShutdownTimeout time.Duration `env:"VPNMUX_SHUTDOWN_TIMEOUT" envDefault:"10s"`
 	ListenPort      uint16        `env:"VPNMUX_LISTEN_PORT" envDefault:"8080"`
+	LogFormat       string        `env:"VPNMUX_LOG_FORMAT" envDefault:"logfmt"`
+	LogLevel        string        `env:"VPNMUX_LOG_LEVEL" envDefault:"info"`
 	LANInterface    string        `env:"VPNMUX_LAN_INTERFACE,notEmpty"`
 	WANInterface    string        `env:"VPNMUX_WAN_INTERFACE,notEmpty"`
 	DNSMark         string        `env:"VPNMUX_DNS_MARK" envDefault:"0x0001"`
+	WANMark         string        `env:"VPNMUX_WAN_MARK" envDefault:"0x0002"`
+	MarkBase        string        `env:"VPNMUX_MARK_BASE" envDefault:"0x0100"`
+
+	RouteTableMin int    `env:"VPNMUX_ROUTE_TABLE_MIN" envDefault:"1"`
+	RouteTableMax int    `env:"VPNMUX_ROUTE_TABLE_MAX" envDefault:"252"`
+	RTTablesFile  string `env:"VPNMUX_RT_TABLES_FILE" envDefault:"/etc/iproute2/rt_tables.d/vpnmux.conf"`
+
+	LocalSubnet6CIDR string `env:"VPNMUX_SUBNET6_CIDR"`
+	IPv6Prefix       string `env:"VPNMUX_IPV6_PREFIX" envDefault:"fd76:706e:6d78::/48"`
+	BlockIPv6        bool   `env:"VPNMUX_IPV6_BLOCK" envDefault:"true"`
+
+	ReconcileInterval time.Duration `env:"VPNMUX_RECONCILE_INTERVAL" envDefault:"1m"`
+	MonitorInterval   time.Duration `env:"VPNMUX_MONITOR_INTERVAL" envDefault:"15s"`
+
+	LeaseFile             string        `env:"VPNMUX_LEASE_FILE"`
+	ClientResolveInterval time.Duration `env:"VPNMUX_CLIENT_RESOLVE_INTERVAL" envDefault:"30s"`
+
+	DNSForwarder          bool     `env:"VPNMUX_DNS_FORWARDER" envDefault:"false"`
+	DNSForwarderPort      uint16   `env:"VPNMUX_DNS_FORWARDER_PORT" envDefault:"53"`
+	DNSForwarderCacheSize int      `env:"VPNMUX_DNS_FORWARDER_CACHE_SIZE" envDefault:"1024"`
+	DNSForwarderUpstreams []string `env:"VPNMUX_DNS_FORWARDER_UPSTREAMS" envSeparator:","`
+
+	AuditRetention      time.Duration `env:"VPNMUX_AUDIT_RETENTION" envDefault:"720h"`
+	AuditActorHeader    string        `env:"VPNMUX_AUDIT_ACTOR_HEADER"`
+	AuditTrustedProxies []string      `env:"VPNMUX_AUDIT_TRUSTED_PROXIES" envSeparator:","`
+
+	EventBuffer int `env:"VPNMUX_EVENT_BUFFER" envDefault:"1000"`
+
+	WebhookTimeout     time.Duration `env:"VPNMUX_WEBHOOK_TIMEOUT" envDefault:"10s"`
+	WebhookMaxAttempts int           `env:"VPNMUX_WEBHOOK_MAX_ATTEMPTS" envDefault:"8"`
+	WebhookBackoff     time.Duration `env:"VPNMUX_WEBHOOK_BACKOFF" envDefault:"10s"`
+	WebhookMaxBackoff  time.Duration `env:"VPNMUX_WEBHOOK_MAX_BACKOFF" envDefault:"1h"`
+	WebhookRetention   time.Duration `env:"VPNMUX_WEBHOOK_RETENTION" envDefault:"168h"`
+
+	MQTTBroker          string `env:"VPNMUX_MQTT_BROKER"`
+	MQTTUsername        string `env:"VPNMUX_MQTT_USERNAME"`
+	MQTTPassword        string `env:"VPNMUX_MQTT_PASSWORD"`
+	MQTTClientID        string `env:"VPNMUX_MQTT_CLIENT_ID" envDefault:"vpnmux"`
+	MQTTTopicPrefix     string `env:"VPNMUX_MQTT_TOPIC_PREFIX" envDefault:"vpnmux"`
+	MQTTDiscoveryPrefix string `env:"VPNMUX_MQTT_DISCOVERY_PREFIX" envDefault:"homeassistant"`
 }
 
 func New() (*Config, error) {
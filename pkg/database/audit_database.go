@@ -0,0 +1,174 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+const (
+	AuditKindMutation = "mutation"
+	AuditKindCommand  = "command"
+)
+
+// AuditDatabase is append-only: entries are only ever removed by Prune.
+type AuditDatabase struct {
+	db *sql.DB
+}
+
+// AuditEntry records either a mutation made via the API or a host command
+// executed by vpnmux. Entries made on behalf of an API request carry its
+// ID and actor.
+type AuditEntry struct {
+	ID        int64     `json:"id"`
+	Time      time.Time `json:"time"`
+	Kind      string    `json:"kind"`
+	RequestID string    `json:"request_id,omitempty"`
+	Actor     string    `json:"actor,omitempty"`
+	// Mutations only: "create", "update" or "delete", the type and ID of
+	// the resource, the request path and response code, and the resource
+	// before and after the request.
+	Action     string          `json:"action,omitempty"`
+	Resource   string          `json:"resource,omitempty"`
+	ResourceID string          `json:"resource_id,omitempty"`
+	Path       string          `json:"path,omitempty"`
+	Code       int             `json:"code,omitempty"`
+	Before     json.RawMessage `json:"before,omitempty"`
+	After      json.RawMessage `json:"after,omitempty"`
+	// Commands only; the exit code is -1 if the command did not run.
+	Command  string `json:"command,omitempty"`
+	ExitCode *int   `json:"exit_code,omitempty"`
+}
+
+// AuditFilter selects audit entries; empty fields match every entry.
+type AuditFilter struct {
+	Kind       string
+	RequestID  string
+	Actor      string
+	Resource   string
+	ResourceID string
+	From       time.Time
+	To         time.Time
+	// Only entries with a lower ID, i.e. older entries; for pagination.
+	Before int64
+	Limit  int
+}
+
+const auditColumns = "id, time, kind, request_id, actor, action, resource, resource_id, path, code, before, after, command, exit_code"
+
+func nullJSON(raw json.RawMessage) sql.NullString {
+	return nullString(string(raw))
+}
+
+// Append adds entries to the log.
+func (d *AuditDatabase) Append(ctx context.Context, entries ...*AuditEntry) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, e := range entries {
+		var code sql.NullInt64
+		if e.Code != 0 {
+			code = sql.NullInt64{Int64: int64(e.Code), Valid: true}
+		}
+		var exitCode sql.NullInt64
+		if e.ExitCode != nil {
+			exitCode = sql.NullInt64{Int64: int64(*e.ExitCode), Valid: true}
+		}
+
+		result, err := tx.ExecContext(ctx, "INSERT INTO audit(time, kind, request_id, actor, action, resource, resource_id, path, code, before, after, command, exit_code) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			e.Time.UnixNano(), e.Kind, e.RequestID, e.Actor, e.Action, e.Resource, e.ResourceID, e.Path, code, nullJSON(e.Before), nullJSON(e.After), e.Command, exitCode)
+		if err != nil {
+			return err
+		}
+		if e.ID, err = result.LastInsertId(); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Query returns the entries matching filter, newest first.
+func (d *AuditDatabase) Query(ctx context.Context, filter AuditFilter) ([]*AuditEntry, error) {
+	var where []string
+	var args []interface{}
+	for _, f := range []struct {
+		column string
+		value  string
+	}{
+		{"kind", filter.Kind},
+		{"request_id", filter.RequestID},
+		{"actor", filter.Actor},
+		{"resource", filter.Resource},
+		{"resource_id", filter.ResourceID},
+	} {
+		if f.value != "" {
+			where = append(where, f.column+" = ?")
+			args = append(args, f.value)
+		}
+	}
+	if !filter.From.IsZero() {
+		where = append(where, "time >= ?")
+		args = append(args, filter.From.UnixNano())
+	}
+	if !filter.To.IsZero() {
+		where = append(where, "time < ?")
+		args = append(args, filter.To.UnixNano())
+	}
+	if filter.Before != 0 {
+		where = append(where, "id < ?")
+		args = append(args, filter.Before)
+	}
+
+	query := "SELECT " + auditColumns + " FROM audit"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY id DESC"
+	if filter.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, filter.Limit)
+	}
+
+	rows, err := d.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries = make([]*AuditEntry, 0)
+	for rows.Next() {
+		e := &AuditEntry{}
+		var t int64
+		var code, exitCode sql.NullInt64
+		var before, after sql.NullString
+		err := rows.Scan(&e.ID, &t, &e.Kind, &e.RequestID, &e.Actor, &e.Action, &e.Resource, &e.ResourceID, &e.Path, &code, &before, &after, &e.Command, &exitCode)
+		if err != nil {
+			return nil, err
+		}
+		e.Time = time.Unix(0, t).UTC()
+		e.Code = int(code.Int64)
+		if before.Valid {
+			e.Before = json.RawMessage(before.String)
+		}
+		if after.Valid {
+			e.After = json.RawMessage(after.String)
+		}
+		if exitCode.Valid {
+			c := int(exitCode.Int64)
+			e.ExitCode = &c
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// Prune deletes entries older than the given time.
+func (d *AuditDatabase) Prune(ctx context.Context, before time.Time) error {
+	_, err := d.db.ExecContext(ctx, "DELETE FROM audit WHERE time < ?", before.UnixNano())
+	return err
+}
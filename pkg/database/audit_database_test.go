@@ -0,0 +1,84 @@
+package database_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/pricec/vpnmux/pkg/database"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAudit(t *testing.T) {
+	ctx := context.Background()
+	h, err := NewHarness(ctx, HarnessOptions{})
+	require.Nil(t, err)
+	defer h.Close()
+
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	exitCode := 1
+	entries := []*database.AuditEntry{
+		{
+			Time:       start,
+			Kind:       database.AuditKindMutation,
+			RequestID:  "r1",
+			Actor:      "alice",
+			Action:     "update",
+			Resource:   "client",
+			ResourceID: "c1",
+			Path:       "/v1/client/c1",
+			Code:       200,
+			Before:     json.RawMessage(`{"name":"old"}`),
+			After:      json.RawMessage(`{"name":"new"}`),
+		},
+		{
+			Time:      start.Add(time.Second),
+			Kind:      database.AuditKindCommand,
+			RequestID: "r1",
+			Actor:     "alice",
+			Command:   "iptables -t filter -C FORWARD -j DROP",
+			ExitCode:  &exitCode,
+		},
+		{
+			Time:    start.Add(time.Hour),
+			Kind:    database.AuditKindCommand,
+			Command: "ip rule show",
+		},
+	}
+	require.Nil(t, h.DB.Audit.Append(ctx, entries...))
+	require.NotZero(t, entries[0].ID)
+
+	all, err := h.DB.Audit.Query(ctx, database.AuditFilter{})
+	require.Nil(t, err)
+	require.Equal(t, 3, len(all))
+	require.Equal(t, "ip rule show", all[0].Command)
+	require.Nil(t, all[0].ExitCode)
+
+	mutations, err := h.DB.Audit.Query(ctx, database.AuditFilter{Kind: database.AuditKindMutation})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(mutations))
+	require.Equal(t, start, mutations[0].Time)
+	require.JSONEq(t, `{"name":"old"}`, string(mutations[0].Before))
+	require.Equal(t, 200, mutations[0].Code)
+
+	request, err := h.DB.Audit.Query(ctx, database.AuditFilter{RequestID: "r1", Limit: 1})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(request))
+	require.Equal(t, 1, *request[0].ExitCode)
+
+	// Pages continue from the last entry of the previous page.
+	older, err := h.DB.Audit.Query(ctx, database.AuditFilter{RequestID: "r1", Before: request[0].ID})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(older))
+	require.Equal(t, "c1", older[0].ResourceID)
+
+	window, err := h.DB.Audit.Query(ctx, database.AuditFilter{From: start.Add(time.Second), To: start.Add(time.Hour)})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(window))
+
+	require.Nil(t, h.DB.Audit.Prune(ctx, start.Add(time.Minute)))
+	all, err = h.DB.Audit.Query(ctx, database.AuditFilter{})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(all))
+}
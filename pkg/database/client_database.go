@@ -12,14 +12,47 @@ type ClientDatabase struct {
 	db *sql.DB
 }
 
+// Client is a host on the LAN, identified by its IPv4 and/or IPv6 address
+// and/or its MAC address. If a MAC address is given, the IPv4 address is
+// kept up to date with the host's current lease or neighbor table entry.
 type Client struct {
-	ID      string `json:"id"`
-	Name    string `json:"name"`
-	Address string `json:"address"`
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Address  string `json:"address"`
+	Address6 string `json:"address6,omitempty"`
+	MAC      string `json:"mac,omitempty"`
+	RateLimit
+	// How the client's packets to the WAN are treated when they are not
+	// routed via a network; one of the KillSwitch constants.
+	KillSwitch string `json:"kill_switch"`
+	// Destinations the client reaches via the WAN, bypassing any network,
+	// if KillSwitch is KillSwitchAllowList.
+	WANAllow []WANAllow `json:"wan_allow,omitempty"`
+	Meta
+}
+
+// Kill switch modes of a client.
+const (
+	// Never forward the client's packets to the WAN.
+	KillSwitchStrict = "strict"
+	// Forward the client's packets to the WAN while it is not assigned to a
+	// network, directly or via its group.
+	KillSwitchUnassigned = "unassigned"
+	// Forward the client's packets to the destinations of its allow-list to
+	// the WAN, whether or not it is assigned to a network.
+	KillSwitchAllowList = "allowlist"
+)
+
+// WANAllow is a destination of a client's allow-list, optionally
+// restricted to a protocol and destination ports.
+type WANAllow struct {
+	Destination string `json:"destination"`
+	Protocol    string `json:"protocol,omitempty"`
+	Ports       string `json:"ports,omitempty"`
 }
 
 func (d *ClientDatabase) List(ctx context.Context) ([]*Client, error) {
-	rows, err := d.db.QueryContext(ctx, "SELECT id, name, address FROM client")
+	rows, err := d.db.QueryContext(ctx, "SELECT id, name, address, address6, mac, upload_kbit, download_kbit, kill_switch, "+metaColumns+" FROM client")
 	if err != nil {
 		return nil, err
 	}
@@ -28,63 +61,167 @@ func (d *ClientDatabase) List(ctx context.Context) ([]*Client, error) {
 	var clients = make([]*Client, 0)
 	for rows.Next() {
 		client := &Client{}
-		if err := rows.Scan(&client.ID, &client.Name, &client.Address); err != nil {
+		if err := rows.Scan(withMeta(&client.Meta, &client.ID, &client.Name, &client.Address, &client.Address6, &client.MAC, &client.UploadKbit, &client.DownloadKbit, &client.KillSwitch)...); err != nil {
 			return nil, err
 		}
 		clients = append(clients, client)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := d.populate(ctx, clients...); err != nil {
+		return nil, err
+	}
 	return clients, nil
 }
 
+// populate reads the allow-lists of the given clients.
+func (d *ClientDatabase) populate(ctx context.Context, clients ...*Client) error {
+	for _, client := range clients {
+		rows, err := d.db.QueryContext(ctx, "SELECT destination, protocol, ports FROM client_wan_allow WHERE client_id = ? ORDER BY position", client.ID)
+		if err != nil {
+			return err
+		}
+
+		client.WANAllow = nil
+		for rows.Next() {
+			var a WANAllow
+			if err := rows.Scan(&a.Destination, &a.Protocol, &a.Ports); err != nil {
+				rows.Close()
+				return err
+			}
+			client.WANAllow = append(client.WANAllow, a)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var clientLister = lister{
+	table:   "client",
+	columns: "id, name, address, address6, mac, upload_kbit, download_kbit, kill_switch, " + metaColumns,
+	sorts: map[string]string{
+		"id":      "id",
+		"name":    "name",
+		"address": "address",
+		"mac":     "mac",
+	},
+}
+
+// Query returns a page of the clients selected by opts.
+func (d *ClientDatabase) Query(ctx context.Context, opts ListOptions) ([]*Client, *Page, error) {
+	clients := make([]*Client, 0)
+	page, err := clientLister.query(ctx, d.db, opts, []filter{
+		nameFilter(opts.Name),
+		{"network_id", "id IN (SELECT client_id FROM client_network WHERE network_id = ?)", opts.NetworkID},
+		{"address", "? IN (address, address6)", opts.Address},
+	}, func() []interface{} {
+		client := &Client{}
+		clients = append(clients, client)
+		return withMeta(&client.Meta, &client.ID, &client.Name, &client.Address, &client.Address6, &client.MAC, &client.UploadKbit, &client.DownloadKbit, &client.KillSwitch)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := d.populate(ctx, clients...); err != nil {
+		return nil, nil, err
+	}
+	return clients, page, nil
+}
+
 func (d *ClientDatabase) Get(ctx context.Context, id string) (*Client, error) {
-	row := d.db.QueryRowContext(ctx, "SELECT id, name, address FROM client WHERE id = ?", id)
+	row := d.db.QueryRowContext(ctx, "SELECT id, name, address, address6, mac, upload_kbit, download_kbit, kill_switch, "+metaColumns+" FROM client WHERE id = ?", id)
 	client := &Client{}
-	err := row.Scan(&client.ID, &client.Name, &client.Address)
+	err := row.Scan(withMeta(&client.Meta, &client.ID, &client.Name, &client.Address, &client.Address6, &client.MAC, &client.UploadKbit, &client.DownloadKbit, &client.KillSwitch)...)
 	switch {
 	case errors.Is(err, sql.ErrNoRows):
 		return nil, ErrNotFound
-	case err == nil:
-		return client, nil
-	default:
+	case err != nil:
+		return nil, err
+	}
+
+	if err := d.populate(ctx, client); err != nil {
 		return nil, err
 	}
+	return client, nil
 }
 
 func (d *ClientDatabase) Put(ctx context.Context, client *Client) (*Client, error) {
 	id := uuid.New()
-	_, err := d.db.ExecContext(ctx, "INSERT INTO client(id, name, address) VALUES(?, ?, ?)", id, client.Name, client.Address)
+	meta := newMeta()
+
+	tx, err := d.db.BeginTx(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO client(id, name, address, address6, mac, upload_kbit, download_kbit, kill_switch, "+metaColumns+") VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", withMetaValues(meta, id, client.Name, client.Address, client.Address6, client.MAC, client.UploadKbit, client.DownloadKbit, client.KillSwitch)...)
+	if err != nil {
+		return nil, writeError(err)
+	}
+	if err := putWANAllow(ctx, tx, id.String(), client.WANAllow); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
 
 	client.ID = id.String()
+	client.Meta = meta
 	return client, nil
 }
 
 func (d *ClientDatabase) Update(ctx context.Context, client *Client) error {
-	result, err := d.db.ExecContext(ctx, "UPDATE client SET name = ?, address = ? WHERE id = ?", client.Name, client.Address, client.ID)
-	if err == nil {
-		rows, err := result.RowsAffected()
-		if err != nil {
-			return err
-		}
-		if rows != int64(1) {
-			return ErrNotFound
-		}
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
 	}
-	return err
+	defer tx.Rollback()
+
+	if err := update(ctx, tx, "client", "id", client.ID, &client.Meta, "name = ?, address = ?, address6 = ?, mac = ?, upload_kbit = ?, download_kbit = ?, kill_switch = ?", client.Name, client.Address, client.Address6, client.MAC, client.UploadKbit, client.DownloadKbit, client.KillSwitch); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM client_wan_allow WHERE client_id = ?", client.ID); err != nil {
+		return err
+	}
+	if err := putWANAllow(ctx, tx, client.ID, client.WANAllow); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
-func (d *ClientDatabase) Delete(ctx context.Context, id string) error {
-	result, err := d.db.ExecContext(ctx, "DELETE FROM client WHERE id = ?", id)
-	if err == nil {
-		rows, err := result.RowsAffected()
-		if err != nil {
-			return err
-		}
-		if rows != int64(1) {
-			return ErrNotFound
+// SetAddress records the address learned for a client, leaving its other
+// fields as they are, and returns the updated client.
+func (d *ClientDatabase) SetAddress(ctx context.Context, id, address string) (*Client, error) {
+	var meta Meta
+	if err := update(ctx, d.db, "client", "id", id, &meta, "address = ?", address); err != nil {
+		return nil, err
+	}
+	return d.Get(ctx, id)
+}
+
+func putWANAllow(ctx context.Context, tx *sql.Tx, id string, allow []WANAllow) error {
+	for i, a := range allow {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO client_wan_allow(client_id, position, destination, protocol, ports) VALUES(?, ?, ?, ?, ?)", id, i, a.Destination, a.Protocol, a.Ports); err != nil {
+			return writeError(err)
 		}
 	}
-	return err
+	return nil
+}
+
+// Delete deletes a client, its allow-list and its group and pool
+// memberships. Clients
+// which are assigned to a network, or are the source or target of a
+// policy, domain route or port forward, are in use and cannot be deleted.
+func (d *ClientDatabase) Delete(ctx context.Context, id string) error {
+	return deleteUnused(ctx, d.db, "client", id,
+		"DELETE FROM client_group_member WHERE client_id = ?",
+		"DELETE FROM network_pool_client WHERE client_id = ?",
+		"DELETE FROM client_wan_allow WHERE client_id = ?",
+	)
 }
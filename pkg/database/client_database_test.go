@@ -7,6 +7,7 @@ import (
 
 	"github.com/pricec/vpnmux/pkg/database"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestUpdateClient(t *testing.T) {
@@ -82,3 +83,164 @@ func TestClients(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Empty(t, clients)
 }
+
+func TestClientMAC(t *testing.T) {
+	ctx := context.Background()
+	h, err := NewHarness(ctx, HarnessOptions{})
+	require.Nil(t, err)
+	defer h.Close()
+
+	client, err := h.DB.Clients.Put(ctx, &database.Client{
+		Name: "test",
+		MAC:  "aa:bb:cc:dd:ee:ff",
+	})
+	require.Nil(t, err)
+
+	client, err = h.DB.Clients.Get(ctx, client.ID)
+	require.Nil(t, err)
+	require.Equal(t, "", client.Address)
+	require.Equal(t, "aa:bb:cc:dd:ee:ff", client.MAC)
+
+	client.Address = "192.168.0.10"
+	require.Nil(t, h.DB.Clients.Update(ctx, client))
+
+	clients, err := h.DB.Clients.List(ctx)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(clients))
+	require.Equal(t, "192.168.0.10", clients[0].Address)
+	require.Equal(t, "aa:bb:cc:dd:ee:ff", clients[0].MAC)
+}
+
+func TestClientAddress6(t *testing.T) {
+	ctx := context.Background()
+	h, err := NewHarness(ctx, HarnessOptions{})
+	require.Nil(t, err)
+	defer h.Close()
+
+	client, err := h.DB.Clients.Put(ctx, &database.Client{
+		Name:     "test",
+		Address:  "192.168.0.10",
+		Address6: "fd00::10",
+	})
+	require.Nil(t, err)
+
+	client, err = h.DB.Clients.Get(ctx, client.ID)
+	require.Nil(t, err)
+	require.Equal(t, "fd00::10", client.Address6)
+
+	client.Address6 = ""
+	require.Nil(t, h.DB.Clients.Update(ctx, client))
+
+	client, err = h.DB.Clients.Get(ctx, client.ID)
+	require.Nil(t, err)
+	require.Equal(t, "", client.Address6)
+}
+
+func TestClientRateLimit(t *testing.T) {
+	ctx := context.Background()
+	h, err := NewHarness(ctx, HarnessOptions{})
+	require.Nil(t, err)
+	defer h.Close()
+
+	client, err := h.DB.Clients.Put(ctx, &database.Client{
+		Name:      "test",
+		Address:   "192.168.0.10",
+		RateLimit: database.RateLimit{UploadKbit: 1000, DownloadKbit: 5000},
+	})
+	require.Nil(t, err)
+
+	client, err = h.DB.Clients.Get(ctx, client.ID)
+	require.Nil(t, err)
+	require.Equal(t, database.RateLimit{UploadKbit: 1000, DownloadKbit: 5000}, client.RateLimit)
+
+	client.RateLimit = database.RateLimit{}
+	require.Nil(t, h.DB.Clients.Update(ctx, client))
+
+	client, err = h.DB.Clients.Get(ctx, client.ID)
+	require.Nil(t, err)
+	require.Equal(t, database.RateLimit{}, client.RateLimit)
+}
+
+func TestClientKillSwitch(t *testing.T) {
+	ctx := context.Background()
+	h, err := NewHarness(ctx, HarnessOptions{})
+	require.Nil(t, err)
+	defer h.Close()
+
+	allow := []database.WANAllow{
+		{Destination: "192.168.1.20", Protocol: "tcp", Ports: "631"},
+		{Destination: "10.0.0.0/8"},
+	}
+	client, err := h.DB.Clients.Put(ctx, &database.Client{
+		Name:       "test",
+		Address:    "192.168.0.10",
+		KillSwitch: database.KillSwitchAllowList,
+		WANAllow:   allow,
+	})
+	require.Nil(t, err)
+
+	client, err = h.DB.Clients.Get(ctx, client.ID)
+	require.Nil(t, err)
+	require.Equal(t, database.KillSwitchAllowList, client.KillSwitch)
+	require.Equal(t, allow, client.WANAllow)
+
+	client.KillSwitch = database.KillSwitchUnassigned
+	client.WANAllow = nil
+	require.Nil(t, h.DB.Clients.Update(ctx, client))
+
+	clients, err := h.DB.Clients.List(ctx)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(clients))
+	require.Equal(t, database.KillSwitchUnassigned, clients[0].KillSwitch)
+	require.Empty(t, clients[0].WANAllow)
+
+	require.Nil(t, h.DB.Clients.Delete(ctx, client.ID))
+}
+
+func TestMigrationsIdempotent(t *testing.T) {
+	ctx := context.Background()
+	h, err := NewHarness(ctx, HarnessOptions{NumClients: 1})
+	require.Nil(t, err)
+	defer h.Close()
+
+	// reopening an existing database must not reapply migrations
+	db, err := database.New(ctx, h.DBPath)
+	require.Nil(t, err)
+
+	client, err := db.Clients.Get(ctx, h.Clients[0].ID)
+	require.Nil(t, err)
+	require.Equal(t, h.Clients[0].Name, client.Name)
+}
+
+func TestSetClientAddress(t *testing.T) {
+	ctx := context.Background()
+
+	f, err := os.CreateTemp("", "")
+	assert.Nil(t, err, "unexpected error creating temporary file")
+	f.Close()
+	defer os.Remove(f.Name())
+
+	db, err := database.New(ctx, f.Name())
+	assert.Nil(t, err, "unexpected error creating database")
+
+	client, err := db.Clients.Put(ctx, &database.Client{
+		Name:    "test",
+		Address: "192.168.0.10",
+		MAC:     "aa:bb:cc:dd:ee:ff",
+	})
+	assert.Nil(t, err)
+
+	// An update made since the client was read is kept.
+	stale := *client
+	client.Name = "name2"
+	assert.Nil(t, db.Clients.Update(ctx, client))
+
+	updated, err := db.Clients.SetAddress(ctx, stale.ID, "192.168.0.11")
+	assert.Nil(t, err)
+	assert.Equal(t, "name2", updated.Name)
+	assert.Equal(t, "192.168.0.11", updated.Address)
+	assert.Greater(t, updated.Version, client.Version)
+
+	_, err = db.Clients.SetAddress(ctx, "missing", "192.168.0.12")
+	assert.Equal(t, database.ErrNotFound, err)
+}
@@ -0,0 +1,191 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/google/uuid"
+)
+
+type ClientGroupDatabase struct {
+	db *sql.DB
+}
+
+// ClientGroup is a set of hosts on the LAN, given as member clients and
+// as subnets, which may be assigned to a network as a unit. A client may
+// be a member of at most one group.
+type ClientGroup struct {
+	ID      string   `json:"id"`
+	Name    string   `json:"name"`
+	CIDRs   []string `json:"cidrs"`
+	Members []string `json:"members"`
+	RateLimit
+	Meta
+}
+
+func (d *ClientGroupDatabase) List(ctx context.Context) ([]*ClientGroup, error) {
+	rows, err := d.db.QueryContext(ctx, "SELECT id, name, upload_kbit, download_kbit, "+metaColumns+" FROM client_group")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var groups = make([]*ClientGroup, 0)
+	for rows.Next() {
+		group := &ClientGroup{}
+		if err := rows.Scan(withMeta(&group.Meta, &group.ID, &group.Name, &group.UploadKbit, &group.DownloadKbit)...); err != nil {
+			return nil, err
+		}
+		groups = append(groups, group)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, group := range groups {
+		if err := d.populate(ctx, group); err != nil {
+			return nil, err
+		}
+	}
+	return groups, nil
+}
+
+func (d *ClientGroupDatabase) Get(ctx context.Context, id string) (*ClientGroup, error) {
+	row := d.db.QueryRowContext(ctx, "SELECT id, name, upload_kbit, download_kbit, "+metaColumns+" FROM client_group WHERE id = ?", id)
+	group := &ClientGroup{}
+	err := row.Scan(withMeta(&group.Meta, &group.ID, &group.Name, &group.UploadKbit, &group.DownloadKbit)...)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return nil, ErrNotFound
+	case err != nil:
+		return nil, err
+	}
+
+	if err := d.populate(ctx, group); err != nil {
+		return nil, err
+	}
+	return group, nil
+}
+
+// GetByMember returns the group of which a client is a member.
+func (d *ClientGroupDatabase) GetByMember(ctx context.Context, clientID string) (*ClientGroup, error) {
+	var id string
+	err := d.db.QueryRowContext(ctx, "SELECT group_id FROM client_group_member WHERE client_id = ?", clientID).Scan(&id)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return nil, ErrNotFound
+	case err != nil:
+		return nil, err
+	}
+	return d.Get(ctx, id)
+}
+
+func (d *ClientGroupDatabase) populate(ctx context.Context, group *ClientGroup) error {
+	var err error
+	group.CIDRs, err = d.strings(ctx, "SELECT cidr FROM client_group_cidr WHERE group_id = ? ORDER BY cidr", group.ID)
+	if err != nil {
+		return err
+	}
+	group.Members, err = d.strings(ctx, "SELECT client_id FROM client_group_member WHERE group_id = ? ORDER BY client_id", group.ID)
+	return err
+}
+
+func (d *ClientGroupDatabase) strings(ctx context.Context, query string, args ...interface{}) ([]string, error) {
+	rows, err := d.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result = make([]string, 0)
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return nil, err
+		}
+		result = append(result, s)
+	}
+	return result, rows.Err()
+}
+
+func (d *ClientGroupDatabase) Put(ctx context.Context, group *ClientGroup) (*ClientGroup, error) {
+	id := uuid.New()
+	meta := newMeta()
+
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "INSERT INTO client_group(id, name, upload_kbit, download_kbit, "+metaColumns+") VALUES(?, ?, ?, ?, ?, ?, ?)", withMetaValues(meta, id, group.Name, group.UploadKbit, group.DownloadKbit)...); err != nil {
+		return nil, err
+	}
+	if err := putGroupEntries(ctx, tx, id.String(), group); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	group.ID = id.String()
+	group.Meta = meta
+	return group, nil
+}
+
+func (d *ClientGroupDatabase) Update(ctx context.Context, group *ClientGroup) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := update(ctx, tx, "client_group", "id", group.ID, &group.Meta, "name = ?, upload_kbit = ?, download_kbit = ?", group.Name, group.UploadKbit, group.DownloadKbit); err != nil {
+		return err
+	}
+
+	for _, statement := range []string{
+		"DELETE FROM client_group_cidr WHERE group_id = ?",
+		"DELETE FROM client_group_member WHERE group_id = ?",
+	} {
+		if _, err := tx.ExecContext(ctx, statement, group.ID); err != nil {
+			return err
+		}
+	}
+	if err := putGroupEntries(ctx, tx, group.ID, group); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func putGroupEntries(ctx context.Context, tx *sql.Tx, id string, group *ClientGroup) error {
+	for _, cidr := range group.CIDRs {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO client_group_cidr(group_id, cidr) VALUES(?, ?)", id, cidr); err != nil {
+			return writeError(err)
+		}
+	}
+	for _, clientID := range group.Members {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO client_group_member(client_id, group_id) VALUES(?, ?)", clientID, id); err != nil {
+			return writeError(err)
+		}
+	}
+	return nil
+}
+
+// RemoveMember removes a client from whichever group it is a member of.
+func (d *ClientGroupDatabase) RemoveMember(ctx context.Context, clientID string) error {
+	_, err := d.db.ExecContext(ctx, "DELETE FROM client_group_member WHERE client_id = ?", clientID)
+	return err
+}
+
+// Delete deletes a group, its subnets, its memberships and its pool
+// membership. Groups which are the source of a policy or domain route, or
+// are assigned to a network, are in use and cannot be deleted.
+func (d *ClientGroupDatabase) Delete(ctx context.Context, id string) error {
+	return deleteUnused(ctx, d.db, "group", id,
+		"DELETE FROM client_group_cidr WHERE group_id = ?",
+		"DELETE FROM client_group_member WHERE group_id = ?",
+		"DELETE FROM network_pool_group WHERE group_id = ?",
+	)
+}
@@ -0,0 +1,125 @@
+package database_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pricec/vpnmux/pkg/database"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientGroups(t *testing.T) {
+	ctx := context.Background()
+	h, err := NewHarness(ctx, HarnessOptions{
+		NumClients:  2,
+		NumNetworks: 1,
+	})
+	require.Nil(t, err)
+	defer h.Close()
+
+	groups, err := h.DB.ClientGroups.List(ctx)
+	require.Nil(t, err)
+	require.Empty(t, groups)
+
+	group, err := h.DB.ClientGroups.Put(ctx, &database.ClientGroup{
+		Name:    "test",
+		CIDRs:   []string{"192.168.2.0/24"},
+		Members: []string{h.Clients[0].ID},
+	})
+	require.Nil(t, err)
+	require.NotEmpty(t, group.ID)
+
+	group, err = h.DB.ClientGroups.Get(ctx, group.ID)
+	require.Nil(t, err)
+	require.Equal(t, []string{"192.168.2.0/24"}, group.CIDRs)
+	require.Equal(t, []string{h.Clients[0].ID}, group.Members)
+
+	member, err := h.DB.ClientGroups.GetByMember(ctx, h.Clients[0].ID)
+	require.Nil(t, err)
+	require.Equal(t, group.ID, member.ID)
+
+	_, err = h.DB.ClientGroups.GetByMember(ctx, h.Clients[1].ID)
+	require.Equal(t, database.ErrNotFound, err)
+
+	// a client may only be a member of one group
+	_, err = h.DB.ClientGroups.Put(ctx, &database.ClientGroup{
+		Name:    "other",
+		Members: []string{h.Clients[0].ID},
+	})
+	require.NotNil(t, err)
+
+	group.CIDRs = []string{"192.168.3.0/24", "192.168.4.0/24"}
+	group.Members = []string{h.Clients[1].ID}
+	err = h.DB.ClientGroups.Update(ctx, group)
+	require.Nil(t, err)
+
+	group, err = h.DB.ClientGroups.Get(ctx, group.ID)
+	require.Nil(t, err)
+	require.Equal(t, []string{"192.168.3.0/24", "192.168.4.0/24"}, group.CIDRs)
+	require.Equal(t, []string{h.Clients[1].ID}, group.Members)
+
+	groups, err = h.DB.ClientGroups.List(ctx)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(groups))
+
+	err = h.DB.ClientGroups.Delete(ctx, group.ID)
+	require.Nil(t, err)
+
+	_, err = h.DB.ClientGroups.Get(ctx, group.ID)
+	require.Equal(t, database.ErrNotFound, err)
+
+	err = h.DB.ClientGroups.Delete(ctx, group.ID)
+	require.Equal(t, database.ErrNotFound, err)
+}
+
+func TestClientGroupNetwork(t *testing.T) {
+	ctx := context.Background()
+	h, err := NewHarness(ctx, HarnessOptions{
+		NumNetworks: 2,
+	})
+	require.Nil(t, err)
+	defer h.Close()
+
+	group, err := h.DB.ClientGroups.Put(ctx, &database.ClientGroup{
+		Name:  "test",
+		CIDRs: []string{"192.168.2.0/24"},
+	})
+	require.Nil(t, err)
+
+	_, err = h.DB.GroupNetworks.Get(ctx, group.ID)
+	require.Equal(t, database.ErrNotFound, err)
+
+	_, err = h.DB.GroupNetworks.Put(ctx, &database.ClientGroupNetwork{
+		GroupID:   group.ID,
+		NetworkID: h.Networks[0].ID,
+	})
+	require.Nil(t, err)
+
+	// assigning again replaces the network
+	_, err = h.DB.GroupNetworks.Put(ctx, &database.ClientGroupNetwork{
+		GroupID:   group.ID,
+		NetworkID: h.Networks[1].ID,
+	})
+	require.Nil(t, err)
+
+	gn, err := h.DB.GroupNetworks.Get(ctx, group.ID)
+	require.Nil(t, err)
+	require.Equal(t, h.Networks[1].ID, gn.NetworkID)
+
+	gns, err := h.DB.GroupNetworks.List(ctx)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(gns))
+
+	err = h.DB.ClientGroups.Delete(ctx, group.ID)
+	require.ErrorIs(t, err, database.ErrInUse)
+	var inUse *database.InUseError
+	require.ErrorAs(t, err, &inUse)
+	require.Equal(t, []database.Dependent{{Resource: "group/network", ID: group.ID, Name: group.Name}}, inUse.Dependents)
+
+	err = h.DB.GroupNetworks.Delete(ctx, group.ID)
+	require.Nil(t, err)
+
+	gns, err = h.DB.GroupNetworks.List(ctx)
+	require.Nil(t, err)
+	require.Empty(t, gns)
+}
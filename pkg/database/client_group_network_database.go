@@ -0,0 +1,64 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+type ClientGroupNetworkDatabase struct {
+	db *sql.DB
+}
+
+type ClientGroupNetwork struct {
+	GroupID   string `json:"group_id"`
+	NetworkID string `json:"network_id"`
+	Meta
+}
+
+func (d *ClientGroupNetworkDatabase) List(ctx context.Context) ([]*ClientGroupNetwork, error) {
+	rows, err := d.db.QueryContext(ctx, "SELECT group_id, network_id, "+metaColumns+" FROM client_group_network")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var gns = make([]*ClientGroupNetwork, 0)
+	for rows.Next() {
+		gn := &ClientGroupNetwork{}
+		if err := rows.Scan(withMeta(&gn.Meta, &gn.GroupID, &gn.NetworkID)...); err != nil {
+			return nil, err
+		}
+		gns = append(gns, gn)
+	}
+	return gns, nil
+}
+
+func (d *ClientGroupNetworkDatabase) Get(ctx context.Context, id string) (*ClientGroupNetwork, error) {
+	row := d.db.QueryRowContext(ctx, "SELECT group_id, network_id, "+metaColumns+" FROM client_group_network WHERE group_id = ?", id)
+	gn := &ClientGroupNetwork{}
+	err := row.Scan(withMeta(&gn.Meta, &gn.GroupID, &gn.NetworkID)...)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return nil, ErrNotFound
+	case err == nil:
+		return gn, nil
+	default:
+		return nil, err
+	}
+}
+
+// Put assigns a group to a network, replacing its assignment, if any, in
+// which case the version of the assignment is incremented.
+func (d *ClientGroupNetworkDatabase) Put(ctx context.Context, gn *ClientGroupNetwork) (*ClientGroupNetwork, error) {
+	row := d.db.QueryRowContext(ctx, "INSERT INTO client_group_network(group_id, network_id, "+metaColumns+") VALUES(?, ?, ?, ?, ?) ON CONFLICT(group_id) DO UPDATE SET network_id = excluded.network_id, version = version + 1, updated_at = excluded.updated_at RETURNING "+metaColumns,
+		withMetaValues(newMeta(), gn.GroupID, gn.NetworkID)...)
+	if err := row.Scan(withMeta(&gn.Meta)...); err != nil {
+		return nil, writeError(err)
+	}
+	return gn, nil
+}
+
+func (d *ClientGroupNetworkDatabase) Delete(ctx context.Context, id string) error {
+	return remove(ctx, d.db, "client_group_network", "group_id", id)
+}
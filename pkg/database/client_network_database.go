@@ -13,10 +13,11 @@ type ClientNetworkDatabase struct {
 type ClientNetwork struct {
 	ClientID  string `json:"client_id"`
 	NetworkID string `json:"network_id"`
+	Meta
 }
 
 func (d *ClientNetworkDatabase) List(ctx context.Context) ([]*ClientNetwork, error) {
-	rows, err := d.db.QueryContext(ctx, "SELECT client_id, network_id FROM client_network")
+	rows, err := d.db.QueryContext(ctx, "SELECT client_id, network_id, "+metaColumns+" FROM client_network")
 	if err != nil {
 		return nil, err
 	}
@@ -25,7 +26,7 @@ func (d *ClientNetworkDatabase) List(ctx context.Context) ([]*ClientNetwork, err
 	var cns = make([]*ClientNetwork, 0)
 	for rows.Next() {
 		cn := &ClientNetwork{}
-		if err := rows.Scan(&cn.ClientID, &cn.NetworkID); err != nil {
+		if err := rows.Scan(withMeta(&cn.Meta, &cn.ClientID, &cn.NetworkID)...); err != nil {
 			return nil, err
 		}
 		cns = append(cns, cn)
@@ -34,9 +35,9 @@ func (d *ClientNetworkDatabase) List(ctx context.Context) ([]*ClientNetwork, err
 }
 
 func (d *ClientNetworkDatabase) Get(ctx context.Context, id string) (*ClientNetwork, error) {
-	row := d.db.QueryRowContext(ctx, "SELECT client_id, network_id FROM client_network WHERE client_id = ?", id)
+	row := d.db.QueryRowContext(ctx, "SELECT client_id, network_id, "+metaColumns+" FROM client_network WHERE client_id = ?", id)
 	cn := &ClientNetwork{}
-	err := row.Scan(&cn.ClientID, &cn.NetworkID)
+	err := row.Scan(withMeta(&cn.Meta, &cn.ClientID, &cn.NetworkID)...)
 	switch {
 	case errors.Is(err, sql.ErrNoRows):
 		return nil, ErrNotFound
@@ -48,37 +49,19 @@ func (d *ClientNetworkDatabase) Get(ctx context.Context, id string) (*ClientNetw
 }
 
 func (d *ClientNetworkDatabase) Put(ctx context.Context, cn *ClientNetwork) (*ClientNetwork, error) {
-	_, err := d.db.ExecContext(ctx, "INSERT INTO client_network(client_id, network_id) VALUES(?, ?)", cn.ClientID, cn.NetworkID)
+	meta := newMeta()
+	_, err := d.db.ExecContext(ctx, "INSERT INTO client_network(client_id, network_id, "+metaColumns+") VALUES(?, ?, ?, ?, ?)", withMetaValues(meta, cn.ClientID, cn.NetworkID)...)
 	if err != nil {
-		return nil, err
+		return nil, writeError(err)
 	}
+	cn.Meta = meta
 	return cn, nil
 }
 
 func (d *ClientNetworkDatabase) Update(ctx context.Context, cn *ClientNetwork) error {
-	result, err := d.db.ExecContext(ctx, "UPDATE client_network SET client_id = ?, network_id = ? WHERE client_id = ?", cn.ClientID, cn.NetworkID, cn.ClientID)
-	if err == nil {
-		rows, err := result.RowsAffected()
-		if err != nil {
-			return err
-		}
-		if rows != int64(1) {
-			return ErrNotFound
-		}
-	}
-	return err
+	return update(ctx, d.db, "client_network", "client_id", cn.ClientID, &cn.Meta, "network_id = ?", cn.NetworkID)
 }
 
 func (d *ClientNetworkDatabase) Delete(ctx context.Context, id string) error {
-	result, err := d.db.ExecContext(ctx, "DELETE FROM client_network WHERE client_id = ?", id)
-	if err == nil {
-		rows, err := result.RowsAffected()
-		if err != nil {
-			return err
-		}
-		if rows != int64(1) {
-			return ErrNotFound
-		}
-	}
-	return err
+	return remove(ctx, d.db, "client_network", "client_id", id)
 }
@@ -0,0 +1,144 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+type ClientUsageDatabase struct {
+	db *sql.DB
+}
+
+// ClientUsage is the traffic forwarded between a client and a network
+// during the interval beginning at Time. Rx is traffic to the client and
+// Tx is traffic from the client.
+type ClientUsage struct {
+	ClientID  string    `json:"client_id"`
+	NetworkID string    `json:"network_id"`
+	Time      time.Time `json:"time"`
+	RxBytes   uint64    `json:"rx_bytes"`
+	RxPackets uint64    `json:"rx_packets"`
+	TxBytes   uint64    `json:"tx_bytes"`
+	TxPackets uint64    `json:"tx_packets"`
+}
+
+// UsageTier is a resolution at which usage is recorded, and how long usage
+// at that resolution is kept.
+type UsageTier struct {
+	Resolution time.Duration
+	Retention  time.Duration
+}
+
+// UsageTiers are the resolutions at which usage is recorded, from finest
+// to coarsest. Every sample is added to a bucket of each tier, so coarser
+// tiers hold downsampled usage for longer.
+var UsageTiers = []UsageTier{
+	{Resolution: time.Minute, Retention: 2 * 24 * time.Hour},
+	{Resolution: time.Hour, Retention: 90 * 24 * time.Hour},
+	{Resolution: 24 * time.Hour, Retention: 5 * 365 * 24 * time.Hour},
+}
+
+// Add adds usage sampled at the given time to the buckets containing that
+// time at every resolution.
+func (d *ClientUsageDatabase) Add(ctx context.Context, t time.Time, usage []*ClientUsage) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, u := range usage {
+		for _, tier := range UsageTiers {
+			_, err := tx.ExecContext(ctx, `INSERT INTO client_usage(client_id, network_id, resolution, time, rx_bytes, rx_packets, tx_bytes, tx_packets)
+				VALUES(?, ?, ?, ?, ?, ?, ?, ?)
+				ON CONFLICT(client_id, resolution, time, network_id) DO UPDATE SET
+					rx_bytes = rx_bytes + excluded.rx_bytes,
+					rx_packets = rx_packets + excluded.rx_packets,
+					tx_bytes = tx_bytes + excluded.tx_bytes,
+					tx_packets = tx_packets + excluded.tx_packets`,
+				u.ClientID, u.NetworkID, seconds(tier.Resolution), bucket(t, tier.Resolution),
+				u.RxBytes, u.RxPackets, u.TxBytes, u.TxPackets)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// Query returns a client's usage of each network from from until to, in
+// buckets of step, which must be a multiple of the finest resolution.
+// Buckets are aligned to the Unix epoch, so the first may begin before
+// from.
+func (d *ClientUsageDatabase) Query(ctx context.Context, clientID string, from, to time.Time, step time.Duration) ([]*ClientUsage, error) {
+	tier := usageTier(step)
+	res := seconds(tier.Resolution)
+	size := seconds(step)
+
+	rows, err := d.db.QueryContext(ctx, `SELECT network_id, (time / ?) * ? AS bucket,
+			SUM(rx_bytes), SUM(rx_packets), SUM(tx_bytes), SUM(tx_packets)
+		FROM client_usage
+		WHERE client_id = ? AND resolution = ? AND time >= ? AND time < ?
+		GROUP BY network_id, bucket
+		ORDER BY network_id, bucket`,
+		size, size, clientID, res, bucket(from, tier.Resolution), to.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var usage = make([]*ClientUsage, 0)
+	for rows.Next() {
+		u := &ClientUsage{ClientID: clientID}
+		var t int64
+		if err := rows.Scan(&u.NetworkID, &t, &u.RxBytes, &u.RxPackets, &u.TxBytes, &u.TxPackets); err != nil {
+			return nil, err
+		}
+		u.Time = time.Unix(t, 0).UTC()
+		usage = append(usage, u)
+	}
+	return usage, rows.Err()
+}
+
+// usageTier returns the coarsest tier whose resolution divides step. Every
+// tier holds the same samples, so the coarsest reads the fewest rows and
+// reaches furthest back.
+func usageTier(step time.Duration) UsageTier {
+	var result UsageTier
+	for _, tier := range UsageTiers {
+		if step%tier.Resolution == 0 {
+			result = tier
+		}
+	}
+	return result
+}
+
+// Prune deletes usage older than the retention of its resolution.
+func (d *ClientUsageDatabase) Prune(ctx context.Context, now time.Time) error {
+	for _, tier := range UsageTiers {
+		_, err := d.db.ExecContext(ctx, "DELETE FROM client_usage WHERE resolution = ? AND time < ?",
+			seconds(tier.Resolution), now.Add(-tier.Retention).Unix())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteClient deletes all of a client's usage.
+func (d *ClientUsageDatabase) DeleteClient(ctx context.Context, clientID string) error {
+	_, err := d.db.ExecContext(ctx, "DELETE FROM client_usage WHERE client_id = ?", clientID)
+	return err
+}
+
+func seconds(d time.Duration) int64 {
+	return int64(d / time.Second)
+}
+
+// bucket returns the start, in Unix seconds, of the bucket of the given
+// resolution containing t.
+func bucket(t time.Time, resolution time.Duration) int64 {
+	res := seconds(resolution)
+	return t.Unix() - t.Unix()%res
+}
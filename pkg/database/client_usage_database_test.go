@@ -0,0 +1,71 @@
+package database_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pricec/vpnmux/pkg/database"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientUsage(t *testing.T) {
+	ctx := context.Background()
+	h, err := NewHarness(ctx, HarnessOptions{
+		NumClients:  1,
+		NumNetworks: 2,
+	})
+	require.Nil(t, err)
+	defer h.Close()
+
+	clientID := h.Clients[0].ID
+	start := time.Now().UTC().Truncate(time.Hour).Add(-time.Hour)
+
+	for i := 0; i < 3; i += 1 {
+		err = h.DB.Usage.Add(ctx, start.Add(time.Duration(i)*time.Minute), []*database.ClientUsage{
+			{ClientID: clientID, NetworkID: h.Networks[0].ID, RxBytes: 100, RxPackets: 1, TxBytes: 10, TxPackets: 1},
+			{ClientID: clientID, NetworkID: h.Networks[1].ID, RxBytes: 200, RxPackets: 2},
+		})
+		require.Nil(t, err)
+	}
+
+	// per-minute buckets
+	usage, err := h.DB.Usage.Query(ctx, clientID, start, start.Add(time.Hour), time.Minute)
+	require.Nil(t, err)
+	require.Equal(t, 6, len(usage))
+
+	// one bucket per network
+	usage, err = h.DB.Usage.Query(ctx, clientID, start, start.Add(time.Hour), time.Hour)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(usage))
+	byNetwork := make(map[string]*database.ClientUsage)
+	for _, u := range usage {
+		require.Equal(t, start, u.Time)
+		byNetwork[u.NetworkID] = u
+	}
+	require.Equal(t, uint64(300), byNetwork[h.Networks[0].ID].RxBytes)
+	require.Equal(t, uint64(30), byNetwork[h.Networks[0].ID].TxBytes)
+	require.Equal(t, uint64(600), byNetwork[h.Networks[1].ID].RxBytes)
+	require.Equal(t, uint64(6), byNetwork[h.Networks[1].ID].RxPackets)
+
+	// outside the range
+	usage, err = h.DB.Usage.Query(ctx, clientID, start.Add(time.Hour), start.Add(2*time.Hour), time.Minute)
+	require.Nil(t, err)
+	require.Empty(t, usage)
+
+	// minute buckets expire first
+	err = h.DB.Usage.Prune(ctx, start.Add(3*24*time.Hour))
+	require.Nil(t, err)
+	usage, err = h.DB.Usage.Query(ctx, clientID, start, start.Add(time.Hour), 5*time.Minute)
+	require.Nil(t, err)
+	require.Empty(t, usage)
+	usage, err = h.DB.Usage.Query(ctx, clientID, start, start.Add(time.Hour), time.Hour)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(usage))
+
+	err = h.DB.Usage.DeleteClient(ctx, clientID)
+	require.Nil(t, err)
+	usage, err = h.DB.Usage.Query(ctx, clientID, start, start.Add(time.Hour), time.Hour)
+	require.Nil(t, err)
+	require.Empty(t, usage)
+}
@@ -20,10 +20,11 @@ type Config struct {
 	PassCred string `json:"pass_cred,omitempty"`
 	CACred   string `json:"ca_cred,omitempty"`
 	OVPNCred string `json:"ovpn_cred,omitempty"`
+	Meta
 }
 
 func (d *ConfigDatabase) List(ctx context.Context) ([]*Config, error) {
-	rows, err := d.db.QueryContext(ctx, "SELECT id, name, host FROM config")
+	rows, err := d.db.QueryContext(ctx, "SELECT id, name, host, "+metaColumns+" FROM config")
 	if err != nil {
 		return nil, err
 	}
@@ -32,7 +33,7 @@ func (d *ConfigDatabase) List(ctx context.Context) ([]*Config, error) {
 	var configs = make([]*Config, 0)
 	for rows.Next() {
 		cfg := &Config{}
-		if err := rows.Scan(&cfg.ID, &cfg.Name, &cfg.Host); err != nil {
+		if err := rows.Scan(withMeta(&cfg.Meta, &cfg.ID, &cfg.Name, &cfg.Host)...); err != nil {
 			return nil, err
 		}
 		configs = append(configs, cfg)
@@ -40,10 +41,35 @@ func (d *ConfigDatabase) List(ctx context.Context) ([]*Config, error) {
 	return configs, nil
 }
 
+var configLister = lister{
+	table:   "config",
+	columns: "id, name, host, " + metaColumns,
+	sorts: map[string]string{
+		"id":   "id",
+		"name": "name",
+		"host": "host",
+	},
+}
+
+// Query returns a page of the configs selected by opts. Like List, it omits
+// their credentials.
+func (d *ConfigDatabase) Query(ctx context.Context, opts ListOptions) ([]*Config, *Page, error) {
+	configs := make([]*Config, 0)
+	page, err := configLister.query(ctx, d.db, opts, []filter{nameFilter(opts.Name)}, func() []interface{} {
+		cfg := &Config{}
+		configs = append(configs, cfg)
+		return withMeta(&cfg.Meta, &cfg.ID, &cfg.Name, &cfg.Host)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return configs, page, nil
+}
+
 func (d *ConfigDatabase) Get(ctx context.Context, id string) (*Config, error) {
-	row := d.db.QueryRowContext(ctx, "SELECT id, name, host, user_c, pass_c, ca_c, ovpn_c FROM config WHERE id = ?", id)
+	row := d.db.QueryRowContext(ctx, "SELECT id, name, host, user_c, pass_c, ca_c, ovpn_c, "+metaColumns+" FROM config WHERE id = ?", id)
 	cfg := &Config{}
-	err := row.Scan(&cfg.ID, &cfg.Name, &cfg.Host, &cfg.UserCred, &cfg.PassCred, &cfg.CACred, &cfg.OVPNCred)
+	err := row.Scan(withMeta(&cfg.Meta, &cfg.ID, &cfg.Name, &cfg.Host, &cfg.UserCred, &cfg.PassCred, &cfg.CACred, &cfg.OVPNCred)...)
 	switch {
 	case errors.Is(err, sql.ErrNoRows):
 		return nil, ErrNotFound
@@ -56,39 +82,21 @@ func (d *ConfigDatabase) Get(ctx context.Context, id string) (*Config, error) {
 
 func (d *ConfigDatabase) Put(ctx context.Context, cfg *Config) (*Config, error) {
 	id := uuid.New()
-	_, err := d.db.ExecContext(ctx, "INSERT INTO config(id, name, host, user_c, pass_c, ca_c, ovpn_c) VALUES(?, ?, ?, ?, ?, ?, ?)", id, cfg.Name, cfg.Host, cfg.UserCred, cfg.PassCred, cfg.CACred, cfg.OVPNCred)
+	meta := newMeta()
+	_, err := d.db.ExecContext(ctx, "INSERT INTO config(id, name, host, user_c, pass_c, ca_c, ovpn_c, "+metaColumns+") VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", withMetaValues(meta, id, cfg.Name, cfg.Host, cfg.UserCred, cfg.PassCred, cfg.CACred, cfg.OVPNCred)...)
 	if err != nil {
-		return nil, err
+		return nil, writeError(err)
 	}
 
 	cfg.ID = id.String()
+	cfg.Meta = meta
 	return cfg, nil
 }
 
 func (d *ConfigDatabase) Update(ctx context.Context, cfg *Config) error {
-	result, err := d.db.ExecContext(ctx, "UPDATE config SET name = ?, host = ?, user_c = ?, pass_c = ?, ca_c = ?, ovpn_c = ? WHERE id = ?", cfg.Name, cfg.Host, cfg.UserCred, cfg.PassCred, cfg.CACred, cfg.OVPNCred, cfg.ID)
-	if err == nil {
-		rows, err := result.RowsAffected()
-		if err != nil {
-			return err
-		}
-		if rows != int64(1) {
-			return ErrNotFound
-		}
-	}
-	return err
+	return update(ctx, d.db, "config", "id", cfg.ID, &cfg.Meta, "name = ?, host = ?, user_c = ?, pass_c = ?, ca_c = ?, ovpn_c = ?", cfg.Name, cfg.Host, cfg.UserCred, cfg.PassCred, cfg.CACred, cfg.OVPNCred)
 }
 
 func (d *ConfigDatabase) Delete(ctx context.Context, id string) error {
-	result, err := d.db.ExecContext(ctx, "DELETE FROM config WHERE id = ?", id)
-	if err == nil {
-		rows, err := result.RowsAffected()
-		if err != nil {
-			return err
-		}
-		if rows != int64(1) {
-			return ErrNotFound
-		}
-	}
-	return err
+	return deleteUnused(ctx, d.db, "config", id)
 }
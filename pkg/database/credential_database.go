@@ -16,10 +16,11 @@ type Credential struct {
 	ID    string `json:"id"`
 	Name  string `json:"name"`
 	Value string `json:"value,omitempty"`
+	Meta
 }
 
 func (d *CredentialDatabase) List(ctx context.Context) ([]*Credential, error) {
-	rows, err := d.db.QueryContext(ctx, "SELECT id, name FROM credential")
+	rows, err := d.db.QueryContext(ctx, "SELECT id, name, "+metaColumns+" FROM credential")
 	if err != nil {
 		return nil, err
 	}
@@ -28,7 +29,7 @@ func (d *CredentialDatabase) List(ctx context.Context) ([]*Credential, error) {
 	var credentials = make([]*Credential, 0)
 	for rows.Next() {
 		cred := &Credential{}
-		if err := rows.Scan(&cred.ID, &cred.Name); err != nil {
+		if err := rows.Scan(withMeta(&cred.Meta, &cred.ID, &cred.Name)...); err != nil {
 			return nil, err
 		}
 		credentials = append(credentials, cred)
@@ -36,10 +37,34 @@ func (d *CredentialDatabase) List(ctx context.Context) ([]*Credential, error) {
 	return credentials, nil
 }
 
+var credentialLister = lister{
+	table:   "credential",
+	columns: "id, name, " + metaColumns,
+	sorts: map[string]string{
+		"id":   "id",
+		"name": "name",
+	},
+}
+
+// Query returns a page of the credentials selected by opts. Like List, it
+// omits their values.
+func (d *CredentialDatabase) Query(ctx context.Context, opts ListOptions) ([]*Credential, *Page, error) {
+	creds := make([]*Credential, 0)
+	page, err := credentialLister.query(ctx, d.db, opts, []filter{nameFilter(opts.Name)}, func() []interface{} {
+		cred := &Credential{}
+		creds = append(creds, cred)
+		return withMeta(&cred.Meta, &cred.ID, &cred.Name)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return creds, page, nil
+}
+
 func (d *CredentialDatabase) Get(ctx context.Context, id string) (*Credential, error) {
-	row := d.db.QueryRowContext(ctx, "SELECT id, name, value FROM credential WHERE id = ?", id)
+	row := d.db.QueryRowContext(ctx, "SELECT id, name, value, "+metaColumns+" FROM credential WHERE id = ?", id)
 	cred := &Credential{}
-	err := row.Scan(&cred.ID, &cred.Name, &cred.Value)
+	err := row.Scan(withMeta(&cred.Meta, &cred.ID, &cred.Name, &cred.Value)...)
 	switch {
 	case errors.Is(err, sql.ErrNoRows):
 		return nil, ErrNotFound
@@ -52,41 +77,23 @@ func (d *CredentialDatabase) Get(ctx context.Context, id string) (*Credential, e
 
 func (d *CredentialDatabase) Put(ctx context.Context, name, value string) (*Credential, error) {
 	id := uuid.New()
-	_, err := d.db.ExecContext(ctx, "INSERT INTO credential(id, name, value) VALUES(?, ?, ?)", id, name, value)
+	meta := newMeta()
+	_, err := d.db.ExecContext(ctx, "INSERT INTO credential(id, name, value, "+metaColumns+") VALUES(?, ?, ?, ?, ?, ?)", withMetaValues(meta, id, name, value)...)
 	if err != nil {
-		return nil, err
+		return nil, writeError(err)
 	}
 	return &Credential{
 		ID:    id.String(),
 		Name:  name,
 		Value: value,
+		Meta:  meta,
 	}, nil
 }
 
 func (d *CredentialDatabase) Update(ctx context.Context, cred *Credential) error {
-	result, err := d.db.ExecContext(ctx, "UPDATE credential SET name = ?, value = ? WHERE id = ?", cred.Name, cred.Value, cred.ID)
-	if err == nil {
-		rows, err := result.RowsAffected()
-		if err != nil {
-			return err
-		}
-		if rows != int64(1) {
-			return ErrNotFound
-		}
-	}
-	return err
+	return update(ctx, d.db, "credential", "id", cred.ID, &cred.Meta, "name = ?, value = ?", cred.Name, cred.Value)
 }
 
 func (d *CredentialDatabase) Delete(ctx context.Context, id string) error {
-	result, err := d.db.ExecContext(ctx, "DELETE FROM credential WHERE id = ?", id)
-	if err == nil {
-		rows, err := result.RowsAffected()
-		if err != nil {
-			return err
-		}
-		if rows != int64(1) {
-			return ErrNotFound
-		}
-	}
-	return err
+	return deleteUnused(ctx, d.db, "credential", id)
 }
@@ -4,7 +4,6 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
-	"log"
 	"os"
 	"path"
 
@@ -14,6 +13,16 @@ import (
 var (
 	ErrNotFound = fmt.Errorf("object not found")
 	ErrInUse    = fmt.Errorf("object is in use")
+	// ErrConflict is returned (wrapped) when a write duplicates a value
+	// which must be unique, e.g. assigning a client which is already
+	// assigned to a network.
+	ErrConflict = fmt.Errorf("object conflicts with an existing object")
+	// ErrInvalidReference is returned (wrapped) when a write refers to a
+	// resource which does not exist.
+	ErrInvalidReference = fmt.Errorf("object refers to a missing object")
+	// ErrVersionMismatch is returned when an update or delete expects a
+	// version of an object other than its current one; see ExpectVersion.
+	ErrVersionMismatch = fmt.Errorf("object has changed")
 )
 
 type Database struct {
@@ -24,6 +33,17 @@ type Database struct {
 	Clients        *ClientDatabase
 	ClientNetworks *ClientNetworkDatabase
 	DNS            *DNSDatabase
+	DomainRoutes   *DomainRouteDatabase
+	Policies       *PolicyDatabase
+	ClientGroups   *ClientGroupDatabase
+	GroupNetworks  *ClientGroupNetworkDatabase
+	Usage          *ClientUsageDatabase
+	PortForwards   *PortForwardDatabase
+	Audit          *AuditDatabase
+	Events         *EventDatabase
+	Webhooks       *WebhookDatabase
+	Schedules      *ScheduleDatabase
+	Pools          *NetworkPoolDatabase
 }
 
 func New(ctx context.Context, dbPath string) (*Database, error) {
@@ -31,7 +51,10 @@ func New(ctx context.Context, dbPath string) (*Database, error) {
 		return nil, err
 	}
 
-	db, err := sql.Open("sqlite", dbPath)
+	// Background writers (e.g. the audit log and webhook deliveries) share
+	// the database with API requests, so connections wait for each other's
+	// locks rather than failing.
+	db, err := sql.Open("sqlite", dbPath+"?_pragma=busy_timeout(5000)")
 	if err != nil {
 		return nil, err
 	}
@@ -39,10 +62,14 @@ func New(ctx context.Context, dbPath string) (*Database, error) {
 	for _, statement := range schema {
 		_, err = db.ExecContext(ctx, statement)
 		if err != nil {
-			log.Panicf("error applying schema: %v", err)
+			return nil, fmt.Errorf("applying schema: %w", err)
 		}
 	}
 
+	if err := migrate(ctx, db); err != nil {
+		return nil, fmt.Errorf("migrating schema: %w", err)
+	}
+
 	return &Database{
 		db: db,
 		Credentials: &CredentialDatabase{
@@ -63,5 +90,112 @@ func New(ctx context.Context, dbPath string) (*Database, error) {
 		DNS: &DNSDatabase{
 			db: db,
 		},
+		DomainRoutes: &DomainRouteDatabase{
+			db: db,
+		},
+		Policies: &PolicyDatabase{
+			db: db,
+		},
+		ClientGroups: &ClientGroupDatabase{
+			db: db,
+		},
+		GroupNetworks: &ClientGroupNetworkDatabase{
+			db: db,
+		},
+		Usage: &ClientUsageDatabase{
+			db: db,
+		},
+		PortForwards: &PortForwardDatabase{
+			db: db,
+		},
+		Audit: &AuditDatabase{
+			db: db,
+		},
+		Events: &EventDatabase{
+			db: db,
+		},
+		Webhooks: &WebhookDatabase{
+			db: db,
+		},
+		Schedules: &ScheduleDatabase{
+			db: db,
+		},
+		Pools: &NetworkPoolDatabase{
+			db: db,
+		},
 	}, nil
 }
+
+func migrate(ctx context.Context, db *sql.DB) error {
+	var version int
+	if err := db.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+
+	for ; version < len(migrations); version += 1 {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, migrations[version]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", version+1, err)
+		}
+
+		// PRAGMA statements don't accept bound parameters.
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %d", version+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RateLimit caps the traffic of a resource in each direction, in kbit/s;
+// zero is unlimited. Upload is traffic from the LAN into a network.
+type RateLimit struct {
+	UploadKbit   int `json:"upload_kbit,omitempty"`
+	DownloadKbit int `json:"download_kbit,omitempty"`
+}
+
+// nullString maps the empty string to NULL, for optional foreign keys.
+func nullString(s string) sql.NullString {
+	return sql.NullString{
+		String: s,
+		Valid:  s != "",
+	}
+}
+
+// countedTables are the tables of the resources reported by Counts.
+var countedTables = []string{
+	"credential",
+	"config",
+	"network",
+	"client",
+	"client_network",
+	"domain_route",
+	"policy",
+	"client_group",
+	"port_forward",
+	"webhook",
+}
+
+// Counts returns the number of rows in each resource table, keyed by the
+// table name.
+func (d *Database) Counts(ctx context.Context) (map[string]int, error) {
+	result := make(map[string]int, len(countedTables))
+	for _, table := range countedTables {
+		var count int
+		// Table names can't be bound parameters.
+		if err := d.db.QueryRowContext(ctx, fmt.Sprintf("SELECT COUNT(*) FROM %s", table)).Scan(&count); err != nil {
+			return nil, err
+		}
+		result[table] = count
+	}
+	return result, nil
+}
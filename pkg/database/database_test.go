@@ -0,0 +1,24 @@
+package database_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCounts(t *testing.T) {
+	ctx := context.Background()
+	h, err := NewHarness(ctx, HarnessOptions{
+		NumClients:  2,
+		NumNetworks: 1,
+	})
+	require.Nil(t, err)
+	defer h.Close()
+
+	counts, err := h.DB.Counts(ctx)
+	require.Nil(t, err)
+	require.Equal(t, 2, counts["client"])
+	require.Equal(t, 1, counts["network"])
+	require.Equal(t, 0, counts["policy"])
+}
@@ -13,6 +13,7 @@ type DNSDatabase struct {
 type DNSRoute struct {
 	ID        string `json:"-"`
 	NetworkID string `json:"network_id"`
+	Meta
 }
 
 var EmptyRoute = &DNSRoute{
@@ -21,9 +22,9 @@ var EmptyRoute = &DNSRoute{
 }
 
 func (d *DNSDatabase) Get(ctx context.Context) (*DNSRoute, error) {
-	row := d.db.QueryRowContext(ctx, "SELECT id, network_id FROM dns_route WHERE id = 0")
+	row := d.db.QueryRowContext(ctx, "SELECT id, network_id, "+metaColumns+" FROM dns_route WHERE id = 0")
 	route := &DNSRoute{}
-	err := row.Scan(&route.ID, &route.NetworkID)
+	err := row.Scan(withMeta(&route.Meta, &route.ID, &route.NetworkID)...)
 	switch {
 	case errors.Is(err, sql.ErrNoRows):
 		return EmptyRoute, nil
@@ -35,38 +36,20 @@ func (d *DNSDatabase) Get(ctx context.Context) (*DNSRoute, error) {
 }
 
 func (d *DNSDatabase) Put(ctx context.Context, route *DNSRoute) (*DNSRoute, error) {
-	_, err := d.db.ExecContext(ctx, "INSERT INTO dns_route(id, network_id) VALUES(0, ?)", route.NetworkID)
+	meta := newMeta()
+	_, err := d.db.ExecContext(ctx, "INSERT INTO dns_route(id, network_id, "+metaColumns+") VALUES(0, ?, ?, ?, ?)", withMetaValues(meta, route.NetworkID)...)
 	if err != nil {
-		return nil, err
+		return nil, writeError(err)
 	}
 	route.ID = "0"
+	route.Meta = meta
 	return route, nil
 }
 
 func (d *DNSDatabase) Update(ctx context.Context, route *DNSRoute) error {
-	result, err := d.db.ExecContext(ctx, "UPDATE dns_route SET network_id = ? WHERE id = 0", route.NetworkID)
-	if err == nil {
-		rows, err := result.RowsAffected()
-		if err != nil {
-			return err
-		}
-		if rows != int64(1) {
-			return ErrNotFound
-		}
-	}
-	return err
+	return update(ctx, d.db, "dns_route", "id", "0", &route.Meta, "network_id = ?", route.NetworkID)
 }
 
 func (d *DNSDatabase) Delete(ctx context.Context) error {
-	result, err := d.db.ExecContext(ctx, "DELETE FROM dns_route WHERE id = 0")
-	if err == nil {
-		rows, err := result.RowsAffected()
-		if err != nil {
-			return err
-		}
-		if rows != int64(1) {
-			return ErrNotFound
-		}
-	}
-	return err
+	return remove(ctx, d.db, "dns_route", "id", "0")
 }
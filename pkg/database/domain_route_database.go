@@ -0,0 +1,92 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/google/uuid"
+)
+
+type DomainRouteDatabase struct {
+	db *sql.DB
+}
+
+// DomainRoute routes traffic from a client or group to destinations
+// matching a domain via a network. The domain is either a name (example.com) or a
+// wildcard matching any subdomain (*.example.com).
+type DomainRoute struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Domain    string `json:"domain"`
+	ClientID  string `json:"client_id,omitempty"`
+	GroupID   string `json:"group_id,omitempty"`
+	NetworkID string `json:"network_id"`
+	Meta
+}
+
+const domainRouteColumns = "id, name, domain, client_id, group_id, network_id"
+
+func scanDomainRoute(row interface{ Scan(...interface{}) error }) (*DomainRoute, error) {
+	route := &DomainRoute{}
+	var clientID, groupID sql.NullString
+	err := row.Scan(withMeta(&route.Meta, &route.ID, &route.Name, &route.Domain, &clientID, &groupID, &route.NetworkID)...)
+	if err != nil {
+		return nil, err
+	}
+	route.ClientID = clientID.String
+	route.GroupID = groupID.String
+	return route, nil
+}
+
+func (d *DomainRouteDatabase) List(ctx context.Context) ([]*DomainRoute, error) {
+	rows, err := d.db.QueryContext(ctx, "SELECT "+domainRouteColumns+", "+metaColumns+" FROM domain_route")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var routes = make([]*DomainRoute, 0)
+	for rows.Next() {
+		route, err := scanDomainRoute(rows)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+func (d *DomainRouteDatabase) Get(ctx context.Context, id string) (*DomainRoute, error) {
+	row := d.db.QueryRowContext(ctx, "SELECT "+domainRouteColumns+", "+metaColumns+" FROM domain_route WHERE id = ?", id)
+	route, err := scanDomainRoute(row)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return nil, ErrNotFound
+	case err == nil:
+		return route, nil
+	default:
+		return nil, err
+	}
+}
+
+func (d *DomainRouteDatabase) Put(ctx context.Context, route *DomainRoute) (*DomainRoute, error) {
+	id := uuid.New()
+	meta := newMeta()
+	_, err := d.db.ExecContext(ctx, "INSERT INTO domain_route("+domainRouteColumns+", "+metaColumns+") VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)", withMetaValues(meta, id, route.Name, route.Domain, nullString(route.ClientID), nullString(route.GroupID), route.NetworkID)...)
+	if err != nil {
+		return nil, writeError(err)
+	}
+
+	route.ID = id.String()
+	route.Meta = meta
+	return route, nil
+}
+
+func (d *DomainRouteDatabase) Update(ctx context.Context, route *DomainRoute) error {
+	return update(ctx, d.db, "domain_route", "id", route.ID, &route.Meta, "name = ?, domain = ?, client_id = ?, group_id = ?, network_id = ?", route.Name, route.Domain, nullString(route.ClientID), nullString(route.GroupID), route.NetworkID)
+}
+
+func (d *DomainRouteDatabase) Delete(ctx context.Context, id string) error {
+	return remove(ctx, d.db, "domain_route", "id", id)
+}
@@ -0,0 +1,98 @@
+package database_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pricec/vpnmux/pkg/database"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdateDomainRoute(t *testing.T) {
+	ctx := context.Background()
+	h, err := NewHarness(ctx, HarnessOptions{
+		NumClients:  1,
+		NumNetworks: 2,
+	})
+	require.Nil(t, err)
+	defer h.Close()
+
+	route, err := h.DB.DomainRoutes.Put(ctx, &database.DomainRoute{
+		Name:      "test",
+		Domain:    "*.example.com",
+		ClientID:  h.Clients[0].ID,
+		NetworkID: h.Networks[0].ID,
+	})
+	require.Nil(t, err)
+	require.Equal(t, "*.example.com", route.Domain)
+
+	route.Domain = "example.org"
+	route.NetworkID = h.Networks[1].ID
+
+	err = h.DB.DomainRoutes.Update(ctx, route)
+	require.Nil(t, err)
+
+	route, err = h.DB.DomainRoutes.Get(ctx, route.ID)
+	require.Nil(t, err)
+	require.Equal(t, "example.org", route.Domain)
+	require.Equal(t, h.Networks[1].ID, route.NetworkID)
+}
+
+func TestDomainRoutes(t *testing.T) {
+	ctx := context.Background()
+	h, err := NewHarness(ctx, HarnessOptions{
+		NumClients:  1,
+		NumNetworks: 1,
+	})
+	require.Nil(t, err)
+	defer h.Close()
+
+	routes, err := h.DB.DomainRoutes.List(ctx)
+	require.Nil(t, err)
+	require.Empty(t, routes)
+
+	route, err := h.DB.DomainRoutes.Put(ctx, &database.DomainRoute{
+		Name:      "test",
+		Domain:    "example.com",
+		ClientID:  h.Clients[0].ID,
+		NetworkID: h.Networks[0].ID,
+	})
+	require.Nil(t, err)
+	require.NotNil(t, route)
+
+	r, err := h.DB.DomainRoutes.Get(ctx, "test")
+	require.Equal(t, database.ErrNotFound, err)
+	require.Nil(t, r)
+
+	r, err = h.DB.DomainRoutes.Get(ctx, route.ID)
+	require.Nil(t, err)
+	require.Equal(t, route, r)
+
+	routes, err = h.DB.DomainRoutes.List(ctx)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(routes))
+
+	err = h.DB.DomainRoutes.Delete(ctx, route.ID)
+	require.Nil(t, err)
+
+	routes, err = h.DB.DomainRoutes.List(ctx)
+	require.Nil(t, err)
+	require.Empty(t, routes)
+}
+
+func TestDomainRouteUnknownNetwork(t *testing.T) {
+	ctx := context.Background()
+	h, err := NewHarness(ctx, HarnessOptions{
+		NumClients: 1,
+	})
+	require.Nil(t, err)
+	defer h.Close()
+
+	_, err = h.DB.DomainRoutes.Put(ctx, &database.DomainRoute{
+		Name:      "test",
+		Domain:    "example.com",
+		ClientID:  h.Clients[0].ID,
+		NetworkID: "missing",
+	})
+	require.NotNil(t, err)
+}
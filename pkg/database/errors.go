@@ -0,0 +1,168 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// Dependent identifies a resource which refers to another, by the path
+// under which the API serves it, e.g. "client/network" for the assignment
+// of a client to a network.
+type Dependent struct {
+	Resource string `json:"resource"`
+	ID       string `json:"id,omitempty"`
+	Name     string `json:"name,omitempty"`
+}
+
+// InUseError is returned when deleting a resource to which others refer;
+// it matches ErrInUse.
+type InUseError struct {
+	Dependents []Dependent
+}
+
+func (e *InUseError) Error() string {
+	var names []string
+	for _, d := range e.Dependents {
+		if d.ID == "" {
+			names = append(names, d.Resource)
+		} else {
+			names = append(names, d.Resource+" "+d.ID)
+		}
+	}
+	return fmt.Sprintf("%v: referred to by %s", ErrInUse, strings.Join(names, ", "))
+}
+
+func (e *InUseError) Is(target error) bool {
+	return target == ErrInUse
+}
+
+// reference selects the ID and name of each resource of a kind which
+// refers to the resource with the ID bound to its query.
+type reference struct {
+	resource string
+	query    string
+}
+
+// references lists, for each kind of resource, the references to it which
+// prevent its deletion.
+var references = map[string][]reference{
+	"credential": {
+		{"config", "SELECT id, name FROM config WHERE ? IN (user_c, pass_c, ca_c, ovpn_c)"},
+	},
+	"config": {
+		{"network", "SELECT id, name FROM network WHERE config = ?"},
+	},
+	"network": {
+		{"client/network", "SELECT c.id, c.name FROM client_network cn JOIN client c ON c.id = cn.client_id WHERE cn.network_id = ?"},
+		{"group/network", "SELECT g.id, g.name FROM client_group_network gn JOIN client_group g ON g.id = gn.group_id WHERE gn.network_id = ?"},
+		{"dns", "SELECT '', '' FROM dns_route WHERE network_id = ?"},
+		{"domain", "SELECT id, name FROM domain_route WHERE network_id = ?"},
+		{"policy", "SELECT id, name FROM policy WHERE network_id = ?"},
+		{"forward", "SELECT id, name FROM port_forward WHERE network_id = ?"},
+		{"schedule", "SELECT DISTINCT s.id, s.name FROM schedule s LEFT JOIN schedule_window w ON w.schedule_id = s.id WHERE ? IN (s.default_network_id, w.network_id)"},
+		{"pool", "SELECT p.id, p.name FROM network_pool_member m JOIN network_pool p ON p.id = m.pool_id WHERE m.network_id = ?"},
+	},
+	"client": {
+		{"client/network", "SELECT c.id, c.name FROM client_network cn JOIN client c ON c.id = cn.client_id WHERE cn.client_id = ?"},
+		{"domain", "SELECT id, name FROM domain_route WHERE client_id = ?"},
+		{"policy", "SELECT id, name FROM policy WHERE client_id = ?"},
+		{"forward", "SELECT id, name FROM port_forward WHERE client_id = ?"},
+		{"schedule", "SELECT id, name FROM schedule WHERE client_id = ?"},
+	},
+	"group": {
+		{"group/network", "SELECT g.id, g.name FROM client_group_network gn JOIN client_group g ON g.id = gn.group_id WHERE gn.group_id = ?"},
+		{"domain", "SELECT id, name FROM domain_route WHERE group_id = ?"},
+		{"policy", "SELECT id, name FROM policy WHERE group_id = ?"},
+	},
+}
+
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// checkInUse returns an InUseError listing the resources which refer to the
+// resource of the given kind and ID, if there are any.
+func checkInUse(ctx context.Context, q querier, resource, id string) error {
+	var dependents []Dependent
+	for _, ref := range references[resource] {
+		rows, err := q.QueryContext(ctx, ref.query, id)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			d := Dependent{Resource: ref.resource}
+			if err := rows.Scan(&d.ID, &d.Name); err != nil {
+				rows.Close()
+				return err
+			}
+			dependents = append(dependents, d)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if len(dependents) > 0 {
+		return &InUseError{Dependents: dependents}
+	}
+	return nil
+}
+
+// writeError translates the constraint violations of an insert or update:
+// a reference to a missing resource is invalid, and a duplicate of a
+// unique value conflicts with the resource which has it.
+func writeError(err error) error {
+	var e *sqlite.Error
+	if !errors.As(err, &e) {
+		return err
+	}
+	switch e.Code() {
+	case sqlite3.SQLITE_CONSTRAINT_FOREIGNKEY:
+		return fmt.Errorf("%w: %v", ErrInvalidReference, err)
+	case sqlite3.SQLITE_CONSTRAINT_UNIQUE, sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY:
+		return fmt.Errorf("%w: %v", ErrConflict, err)
+	}
+	return err
+}
+
+// deleteError translates the constraint violations of a delete, which are
+// references to the deleted resource not caught by checkInUse.
+func deleteError(err error) error {
+	var e *sqlite.Error
+	if errors.As(err, &e) && e.Code() == sqlite3.SQLITE_CONSTRAINT_FOREIGNKEY {
+		return fmt.Errorf("%w: %v", ErrInUse, err)
+	}
+	return err
+}
+
+// deleteUnused deletes the resource of the given kind and ID, unless other
+// resources refer to it, after executing statements with the ID bound to
+// delete the rows which belong to it.
+func deleteUnused(ctx context.Context, db *sql.DB, resource, id string, statements ...string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := checkInUse(ctx, tx, resource, id); err != nil {
+		return err
+	}
+
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(ctx, statement, id); err != nil {
+			return deleteError(err)
+		}
+	}
+	if err := remove(ctx, tx, tables[resource], "id", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,83 @@
+package database_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pricec/vpnmux/pkg/database"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeleteInUse(t *testing.T) {
+	ctx := context.Background()
+	h, err := NewHarness(ctx, HarnessOptions{
+		NumClients:  2,
+		NumNetworks: 1,
+	})
+	require.Nil(t, err)
+	defer h.Close()
+
+	net := h.Networks[0]
+	_, err = h.DB.ClientNetworks.Put(ctx, &database.ClientNetwork{ClientID: h.Clients[0].ID, NetworkID: net.ID})
+	require.Nil(t, err)
+	f, err := h.DB.PortForwards.Put(ctx, &database.PortForward{
+		Name:         "web",
+		NetworkID:    net.ID,
+		Protocol:     "tcp",
+		ExternalPort: 8080,
+		ClientID:     h.Clients[1].ID,
+		InternalPort: 80,
+	})
+	require.Nil(t, err)
+
+	var inUse *database.InUseError
+	err = h.DB.Networks.Delete(ctx, net.ID)
+	require.ErrorIs(t, err, database.ErrInUse)
+	require.ErrorAs(t, err, &inUse)
+	require.Equal(t, []database.Dependent{
+		{Resource: "client/network", ID: h.Clients[0].ID, Name: h.Clients[0].Name},
+		{Resource: "forward", ID: f.ID, Name: f.Name},
+	}, inUse.Dependents)
+
+	err = h.DB.Configs.Delete(ctx, h.Configs[0].ID)
+	require.ErrorAs(t, err, &inUse)
+	require.Equal(t, []database.Dependent{{Resource: "network", ID: net.ID, Name: net.Name}}, inUse.Dependents)
+
+	err = h.DB.Credentials.Delete(ctx, h.Configs[0].UserCred)
+	require.ErrorAs(t, err, &inUse)
+	require.Equal(t, []database.Dependent{{Resource: "config", ID: h.Configs[0].ID, Name: h.Configs[0].Name}}, inUse.Dependents)
+
+	err = h.DB.Clients.Delete(ctx, h.Clients[1].ID)
+	require.ErrorAs(t, err, &inUse)
+	require.Equal(t, []database.Dependent{{Resource: "forward", ID: f.ID, Name: f.Name}}, inUse.Dependents)
+
+	// A client's group membership does not prevent its deletion.
+	group, err := h.DB.ClientGroups.Put(ctx, &database.ClientGroup{Name: "g", Members: []string{h.Clients[1].ID}})
+	require.Nil(t, err)
+	require.Nil(t, h.DB.PortForwards.Delete(ctx, f.ID))
+	require.Nil(t, h.DB.Clients.Delete(ctx, h.Clients[1].ID))
+	group, err = h.DB.ClientGroups.Get(ctx, group.ID)
+	require.Nil(t, err)
+	require.Empty(t, group.Members)
+
+	require.Equal(t, database.ErrNotFound, h.DB.Clients.Delete(ctx, h.Clients[1].ID))
+}
+
+func TestWriteErrors(t *testing.T) {
+	ctx := context.Background()
+	h, err := NewHarness(ctx, HarnessOptions{
+		NumClients:  1,
+		NumNetworks: 1,
+	})
+	require.Nil(t, err)
+	defer h.Close()
+
+	_, err = h.DB.Networks.Put(ctx, &database.Network{Name: "n", ConfigID: "missing"})
+	require.ErrorIs(t, err, database.ErrInvalidReference)
+
+	cn := &database.ClientNetwork{ClientID: h.Clients[0].ID, NetworkID: h.Networks[0].ID}
+	_, err = h.DB.ClientNetworks.Put(ctx, cn)
+	require.Nil(t, err)
+	_, err = h.DB.ClientNetworks.Put(ctx, cn)
+	require.ErrorIs(t, err, database.ErrConflict)
+}
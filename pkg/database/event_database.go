@@ -0,0 +1,87 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// EventDatabase keeps the most recent events, so that subscribers can
+// resume their stream after reconnecting, even across restarts.
+type EventDatabase struct {
+	db *sql.DB
+}
+
+type Event struct {
+	ID         int64           `json:"id"`
+	Time       time.Time       `json:"time"`
+	Type       string          `json:"type"`
+	Resource   string          `json:"resource,omitempty"`
+	ResourceID string          `json:"resource_id,omitempty"`
+	Data       json.RawMessage `json:"data,omitempty"`
+}
+
+// Append adds an event, assigning its ID, and deletes all but the keep
+// most recent events.
+func (d *EventDatabase) Append(ctx context.Context, e *Event, keep int) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, "INSERT INTO event(time, type, resource, resource_id, data) VALUES(?, ?, ?, ?, ?)",
+		e.Time.UnixNano(), e.Type, e.Resource, e.ResourceID, nullJSON(e.Data))
+	if err != nil {
+		return err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM event WHERE id <= ?", id-int64(keep)); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	e.ID = id
+	return nil
+}
+
+// Since returns the events with IDs greater than id, oldest first.
+func (d *EventDatabase) Since(ctx context.Context, id int64) ([]*Event, error) {
+	rows, err := d.db.QueryContext(ctx, "SELECT id, time, type, resource, resource_id, data FROM event WHERE id > ? ORDER BY id", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events = make([]*Event, 0)
+	for rows.Next() {
+		e := &Event{}
+		var t int64
+		var data sql.NullString
+		if err := rows.Scan(&e.ID, &t, &e.Type, &e.Resource, &e.ResourceID, &data); err != nil {
+			return nil, err
+		}
+		e.Time = time.Unix(0, t).UTC()
+		if data.Valid {
+			e.Data = json.RawMessage(data.String)
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// Bounds returns the IDs of the oldest and most recent events kept, or
+// zero if there are none.
+func (d *EventDatabase) Bounds(ctx context.Context) (oldest, latest int64, err error) {
+	var min, max sql.NullInt64
+	if err := d.db.QueryRowContext(ctx, "SELECT MIN(id), MAX(id) FROM event").Scan(&min, &max); err != nil {
+		return 0, 0, err
+	}
+	return min.Int64, max.Int64, nil
+}
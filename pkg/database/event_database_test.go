@@ -0,0 +1,55 @@
+package database_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/pricec/vpnmux/pkg/database"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEvents(t *testing.T) {
+	ctx := context.Background()
+	h, err := NewHarness(ctx, HarnessOptions{})
+	require.Nil(t, err)
+	defer h.Close()
+
+	oldest, latest, err := h.DB.Events.Bounds(ctx)
+	require.Nil(t, err)
+	require.Zero(t, oldest)
+	require.Zero(t, latest)
+
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	var ids []int64
+	for i := 0; i < 5; i += 1 {
+		e := &database.Event{
+			Time:       start.Add(time.Duration(i) * time.Second),
+			Type:       "update",
+			Resource:   "client",
+			ResourceID: "c1",
+			Data:       json.RawMessage(`{"name":"client"}`),
+		}
+		require.Nil(t, h.DB.Events.Append(ctx, e, 3))
+		ids = append(ids, e.ID)
+	}
+
+	// Only the three most recent events are kept.
+	oldest, latest, err = h.DB.Events.Bounds(ctx)
+	require.Nil(t, err)
+	require.Equal(t, ids[2], oldest)
+	require.Equal(t, ids[4], latest)
+
+	events, err := h.DB.Events.Since(ctx, 0)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(events))
+	require.Equal(t, ids[2], events[0].ID)
+	require.Equal(t, start.Add(2*time.Second), events[0].Time)
+	require.JSONEq(t, `{"name":"client"}`, string(events[0].Data))
+
+	events, err = h.DB.Events.Since(ctx, ids[3])
+	require.Nil(t, err)
+	require.Equal(t, 1, len(events))
+	require.Equal(t, ids[4], events[0].ID)
+}
@@ -0,0 +1,178 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// ErrInvalidQuery is returned (wrapped) when the options of a list query
+// are invalid, e.g. it sorts by an unknown field or its cursor is
+// malformed.
+var ErrInvalidQuery = fmt.Errorf("invalid query")
+
+// ListOptions select a page of a list of resources.
+type ListOptions struct {
+	// Only resources whose name contains Name, ignoring case.
+	Name string
+	// Only clients assigned directly to the network with this ID.
+	NetworkID string
+	// Only clients with this IPv4 or IPv6 address.
+	Address string
+	// The field by which resources are sorted, ascending, or descending if
+	// prefixed with "-"; resources are sorted by name by default. Ties are
+	// broken by ID.
+	Sort string
+	// The Next cursor of the previous page; empty for the first page.
+	Cursor string
+	// The size of the page; zero lists every resource.
+	Limit int
+}
+
+// Page describes the page of a list returned by a query.
+type Page struct {
+	// The number of resources matching the filters, in every page.
+	Total int
+	// The cursor of the next page, or empty if this is the last page.
+	Next string
+}
+
+// lister runs list queries against a table.
+type lister struct {
+	table   string
+	columns string
+	// The fields by which resources can be sorted, and their columns.
+	sorts map[string]string
+}
+
+// filter is a condition on the rows of a list, applied if value is not
+// empty.
+type filter struct {
+	name      string
+	condition string
+	value     string
+}
+
+// cursor is the position after which a page starts: the value of the sort
+// column and the ID of the last resource of the previous page.
+type cursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	ID    string `json:"i"`
+}
+
+// query returns a page of the resources matching filters, by scanning the
+// columns of each row into the destinations returned by dest. Filters of
+// opts for which no filter is given are not supported.
+func (l lister) query(ctx context.Context, db *sql.DB, opts ListOptions, filters []filter, dest func() []interface{}) (*Page, error) {
+	var where []string
+	var args []interface{}
+	supported := make(map[string]bool)
+	for _, f := range filters {
+		supported[f.name] = true
+		if f.value != "" {
+			where = append(where, f.condition)
+			args = append(args, f.value)
+		}
+	}
+	for name, value := range map[string]string{
+		"name":       opts.Name,
+		"network_id": opts.NetworkID,
+		"address":    opts.Address,
+	} {
+		if value != "" && !supported[name] {
+			return nil, fmt.Errorf("%w: %s can't be filtered by %s", ErrInvalidQuery, l.table, name)
+		}
+	}
+
+	page := &Page{}
+	count := "SELECT COUNT(*) FROM " + l.table
+	if len(where) > 0 {
+		count += " WHERE " + strings.Join(where, " AND ")
+	}
+	if err := db.QueryRowContext(ctx, count, args...).Scan(&page.Total); err != nil {
+		return nil, err
+	}
+
+	sort := opts.Sort
+	if sort == "" {
+		sort = "name"
+	}
+	direction, op := "ASC", ">"
+	if strings.HasPrefix(sort, "-") {
+		direction, op = "DESC", "<"
+	}
+	column, ok := l.sorts[strings.TrimPrefix(sort, "-")]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s can't be sorted by %s", ErrInvalidQuery, l.table, strings.TrimPrefix(sort, "-"))
+	}
+
+	if opts.Cursor != "" {
+		c, err := decodeCursor(opts.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		if c.Sort != sort {
+			return nil, fmt.Errorf("%w: cursor of a list sorted by %s", ErrInvalidQuery, c.Sort)
+		}
+		where = append(where, fmt.Sprintf("(%s %s ? OR (%s = ? AND id %s ?))", column, op, column, op))
+		args = append(args, c.Value, c.Value, c.ID)
+	}
+
+	query := fmt.Sprintf("SELECT %s, %s, id FROM %s", l.columns, column, l.table)
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += fmt.Sprintf(" ORDER BY %s %s, id %s", column, direction, direction)
+	if opts.Limit > 0 {
+		// One more than the page, to learn whether there is a next page.
+		query += " LIMIT ?"
+		args = append(args, opts.Limit+1)
+	}
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var n int
+	var last cursor
+	for rows.Next() {
+		n += 1
+		if opts.Limit > 0 && n > opts.Limit {
+			page.Next = encodeCursor(last)
+			break
+		}
+		last = cursor{Sort: sort}
+		if err := rows.Scan(append(dest(), &last.Value, &last.ID)...); err != nil {
+			return nil, err
+		}
+	}
+	return page, rows.Err()
+}
+
+// nameFilter matches the resources whose name contains name, ignoring case.
+func nameFilter(name string) filter {
+	return filter{"name", "instr(lower(name), lower(?)) > 0", name}
+}
+
+func encodeCursor(c cursor) string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s string) (cursor, error) {
+	var c cursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err == nil {
+		err = json.Unmarshal(b, &c)
+	}
+	if err != nil {
+		return c, fmt.Errorf("%w: malformed cursor", ErrInvalidQuery)
+	}
+	return c, nil
+}
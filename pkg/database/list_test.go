@@ -0,0 +1,87 @@
+package database_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/pricec/vpnmux/pkg/database"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryClients(t *testing.T) {
+	ctx := context.Background()
+	h, err := NewHarness(ctx, HarnessOptions{NumNetworks: 1})
+	require.Nil(t, err)
+	defer h.Close()
+
+	var clients []*database.Client
+	for i := 0; i < 7; i += 1 {
+		c, err := h.DB.Clients.Put(ctx, &database.Client{
+			// Two clients share each name, so ties are broken by ID.
+			Name:    fmt.Sprintf("Client %d", i/2),
+			Address: fmt.Sprintf("10.0.0.%d", 7-i),
+		})
+		require.Nil(t, err)
+		clients = append(clients, c)
+	}
+	_, err = h.DB.ClientNetworks.Put(ctx, &database.ClientNetwork{ClientID: clients[2].ID, NetworkID: h.Networks[0].ID})
+	require.Nil(t, err)
+
+	// Every page, in order.
+	for _, sort := range []string{"", "-name", "address", "-id"} {
+		all, page, err := h.DB.Clients.Query(ctx, database.ListOptions{Sort: sort})
+		require.Nil(t, err)
+		require.Equal(t, 7, page.Total)
+		require.Empty(t, page.Next)
+		require.Len(t, all, 7)
+
+		var paged []*database.Client
+		opts := database.ListOptions{Sort: sort, Limit: 3}
+		for {
+			clients, page, err := h.DB.Clients.Query(ctx, opts)
+			require.Nil(t, err)
+			require.Equal(t, 7, page.Total)
+			require.LessOrEqual(t, len(clients), 3)
+			paged = append(paged, clients...)
+			if page.Next == "" {
+				break
+			}
+			opts.Cursor = page.Next
+		}
+		require.Equal(t, all, paged, "sort %q", sort)
+	}
+
+	all, _, err := h.DB.Clients.Query(ctx, database.ListOptions{Sort: "address"})
+	require.Nil(t, err)
+	require.Equal(t, "10.0.0.1", all[0].Address)
+	all, _, err = h.DB.Clients.Query(ctx, database.ListOptions{Sort: "-name"})
+	require.Nil(t, err)
+	require.Equal(t, "Client 3", all[0].Name)
+
+	// Filters.
+	filtered, page, err := h.DB.Clients.Query(ctx, database.ListOptions{Name: "client 1"})
+	require.Nil(t, err)
+	require.Equal(t, 2, page.Total)
+	require.Len(t, filtered, 2)
+
+	filtered, _, err = h.DB.Clients.Query(ctx, database.ListOptions{NetworkID: h.Networks[0].ID})
+	require.Nil(t, err)
+	require.Equal(t, []*database.Client{clients[2]}, filtered)
+
+	filtered, _, err = h.DB.Clients.Query(ctx, database.ListOptions{Address: "10.0.0.7"})
+	require.Nil(t, err)
+	require.Equal(t, []*database.Client{clients[0]}, filtered)
+
+	// Invalid options.
+	_, _, err = h.DB.Clients.Query(ctx, database.ListOptions{Sort: "upload_kbit"})
+	require.ErrorIs(t, err, database.ErrInvalidQuery)
+	_, _, err = h.DB.Clients.Query(ctx, database.ListOptions{Cursor: "bogus"})
+	require.ErrorIs(t, err, database.ErrInvalidQuery)
+	_, page, err = h.DB.Clients.Query(ctx, database.ListOptions{Limit: 1})
+	require.Nil(t, err)
+	_, _, err = h.DB.Clients.Query(ctx, database.ListOptions{Sort: "-name", Cursor: page.Next})
+	require.ErrorIs(t, err, database.ErrInvalidQuery)
+	_, _, err = h.DB.Networks.Query(ctx, database.ListOptions{Address: "10.0.0.1"})
+	require.ErrorIs(t, err, database.ErrInvalidQuery)
+}
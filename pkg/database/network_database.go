@@ -16,10 +16,18 @@ type Network struct {
 	ID       string `json:"id"`
 	Name     string `json:"name"`
 	ConfigID string `json:"config_id"`
+	// Whether the network carries IPv6, for providers which offer it.
+	IPv6 bool `json:"ipv6"`
+	RateLimit
+	// The route table and fwmark allocated to the network, or zero if not
+	// yet allocated; kept when its container is rebuilt.
+	RouteTableID int `json:"route_table_id"`
+	Mark         int `json:"fwmark"`
+	Meta
 }
 
 func (d *NetworkDatabase) List(ctx context.Context) ([]*Network, error) {
-	rows, err := d.db.QueryContext(ctx, "SELECT id, name, config FROM network")
+	rows, err := d.db.QueryContext(ctx, "SELECT id, name, config, ipv6, upload_kbit, download_kbit, route_table_id, fwmark, "+metaColumns+" FROM network")
 	if err != nil {
 		return nil, err
 	}
@@ -28,7 +36,7 @@ func (d *NetworkDatabase) List(ctx context.Context) ([]*Network, error) {
 	var networks = make([]*Network, 0)
 	for rows.Next() {
 		net := &Network{}
-		if err := rows.Scan(&net.ID, &net.Name, &net.ConfigID); err != nil {
+		if err := rows.Scan(withMeta(&net.Meta, &net.ID, &net.Name, &net.ConfigID, &net.IPv6, &net.UploadKbit, &net.DownloadKbit, &net.RouteTableID, &net.Mark)...); err != nil {
 			return nil, err
 		}
 		networks = append(networks, net)
@@ -36,10 +44,33 @@ func (d *NetworkDatabase) List(ctx context.Context) ([]*Network, error) {
 	return networks, nil
 }
 
+var networkLister = lister{
+	table:   "network",
+	columns: "id, name, config, ipv6, upload_kbit, download_kbit, route_table_id, fwmark, " + metaColumns,
+	sorts: map[string]string{
+		"id":   "id",
+		"name": "name",
+	},
+}
+
+// Query returns a page of the networks selected by opts.
+func (d *NetworkDatabase) Query(ctx context.Context, opts ListOptions) ([]*Network, *Page, error) {
+	networks := make([]*Network, 0)
+	page, err := networkLister.query(ctx, d.db, opts, []filter{nameFilter(opts.Name)}, func() []interface{} {
+		net := &Network{}
+		networks = append(networks, net)
+		return withMeta(&net.Meta, &net.ID, &net.Name, &net.ConfigID, &net.IPv6, &net.UploadKbit, &net.DownloadKbit, &net.RouteTableID, &net.Mark)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return networks, page, nil
+}
+
 func (d *NetworkDatabase) Get(ctx context.Context, id string) (*Network, error) {
-	row := d.db.QueryRowContext(ctx, "SELECT id, name, config FROM network WHERE id = ?", id)
+	row := d.db.QueryRowContext(ctx, "SELECT id, name, config, ipv6, upload_kbit, download_kbit, route_table_id, fwmark, "+metaColumns+" FROM network WHERE id = ?", id)
 	net := &Network{}
-	err := row.Scan(&net.ID, &net.Name, &net.ConfigID)
+	err := row.Scan(withMeta(&net.Meta, &net.ID, &net.Name, &net.ConfigID, &net.IPv6, &net.UploadKbit, &net.DownloadKbit, &net.RouteTableID, &net.Mark)...)
 	switch {
 	case errors.Is(err, sql.ErrNoRows):
 		return nil, ErrNotFound
@@ -52,39 +83,37 @@ func (d *NetworkDatabase) Get(ctx context.Context, id string) (*Network, error)
 
 func (d *NetworkDatabase) Put(ctx context.Context, net *Network) (*Network, error) {
 	id := uuid.New()
-	_, err := d.db.ExecContext(ctx, "INSERT INTO network(id, name, config) VALUES(?, ?, ?)", id, net.Name, net.ConfigID)
+	meta := newMeta()
+	_, err := d.db.ExecContext(ctx, "INSERT INTO network(id, name, config, ipv6, upload_kbit, download_kbit, route_table_id, fwmark, "+metaColumns+") VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", withMetaValues(meta, id, net.Name, net.ConfigID, net.IPv6, net.UploadKbit, net.DownloadKbit, net.RouteTableID, net.Mark)...)
 	if err != nil {
-		return nil, err
+		return nil, writeError(err)
 	}
 
 	net.ID = id.String()
+	net.Meta = meta
 	return net, nil
 }
 
 func (d *NetworkDatabase) Update(ctx context.Context, net *Network) error {
-	result, err := d.db.ExecContext(ctx, "UPDATE network SET name = ?, config = ? WHERE id = ?", net.Name, net.ConfigID, net.ID)
-	if err == nil {
-		rows, err := result.RowsAffected()
-		if err != nil {
-			return err
-		}
-		if rows != int64(1) {
-			return ErrNotFound
-		}
+	return update(ctx, d.db, "network", "id", net.ID, &net.Meta, "name = ?, config = ?, ipv6 = ?, upload_kbit = ?, download_kbit = ?", net.Name, net.ConfigID, net.IPv6, net.UploadKbit, net.DownloadKbit)
+}
+
+// SetRouting records the route table and fwmark allocated to a network
+// whose routing was set up before they were stored, without changing its
+// version.
+func (d *NetworkDatabase) SetRouting(ctx context.Context, id string, routeTableID, mark int) error {
+	result, err := d.db.ExecContext(ctx, "UPDATE network SET route_table_id = ?, fwmark = ? WHERE id = ?", routeTableID, mark, id)
+	if err != nil {
+		return writeError(err)
 	}
-	return err
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
 }
 
 func (d *NetworkDatabase) Delete(ctx context.Context, id string) error {
-	result, err := d.db.ExecContext(ctx, "DELETE FROM network WHERE id = ?", id)
-	if err == nil {
-		rows, err := result.RowsAffected()
-		if err != nil {
-			return err
-		}
-		if rows != int64(1) {
-			return ErrNotFound
-		}
-	}
-	return err
+	return deleteUnused(ctx, d.db, "network", id)
 }
@@ -18,7 +18,10 @@ func TestUpdateNetwork(t *testing.T) {
 	net, err := h.DB.Networks.Get(ctx, h.Networks[0].ID)
 	require.Nil(t, err)
 	require.NotNil(t, net)
+	require.False(t, net.IPv6)
 	net.Name = "name2"
+	net.IPv6 = true
+	net.UploadKbit = 1000
 
 	err = h.DB.Networks.Update(ctx, net)
 	require.Nil(t, err)
@@ -26,6 +29,9 @@ func TestUpdateNetwork(t *testing.T) {
 	net, err = h.DB.Networks.Get(ctx, net.ID)
 	require.Nil(t, err)
 	require.Equal(t, "name2", net.Name)
+	require.True(t, net.IPv6)
+	require.Equal(t, 1000, net.UploadKbit)
+	require.Equal(t, 0, net.DownloadKbit)
 }
 
 func TestNetworks(t *testing.T) {
@@ -58,3 +64,34 @@ func TestNetworks(t *testing.T) {
 	require.Nil(t, err)
 	require.Empty(t, nets)
 }
+
+func TestNetworkRouting(t *testing.T) {
+	ctx := context.Background()
+	h, err := NewHarness(ctx, HarnessOptions{
+		NumNetworks: 2,
+	})
+	require.Nil(t, err)
+	defer h.Close()
+
+	// Networks created before their routing was stored have none.
+	require.Equal(t, 0, h.Networks[0].RouteTableID)
+
+	require.Nil(t, h.DB.Networks.SetRouting(ctx, h.Networks[0].ID, 100, 0x164))
+	net, err := h.DB.Networks.Get(ctx, h.Networks[0].ID)
+	require.Nil(t, err)
+	require.Equal(t, 100, net.RouteTableID)
+	require.Equal(t, 0x164, net.Mark)
+	require.Equal(t, h.Networks[0].Version, net.Version)
+
+	// A route table belongs to a single network.
+	require.ErrorIs(t, h.DB.Networks.SetRouting(ctx, h.Networks[1].ID, 100, 0x164), database.ErrConflict)
+	_, err = h.DB.Networks.Put(ctx, &database.Network{Name: "other", ConfigID: h.Networks[0].ConfigID, RouteTableID: 100})
+	require.ErrorIs(t, err, database.ErrConflict)
+	require.ErrorIs(t, h.DB.Networks.SetRouting(ctx, "missing", 101, 0x165), database.ErrNotFound)
+
+	net, err = h.DB.Networks.Put(ctx, &database.Network{Name: "other", ConfigID: h.Networks[0].ConfigID, RouteTableID: 101, Mark: 0x165})
+	require.Nil(t, err)
+	net, err = h.DB.Networks.Get(ctx, net.ID)
+	require.Nil(t, err)
+	require.Equal(t, 101, net.RouteTableID)
+}
@@ -0,0 +1,195 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/google/uuid"
+)
+
+type NetworkPoolDatabase struct {
+	db *sql.DB
+}
+
+// NetworkPool spreads the new connections of its clients, and of the
+// members and subnets of its groups, across its networks in proportion to
+// their weights. A client or group is in at most one pool.
+type NetworkPool struct {
+	ID       string       `json:"id"`
+	Name     string       `json:"name"`
+	Networks []PoolMember `json:"networks"`
+	Clients  []string     `json:"clients"`
+	Groups   []string     `json:"groups"`
+	Meta
+}
+
+// PoolMember is a network of a pool, which receives a share of the pool's
+// new connections proportional to its weight.
+type PoolMember struct {
+	NetworkID string `json:"network_id"`
+	Weight    int    `json:"weight"`
+}
+
+func (d *NetworkPoolDatabase) List(ctx context.Context) ([]*NetworkPool, error) {
+	rows, err := d.db.QueryContext(ctx, "SELECT id, name, "+metaColumns+" FROM network_pool ORDER BY name, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pools = make([]*NetworkPool, 0)
+	for rows.Next() {
+		p := &NetworkPool{}
+		if err := rows.Scan(withMeta(&p.Meta, &p.ID, &p.Name)...); err != nil {
+			return nil, err
+		}
+		pools = append(pools, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, p := range pools {
+		if err := d.populate(ctx, p); err != nil {
+			return nil, err
+		}
+	}
+	return pools, nil
+}
+
+func (d *NetworkPoolDatabase) Get(ctx context.Context, id string) (*NetworkPool, error) {
+	row := d.db.QueryRowContext(ctx, "SELECT id, name, "+metaColumns+" FROM network_pool WHERE id = ?", id)
+	p := &NetworkPool{}
+	err := row.Scan(withMeta(&p.Meta, &p.ID, &p.Name)...)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return nil, ErrNotFound
+	case err != nil:
+		return nil, err
+	}
+
+	if err := d.populate(ctx, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (d *NetworkPoolDatabase) populate(ctx context.Context, p *NetworkPool) error {
+	rows, err := d.db.QueryContext(ctx, "SELECT network_id, weight FROM network_pool_member WHERE pool_id = ? ORDER BY position", p.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	p.Networks = make([]PoolMember, 0)
+	for rows.Next() {
+		var m PoolMember
+		if err := rows.Scan(&m.NetworkID, &m.Weight); err != nil {
+			return err
+		}
+		p.Networks = append(p.Networks, m)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	p.Clients, err = queryStrings(ctx, d.db, "SELECT client_id FROM network_pool_client WHERE pool_id = ? ORDER BY client_id", p.ID)
+	if err != nil {
+		return err
+	}
+	p.Groups, err = queryStrings(ctx, d.db, "SELECT group_id FROM network_pool_group WHERE pool_id = ? ORDER BY group_id", p.ID)
+	return err
+}
+
+func (d *NetworkPoolDatabase) Put(ctx context.Context, p *NetworkPool) (*NetworkPool, error) {
+	id := uuid.New()
+	meta := newMeta()
+
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "INSERT INTO network_pool(id, name, "+metaColumns+") VALUES(?, ?, ?, ?, ?)", withMetaValues(meta, id, p.Name)...); err != nil {
+		return nil, err
+	}
+	if err := putPoolEntries(ctx, tx, id.String(), p); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	p.ID = id.String()
+	p.Meta = meta
+	return p, nil
+}
+
+func (d *NetworkPoolDatabase) Update(ctx context.Context, p *NetworkPool) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := update(ctx, tx, "network_pool", "id", p.ID, &p.Meta, "name = ?", p.Name); err != nil {
+		return err
+	}
+	for _, statement := range []string{
+		"DELETE FROM network_pool_member WHERE pool_id = ?",
+		"DELETE FROM network_pool_client WHERE pool_id = ?",
+		"DELETE FROM network_pool_group WHERE pool_id = ?",
+	} {
+		if _, err := tx.ExecContext(ctx, statement, p.ID); err != nil {
+			return err
+		}
+	}
+	if err := putPoolEntries(ctx, tx, p.ID, p); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func putPoolEntries(ctx context.Context, tx *sql.Tx, id string, p *NetworkPool) error {
+	for i, m := range p.Networks {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO network_pool_member(pool_id, network_id, weight, position) VALUES(?, ?, ?, ?)", id, m.NetworkID, m.Weight, i); err != nil {
+			return writeError(err)
+		}
+	}
+	for _, clientID := range p.Clients {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO network_pool_client(client_id, pool_id) VALUES(?, ?)", clientID, id); err != nil {
+			return writeError(err)
+		}
+	}
+	for _, groupID := range p.Groups {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO network_pool_group(group_id, pool_id) VALUES(?, ?)", groupID, id); err != nil {
+			return writeError(err)
+		}
+	}
+	return nil
+}
+
+// Delete deletes a pool, its networks and its memberships.
+func (d *NetworkPoolDatabase) Delete(ctx context.Context, id string) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, statement := range []string{
+		"DELETE FROM network_pool_member WHERE pool_id = ?",
+		"DELETE FROM network_pool_client WHERE pool_id = ?",
+		"DELETE FROM network_pool_group WHERE pool_id = ?",
+	} {
+		if _, err := tx.ExecContext(ctx, statement, id); err != nil {
+			return err
+		}
+	}
+	if err := remove(ctx, tx, "network_pool", "id", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,71 @@
+package database_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pricec/vpnmux/pkg/database"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNetworkPool(t *testing.T) {
+	ctx := context.Background()
+	h, err := NewHarness(ctx, HarnessOptions{
+		NumClients:  2,
+		NumNetworks: 2,
+	})
+	require.Nil(t, err)
+	defer h.Close()
+
+	group, err := h.DB.ClientGroups.Put(ctx, &database.ClientGroup{Name: "kids"})
+	require.Nil(t, err)
+
+	p, err := h.DB.Pools.Put(ctx, &database.NetworkPool{
+		Name: "exits",
+		Networks: []database.PoolMember{
+			{NetworkID: h.Networks[1].ID, Weight: 3},
+			{NetworkID: h.Networks[0].ID, Weight: 1},
+		},
+		Clients: []string{h.Clients[0].ID},
+		Groups:  []string{group.ID},
+	})
+	require.Nil(t, err)
+	require.Equal(t, int64(1), p.Version)
+
+	got, err := h.DB.Pools.Get(ctx, p.ID)
+	require.Nil(t, err)
+	require.Equal(t, p.Networks, got.Networks)
+	require.Equal(t, []string{h.Clients[0].ID}, got.Clients)
+	require.Equal(t, []string{group.ID}, got.Groups)
+
+	// A client is in at most one pool, and pools refer to existing
+	// resources.
+	_, err = h.DB.Pools.Put(ctx, &database.NetworkPool{Name: "other", Clients: []string{h.Clients[0].ID}})
+	require.ErrorIs(t, err, database.ErrConflict)
+	_, err = h.DB.Pools.Put(ctx, &database.NetworkPool{Name: "other", Networks: []database.PoolMember{{NetworkID: "missing", Weight: 1}}})
+	require.ErrorIs(t, err, database.ErrInvalidReference)
+
+	// Networks of a pool can't be deleted, but clients and groups leave it.
+	require.ErrorIs(t, h.DB.Networks.Delete(ctx, h.Networks[0].ID), database.ErrInUse)
+	require.Nil(t, h.DB.Clients.Delete(ctx, h.Clients[0].ID))
+	require.Nil(t, h.DB.ClientGroups.Delete(ctx, group.ID))
+	got, err = h.DB.Pools.Get(ctx, p.ID)
+	require.Nil(t, err)
+	require.Empty(t, got.Clients)
+	require.Empty(t, got.Groups)
+
+	got.Networks = got.Networks[:1]
+	got.Clients = []string{h.Clients[1].ID}
+	require.Nil(t, h.DB.Pools.Update(ctx, got))
+	require.Equal(t, int64(2), got.Version)
+	require.Nil(t, h.DB.Networks.Delete(ctx, h.Networks[0].ID))
+
+	list, err := h.DB.Pools.List(ctx)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(list))
+	require.Equal(t, []string{h.Clients[1].ID}, list[0].Clients)
+
+	require.Nil(t, h.DB.Pools.Delete(ctx, p.ID))
+	require.ErrorIs(t, h.DB.Pools.Delete(ctx, p.ID), database.ErrNotFound)
+	require.Nil(t, h.DB.Clients.Delete(ctx, h.Clients[1].ID))
+}
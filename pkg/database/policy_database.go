@@ -0,0 +1,105 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/google/uuid"
+)
+
+const (
+	PolicyActionNetwork = "network"
+	PolicyActionWAN     = "wan"
+	PolicyActionDrop    = "drop"
+)
+
+type PolicyDatabase struct {
+	db *sql.DB
+}
+
+// Policy routes matching packets according to its action. Policies are
+// evaluated in ascending order of priority; the first match applies.
+type Policy struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Priority int    `json:"priority"`
+	// Source client or group; if both are empty, the policy applies to
+	// every host on the LAN.
+	ClientID    string `json:"client_id,omitempty"`
+	GroupID     string `json:"group_id,omitempty"`
+	Destination string `json:"destination,omitempty"`
+	Protocol    string `json:"protocol,omitempty"`
+	Ports       string `json:"ports,omitempty"`
+	Action      string `json:"action"`
+	// Network to route via; only used with PolicyActionNetwork.
+	NetworkID string `json:"network_id,omitempty"`
+	Meta
+}
+
+const policyColumns = "id, name, priority, client_id, group_id, destination, protocol, ports, action, network_id"
+
+func scanPolicy(row interface{ Scan(...interface{}) error }) (*Policy, error) {
+	policy := &Policy{}
+	var clientID, groupID, networkID sql.NullString
+	err := row.Scan(withMeta(&policy.Meta, &policy.ID, &policy.Name, &policy.Priority, &clientID, &groupID, &policy.Destination, &policy.Protocol, &policy.Ports, &policy.Action, &networkID)...)
+	if err != nil {
+		return nil, err
+	}
+	policy.ClientID = clientID.String
+	policy.GroupID = groupID.String
+	policy.NetworkID = networkID.String
+	return policy, nil
+}
+
+func (d *PolicyDatabase) List(ctx context.Context) ([]*Policy, error) {
+	rows, err := d.db.QueryContext(ctx, "SELECT "+policyColumns+", "+metaColumns+" FROM policy ORDER BY priority, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var policies = make([]*Policy, 0)
+	for rows.Next() {
+		policy, err := scanPolicy(rows)
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, policy)
+	}
+	return policies, nil
+}
+
+func (d *PolicyDatabase) Get(ctx context.Context, id string) (*Policy, error) {
+	row := d.db.QueryRowContext(ctx, "SELECT "+policyColumns+", "+metaColumns+" FROM policy WHERE id = ?", id)
+	policy, err := scanPolicy(row)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return nil, ErrNotFound
+	case err == nil:
+		return policy, nil
+	default:
+		return nil, err
+	}
+}
+
+func (d *PolicyDatabase) Put(ctx context.Context, policy *Policy) (*Policy, error) {
+	id := uuid.New()
+	meta := newMeta()
+	_, err := d.db.ExecContext(ctx, "INSERT INTO policy("+policyColumns+", "+metaColumns+") VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", withMetaValues(meta, id, policy.Name, policy.Priority, nullString(policy.ClientID), nullString(policy.GroupID), policy.Destination, policy.Protocol, policy.Ports, policy.Action, nullString(policy.NetworkID))...)
+	if err != nil {
+		return nil, writeError(err)
+	}
+
+	policy.ID = id.String()
+	policy.Meta = meta
+	return policy, nil
+}
+
+func (d *PolicyDatabase) Update(ctx context.Context, policy *Policy) error {
+	return update(ctx, d.db, "policy", "id", policy.ID, &policy.Meta, "name = ?, priority = ?, client_id = ?, group_id = ?, destination = ?, protocol = ?, ports = ?, action = ?, network_id = ?", policy.Name, policy.Priority, nullString(policy.ClientID), nullString(policy.GroupID), policy.Destination, policy.Protocol, policy.Ports, policy.Action, nullString(policy.NetworkID))
+}
+
+func (d *PolicyDatabase) Delete(ctx context.Context, id string) error {
+	return remove(ctx, d.db, "policy", "id", id)
+}
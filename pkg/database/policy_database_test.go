@@ -0,0 +1,84 @@
+package database_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pricec/vpnmux/pkg/database"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdatePolicy(t *testing.T) {
+	ctx := context.Background()
+	h, err := NewHarness(ctx, HarnessOptions{
+		NumClients:  1,
+		NumNetworks: 1,
+	})
+	require.Nil(t, err)
+	defer h.Close()
+
+	p, err := h.DB.Policies.Put(ctx, &database.Policy{
+		Name:        "streaming",
+		Priority:    10,
+		ClientID:    h.Clients[0].ID,
+		Destination: "10.0.0.0/8",
+		Protocol:    "tcp",
+		Ports:       "443",
+		Action:      database.PolicyActionNetwork,
+		NetworkID:   h.Networks[0].ID,
+	})
+	require.Nil(t, err)
+
+	p.ClientID = ""
+	p.NetworkID = ""
+	p.Action = database.PolicyActionWAN
+
+	err = h.DB.Policies.Update(ctx, p)
+	require.Nil(t, err)
+
+	p, err = h.DB.Policies.Get(ctx, p.ID)
+	require.Nil(t, err)
+	require.Equal(t, "", p.ClientID)
+	require.Equal(t, "", p.NetworkID)
+	require.Equal(t, database.PolicyActionWAN, p.Action)
+	require.Equal(t, "443", p.Ports)
+}
+
+func TestPolicies(t *testing.T) {
+	ctx := context.Background()
+	h, err := NewHarness(ctx, HarnessOptions{})
+	require.Nil(t, err)
+	defer h.Close()
+
+	policies, err := h.DB.Policies.List(ctx)
+	require.Nil(t, err)
+	require.Empty(t, policies)
+
+	for _, priority := range []int{30, 10, 20} {
+		_, err := h.DB.Policies.Put(ctx, &database.Policy{
+			Name:     "test",
+			Priority: priority,
+			Action:   database.PolicyActionDrop,
+		})
+		require.Nil(t, err)
+	}
+
+	p, err := h.DB.Policies.Get(ctx, "test")
+	require.Equal(t, database.ErrNotFound, err)
+	require.Nil(t, p)
+
+	policies, err = h.DB.Policies.List(ctx)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(policies))
+	require.Equal(t, 10, policies[0].Priority)
+	require.Equal(t, 20, policies[1].Priority)
+	require.Equal(t, 30, policies[2].Priority)
+
+	for _, policy := range policies {
+		require.Nil(t, h.DB.Policies.Delete(ctx, policy.ID))
+	}
+
+	policies, err = h.DB.Policies.List(ctx)
+	require.Nil(t, err)
+	require.Empty(t, policies)
+}
@@ -0,0 +1,89 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/google/uuid"
+)
+
+type PortForwardDatabase struct {
+	db *sql.DB
+}
+
+// PortForward forwards connections to a port of a network's VPN exit to a
+// port of a client on the LAN.
+type PortForward struct {
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	NetworkID    string `json:"network_id"`
+	Protocol     string `json:"protocol"`
+	ExternalPort int    `json:"external_port"`
+	ClientID     string `json:"client_id"`
+	InternalPort int    `json:"internal_port"`
+	Meta
+}
+
+const portForwardColumns = "id, name, network_id, protocol, external_port, client_id, internal_port"
+
+func scanPortForward(row interface{ Scan(...interface{}) error }) (*PortForward, error) {
+	f := &PortForward{}
+	err := row.Scan(withMeta(&f.Meta, &f.ID, &f.Name, &f.NetworkID, &f.Protocol, &f.ExternalPort, &f.ClientID, &f.InternalPort)...)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (d *PortForwardDatabase) List(ctx context.Context) ([]*PortForward, error) {
+	rows, err := d.db.QueryContext(ctx, "SELECT "+portForwardColumns+", "+metaColumns+" FROM port_forward ORDER BY network_id, protocol, external_port")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var forwards = make([]*PortForward, 0)
+	for rows.Next() {
+		f, err := scanPortForward(rows)
+		if err != nil {
+			return nil, err
+		}
+		forwards = append(forwards, f)
+	}
+	return forwards, nil
+}
+
+func (d *PortForwardDatabase) Get(ctx context.Context, id string) (*PortForward, error) {
+	row := d.db.QueryRowContext(ctx, "SELECT "+portForwardColumns+", "+metaColumns+" FROM port_forward WHERE id = ?", id)
+	f, err := scanPortForward(row)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return nil, ErrNotFound
+	case err == nil:
+		return f, nil
+	default:
+		return nil, err
+	}
+}
+
+func (d *PortForwardDatabase) Put(ctx context.Context, f *PortForward) (*PortForward, error) {
+	id := uuid.New()
+	meta := newMeta()
+	_, err := d.db.ExecContext(ctx, "INSERT INTO port_forward("+portForwardColumns+", "+metaColumns+") VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", withMetaValues(meta, id, f.Name, f.NetworkID, f.Protocol, f.ExternalPort, f.ClientID, f.InternalPort)...)
+	if err != nil {
+		return nil, writeError(err)
+	}
+
+	f.ID = id.String()
+	f.Meta = meta
+	return f, nil
+}
+
+func (d *PortForwardDatabase) Update(ctx context.Context, f *PortForward) error {
+	return update(ctx, d.db, "port_forward", "id", f.ID, &f.Meta, "name = ?, network_id = ?, protocol = ?, external_port = ?, client_id = ?, internal_port = ?", f.Name, f.NetworkID, f.Protocol, f.ExternalPort, f.ClientID, f.InternalPort)
+}
+
+func (d *PortForwardDatabase) Delete(ctx context.Context, id string) error {
+	return remove(ctx, d.db, "port_forward", "id", id)
+}
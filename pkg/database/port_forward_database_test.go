@@ -0,0 +1,59 @@
+package database_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pricec/vpnmux/pkg/database"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPortForwards(t *testing.T) {
+	ctx := context.Background()
+	h, err := NewHarness(ctx, HarnessOptions{
+		NumClients:  1,
+		NumNetworks: 1,
+	})
+	require.Nil(t, err)
+	defer h.Close()
+
+	forwards, err := h.DB.PortForwards.List(ctx)
+	require.Nil(t, err)
+	require.Empty(t, forwards)
+
+	f, err := h.DB.PortForwards.Put(ctx, &database.PortForward{
+		Name:         "game",
+		NetworkID:    h.Networks[0].ID,
+		Protocol:     "udp",
+		ExternalPort: 51413,
+		ClientID:     h.Clients[0].ID,
+		InternalPort: 6881,
+	})
+	require.Nil(t, err)
+
+	// Each external port of a network can only be forwarded once.
+	_, err = h.DB.PortForwards.Put(ctx, &database.PortForward{
+		Name:         "duplicate",
+		NetworkID:    h.Networks[0].ID,
+		Protocol:     "udp",
+		ExternalPort: 51413,
+		ClientID:     h.Clients[0].ID,
+		InternalPort: 6882,
+	})
+	require.NotNil(t, err)
+
+	f.InternalPort = 6889
+	require.Nil(t, h.DB.PortForwards.Update(ctx, f))
+
+	f, err = h.DB.PortForwards.Get(ctx, f.ID)
+	require.Nil(t, err)
+	require.Equal(t, "udp", f.Protocol)
+	require.Equal(t, 51413, f.ExternalPort)
+	require.Equal(t, 6889, f.InternalPort)
+
+	require.Nil(t, h.DB.PortForwards.Delete(ctx, f.ID))
+	require.Equal(t, database.ErrNotFound, h.DB.PortForwards.Delete(ctx, f.ID))
+
+	_, err = h.DB.PortForwards.Get(ctx, f.ID)
+	require.Equal(t, database.ErrNotFound, err)
+}
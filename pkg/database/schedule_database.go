@@ -0,0 +1,192 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+type ScheduleDatabase struct {
+	db *sql.DB
+}
+
+// Schedule assigns a client to networks by time of day: to the network of
+// the first of its windows which is open, or else to its default network.
+// An empty network ID leaves the client unassigned, so that it falls back
+// to the network of its group, if any. A client has at most one schedule.
+type Schedule struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	ClientID string `json:"client_id"`
+	// IANA name of the time zone of the windows, e.g. "Europe/Paris"; the
+	// gateway's local time if empty.
+	TimeZone         string           `json:"time_zone"`
+	DefaultNetworkID string           `json:"default_network_id"`
+	Windows          []ScheduleWindow `json:"windows"`
+	Meta
+}
+
+// ScheduleWindow is a period of each of the given days, from Start until
+// End (times of day such as "08:30"), during which a client is assigned to
+// a network. A window whose end is not after its start ends on the next
+// day.
+type ScheduleWindow struct {
+	// Days of the week, e.g. "mon", or ranges of them, e.g. "mon-fri"; every
+	// day if empty.
+	Days      []string `json:"days"`
+	Start     string   `json:"start"`
+	End       string   `json:"end"`
+	NetworkID string   `json:"network_id"`
+}
+
+const scheduleColumns = "id, name, client_id, time_zone, default_network_id"
+
+func scanSchedule(row interface{ Scan(...interface{}) error }) (*Schedule, error) {
+	s := &Schedule{}
+	err := row.Scan(withMeta(&s.Meta, &s.ID, &s.Name, &s.ClientID, &s.TimeZone, &s.DefaultNetworkID)...)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (d *ScheduleDatabase) List(ctx context.Context) ([]*Schedule, error) {
+	rows, err := d.db.QueryContext(ctx, "SELECT "+scheduleColumns+", "+metaColumns+" FROM schedule ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var schedules = make([]*Schedule, 0)
+	for rows.Next() {
+		s, err := scanSchedule(rows)
+		if err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, s := range schedules {
+		if err := d.populate(ctx, s); err != nil {
+			return nil, err
+		}
+	}
+	return schedules, nil
+}
+
+func (d *ScheduleDatabase) Get(ctx context.Context, id string) (*Schedule, error) {
+	row := d.db.QueryRowContext(ctx, "SELECT "+scheduleColumns+", "+metaColumns+" FROM schedule WHERE id = ?", id)
+	s, err := scanSchedule(row)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return nil, ErrNotFound
+	case err != nil:
+		return nil, err
+	}
+
+	if err := d.populate(ctx, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (d *ScheduleDatabase) populate(ctx context.Context, s *Schedule) error {
+	rows, err := d.db.QueryContext(ctx, "SELECT days, start_time, end_time, network_id FROM schedule_window WHERE schedule_id = ? ORDER BY position", s.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	s.Windows = make([]ScheduleWindow, 0)
+	for rows.Next() {
+		var w ScheduleWindow
+		var days string
+		if err := rows.Scan(&days, &w.Start, &w.End, &w.NetworkID); err != nil {
+			return err
+		}
+		w.Days = make([]string, 0)
+		if days != "" {
+			w.Days = strings.Split(days, ",")
+		}
+		s.Windows = append(s.Windows, w)
+	}
+	return rows.Err()
+}
+
+func (d *ScheduleDatabase) Put(ctx context.Context, s *Schedule) (*Schedule, error) {
+	id := uuid.New()
+	meta := newMeta()
+
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO schedule("+scheduleColumns+", "+metaColumns+") VALUES(?, ?, ?, ?, ?, ?, ?, ?)", withMetaValues(meta, id, s.Name, s.ClientID, s.TimeZone, s.DefaultNetworkID)...)
+	if err != nil {
+		return nil, writeError(err)
+	}
+	if err := putScheduleWindows(ctx, tx, id.String(), s.Windows); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	s.ID = id.String()
+	s.Meta = meta
+	return s, nil
+}
+
+func (d *ScheduleDatabase) Update(ctx context.Context, s *Schedule) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := update(ctx, tx, "schedule", "id", s.ID, &s.Meta, "name = ?, client_id = ?, time_zone = ?, default_network_id = ?", s.Name, s.ClientID, s.TimeZone, s.DefaultNetworkID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM schedule_window WHERE schedule_id = ?", s.ID); err != nil {
+		return err
+	}
+	if err := putScheduleWindows(ctx, tx, s.ID, s.Windows); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func putScheduleWindows(ctx context.Context, tx *sql.Tx, id string, windows []ScheduleWindow) error {
+	for i, w := range windows {
+		_, err := tx.ExecContext(ctx, "INSERT INTO schedule_window(schedule_id, position, days, start_time, end_time, network_id) VALUES(?, ?, ?, ?, ?, ?)", id, i, strings.Join(w.Days, ","), w.Start, w.End, w.NetworkID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete deletes a schedule and its windows.
+func (d *ScheduleDatabase) Delete(ctx context.Context, id string) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM schedule_window WHERE schedule_id = ?", id); err != nil {
+		return err
+	}
+	if err := remove(ctx, tx, "schedule", "id", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
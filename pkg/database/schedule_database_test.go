@@ -0,0 +1,64 @@
+package database_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pricec/vpnmux/pkg/database"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchedule(t *testing.T) {
+	ctx := context.Background()
+	h, err := NewHarness(ctx, HarnessOptions{
+		NumClients:  2,
+		NumNetworks: 2,
+	})
+	require.Nil(t, err)
+	defer h.Close()
+
+	s, err := h.DB.Schedules.Put(ctx, &database.Schedule{
+		Name:             "school",
+		ClientID:         h.Clients[0].ID,
+		TimeZone:         "Europe/Paris",
+		DefaultNetworkID: h.Networks[0].ID,
+		Windows: []database.ScheduleWindow{
+			{Days: []string{"mon-fri"}, Start: "08:00", End: "15:00", NetworkID: h.Networks[1].ID},
+			{Start: "22:00", End: "07:00"},
+		},
+	})
+	require.Nil(t, err)
+	require.Equal(t, int64(1), s.Version)
+
+	got, err := h.DB.Schedules.Get(ctx, s.ID)
+	require.Nil(t, err)
+	require.Equal(t, s.DefaultNetworkID, got.DefaultNetworkID)
+	require.Equal(t, []database.ScheduleWindow{
+		{Days: []string{"mon-fri"}, Start: "08:00", End: "15:00", NetworkID: h.Networks[1].ID},
+		{Days: []string{}, Start: "22:00", End: "07:00"},
+	}, got.Windows)
+
+	// A client has at most one schedule.
+	_, err = h.DB.Schedules.Put(ctx, &database.Schedule{Name: "other", ClientID: h.Clients[0].ID})
+	require.ErrorIs(t, err, database.ErrConflict)
+
+	// Clients and networks used by a schedule can't be deleted.
+	require.ErrorIs(t, h.DB.Clients.Delete(ctx, h.Clients[0].ID), database.ErrInUse)
+	require.ErrorIs(t, h.DB.Networks.Delete(ctx, h.Networks[0].ID), database.ErrInUse)
+	require.ErrorIs(t, h.DB.Networks.Delete(ctx, h.Networks[1].ID), database.ErrInUse)
+
+	got.Windows = got.Windows[1:]
+	got.DefaultNetworkID = ""
+	require.Nil(t, h.DB.Schedules.Update(ctx, got))
+	require.Equal(t, int64(2), got.Version)
+	require.Nil(t, h.DB.Networks.Delete(ctx, h.Networks[1].ID))
+
+	list, err := h.DB.Schedules.List(ctx)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(list))
+	require.Equal(t, 1, len(list[0].Windows))
+
+	require.Nil(t, h.DB.Schedules.Delete(ctx, s.ID))
+	require.ErrorIs(t, h.DB.Schedules.Delete(ctx, s.ID), database.ErrNotFound)
+	require.Nil(t, h.DB.Clients.Delete(ctx, h.Clients[0].ID))
+}
@@ -55,5 +55,317 @@ var schema = []string{
         network_id TEXT,
         FOREIGN KEY(network_id) REFERENCES network(id)
     );
+    `,
+	`
+    CREATE TABLE IF NOT EXISTS domain_route(
+        id TEXT NOT NULL PRIMARY KEY,
+        name TEXT NOT NULL,
+        domain TEXT NOT NULL,
+        client_id TEXT NOT NULL,
+        network_id TEXT NOT NULL,
+        FOREIGN KEY(client_id) REFERENCES client(id),
+        FOREIGN KEY(network_id) REFERENCES network(id)
+    );
+    `,
+	`
+    CREATE TABLE IF NOT EXISTS policy(
+        id TEXT NOT NULL PRIMARY KEY,
+        name TEXT NOT NULL,
+        priority INTEGER NOT NULL,
+        client_id TEXT,
+        destination TEXT NOT NULL,
+        protocol TEXT NOT NULL,
+        ports TEXT NOT NULL,
+        action TEXT NOT NULL,
+        network_id TEXT,
+        FOREIGN KEY(client_id) REFERENCES client(id),
+        FOREIGN KEY(network_id) REFERENCES network(id)
+    );
+    `,
+	`
+    CREATE TABLE IF NOT EXISTS client_group(
+        id TEXT NOT NULL PRIMARY KEY,
+        name TEXT NOT NULL
+    );
+    `,
+	`
+    CREATE TABLE IF NOT EXISTS client_group_cidr(
+        group_id TEXT NOT NULL,
+        cidr TEXT NOT NULL,
+        PRIMARY KEY(group_id, cidr),
+        FOREIGN KEY(group_id) REFERENCES client_group(id) ON DELETE CASCADE
+    );
+    `,
+	`
+    CREATE TABLE IF NOT EXISTS client_group_member(
+        client_id TEXT NOT NULL PRIMARY KEY,
+        group_id TEXT NOT NULL,
+        FOREIGN KEY(client_id) REFERENCES client(id),
+        FOREIGN KEY(group_id) REFERENCES client_group(id) ON DELETE CASCADE
+    );
+    `,
+	`
+    CREATE TABLE IF NOT EXISTS client_group_network(
+        group_id TEXT NOT NULL PRIMARY KEY,
+        network_id TEXT,
+        FOREIGN KEY(group_id) REFERENCES client_group(id),
+        FOREIGN KEY(network_id) REFERENCES network(id)
+    );
+    `,
+}
+
+// migrations alter tables created by the schema above. Each is applied
+// exactly once, in order; the number applied is recorded in the database's
+// user_version.
+var migrations = []string{
+	`
+    ALTER TABLE client ADD COLUMN mac TEXT NOT NULL DEFAULT '';
+    `,
+	`
+    ALTER TABLE policy ADD COLUMN group_id TEXT REFERENCES client_group(id);
+    `,
+	`
+    CREATE TABLE domain_route_v2(
+        id TEXT NOT NULL PRIMARY KEY,
+        name TEXT NOT NULL,
+        domain TEXT NOT NULL,
+        client_id TEXT,
+        group_id TEXT,
+        network_id TEXT NOT NULL,
+        FOREIGN KEY(client_id) REFERENCES client(id),
+        FOREIGN KEY(group_id) REFERENCES client_group(id),
+        FOREIGN KEY(network_id) REFERENCES network(id)
+    );
+    INSERT INTO domain_route_v2(id, name, domain, client_id, network_id)
+        SELECT id, name, domain, client_id, network_id FROM domain_route;
+    DROP TABLE domain_route;
+    ALTER TABLE domain_route_v2 RENAME TO domain_route;
+    `,
+	`
+    ALTER TABLE client ADD COLUMN address6 TEXT NOT NULL DEFAULT '';
+    `,
+	`
+    ALTER TABLE network ADD COLUMN ipv6 INTEGER NOT NULL DEFAULT 0;
+    `,
+	`
+    CREATE TABLE client_usage(
+        client_id TEXT NOT NULL,
+        network_id TEXT NOT NULL,
+        resolution INTEGER NOT NULL,
+        time INTEGER NOT NULL,
+        rx_bytes INTEGER NOT NULL DEFAULT 0,
+        rx_packets INTEGER NOT NULL DEFAULT 0,
+        tx_bytes INTEGER NOT NULL DEFAULT 0,
+        tx_packets INTEGER NOT NULL DEFAULT 0,
+        PRIMARY KEY(client_id, resolution, time, network_id)
+    );
+    CREATE INDEX client_usage_time ON client_usage(resolution, time);
+    `,
+	`
+    ALTER TABLE client ADD COLUMN upload_kbit INTEGER NOT NULL DEFAULT 0;
+    ALTER TABLE client ADD COLUMN download_kbit INTEGER NOT NULL DEFAULT 0;
+    ALTER TABLE client_group ADD COLUMN upload_kbit INTEGER NOT NULL DEFAULT 0;
+    ALTER TABLE client_group ADD COLUMN download_kbit INTEGER NOT NULL DEFAULT 0;
+    ALTER TABLE network ADD COLUMN upload_kbit INTEGER NOT NULL DEFAULT 0;
+    ALTER TABLE network ADD COLUMN download_kbit INTEGER NOT NULL DEFAULT 0;
+    `,
+	`
+    CREATE TABLE port_forward(
+        id TEXT NOT NULL PRIMARY KEY,
+        name TEXT NOT NULL,
+        network_id TEXT NOT NULL,
+        protocol TEXT NOT NULL,
+        external_port INTEGER NOT NULL,
+        client_id TEXT NOT NULL,
+        internal_port INTEGER NOT NULL,
+        UNIQUE(network_id, protocol, external_port),
+        FOREIGN KEY(network_id) REFERENCES network(id),
+        FOREIGN KEY(client_id) REFERENCES client(id)
+    );
+    `,
+	`
+    CREATE TABLE audit(
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        time INTEGER NOT NULL,
+        kind TEXT NOT NULL,
+        request_id TEXT NOT NULL DEFAULT '',
+        actor TEXT NOT NULL DEFAULT '',
+        action TEXT NOT NULL DEFAULT '',
+        resource TEXT NOT NULL DEFAULT '',
+        resource_id TEXT NOT NULL DEFAULT '',
+        path TEXT NOT NULL DEFAULT '',
+        code INTEGER,
+        before TEXT,
+        after TEXT,
+        command TEXT NOT NULL DEFAULT '',
+        exit_code INTEGER
+    );
+    CREATE INDEX audit_time ON audit(time);
+    `,
+	`
+    CREATE TABLE event(
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        time INTEGER NOT NULL,
+        type TEXT NOT NULL,
+        resource TEXT NOT NULL DEFAULT '',
+        resource_id TEXT NOT NULL DEFAULT '',
+        data TEXT
+    );
+    `,
+	`
+    CREATE TABLE webhook(
+        id TEXT NOT NULL PRIMARY KEY,
+        name TEXT NOT NULL,
+        url TEXT NOT NULL,
+        secret TEXT NOT NULL DEFAULT ''
+    );
+    CREATE TABLE webhook_event(
+        webhook_id TEXT NOT NULL,
+        type TEXT NOT NULL,
+        PRIMARY KEY(webhook_id, type),
+        FOREIGN KEY(webhook_id) REFERENCES webhook(id) ON DELETE CASCADE
+    );
+    CREATE TABLE webhook_resource(
+        webhook_id TEXT NOT NULL,
+        resource TEXT NOT NULL,
+        PRIMARY KEY(webhook_id, resource),
+        FOREIGN KEY(webhook_id) REFERENCES webhook(id) ON DELETE CASCADE
+    );
+    CREATE TABLE webhook_delivery(
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        webhook_id TEXT NOT NULL,
+        event_id INTEGER NOT NULL,
+        event_type TEXT NOT NULL,
+        payload TEXT NOT NULL,
+        status TEXT NOT NULL,
+        attempts INTEGER NOT NULL DEFAULT 0,
+        response_code INTEGER NOT NULL DEFAULT 0,
+        error TEXT NOT NULL DEFAULT '',
+        created INTEGER NOT NULL,
+        updated INTEGER NOT NULL,
+        next_attempt INTEGER NOT NULL,
+        FOREIGN KEY(webhook_id) REFERENCES webhook(id) ON DELETE CASCADE
+    );
+    CREATE INDEX webhook_delivery_due ON webhook_delivery(status, next_attempt);
+    `,
+	`
+    ALTER TABLE credential ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
+    ALTER TABLE credential ADD COLUMN created_at INTEGER NOT NULL DEFAULT 0;
+    ALTER TABLE credential ADD COLUMN updated_at INTEGER NOT NULL DEFAULT 0;
+    UPDATE credential SET created_at = strftime('%s', 'now') * 1000000000, updated_at = strftime('%s', 'now') * 1000000000;
+    ALTER TABLE config ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
+    ALTER TABLE config ADD COLUMN created_at INTEGER NOT NULL DEFAULT 0;
+    ALTER TABLE config ADD COLUMN updated_at INTEGER NOT NULL DEFAULT 0;
+    UPDATE config SET created_at = strftime('%s', 'now') * 1000000000, updated_at = strftime('%s', 'now') * 1000000000;
+    ALTER TABLE network ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
+    ALTER TABLE network ADD COLUMN created_at INTEGER NOT NULL DEFAULT 0;
+    ALTER TABLE network ADD COLUMN updated_at INTEGER NOT NULL DEFAULT 0;
+    UPDATE network SET created_at = strftime('%s', 'now') * 1000000000, updated_at = strftime('%s', 'now') * 1000000000;
+    ALTER TABLE client ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
+    ALTER TABLE client ADD COLUMN created_at INTEGER NOT NULL DEFAULT 0;
+    ALTER TABLE client ADD COLUMN updated_at INTEGER NOT NULL DEFAULT 0;
+    UPDATE client SET created_at = strftime('%s', 'now') * 1000000000, updated_at = strftime('%s', 'now') * 1000000000;
+    ALTER TABLE client_network ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
+    ALTER TABLE client_network ADD COLUMN created_at INTEGER NOT NULL DEFAULT 0;
+    ALTER TABLE client_network ADD COLUMN updated_at INTEGER NOT NULL DEFAULT 0;
+    UPDATE client_network SET created_at = strftime('%s', 'now') * 1000000000, updated_at = strftime('%s', 'now') * 1000000000;
+    ALTER TABLE dns_route ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
+    ALTER TABLE dns_route ADD COLUMN created_at INTEGER NOT NULL DEFAULT 0;
+    ALTER TABLE dns_route ADD COLUMN updated_at INTEGER NOT NULL DEFAULT 0;
+    UPDATE dns_route SET created_at = strftime('%s', 'now') * 1000000000, updated_at = strftime('%s', 'now') * 1000000000;
+    ALTER TABLE domain_route ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
+    ALTER TABLE domain_route ADD COLUMN created_at INTEGER NOT NULL DEFAULT 0;
+    ALTER TABLE domain_route ADD COLUMN updated_at INTEGER NOT NULL DEFAULT 0;
+    UPDATE domain_route SET created_at = strftime('%s', 'now') * 1000000000, updated_at = strftime('%s', 'now') * 1000000000;
+    ALTER TABLE policy ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
+    ALTER TABLE policy ADD COLUMN created_at INTEGER NOT NULL DEFAULT 0;
+    ALTER TABLE policy ADD COLUMN updated_at INTEGER NOT NULL DEFAULT 0;
+    UPDATE policy SET created_at = strftime('%s', 'now') * 1000000000, updated_at = strftime('%s', 'now') * 1000000000;
+    ALTER TABLE client_group ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
+    ALTER TABLE client_group ADD COLUMN created_at INTEGER NOT NULL DEFAULT 0;
+    ALTER TABLE client_group ADD COLUMN updated_at INTEGER NOT NULL DEFAULT 0;
+    UPDATE client_group SET created_at = strftime('%s', 'now') * 1000000000, updated_at = strftime('%s', 'now') * 1000000000;
+    ALTER TABLE client_group_network ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
+    ALTER TABLE client_group_network ADD COLUMN created_at INTEGER NOT NULL DEFAULT 0;
+    ALTER TABLE client_group_network ADD COLUMN updated_at INTEGER NOT NULL DEFAULT 0;
+    UPDATE client_group_network SET created_at = strftime('%s', 'now') * 1000000000, updated_at = strftime('%s', 'now') * 1000000000;
+    ALTER TABLE port_forward ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
+    ALTER TABLE port_forward ADD COLUMN created_at INTEGER NOT NULL DEFAULT 0;
+    ALTER TABLE port_forward ADD COLUMN updated_at INTEGER NOT NULL DEFAULT 0;
+    UPDATE port_forward SET created_at = strftime('%s', 'now') * 1000000000, updated_at = strftime('%s', 'now') * 1000000000;
+    ALTER TABLE webhook ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
+    ALTER TABLE webhook ADD COLUMN created_at INTEGER NOT NULL DEFAULT 0;
+    ALTER TABLE webhook ADD COLUMN updated_at INTEGER NOT NULL DEFAULT 0;
+    UPDATE webhook SET created_at = strftime('%s', 'now') * 1000000000, updated_at = strftime('%s', 'now') * 1000000000;
+    `,
+	`
+    CREATE TABLE schedule(
+        id TEXT NOT NULL PRIMARY KEY,
+        name TEXT NOT NULL,
+        client_id TEXT NOT NULL UNIQUE,
+        time_zone TEXT NOT NULL DEFAULT '',
+        default_network_id TEXT NOT NULL DEFAULT '',
+        version INTEGER NOT NULL DEFAULT 1,
+        created_at INTEGER NOT NULL DEFAULT 0,
+        updated_at INTEGER NOT NULL DEFAULT 0,
+        FOREIGN KEY(client_id) REFERENCES client(id)
+    );
+    CREATE TABLE schedule_window(
+        schedule_id TEXT NOT NULL,
+        position INTEGER NOT NULL,
+        days TEXT NOT NULL,
+        start_time TEXT NOT NULL,
+        end_time TEXT NOT NULL,
+        network_id TEXT NOT NULL DEFAULT '',
+        PRIMARY KEY(schedule_id, position),
+        FOREIGN KEY(schedule_id) REFERENCES schedule(id) ON DELETE CASCADE
+    );
+    `,
+	`
+    CREATE TABLE network_pool(
+        id TEXT NOT NULL PRIMARY KEY,
+        name TEXT NOT NULL,
+        version INTEGER NOT NULL DEFAULT 1,
+        created_at INTEGER NOT NULL DEFAULT 0,
+        updated_at INTEGER NOT NULL DEFAULT 0
+    );
+    CREATE TABLE network_pool_member(
+        pool_id TEXT NOT NULL,
+        network_id TEXT NOT NULL,
+        weight INTEGER NOT NULL,
+        position INTEGER NOT NULL,
+        PRIMARY KEY(pool_id, network_id),
+        FOREIGN KEY(pool_id) REFERENCES network_pool(id) ON DELETE CASCADE,
+        FOREIGN KEY(network_id) REFERENCES network(id)
+    );
+    CREATE TABLE network_pool_client(
+        client_id TEXT NOT NULL PRIMARY KEY,
+        pool_id TEXT NOT NULL,
+        FOREIGN KEY(client_id) REFERENCES client(id),
+        FOREIGN KEY(pool_id) REFERENCES network_pool(id) ON DELETE CASCADE
+    );
+    CREATE TABLE network_pool_group(
+        group_id TEXT NOT NULL PRIMARY KEY,
+        pool_id TEXT NOT NULL,
+        FOREIGN KEY(group_id) REFERENCES client_group(id),
+        FOREIGN KEY(pool_id) REFERENCES network_pool(id) ON DELETE CASCADE
+    );
+    `,
+	`
+    ALTER TABLE client ADD COLUMN kill_switch TEXT NOT NULL DEFAULT 'strict';
+    CREATE TABLE client_wan_allow(
+        client_id TEXT NOT NULL,
+        position INTEGER NOT NULL,
+        destination TEXT NOT NULL,
+        protocol TEXT NOT NULL DEFAULT '',
+        ports TEXT NOT NULL DEFAULT '',
+        PRIMARY KEY(client_id, position),
+        FOREIGN KEY(client_id) REFERENCES client(id)
+    );
+    `,
+	`
+    ALTER TABLE network ADD COLUMN route_table_id INTEGER NOT NULL DEFAULT 0;
+    ALTER TABLE network ADD COLUMN fwmark INTEGER NOT NULL DEFAULT 0;
+    CREATE UNIQUE INDEX network_route_table_id ON network(route_table_id) WHERE route_table_id != 0;
     `,
 }
@@ -0,0 +1,178 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Meta is the version of a resource and the times at which it was created
+// and last updated. The version starts at 1 and is incremented by every
+// update, so that clients can detect concurrent changes.
+type Meta struct {
+	Version   int64     `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ETag returns the entity tag of the version of a resource, or the empty
+// string if it has none.
+func (m Meta) ETag() string {
+	if m.Version == 0 {
+		return ""
+	}
+	return strconv.Quote(strconv.FormatInt(m.Version, 10))
+}
+
+// newMeta returns the metadata of a resource created now.
+func newMeta() Meta {
+	now := time.Now().UTC().Round(0)
+	return Meta{
+		Version:   1,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+}
+
+// metaColumns are the columns of the metadata of a resource, which follow
+// the other columns of a row in queries.
+const metaColumns = "version, created_at, updated_at"
+
+// withMeta appends the destinations into which metaColumns are scanned to
+// dest.
+func withMeta(meta *Meta, dest ...interface{}) []interface{} {
+	return append(dest, &meta.Version, (*unixNano)(&meta.CreatedAt), (*unixNano)(&meta.UpdatedAt))
+}
+
+// withMetaValues appends the values of metaColumns to args.
+func withMetaValues(meta Meta, args ...interface{}) []interface{} {
+	return append(args, meta.Version, meta.CreatedAt.UnixNano(), meta.UpdatedAt.UnixNano())
+}
+
+// unixNano scans a time stored as nanoseconds since the epoch.
+type unixNano time.Time
+
+func (t *unixNano) Scan(src interface{}) error {
+	n, ok := src.(int64)
+	if !ok {
+		return fmt.Errorf("unsupported time %T", src)
+	}
+	*t = unixNano(time.Unix(0, n).UTC())
+	return nil
+}
+
+// tables are the tables in which the resources served by the API, named
+// like Dependent.Resource, are stored.
+var tables = map[string]string{
+	"credential":     "credential",
+	"config":         "config",
+	"network":        "network",
+	"client":         "client",
+	"client/network": "client_network",
+	"dns":            "dns_route",
+	"domain":         "domain_route",
+	"policy":         "policy",
+	"group":          "client_group",
+	"group/network":  "client_group_network",
+	"forward":        "port_forward",
+	"webhook":        "webhook",
+	"schedule":       "schedule",
+	"pool":           "network_pool",
+}
+
+// precondition is the version which the resource with the given ID must
+// have for a write to it to succeed.
+type precondition struct {
+	table    string
+	id       string
+	versions []int64
+}
+
+type preconditionKey struct{}
+
+// ExpectVersion returns a context in which updates and deletes of the
+// resource of the given kind and ID fail with ErrVersionMismatch unless
+// its current version is one of versions. Writes to other resources, e.g.
+// those cascading from the write, are unaffected.
+func ExpectVersion(ctx context.Context, resource, id string, versions ...int64) context.Context {
+	return context.WithValue(ctx, preconditionKey{}, &precondition{
+		table:    tables[resource],
+		id:       id,
+		versions: versions,
+	})
+}
+
+// versionCondition returns the condition which the row of the given table
+// and ID must satisfy to be written in ctx, if any, and its arguments.
+func versionCondition(ctx context.Context, table, id string) (string, []interface{}) {
+	p, ok := ctx.Value(preconditionKey{}).(*precondition)
+	if !ok || p.table != table || p.id != id {
+		return "", nil
+	}
+	if len(p.versions) == 0 {
+		return " AND 0", nil
+	}
+	args := make([]interface{}, len(p.versions))
+	for i, v := range p.versions {
+		args[i] = v
+	}
+	return " AND version IN (?" + strings.Repeat(", ?", len(args)-1) + ")", args
+}
+
+type execQuerier interface {
+	querier
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// missing returns the reason no row of the given table and ID was
+// written: either there is none, or it doesn't have the expected version.
+func missing(ctx context.Context, q execQuerier, table, key, id string) error {
+	var exists bool
+	query := fmt.Sprintf("SELECT EXISTS(SELECT 1 FROM %s WHERE %s = ?)", table, key)
+	if err := q.QueryRowContext(ctx, query, id).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return ErrVersionMismatch
+	}
+	return ErrNotFound
+}
+
+// update assigns the columns of the row of table whose key is id, with
+// set, a list of assignments whose arguments are args. It increments the
+// version of the row and fills meta with its metadata after the update.
+func update(ctx context.Context, q execQuerier, table, key, id string, meta *Meta, set string, args ...interface{}) error {
+	query := fmt.Sprintf("UPDATE %s SET %s, version = version + 1, updated_at = ? WHERE %s = ?", table, set, key)
+	args = append(args, time.Now().UnixNano(), id)
+	condition, conditionArgs := versionCondition(ctx, table, id)
+	query += condition + " RETURNING " + metaColumns
+
+	err := q.QueryRowContext(ctx, query, append(args, conditionArgs...)...).Scan(withMeta(meta)...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return missing(ctx, q, table, key, id)
+	}
+	return writeError(err)
+}
+
+// remove deletes the row of table whose key is id.
+func remove(ctx context.Context, q execQuerier, table, key, id string) error {
+	condition, args := versionCondition(ctx, table, id)
+	query := fmt.Sprintf("DELETE FROM %s WHERE %s = ?", table, key) + condition
+	result, err := q.ExecContext(ctx, query, append([]interface{}{id}, args...)...)
+	if err != nil {
+		return deleteError(err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows != int64(1) {
+		return missing(ctx, q, table, key, id)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package database_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pricec/vpnmux/pkg/database"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVersions(t *testing.T) {
+	ctx := context.Background()
+	h, err := NewHarness(ctx, HarnessOptions{
+		NumClients:  1,
+		NumNetworks: 1,
+	})
+	require.Nil(t, err)
+	defer h.Close()
+
+	client := h.Clients[0]
+	require.Equal(t, int64(1), client.Version)
+	require.False(t, client.CreatedAt.IsZero())
+	require.Equal(t, client.CreatedAt, client.UpdatedAt)
+	require.Equal(t, `"1"`, client.ETag())
+
+	got, err := h.DB.Clients.Get(ctx, client.ID)
+	require.Nil(t, err)
+	require.Equal(t, client.Meta, got.Meta)
+
+	got.Name = "renamed"
+	require.Nil(t, h.DB.Clients.Update(ctx, got))
+	require.Equal(t, int64(2), got.Version)
+	require.Equal(t, client.CreatedAt, got.CreatedAt)
+	require.True(t, got.UpdatedAt.After(client.UpdatedAt))
+
+	// Updates and deletes expecting a stale version fail, and leave the
+	// client unchanged.
+	stale := database.ExpectVersion(ctx, "client", client.ID, 1)
+	got.Name = "stale"
+	require.ErrorIs(t, h.DB.Clients.Update(stale, got), database.ErrVersionMismatch)
+	require.ErrorIs(t, h.DB.Clients.Delete(stale, client.ID), database.ErrVersionMismatch)
+	got, err = h.DB.Clients.Get(ctx, client.ID)
+	require.Nil(t, err)
+	require.Equal(t, "renamed", got.Name)
+	require.Equal(t, int64(2), got.Version)
+
+	// Any of several versions may be expected.
+	current := database.ExpectVersion(ctx, "client", client.ID, 1, 2)
+	got.Name = "current"
+	require.Nil(t, h.DB.Clients.Update(current, got))
+	require.Equal(t, int64(3), got.Version)
+
+	// Other resources are written regardless of the expected version.
+	cn := &database.ClientNetwork{ClientID: client.ID, NetworkID: h.Networks[0].ID}
+	_, err = h.DB.ClientNetworks.Put(stale, cn)
+	require.Nil(t, err)
+	require.Nil(t, h.DB.ClientNetworks.Update(stale, cn))
+	require.Equal(t, int64(2), cn.Version)
+	require.Nil(t, h.DB.ClientNetworks.Delete(stale, client.ID))
+
+	missing := database.ExpectVersion(ctx, "client", "missing", 1)
+	require.ErrorIs(t, h.DB.Clients.Delete(missing, "missing"), database.ErrNotFound)
+
+	require.Nil(t, h.DB.Clients.Delete(database.ExpectVersion(ctx, "client", client.ID, 3), client.ID))
+}
+
+func TestGroupNetworkVersions(t *testing.T) {
+	ctx := context.Background()
+	h, err := NewHarness(ctx, HarnessOptions{
+		NumNetworks: 2,
+	})
+	require.Nil(t, err)
+	defer h.Close()
+
+	group, err := h.DB.ClientGroups.Put(ctx, &database.ClientGroup{Name: "g"})
+	require.Nil(t, err)
+	require.Equal(t, int64(1), group.Version)
+
+	gn, err := h.DB.GroupNetworks.Put(ctx, &database.ClientGroupNetwork{GroupID: group.ID, NetworkID: h.Networks[0].ID})
+	require.Nil(t, err)
+	require.Equal(t, int64(1), gn.Version)
+
+	// Reassigning the group updates its assignment.
+	gn, err = h.DB.GroupNetworks.Put(ctx, &database.ClientGroupNetwork{GroupID: group.ID, NetworkID: h.Networks[1].ID})
+	require.Nil(t, err)
+	require.Equal(t, int64(2), gn.Version)
+
+	stale := database.ExpectVersion(ctx, "group/network", group.ID, 1)
+	require.ErrorIs(t, h.DB.GroupNetworks.Delete(stale, group.ID), database.ErrVersionMismatch)
+	require.Nil(t, h.DB.GroupNetworks.Delete(ctx, group.ID))
+
+	group.Name = "renamed"
+	require.ErrorIs(t, h.DB.ClientGroups.Update(database.ExpectVersion(ctx, "group", group.ID, 2), group), database.ErrVersionMismatch)
+	require.Nil(t, h.DB.ClientGroups.Update(database.ExpectVersion(ctx, "group", group.ID, 1), group))
+	require.Equal(t, int64(2), group.Version)
+}
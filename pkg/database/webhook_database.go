@@ -0,0 +1,305 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type WebhookDatabase struct {
+	db *sql.DB
+}
+
+// Webhook receives the events of the given types concerning the given
+// resources, e.g. "update" events of "credential"s; no types or resources
+// match every event. Payloads are signed with the secret, and are not sent
+// without one.
+type Webhook struct {
+	ID        string   `json:"id"`
+	Name      string   `json:"name"`
+	URL       string   `json:"url"`
+	Secret    string   `json:"secret,omitempty"`
+	Events    []string `json:"events"`
+	Resources []string `json:"resources"`
+	Meta
+}
+
+// Matches returns true iff the webhook receives events of the given type
+// concerning the given resource.
+func (w *Webhook) Matches(eventType, resource string) bool {
+	return matchAny(w.Events, eventType) && matchAny(w.Resources, resource)
+}
+
+func matchAny(values []string, s string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Delivery statuses.
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// WebhookDelivery is an attempt to deliver an event to a webhook, which is
+// retried while pending.
+type WebhookDelivery struct {
+	ID           int64           `json:"id"`
+	WebhookID    string          `json:"webhook_id"`
+	EventID      int64           `json:"event_id"`
+	EventType    string          `json:"event_type"`
+	Payload      json.RawMessage `json:"payload"`
+	Status       string          `json:"status"`
+	Attempts     int             `json:"attempts"`
+	ResponseCode int             `json:"response_code,omitempty"`
+	Error        string          `json:"error,omitempty"`
+	Created      time.Time       `json:"created"`
+	Updated      time.Time       `json:"updated"`
+	NextAttempt  time.Time       `json:"next_attempt"`
+}
+
+func (d *WebhookDatabase) List(ctx context.Context) ([]*Webhook, error) {
+	rows, err := d.db.QueryContext(ctx, "SELECT id, name, url, secret, "+metaColumns+" FROM webhook ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var webhooks = make([]*Webhook, 0)
+	for rows.Next() {
+		w := &Webhook{}
+		if err := rows.Scan(withMeta(&w.Meta, &w.ID, &w.Name, &w.URL, &w.Secret)...); err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, w)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, w := range webhooks {
+		if err := d.populate(ctx, w); err != nil {
+			return nil, err
+		}
+	}
+	return webhooks, nil
+}
+
+func (d *WebhookDatabase) Get(ctx context.Context, id string) (*Webhook, error) {
+	row := d.db.QueryRowContext(ctx, "SELECT id, name, url, secret, "+metaColumns+" FROM webhook WHERE id = ?", id)
+	w := &Webhook{}
+	err := row.Scan(withMeta(&w.Meta, &w.ID, &w.Name, &w.URL, &w.Secret)...)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return nil, ErrNotFound
+	case err != nil:
+		return nil, err
+	}
+
+	if err := d.populate(ctx, w); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (d *WebhookDatabase) populate(ctx context.Context, w *Webhook) error {
+	var err error
+	w.Events, err = queryStrings(ctx, d.db, "SELECT type FROM webhook_event WHERE webhook_id = ? ORDER BY type", w.ID)
+	if err != nil {
+		return err
+	}
+	w.Resources, err = queryStrings(ctx, d.db, "SELECT resource FROM webhook_resource WHERE webhook_id = ? ORDER BY resource", w.ID)
+	return err
+}
+
+func queryStrings(ctx context.Context, db *sql.DB, query string, args ...interface{}) ([]string, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result = make([]string, 0)
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return nil, err
+		}
+		result = append(result, s)
+	}
+	return result, rows.Err()
+}
+
+func (d *WebhookDatabase) Put(ctx context.Context, w *Webhook) (*Webhook, error) {
+	id := uuid.New()
+	meta := newMeta()
+
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "INSERT INTO webhook(id, name, url, secret, "+metaColumns+") VALUES(?, ?, ?, ?, ?, ?, ?)", withMetaValues(meta, id, w.Name, w.URL, w.Secret)...); err != nil {
+		return nil, err
+	}
+	if err := putWebhookFilters(ctx, tx, id.String(), w); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	w.ID = id.String()
+	w.Meta = meta
+	return w, nil
+}
+
+// Update changes a webhook; its secret is only changed if one is given.
+func (d *WebhookDatabase) Update(ctx context.Context, w *Webhook) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := update(ctx, tx, "webhook", "id", w.ID, &w.Meta, "name = ?, url = ?, secret = CASE WHEN ? = '' THEN secret ELSE ? END", w.Name, w.URL, w.Secret, w.Secret); err != nil {
+		return err
+	}
+
+	for _, statement := range []string{
+		"DELETE FROM webhook_event WHERE webhook_id = ?",
+		"DELETE FROM webhook_resource WHERE webhook_id = ?",
+	} {
+		if _, err := tx.ExecContext(ctx, statement, w.ID); err != nil {
+			return err
+		}
+	}
+	if err := putWebhookFilters(ctx, tx, w.ID, w); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func putWebhookFilters(ctx context.Context, tx *sql.Tx, id string, w *Webhook) error {
+	for _, typ := range w.Events {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO webhook_event(webhook_id, type) VALUES(?, ?)", id, typ); err != nil {
+			return err
+		}
+	}
+	for _, resource := range w.Resources {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO webhook_resource(webhook_id, resource) VALUES(?, ?)", id, resource); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete deletes a webhook, its filters and its deliveries.
+func (d *WebhookDatabase) Delete(ctx context.Context, id string) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, statement := range []string{
+		"DELETE FROM webhook_event WHERE webhook_id = ?",
+		"DELETE FROM webhook_resource WHERE webhook_id = ?",
+		"DELETE FROM webhook_delivery WHERE webhook_id = ?",
+	} {
+		if _, err := tx.ExecContext(ctx, statement, id); err != nil {
+			return err
+		}
+	}
+
+	if err := remove(ctx, tx, "webhook", "id", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+const webhookDeliveryColumns = "id, webhook_id, event_id, event_type, payload, status, attempts, response_code, error, created, updated, next_attempt"
+
+func scanWebhookDelivery(row interface{ Scan(...interface{}) error }) (*WebhookDelivery, error) {
+	d := &WebhookDelivery{}
+	var payload string
+	var created, updated, next int64
+	err := row.Scan(&d.ID, &d.WebhookID, &d.EventID, &d.EventType, &payload, &d.Status, &d.Attempts, &d.ResponseCode, &d.Error, &created, &updated, &next)
+	if err != nil {
+		return nil, err
+	}
+	d.Payload = json.RawMessage(payload)
+	d.Created = time.Unix(0, created).UTC()
+	d.Updated = time.Unix(0, updated).UTC()
+	d.NextAttempt = time.Unix(0, next).UTC()
+	return d, nil
+}
+
+func (d *WebhookDatabase) deliveries(ctx context.Context, query string, args ...interface{}) ([]*WebhookDelivery, error) {
+	rows, err := d.db.QueryContext(ctx, "SELECT "+webhookDeliveryColumns+" FROM webhook_delivery "+query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result = make([]*WebhookDelivery, 0)
+	for rows.Next() {
+		delivery, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, delivery)
+	}
+	return result, rows.Err()
+}
+
+// AddDelivery queues a delivery, to be attempted at its NextAttempt.
+func (d *WebhookDatabase) AddDelivery(ctx context.Context, delivery *WebhookDelivery) error {
+	result, err := d.db.ExecContext(ctx, "INSERT INTO webhook_delivery(webhook_id, event_id, event_type, payload, status, attempts, response_code, error, created, updated, next_attempt) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		delivery.WebhookID, delivery.EventID, delivery.EventType, string(delivery.Payload), delivery.Status, delivery.Attempts, delivery.ResponseCode, delivery.Error,
+		delivery.Created.UnixNano(), delivery.Updated.UnixNano(), delivery.NextAttempt.UnixNano())
+	if err != nil {
+		return err
+	}
+	delivery.ID, err = result.LastInsertId()
+	return err
+}
+
+// UpdateDelivery records the outcome of an attempt.
+func (d *WebhookDatabase) UpdateDelivery(ctx context.Context, delivery *WebhookDelivery) error {
+	_, err := d.db.ExecContext(ctx, "UPDATE webhook_delivery SET status = ?, attempts = ?, response_code = ?, error = ?, updated = ?, next_attempt = ? WHERE id = ?",
+		delivery.Status, delivery.Attempts, delivery.ResponseCode, delivery.Error, delivery.Updated.UnixNano(), delivery.NextAttempt.UnixNano(), delivery.ID)
+	return err
+}
+
+// DueDeliveries returns the pending deliveries due to be attempted by now,
+// oldest first.
+func (d *WebhookDatabase) DueDeliveries(ctx context.Context, now time.Time) ([]*WebhookDelivery, error) {
+	return d.deliveries(ctx, "WHERE status = ? AND next_attempt <= ? ORDER BY id", DeliveryPending, now.UnixNano())
+}
+
+// Deliveries returns the most recent deliveries to a webhook, newest
+// first.
+func (d *WebhookDatabase) Deliveries(ctx context.Context, webhookID string, limit int) ([]*WebhookDelivery, error) {
+	return d.deliveries(ctx, "WHERE webhook_id = ? ORDER BY id DESC LIMIT ?", webhookID, limit)
+}
+
+// PruneDeliveries deletes the deliveries which are no longer pending and
+// were last attempted before the given time.
+func (d *WebhookDatabase) PruneDeliveries(ctx context.Context, before time.Time) error {
+	_, err := d.db.ExecContext(ctx, "DELETE FROM webhook_delivery WHERE status != ? AND updated < ?", DeliveryPending, before.UnixNano())
+	return err
+}
@@ -0,0 +1,93 @@
+package database_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/pricec/vpnmux/pkg/database"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhook(t *testing.T) {
+	ctx := context.Background()
+	h, err := NewHarness(ctx, HarnessOptions{})
+	require.Nil(t, err)
+	defer h.Close()
+
+	w, err := h.DB.Webhooks.Put(ctx, &database.Webhook{
+		Name:      "alerts",
+		URL:       "https://example.com/hook",
+		Secret:    "s3cret",
+		Events:    []string{"network_state", "update"},
+		Resources: []string{"network", "credential"},
+	})
+	require.Nil(t, err)
+
+	got, err := h.DB.Webhooks.Get(ctx, w.ID)
+	require.Nil(t, err)
+	require.Equal(t, "s3cret", got.Secret)
+	require.Equal(t, []string{"network_state", "update"}, got.Events)
+	require.Equal(t, []string{"credential", "network"}, got.Resources)
+	require.True(t, got.Matches("update", "credential"))
+	require.False(t, got.Matches("delete", "credential"))
+	require.False(t, got.Matches("update", "client"))
+
+	// The secret is kept unless a new one is given.
+	got.Secret = ""
+	got.Events = nil
+	require.Nil(t, h.DB.Webhooks.Update(ctx, got))
+	got, err = h.DB.Webhooks.Get(ctx, w.ID)
+	require.Nil(t, err)
+	require.Equal(t, "s3cret", got.Secret)
+	require.Empty(t, got.Events)
+	require.True(t, got.Matches("delete", "credential"))
+
+	list, err := h.DB.Webhooks.List(ctx)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(list))
+
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	d := &database.WebhookDelivery{
+		WebhookID:   w.ID,
+		EventID:     1,
+		EventType:   "update",
+		Payload:     json.RawMessage(`{"id":1}`),
+		Status:      database.DeliveryPending,
+		Created:     now,
+		Updated:     now,
+		NextAttempt: now.Add(time.Minute),
+	}
+	require.Nil(t, h.DB.Webhooks.AddDelivery(ctx, d))
+
+	due, err := h.DB.Webhooks.DueDeliveries(ctx, now)
+	require.Nil(t, err)
+	require.Empty(t, due)
+	due, err = h.DB.Webhooks.DueDeliveries(ctx, now.Add(time.Minute))
+	require.Nil(t, err)
+	require.Equal(t, 1, len(due))
+	require.JSONEq(t, `{"id":1}`, string(due[0].Payload))
+
+	d.Status = database.DeliveryDelivered
+	d.Attempts = 1
+	d.ResponseCode = 204
+	d.Updated = now.Add(time.Minute)
+	require.Nil(t, h.DB.Webhooks.UpdateDelivery(ctx, d))
+
+	deliveries, err := h.DB.Webhooks.Deliveries(ctx, w.ID, 10)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(deliveries))
+	require.Equal(t, 204, deliveries[0].ResponseCode)
+	require.Equal(t, now.Add(time.Minute), deliveries[0].Updated)
+
+	require.Nil(t, h.DB.Webhooks.PruneDeliveries(ctx, now.Add(time.Hour)))
+	deliveries, err = h.DB.Webhooks.Deliveries(ctx, w.ID, 10)
+	require.Nil(t, err)
+	require.Empty(t, deliveries)
+
+	require.Nil(t, h.DB.Webhooks.Delete(ctx, w.ID))
+	_, err = h.DB.Webhooks.Get(ctx, w.ID)
+	require.Equal(t, database.ErrNotFound, err)
+	require.Equal(t, database.ErrNotFound, h.DB.Webhooks.Delete(ctx, w.ID))
+}
@@ -0,0 +1,183 @@
+package dns
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+type cacheKey struct {
+	Name  string
+	Type  dnsmessage.Type
+	Class dnsmessage.Class
+}
+
+type cacheEntry struct {
+	key     cacheKey
+	msg     dnsmessage.Message
+	stored  time.Time
+	expires time.Time
+}
+
+type CacheStats struct {
+	Entries int    `json:"entries"`
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
+}
+
+// Cache is a fixed-size, least-recently-used cache of DNS responses keyed
+// by question. Entries expire after the smallest TTL in the response.
+type Cache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[cacheKey]*list.Element
+	lru     *list.List
+	hits    uint64
+	misses  uint64
+}
+
+// NewCache returns a cache holding at most size responses. A size of zero
+// disables caching.
+func NewCache(size int) *Cache {
+	return &Cache{
+		size:    size,
+		entries: make(map[cacheKey]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func keyFor(q dnsmessage.Question) cacheKey {
+	return cacheKey{
+		Name:  strings.ToLower(q.Name.String()),
+		Type:  q.Type,
+		Class: q.Class,
+	}
+}
+
+// Get returns a copy of the cached response to q, with TTLs reduced by the
+// time spent in the cache.
+func (c *Cache) Get(q dnsmessage.Question, now time.Time) (*dnsmessage.Message, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[keyFor(q)]
+	if !ok {
+		c.misses += 1
+		return nil, false
+	}
+
+	entry := elem.Value.(*cacheEntry)
+	if !now.Before(entry.expires) {
+		c.remove(elem)
+		c.misses += 1
+		return nil, false
+	}
+
+	c.lru.MoveToFront(elem)
+	c.hits += 1
+
+	elapsed := uint32(now.Sub(entry.stored) / time.Second)
+	msg := entry.msg
+	msg.Answers = ageResources(entry.msg.Answers, elapsed)
+	msg.Authorities = ageResources(entry.msg.Authorities, elapsed)
+	msg.Additionals = ageResources(entry.msg.Additionals, elapsed)
+	return &msg, true
+}
+
+// Put stores msg as the response to q. Responses which are not cacheable
+// (errors other than NXDOMAIN, truncated responses, or responses without
+// any TTL) are ignored.
+func (c *Cache) Put(q dnsmessage.Question, msg *dnsmessage.Message, now time.Time) {
+	if c.size <= 0 {
+		return
+	}
+
+	ttl, ok := cacheTTL(msg)
+	if !ok {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := keyFor(q)
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+
+	entry := &cacheEntry{
+		key:     key,
+		msg:     *msg,
+		stored:  now,
+		expires: now.Add(time.Duration(ttl) * time.Second),
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *Cache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return CacheStats{
+		Entries: c.lru.Len(),
+		Hits:    c.hits,
+		Misses:  c.misses,
+	}
+}
+
+func (c *Cache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.key)
+}
+
+func cacheTTL(msg *dnsmessage.Message) (uint32, bool) {
+	if msg.Truncated {
+		return 0, false
+	}
+
+	switch msg.RCode {
+	case dnsmessage.RCodeSuccess, dnsmessage.RCodeNameError:
+	default:
+		return 0, false
+	}
+
+	found := false
+	var ttl uint32
+	for _, rrs := range [][]dnsmessage.Resource{msg.Answers, msg.Authorities} {
+		for _, rr := range rrs {
+			if !found || rr.Header.TTL < ttl {
+				ttl = rr.Header.TTL
+				found = true
+			}
+		}
+	}
+	return ttl, found && ttl > 0
+}
+
+func ageResources(rrs []dnsmessage.Resource, elapsed uint32) []dnsmessage.Resource {
+	if len(rrs) == 0 {
+		return rrs
+	}
+
+	result := make([]dnsmessage.Resource, len(rrs))
+	for i, rr := range rrs {
+		result[i] = rr
+		if rr.Header.Type == dnsmessage.TypeOPT {
+			// the TTL field of an OPT record holds flags
+			continue
+		}
+		if rr.Header.TTL > elapsed {
+			result[i].Header.TTL = rr.Header.TTL - elapsed
+		} else {
+			result[i].Header.TTL = 0
+		}
+	}
+	return result
+}
@@ -0,0 +1,103 @@
+package dns_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pricec/vpnmux/pkg/dns"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func question(name string) dnsmessage.Question {
+	return dnsmessage.Question{
+		Name:  dnsmessage.MustNewName(name),
+		Type:  dnsmessage.TypeA,
+		Class: dnsmessage.ClassINET,
+	}
+}
+
+func answer(q dnsmessage.Question, ttl uint32) *dnsmessage.Message {
+	return &dnsmessage.Message{
+		Header:    dnsmessage.Header{Response: true},
+		Questions: []dnsmessage.Question{q},
+		Answers: []dnsmessage.Resource{
+			{
+				Header: dnsmessage.ResourceHeader{
+					Name:  q.Name,
+					Type:  dnsmessage.TypeA,
+					Class: dnsmessage.ClassINET,
+					TTL:   ttl,
+				},
+				Body: &dnsmessage.AResource{A: [4]byte{10, 0, 0, 1}},
+			},
+		},
+	}
+}
+
+func TestCacheExpiry(t *testing.T) {
+	now := time.Now()
+	c := dns.NewCache(10)
+	q := question("example.com.")
+
+	_, ok := c.Get(q, now)
+	require.False(t, ok)
+
+	c.Put(q, answer(q, 60), now)
+
+	msg, ok := c.Get(question("EXAMPLE.com."), now.Add(10*time.Second))
+	require.True(t, ok)
+	require.Equal(t, uint32(50), msg.Answers[0].Header.TTL)
+
+	_, ok = c.Get(q, now.Add(60*time.Second))
+	require.False(t, ok)
+
+	stats := c.Stats()
+	require.Equal(t, uint64(1), stats.Hits)
+	require.Equal(t, uint64(2), stats.Misses)
+	require.Equal(t, 0, stats.Entries)
+}
+
+func TestCacheEviction(t *testing.T) {
+	now := time.Now()
+	c := dns.NewCache(2)
+	q1 := question("one.example.com.")
+	q2 := question("two.example.com.")
+	q3 := question("three.example.com.")
+
+	c.Put(q1, answer(q1, 60), now)
+	c.Put(q2, answer(q2, 60), now)
+
+	// touch q1 so that q2 is the least recently used
+	_, ok := c.Get(q1, now)
+	require.True(t, ok)
+
+	c.Put(q3, answer(q3, 60), now)
+	require.Equal(t, 2, c.Stats().Entries)
+
+	_, ok = c.Get(q2, now)
+	require.False(t, ok)
+	_, ok = c.Get(q1, now)
+	require.True(t, ok)
+	_, ok = c.Get(q3, now)
+	require.True(t, ok)
+}
+
+func TestCacheUncacheable(t *testing.T) {
+	now := time.Now()
+	c := dns.NewCache(10)
+	q := question("example.com.")
+
+	msg := answer(q, 60)
+	msg.RCode = dnsmessage.RCodeServerFailure
+	c.Put(q, msg, now)
+
+	msg = answer(q, 0)
+	c.Put(q, msg, now)
+
+	disabled := dns.NewCache(0)
+	disabled.Put(q, answer(q, 60), now)
+
+	require.Equal(t, 0, c.Stats().Entries)
+	require.Equal(t, 0, disabled.Stats().Entries)
+}
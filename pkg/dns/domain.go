@@ -0,0 +1,79 @@
+package dns
+
+import (
+	"net"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Address is an IP address found in the answer to a query for Name.
+type Address struct {
+	Name string
+	IP   net.IP
+	TTL  uint32
+}
+
+// NormalizeDomain lower-cases a domain name or pattern and strips any
+// trailing dot.
+func NormalizeDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(domain), ".")
+}
+
+// ValidDomainPattern returns true iff pattern is a domain name, optionally
+// prefixed with "*." to match its subdomains.
+func ValidDomainPattern(pattern string) bool {
+	name := strings.TrimPrefix(NormalizeDomain(pattern), "*.")
+	if name == "" || len(name) > 253 {
+		return false
+	}
+
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || strings.Contains(label, "*") {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchDomain returns true iff name matches pattern. A pattern of the form
+// "*.example.com" matches any subdomain of example.com but not example.com
+// itself; any other pattern must equal name.
+func MatchDomain(pattern, name string) bool {
+	pattern = NormalizeDomain(pattern)
+	name = NormalizeDomain(name)
+
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(name, pattern[1:])
+	}
+	return pattern == name
+}
+
+// Addresses returns the A and AAAA records in the answer section of msg.
+// Records reached through CNAMEs are attributed to the queried name.
+func Addresses(msg *dnsmessage.Message) []Address {
+	if len(msg.Questions) == 0 {
+		return nil
+	}
+	name := NormalizeDomain(msg.Questions[0].Name.String())
+
+	var result []Address
+	for _, rr := range msg.Answers {
+		var ip net.IP
+		switch body := rr.Body.(type) {
+		case *dnsmessage.AResource:
+			ip = net.IP(body.A[:])
+		case *dnsmessage.AAAAResource:
+			ip = net.IP(body.AAAA[:])
+		default:
+			continue
+		}
+
+		result = append(result, Address{
+			Name: name,
+			IP:   ip,
+			TTL:  rr.Header.TTL,
+		})
+	}
+	return result
+}
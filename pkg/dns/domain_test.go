@@ -0,0 +1,54 @@
+package dns_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/pricec/vpnmux/pkg/dns"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestMatchDomain(t *testing.T) {
+	require.True(t, dns.MatchDomain("example.com", "example.com."))
+	require.True(t, dns.MatchDomain("example.com", "EXAMPLE.COM"))
+	require.False(t, dns.MatchDomain("example.com", "www.example.com"))
+
+	require.True(t, dns.MatchDomain("*.example.com", "www.example.com"))
+	require.True(t, dns.MatchDomain("*.example.com", "a.b.example.com."))
+	require.False(t, dns.MatchDomain("*.example.com", "example.com"))
+	require.False(t, dns.MatchDomain("*.example.com", "badexample.com"))
+}
+
+func TestValidDomainPattern(t *testing.T) {
+	require.True(t, dns.ValidDomainPattern("example.com"))
+	require.True(t, dns.ValidDomainPattern("*.example.com"))
+	require.True(t, dns.ValidDomainPattern("example.com."))
+
+	require.False(t, dns.ValidDomainPattern(""))
+	require.False(t, dns.ValidDomainPattern("*."))
+	require.False(t, dns.ValidDomainPattern("www.*.example.com"))
+	require.False(t, dns.ValidDomainPattern("example..com"))
+}
+
+func TestAddresses(t *testing.T) {
+	q := question("www.example.com.")
+	msg := answer(q, 60)
+	msg.Answers = append([]dnsmessage.Resource{
+		{
+			Header: dnsmessage.ResourceHeader{
+				Name:  q.Name,
+				Type:  dnsmessage.TypeCNAME,
+				Class: dnsmessage.ClassINET,
+				TTL:   300,
+			},
+			Body: &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName("cdn.example.net.")},
+		},
+	}, msg.Answers...)
+
+	addrs := dns.Addresses(msg)
+	require.Equal(t, 1, len(addrs))
+	require.Equal(t, "www.example.com", addrs[0].Name)
+	require.True(t, net.ParseIP("10.0.0.1").Equal(addrs[0].IP))
+	require.Equal(t, uint32(60), addrs[0].TTL)
+}
@@ -0,0 +1,419 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/pricec/vpnmux/pkg/logging"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const maxMessageSize = 65535
+
+var ErrNoUpstreams = fmt.Errorf("no upstream DNS servers")
+
+type ForwarderOptions struct {
+	// Address (host:port) on which to listen for queries, over both
+	// UDP and TCP.
+	Listen string
+	// Upstream servers to use when Refresh returns none. Entries without
+	// a port use port 53.
+	Upstreams []string
+	// If nonzero, firewall mark applied to upstream sockets so that the
+	// queries may be policy routed.
+	Mark int
+	// Maximum number of cached responses; zero disables caching.
+	CacheSize int
+	// Timeout for each upstream exchange.
+	Timeout time.Duration
+	// If set, called every RefreshInterval to discover upstream servers
+	// (e.g. those pushed by an OpenVPN server).
+	Refresh         func() ([]string, error)
+	RefreshInterval time.Duration
+	// If set, called with every response returned to a client.
+	Observe func(*dnsmessage.Message)
+}
+
+type ForwarderStatus struct {
+	Listen    string     `json:"listen"`
+	Upstreams []string   `json:"upstreams"`
+	Cache     CacheStats `json:"cache"`
+}
+
+// Forwarder is a caching DNS forwarder which relays each query to the
+// first responsive upstream server.
+type Forwarder struct {
+	opts  ForwarderOptions
+	cache *Cache
+	udp   net.PacketConn
+	tcp   net.Listener
+	log   *logging.Logger
+
+	mu        sync.RWMutex
+	upstreams []string
+	preferred int
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewForwarder(opts ForwarderOptions) (*Forwarder, error) {
+	if opts.Timeout == 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	if opts.RefreshInterval == 0 {
+		opts.RefreshInterval = time.Minute
+	}
+
+	f := &Forwarder{
+		opts:  opts,
+		cache: NewCache(opts.CacheSize),
+		log:   logging.Default().With("listen", opts.Listen),
+		done:  make(chan struct{}),
+	}
+	f.refresh()
+
+	udp, err := net.ListenPacket("udp", opts.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("listening on udp %s: %w", opts.Listen, err)
+	}
+	f.udp = udp
+
+	// Listen on TCP using the same port, which matters when opts.Listen
+	// requested an ephemeral port.
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+	if err != nil {
+		udp.Close()
+		return nil, fmt.Errorf("listening on tcp %s: %w", opts.Listen, err)
+	}
+	f.tcp = tcp
+
+	f.wg.Add(2)
+	go f.serveUDP()
+	go f.serveTCP()
+	if opts.Refresh != nil {
+		f.wg.Add(1)
+		go f.refreshLoop()
+	}
+	return f, nil
+}
+
+// Addr returns the address the forwarder is listening on.
+func (f *Forwarder) Addr() string {
+	return f.udp.LocalAddr().String()
+}
+
+func (f *Forwarder) Status() ForwarderStatus {
+	return ForwarderStatus{
+		Listen:    f.Addr(),
+		Upstreams: f.Upstreams(),
+		Cache:     f.cache.Stats(),
+	}
+}
+
+func (f *Forwarder) Upstreams() []string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return append([]string{}, f.upstreams...)
+}
+
+func (f *Forwarder) Close() error {
+	var result error
+
+	close(f.done)
+	if err := f.udp.Close(); err != nil {
+		result = multierror.Append(result, err)
+	}
+	if err := f.tcp.Close(); err != nil {
+		result = multierror.Append(result, err)
+	}
+	f.wg.Wait()
+
+	return result
+}
+
+func (f *Forwarder) refreshLoop() {
+	defer f.wg.Done()
+
+	ticker := time.NewTicker(f.opts.RefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-f.done:
+			return
+		case <-ticker.C:
+			f.refresh()
+		}
+	}
+}
+
+func (f *Forwarder) refresh() {
+	upstreams := f.opts.Upstreams
+	if f.opts.Refresh != nil {
+		discovered, err := f.opts.Refresh()
+		if err != nil {
+			f.log.Warn("error refreshing upstreams", "err", err)
+		} else if len(discovered) > 0 {
+			upstreams = discovered
+		}
+	}
+
+	normalized := make([]string, 0, len(upstreams))
+	for _, upstream := range upstreams {
+		if _, _, err := net.SplitHostPort(upstream); err != nil {
+			upstream = net.JoinHostPort(upstream, "53")
+		}
+		normalized = append(normalized, upstream)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !equal(f.upstreams, normalized) {
+		f.upstreams = normalized
+		f.preferred = 0
+	}
+}
+
+func (f *Forwarder) serveUDP() {
+	defer f.wg.Done()
+
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, addr, err := f.udp.ReadFrom(buf)
+		if err != nil {
+			if !f.closed() {
+				f.log.Error("error reading query", "err", err)
+			}
+			return
+		}
+
+		query := append([]byte{}, buf[:n]...)
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+
+			response, err := f.resolve(query, "udp")
+			if err != nil {
+				f.log.Warn("error resolving query", "client", addr, "err", err)
+				return
+			}
+			if _, err := f.udp.WriteTo(response, addr); err != nil {
+				f.log.Warn("error responding to query", "client", addr, "err", err)
+			}
+		}()
+	}
+}
+
+func (f *Forwarder) serveTCP() {
+	defer f.wg.Done()
+
+	for {
+		conn, err := f.tcp.Accept()
+		if err != nil {
+			if !f.closed() {
+				f.log.Error("error accepting connection", "err", err)
+			}
+			return
+		}
+
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+			defer conn.Close()
+
+			for {
+				conn.SetDeadline(time.Now().Add(2 * f.opts.Timeout))
+				query, err := readTCPMessage(conn)
+				if err != nil {
+					return
+				}
+
+				response, err := f.resolve(query, "tcp")
+				if err != nil {
+					f.log.Warn("error resolving query", "client", conn.RemoteAddr(), "err", err)
+					return
+				}
+				if err := writeTCPMessage(conn, response); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+func (f *Forwarder) closed() bool {
+	select {
+	case <-f.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// resolve answers a single query from the cache or an upstream server.
+// Queries which cannot be parsed are dropped; upstream failures are
+// reported to the client as SERVFAIL.
+func (f *Forwarder) resolve(query []byte, proto string) ([]byte, error) {
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if msg, ok := f.cache.Get(q, now); ok {
+		msg.Header.ID = header.ID
+		f.observe(msg)
+		return msg.Pack()
+	}
+
+	raw, err := f.exchange(query, proto)
+	if err != nil {
+		f.log.Warn("error forwarding query", "name", q.Name, "err", err)
+		return failure(header, q)
+	}
+
+	msg := &dnsmessage.Message{}
+	if err := msg.Unpack(raw); err != nil {
+		return nil, fmt.Errorf("unpacking upstream response: %w", err)
+	}
+	f.cache.Put(q, msg, now)
+	f.observe(msg)
+	return raw, nil
+}
+
+func (f *Forwarder) observe(msg *dnsmessage.Message) {
+	if f.opts.Observe != nil {
+		f.opts.Observe(msg)
+	}
+}
+
+func (f *Forwarder) exchange(query []byte, proto string) ([]byte, error) {
+	f.mu.RLock()
+	upstreams := f.upstreams
+	preferred := f.preferred
+	f.mu.RUnlock()
+
+	if len(upstreams) == 0 {
+		return nil, ErrNoUpstreams
+	}
+
+	var result error
+	for i := range upstreams {
+		idx := (preferred + i) % len(upstreams)
+		response, err := f.exchangeWith(upstreams[idx], query, proto)
+		if err != nil {
+			result = multierror.Append(result, err)
+			continue
+		}
+
+		if idx != preferred {
+			f.mu.Lock()
+			if equal(f.upstreams, upstreams) {
+				f.preferred = idx
+			}
+			f.mu.Unlock()
+		}
+		return response, nil
+	}
+	return nil, result
+}
+
+func (f *Forwarder) exchangeWith(upstream string, query []byte, proto string) ([]byte, error) {
+	dialer := net.Dialer{
+		Timeout: f.opts.Timeout,
+		Control: markControl(f.opts.Mark),
+	}
+
+	conn, err := dialer.Dial(proto, upstream)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(f.opts.Timeout))
+
+	if proto == "tcp" {
+		if err := writeTCPMessage(conn, query); err != nil {
+			return nil, err
+		}
+		return readTCPMessage(conn)
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Discard anything which isn't a response to our query.
+		if n >= 2 && binary.BigEndian.Uint16(buf) == binary.BigEndian.Uint16(query) {
+			return buf[:n], nil
+		}
+	}
+}
+
+func failure(header dnsmessage.Header, q dnsmessage.Question) ([]byte, error) {
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               header.ID,
+			Response:         true,
+			OpCode:           header.OpCode,
+			RecursionDesired: header.RecursionDesired,
+			RCode:            dnsmessage.RCodeServerFailure,
+		},
+		Questions: []dnsmessage.Question{q},
+	}
+	return msg.Pack()
+}
+
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	if length == 0 {
+		return nil, errors.New("empty message")
+	}
+
+	msg := make([]byte, length)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func writeTCPMessage(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
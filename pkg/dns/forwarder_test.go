@@ -0,0 +1,157 @@
+package dns_test
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pricec/vpnmux/pkg/dns"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// upstream is a fake DNS server which answers every A query with
+// 10.0.0.1 and counts the queries it receives.
+type upstream struct {
+	conn    net.PacketConn
+	queries int32
+}
+
+func newUpstream(t *testing.T) *upstream {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+
+	u := &upstream{conn: conn}
+	go u.serve()
+	return u
+}
+
+func (u *upstream) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := u.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		atomic.AddInt32(&u.queries, 1)
+
+		query := &dnsmessage.Message{}
+		if err := query.Unpack(buf[:n]); err != nil {
+			continue
+		}
+
+		response := answer(query.Questions[0], 300)
+		response.Header.ID = query.Header.ID
+		raw, err := response.Pack()
+		if err != nil {
+			continue
+		}
+		u.conn.WriteTo(raw, addr)
+	}
+}
+
+func (u *upstream) Addr() string {
+	return u.conn.LocalAddr().String()
+}
+
+func (u *upstream) Queries() int {
+	return int(atomic.LoadInt32(&u.queries))
+}
+
+func (u *upstream) Close() error {
+	return u.conn.Close()
+}
+
+func query(t *testing.T, addr string, id uint16, name string) *dnsmessage.Message {
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{question(name)},
+	}
+	raw, err := msg.Pack()
+	require.Nil(t, err)
+
+	conn, err := net.Dial("udp", addr)
+	require.Nil(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = conn.Write(raw)
+	require.Nil(t, err)
+
+	buf := make([]byte, 512)
+	n, err := conn.Read(buf)
+	require.Nil(t, err)
+
+	response := &dnsmessage.Message{}
+	require.Nil(t, response.Unpack(buf[:n]))
+	return response
+}
+
+func TestForwarder(t *testing.T) {
+	u := newUpstream(t)
+	defer u.Close()
+
+	var observed int32
+	f, err := dns.NewForwarder(dns.ForwarderOptions{
+		Listen:    "127.0.0.1:0",
+		CacheSize: 10,
+		Refresh: func() ([]string, error) {
+			return []string{u.Addr()}, nil
+		},
+		Observe: func(msg *dnsmessage.Message) {
+			atomic.AddInt32(&observed, int32(len(dns.Addresses(msg))))
+		},
+	})
+	require.Nil(t, err)
+	defer f.Close()
+
+	require.Equal(t, []string{u.Addr()}, f.Upstreams())
+
+	response := query(t, f.Addr(), 1234, "example.com.")
+	require.Equal(t, uint16(1234), response.Header.ID)
+	require.Equal(t, dnsmessage.RCodeSuccess, response.Header.RCode)
+	require.Equal(t, 1, len(response.Answers))
+	require.Equal(t, 1, u.Queries())
+
+	response = query(t, f.Addr(), 4321, "example.com.")
+	require.Equal(t, uint16(4321), response.Header.ID)
+	require.Equal(t, 1, len(response.Answers))
+	require.Equal(t, 1, u.Queries(), "expected cached response")
+	require.Equal(t, uint64(1), f.Status().Cache.Hits)
+	require.Equal(t, int32(2), atomic.LoadInt32(&observed))
+}
+
+func TestForwarderFailover(t *testing.T) {
+	u := newUpstream(t)
+	defer u.Close()
+
+	// reserve a port with nothing listening on it
+	dead, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	deadAddr := dead.LocalAddr().String()
+	dead.Close()
+
+	f, err := dns.NewForwarder(dns.ForwarderOptions{
+		Listen:    "127.0.0.1:0",
+		Upstreams: []string{deadAddr, u.Addr()},
+		Timeout:   500 * time.Millisecond,
+	})
+	require.Nil(t, err)
+	defer f.Close()
+
+	response := query(t, f.Addr(), 1, "example.com.")
+	require.Equal(t, dnsmessage.RCodeSuccess, response.Header.RCode)
+	require.Equal(t, 1, u.Queries())
+}
+
+func TestForwarderNoUpstreams(t *testing.T) {
+	f, err := dns.NewForwarder(dns.ForwarderOptions{
+		Listen: "127.0.0.1:0",
+	})
+	require.Nil(t, err)
+	defer f.Close()
+
+	response := query(t, f.Addr(), 1, "example.com.")
+	require.Equal(t, dnsmessage.RCodeServerFailure, response.Header.RCode)
+}
@@ -0,0 +1,24 @@
+package dns
+
+import (
+	"syscall"
+)
+
+// markControl returns a dialer control function which applies the given
+// firewall mark to outgoing sockets, or nil if mark is zero.
+func markControl(mark int) func(network, address string, c syscall.RawConn) error {
+	if mark == 0 {
+		return nil
+	}
+
+	return func(network, address string, c syscall.RawConn) error {
+		var result error
+		err := c.Control(func(fd uintptr) {
+			result = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, mark)
+		})
+		if err != nil {
+			return err
+		}
+		return result
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package dns
+
+import (
+	"fmt"
+	"syscall"
+)
+
+func markControl(mark int) func(network, address string, c syscall.RawConn) error {
+	if mark == 0 {
+		return nil
+	}
+
+	return func(network, address string, c syscall.RawConn) error {
+		return fmt.Errorf("firewall marks are only supported on linux")
+	}
+}
@@ -0,0 +1,175 @@
+// Package events publishes changes to resources and to the state of the
+// gateway, e.g. a tunnel going down, to subscribers such as the API's event
+// stream. The most recent events are kept in the database, so that a
+// subscriber which reconnects can resume where it left off.
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/pricec/vpnmux/pkg/database"
+	"github.com/pricec/vpnmux/pkg/logging"
+)
+
+// Event types.
+const (
+	TypeCreate       = "create"
+	TypeUpdate       = "update"
+	TypeDelete       = "delete"
+	TypeRepair       = "repair"
+	TypeNetworkState = "network_state"
+	// A pass of the periodic reconciliation started failing, or succeeded
+	// again after failing.
+	TypeReconcileError     = "reconcile_error"
+	TypeReconcileRecovered = "reconcile_recovered"
+	// TypeReset tells a subscriber that events it missed are no longer
+	// kept, so it must refetch any state it depends on.
+	TypeReset = "reset"
+)
+
+// Types are the types of event which can be published, i.e. all but
+// TypeReset.
+var Types = []string{
+	TypeCreate,
+	TypeUpdate,
+	TypeDelete,
+	TypeRepair,
+	TypeNetworkState,
+	TypeReconcileError,
+	TypeReconcileRecovered,
+}
+
+// ErrClosed is returned when subscribing to a stopped broker.
+var ErrClosed = errors.New("event broker closed")
+
+// subscriberBuffer is the number of events a subscriber can fall behind
+// before it is dropped.
+const subscriberBuffer = 64
+
+// Broker fans events out to subscribers, keeping the keep most recent.
+type Broker struct {
+	db   *database.EventDatabase
+	keep int
+
+	mu          sync.Mutex
+	closed      bool
+	subscribers map[chan *database.Event]struct{}
+}
+
+// NewBroker returns a broker which runs until ctx is done, when every
+// subscription ends.
+func NewBroker(ctx context.Context, db *database.EventDatabase, keep int) *Broker {
+	b := &Broker{
+		db:          db,
+		keep:        keep,
+		subscribers: make(map[chan *database.Event]struct{}),
+	}
+	go func() {
+		<-ctx.Done()
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.closed = true
+		for ch := range b.subscribers {
+			b.drop(ch)
+		}
+	}()
+	return b
+}
+
+// drop ends a subscription; b.mu must be held.
+func (b *Broker) drop(ch chan *database.Event) {
+	delete(b.subscribers, ch)
+	close(ch)
+}
+
+// Publish records an event and sends it to every subscriber. Subscribers
+// too slow to keep up are dropped, and must resubscribe. Publishing to a
+// nil broker does nothing.
+func (b *Broker) Publish(ctx context.Context, typ, resource, resourceID string, data interface{}) {
+	if b == nil {
+		return
+	}
+
+	e := &database.Event{
+		Time:       time.Now().UTC(),
+		Type:       typ,
+		Resource:   resource,
+		ResourceID: resourceID,
+	}
+	switch data := data.(type) {
+	case nil:
+	case json.RawMessage:
+		e.Data = data
+	default:
+		raw, err := json.Marshal(data)
+		if err != nil {
+			logging.Error(ctx, "error encoding event", "type", typ, "err", err)
+			return
+		}
+		e.Data = raw
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.db.Append(ctx, e, b.keep); err != nil {
+		logging.Error(ctx, "error recording event", "type", typ, "err", err)
+		return
+	}
+	for ch := range b.subscribers {
+		select {
+		case ch <- e:
+		default:
+			logging.Warn(ctx, "dropping slow event subscriber")
+			b.drop(ch)
+		}
+	}
+}
+
+// Subscribe returns the events after lastID, followed by a channel of the
+// events published from then on, which is closed when the subscription
+// ends. If events after lastID are no longer kept, a reset is returned
+// instead. If lastID is zero, only new events are sent.
+func (b *Broker) Subscribe(ctx context.Context, lastID int64) ([]*database.Event, <-chan *database.Event, func(), error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil, nil, nil, ErrClosed
+	}
+
+	var missed []*database.Event
+	if lastID > 0 {
+		oldest, latest, err := b.db.Bounds(ctx)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		// The latest ID can only be behind lastID if the database was
+		// replaced, and its IDs started over.
+		if lastID < oldest-1 || lastID > latest {
+			missed = []*database.Event{{
+				ID:   latest,
+				Time: time.Now(),
+				Type: TypeReset,
+			}}
+		} else if missed, err = b.db.Since(ctx, lastID); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	ch := make(chan *database.Event, subscriberBuffer)
+	b.subscribers[ch] = struct{}{}
+	cancel := func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subscribers[ch]; ok {
+			b.drop(ch)
+		}
+	}
+	return missed, ch, cancel, nil
+}
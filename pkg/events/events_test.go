@@ -0,0 +1,103 @@
+package events_test
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/pricec/vpnmux/pkg/database"
+	"github.com/pricec/vpnmux/pkg/events"
+	"github.com/stretchr/testify/require"
+)
+
+func newDatabase(t *testing.T) *database.Database {
+	f, err := os.CreateTemp("", "")
+	require.Nil(t, err)
+	f.Close()
+	t.Cleanup(func() { os.Remove(f.Name()) })
+
+	db, err := database.New(context.Background(), f.Name())
+	require.Nil(t, err)
+	return db
+}
+
+func TestBroker(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := events.NewBroker(ctx, newDatabase(t).Events, 3)
+
+	missed, ch, unsubscribe, err := b.Subscribe(ctx, 0)
+	require.Nil(t, err)
+	require.Empty(t, missed)
+
+	b.Publish(ctx, events.TypeCreate, "client", "c1", map[string]string{"id": "c1"})
+	e := <-ch
+	require.Equal(t, events.TypeCreate, e.Type)
+	require.Equal(t, "c1", e.ResourceID)
+	require.JSONEq(t, `{"id":"c1"}`, string(e.Data))
+	first := e.ID
+	unsubscribe()
+	_, ok := <-ch
+	require.False(t, ok)
+
+	b.Publish(ctx, events.TypeUpdate, "client", "c1", nil)
+	b.Publish(ctx, events.TypeDelete, "client", "c1", nil)
+
+	// Resuming replays the events published since.
+	missed, _, unsubscribe, err = b.Subscribe(ctx, first)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(missed))
+	require.Equal(t, events.TypeUpdate, missed[0].Type)
+	require.Equal(t, events.TypeDelete, missed[1].Type)
+	unsubscribe()
+
+	// Once the events missed are no longer kept, a reset is sent.
+	b.Publish(ctx, events.TypeRepair, "client", "", map[string]int{"repairs": 1})
+	b.Publish(ctx, events.TypeRepair, "client", "", map[string]int{"repairs": 1})
+	missed, _, unsubscribe, err = b.Subscribe(ctx, first)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(missed))
+	require.Equal(t, events.TypeReset, missed[0].Type)
+	unsubscribe()
+
+	missed, _, unsubscribe, err = b.Subscribe(ctx, first+1000)
+	require.Nil(t, err)
+	require.Equal(t, events.TypeReset, missed[0].Type)
+	unsubscribe()
+}
+
+func TestBrokerSlowSubscriber(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := events.NewBroker(ctx, newDatabase(t).Events, 1000)
+
+	_, ch, _, err := b.Subscribe(ctx, 0)
+	require.Nil(t, err)
+	for i := 0; i < 100; i += 1 {
+		b.Publish(ctx, events.TypeUpdate, "client", "c1", nil)
+	}
+
+	count := 0
+	for range ch {
+		count += 1
+	}
+	require.Less(t, count, 100)
+}
+
+func TestBrokerClose(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	b := events.NewBroker(ctx, newDatabase(t).Events, 10)
+
+	_, ch, _, err := b.Subscribe(ctx, 0)
+	require.Nil(t, err)
+	cancel()
+
+	_, ok := <-ch
+	require.False(t, ok)
+	_, _, _, err = b.Subscribe(context.Background(), 0)
+	require.ErrorIs(t, err, events.ErrClosed)
+
+	// Publishing to a nil broker is a no-op.
+	var nilBroker *events.Broker
+	nilBroker.Publish(context.Background(), events.TypeUpdate, "client", "c1", nil)
+}
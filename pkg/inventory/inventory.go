@@ -0,0 +1,179 @@
+// Package inventory reads lists of the hosts on the LAN, so that they may
+// be imported as clients: CSV files, DHCP leases and the neighbor table.
+package inventory
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pricec/vpnmux/pkg/lease"
+	"github.com/pricec/vpnmux/pkg/network"
+)
+
+// Host is a host on the LAN to be imported as a client.
+type Host struct {
+	Name     string `json:"name"`
+	Address  string `json:"address,omitempty"`
+	Address6 string `json:"address6,omitempty"`
+	MAC      string `json:"mac,omitempty"`
+	// Name or ID of the network to which the client is assigned; optional.
+	Network string `json:"network,omitempty"`
+}
+
+// Keys returns the identifiers of a host which no two clients may share:
+// its MAC address and its IPv4 and IPv6 addresses, normalized.
+func (h Host) Keys() []string {
+	var keys []string
+	if mac, err := net.ParseMAC(h.MAC); err == nil {
+		keys = append(keys, "mac "+mac.String())
+	}
+	for _, address := range []string{h.Address, h.Address6} {
+		if ip := net.ParseIP(address); ip != nil {
+			keys = append(keys, "ip "+ip.String())
+		}
+	}
+	return keys
+}
+
+// csvColumns are the columns of a CSV file without a header.
+var csvColumns = []string{"name", "address", "network"}
+
+// ParseCSV parses a CSV file listing a host on each row. If the first row
+// is a header, whose first column is "name", it names the columns, which
+// may be name, address, address6, mac and network in any order; otherwise
+// the columns are the name, an address and, optionally, a network. The
+// kind of the address in an address column (IPv4, IPv6 or MAC) is
+// detected from its form. Blank lines and lines starting with # are
+// skipped.
+func ParseCSV(r io.Reader) ([]Host, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	reader.Comment = '#'
+
+	columns := csvColumns
+	var hosts []Host
+	for row := 0; ; row += 1 {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return hosts, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if row == 0 && strings.EqualFold(strings.TrimSpace(record[0]), "name") {
+			columns = make([]string, len(record))
+			for i, column := range record {
+				columns[i] = strings.ToLower(strings.TrimSpace(column))
+				switch columns[i] {
+				case "name", "address", "address6", "mac", "network":
+				default:
+					return nil, fmt.Errorf("unknown column %q", column)
+				}
+			}
+			continue
+		}
+		if len(record) > len(columns) {
+			return nil, fmt.Errorf("row %d: expected at most %d columns", row+1, len(columns))
+		}
+
+		var h Host
+		for i, value := range record {
+			value = strings.TrimSpace(value)
+			switch columns[i] {
+			case "name":
+				h.Name = value
+			case "address":
+				h.setAddress(value)
+			case "address6":
+				h.Address6 = value
+			case "mac":
+				h.MAC = value
+			case "network":
+				h.Network = value
+			}
+		}
+		hosts = append(hosts, h)
+	}
+}
+
+// setAddress sets the IPv4, IPv6 or MAC address of h, depending on the form
+// of address. Addresses of no known form are kept as IPv4 addresses, to be
+// rejected when the client is validated.
+func (h *Host) setAddress(address string) {
+	if address == "" {
+		return
+	}
+	if ip := net.ParseIP(address); ip != nil && ip.To4() == nil {
+		h.Address6 = address
+		return
+	}
+	if _, err := net.ParseMAC(address); err == nil {
+		h.MAC = address
+		return
+	}
+	h.Address = address
+}
+
+// FromLeases returns a host for each MAC address with an active lease at
+// the given time, at the address of its most recent lease and named after
+// its hostname, or its MAC address if it has none.
+func FromLeases(leases []lease.Lease, now time.Time) []Host {
+	var hosts []Host
+	seen := make(map[string]bool)
+	for _, l := range leases {
+		mac := strings.ToLower(l.MAC)
+		if seen[mac] || !l.Active(now) {
+			continue
+		}
+		seen[mac] = true
+
+		address, _ := lease.Find(leases, l.MAC, now)
+		hosts = append(hosts, Host{
+			Name:    hostname(leases, l.MAC),
+			Address: address,
+			MAC:     l.MAC,
+		})
+	}
+	return hosts
+}
+
+// FromNeighbors returns a host for each MAC address in the neighbor table,
+// at its preferred address and named after the hostname of its DHCP lease,
+// if it has one, or else its MAC address.
+func FromNeighbors(neighbors []network.Neighbor, leases []lease.Lease) []Host {
+	var hosts []Host
+	seen := make(map[string]bool)
+	for _, n := range neighbors {
+		mac := strings.ToLower(n.MAC)
+		if seen[mac] {
+			continue
+		}
+		seen[mac] = true
+
+		address, _ := network.FindNeighbor(neighbors, n.MAC)
+		hosts = append(hosts, Host{
+			Name:    hostname(leases, n.MAC),
+			Address: address,
+			MAC:     n.MAC,
+		})
+	}
+	return hosts
+}
+
+// hostname returns the last hostname leased to mac, or mac if there is none.
+func hostname(leases []lease.Lease, mac string) string {
+	name := mac
+	for _, l := range leases {
+		if strings.EqualFold(l.MAC, mac) && l.Hostname != "" {
+			name = l.Hostname
+		}
+	}
+	return name
+}
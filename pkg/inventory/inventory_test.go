@@ -0,0 +1,76 @@
+package inventory_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pricec/vpnmux/pkg/inventory"
+	"github.com/pricec/vpnmux/pkg/lease"
+	"github.com/pricec/vpnmux/pkg/network"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCSV(t *testing.T) {
+	hosts, err := inventory.ParseCSV(strings.NewReader(`# hosts
+laptop, 192.168.0.10, home
+phone,fd00::10
+
+printer,aa:bb:cc:dd:ee:01
+`))
+	require.Nil(t, err)
+	require.Equal(t, []inventory.Host{
+		{Name: "laptop", Address: "192.168.0.10", Network: "home"},
+		{Name: "phone", Address6: "fd00::10"},
+		{Name: "printer", MAC: "aa:bb:cc:dd:ee:01"},
+	}, hosts)
+
+	hosts, err = inventory.ParseCSV(strings.NewReader(`Name,MAC,Address,Address6
+tv,aa:bb:cc:dd:ee:02,192.168.0.11,fd00::11
+`))
+	require.Nil(t, err)
+	require.Equal(t, []inventory.Host{
+		{Name: "tv", Address: "192.168.0.11", Address6: "fd00::11", MAC: "aa:bb:cc:dd:ee:02"},
+	}, hosts)
+
+	_, err = inventory.ParseCSV(strings.NewReader("name,hostname\n"))
+	require.NotNil(t, err)
+
+	_, err = inventory.ParseCSV(strings.NewReader("laptop,192.168.0.10,home,extra\n"))
+	require.NotNil(t, err)
+}
+
+func TestKeys(t *testing.T) {
+	h := inventory.Host{Address: "192.168.0.10", Address6: "FD00::0010", MAC: "AA:BB:CC:DD:EE:01"}
+	require.Equal(t, []string{"mac aa:bb:cc:dd:ee:01", "ip 192.168.0.10", "ip fd00::10"}, h.Keys())
+	require.Empty(t, inventory.Host{Address: "invalid"}.Keys())
+}
+
+func TestFromLeases(t *testing.T) {
+	now := time.Now()
+	leases := []lease.Lease{
+		{MAC: "aa:bb:cc:dd:ee:01", IP: "192.168.0.10", Hostname: "laptop", Expires: now.Add(time.Hour)},
+		{MAC: "AA:BB:CC:DD:EE:01", IP: "192.168.0.11", Expires: now.Add(2 * time.Hour)},
+		{MAC: "aa:bb:cc:dd:ee:02", IP: "192.168.0.12"},
+		{MAC: "aa:bb:cc:dd:ee:03", IP: "192.168.0.13", Hostname: "gone", Expires: now.Add(-time.Hour)},
+	}
+	require.Equal(t, []inventory.Host{
+		{Name: "laptop", Address: "192.168.0.11", MAC: "aa:bb:cc:dd:ee:01"},
+		{Name: "aa:bb:cc:dd:ee:02", Address: "192.168.0.12", MAC: "aa:bb:cc:dd:ee:02"},
+	}, inventory.FromLeases(leases, now))
+}
+
+func TestFromNeighbors(t *testing.T) {
+	neighbors := []network.Neighbor{
+		{IP: "192.168.0.10", MAC: "aa:bb:cc:dd:ee:01", State: "STALE"},
+		{IP: "192.168.0.11", MAC: "aa:bb:cc:dd:ee:01", State: "REACHABLE"},
+		{IP: "192.168.0.12", MAC: "aa:bb:cc:dd:ee:02", State: "REACHABLE"},
+	}
+	leases := []lease.Lease{
+		{MAC: "AA:BB:CC:DD:EE:02", IP: "192.168.0.12", Hostname: "phone"},
+	}
+	require.Equal(t, []inventory.Host{
+		{Name: "aa:bb:cc:dd:ee:01", Address: "192.168.0.11", MAC: "aa:bb:cc:dd:ee:01"},
+		{Name: "phone", Address: "192.168.0.12", MAC: "aa:bb:cc:dd:ee:02"},
+	}, inventory.FromNeighbors(neighbors, leases))
+}
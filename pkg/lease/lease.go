@@ -0,0 +1,195 @@
+// Package lease reads DHCP server lease files, so that hosts may be
+// identified by MAC address rather than by a (dynamic) IP address.
+package lease
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Lease struct {
+	MAC      string
+	IP       string
+	Hostname string
+	// Zero if the lease never expires.
+	Expires time.Time
+}
+
+// Active returns true iff the lease has not expired at the given time.
+func (l Lease) Active(now time.Time) bool {
+	return l.Expires.IsZero() || now.Before(l.Expires)
+}
+
+// Read parses a dnsmasq or ISC dhcpd lease file, detecting its format
+// from its content.
+func Read(path string) ([]Lease, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Parse parses the content of a dnsmasq or ISC dhcpd lease file, detecting
+// its format.
+func Parse(data []byte) ([]Lease, error) {
+	if bytes.Contains(data, []byte("{")) {
+		return ParseISC(bytes.NewReader(data))
+	}
+	return ParseDnsmasq(bytes.NewReader(data))
+}
+
+// Find returns the address of the most recent active lease for mac, if
+// there is one.
+func Find(leases []Lease, mac string, now time.Time) (string, bool) {
+	var result *Lease
+	for i := range leases {
+		l := &leases[i]
+		if !strings.EqualFold(l.MAC, mac) || !l.Active(now) {
+			continue
+		}
+		if result == nil || l.Expires.IsZero() || (!result.Expires.IsZero() && l.Expires.After(result.Expires)) {
+			result = l
+		}
+	}
+
+	if result == nil {
+		return "", false
+	}
+	return result.IP, true
+}
+
+// ParseDnsmasq parses a dnsmasq lease file, in which each line has the
+// form "<expiry> <mac> <ip> <hostname> <client-id>". The expiry is a unix
+// timestamp, or 0 for infinite leases.
+func ParseDnsmasq(r io.Reader) ([]Lease, error) {
+	var leases []Lease
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line += 1 {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		// DHCPv6 leases are preceded by a "duid" line and have no MAC.
+		if fields[0] == "duid" {
+			continue
+		}
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("line %d: expected at least 4 fields", line)
+		}
+
+		expiry, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid expiry: %w", line, err)
+		}
+
+		mac, err := net.ParseMAC(fields[1])
+		if err != nil {
+			continue
+		}
+
+		ip := net.ParseIP(fields[2])
+		if ip == nil || ip.To4() == nil {
+			continue
+		}
+
+		l := Lease{
+			MAC: mac.String(),
+			IP:  ip.String(),
+		}
+		if fields[3] != "*" {
+			l.Hostname = fields[3]
+		}
+		if expiry != 0 {
+			l.Expires = time.Unix(expiry, 0)
+		}
+		leases = append(leases, l)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return leases, nil
+}
+
+// ParseISC parses an ISC dhcpd lease file. Only leases in the active
+// binding state are returned; since dhcpd appends updated leases to the
+// file, later declarations for an address replace earlier ones.
+func ParseISC(r io.Reader) ([]Lease, error) {
+	var (
+		order   []string
+		byIP    = make(map[string]*Lease)
+		active  = make(map[string]bool)
+		current *Lease
+	)
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line += 1 {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(strings.TrimSuffix(text, ";"))
+		switch {
+		case fields[0] == "lease" && len(fields) >= 2 && current == nil:
+			ip := net.ParseIP(fields[1])
+			if ip == nil || ip.To4() == nil {
+				return nil, fmt.Errorf("line %d: invalid lease address %q", line, fields[1])
+			}
+			current = &Lease{IP: ip.String()}
+		case fields[0] == "}":
+			if current == nil {
+				continue
+			}
+			if _, ok := byIP[current.IP]; !ok {
+				order = append(order, current.IP)
+			}
+			byIP[current.IP] = current
+			current = nil
+		case current == nil:
+		case fields[0] == "ends" && len(fields) >= 2:
+			if fields[1] == "never" {
+				continue
+			}
+			if len(fields) < 4 {
+				return nil, fmt.Errorf("line %d: invalid lease end", line)
+			}
+			ends, err := time.Parse("2006/01/02 15:04:05", fields[2]+" "+fields[3])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid lease end: %w", line, err)
+			}
+			current.Expires = ends
+		case fields[0] == "binding" && len(fields) == 3 && fields[1] == "state":
+			active[current.IP] = fields[2] == "active"
+		case fields[0] == "hardware" && len(fields) == 3:
+			mac, err := net.ParseMAC(fields[2])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid hardware address: %w", line, err)
+			}
+			current.MAC = mac.String()
+		case fields[0] == "client-hostname" && len(fields) >= 2:
+			current.Hostname = strings.Trim(strings.Join(fields[1:], " "), `"`)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var leases []Lease
+	for _, ip := range order {
+		if l := byIP[ip]; active[ip] && l.MAC != "" {
+			leases = append(leases, *l)
+		}
+	}
+	return leases, nil
+}
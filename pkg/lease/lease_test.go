@@ -0,0 +1,106 @@
+package lease_test
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pricec/vpnmux/pkg/lease"
+	"github.com/stretchr/testify/require"
+)
+
+const dnsmasqLeases = `1893456000 aa:bb:cc:dd:ee:01 192.168.0.10 laptop 01:aa:bb:cc:dd:ee:01
+0 AA:BB:CC:DD:EE:02 192.168.0.11 * *
+duid 00:01:00:01:2a:2b:2c:2d:aa:bb:cc:dd:ee:03
+1893456000 1234 fd00::10 phone 00:01:00:01
+`
+
+const iscLeases = `# The format of this file is documented in the dhcpd.leases(5) manual page.
+lease 192.168.0.20 {
+  starts 1 2022/05/02 10:00:00;
+  ends 1 2022/05/02 22:00:00;
+  binding state active;
+  hardware ethernet aa:bb:cc:dd:ee:04;
+  client-hostname "old name";
+}
+lease 192.168.0.21 {
+  starts 1 2022/05/02 10:00:00;
+  ends 1 2022/05/02 22:00:00;
+  binding state free;
+  hardware ethernet aa:bb:cc:dd:ee:05;
+}
+lease 192.168.0.20 {
+  starts 1 2022/05/02 12:00:00;
+  ends never;
+  binding state active;
+  hardware ethernet aa:bb:cc:dd:ee:04;
+  client-hostname "desktop";
+}
+`
+
+func TestParseDnsmasq(t *testing.T) {
+	leases, err := lease.ParseDnsmasq(strings.NewReader(dnsmasqLeases))
+	require.Nil(t, err)
+	require.Equal(t, []lease.Lease{
+		{
+			MAC:      "aa:bb:cc:dd:ee:01",
+			IP:       "192.168.0.10",
+			Hostname: "laptop",
+			Expires:  time.Unix(1893456000, 0),
+		},
+		{
+			MAC: "aa:bb:cc:dd:ee:02",
+			IP:  "192.168.0.11",
+		},
+	}, leases)
+}
+
+func TestParseISC(t *testing.T) {
+	leases, err := lease.ParseISC(strings.NewReader(iscLeases))
+	require.Nil(t, err)
+	require.Equal(t, []lease.Lease{
+		{
+			MAC:      "aa:bb:cc:dd:ee:04",
+			IP:       "192.168.0.20",
+			Hostname: "desktop",
+		},
+	}, leases)
+}
+
+func TestFind(t *testing.T) {
+	now := time.Now()
+	leases := []lease.Lease{
+		{MAC: "aa:bb:cc:dd:ee:01", IP: "192.168.0.10", Expires: now.Add(-time.Hour)},
+		{MAC: "aa:bb:cc:dd:ee:01", IP: "192.168.0.11", Expires: now.Add(time.Hour)},
+		{MAC: "aa:bb:cc:dd:ee:01", IP: "192.168.0.12", Expires: now.Add(2 * time.Hour)},
+		{MAC: "aa:bb:cc:dd:ee:02", IP: "192.168.0.13"},
+	}
+
+	ip, ok := lease.Find(leases, "AA:BB:CC:DD:EE:01", now)
+	require.True(t, ok)
+	require.Equal(t, "192.168.0.12", ip)
+
+	ip, ok = lease.Find(leases, "aa:bb:cc:dd:ee:02", now)
+	require.True(t, ok)
+	require.Equal(t, "192.168.0.13", ip)
+
+	_, ok = lease.Find(leases, "aa:bb:cc:dd:ee:03", now)
+	require.False(t, ok)
+}
+
+func TestRead(t *testing.T) {
+	for _, content := range []string{dnsmasqLeases, iscLeases} {
+		f, err := os.CreateTemp("", "")
+		require.Nil(t, err)
+		defer os.Remove(f.Name())
+
+		_, err = f.WriteString(content)
+		require.Nil(t, err)
+		f.Close()
+
+		leases, err := lease.Read(f.Name())
+		require.Nil(t, err)
+		require.NotEmpty(t, leases)
+	}
+}
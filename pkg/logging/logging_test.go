@@ -0,0 +1,59 @@
+package logging_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pricec/vpnmux/pkg/logging"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLevel(t *testing.T) {
+	level, err := logging.ParseLevel("WARN")
+	require.Nil(t, err)
+	require.Equal(t, logging.LevelWarn, level)
+
+	_, err = logging.ParseLevel("verbose")
+	require.NotNil(t, err)
+}
+
+func TestLogfmt(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := logging.New(&buf, logging.FormatLogfmt, logging.LevelInfo)
+	require.Nil(t, err)
+
+	l.Debug("hidden")
+	l.With("request_id", "abc").Info("executing command", "cmd", "ip rule show", "took", time.Second, "err", fmt.Errorf("exit status 1"))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Equal(t, 1, len(lines))
+	require.Regexp(t, `^time=\S+ level=info msg="executing command" request_id=abc cmd="ip rule show" took=1s err="exit status 1"$`, lines[0])
+}
+
+func TestJSON(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := logging.New(&buf, logging.FormatJSON, logging.LevelDebug)
+	require.Nil(t, err)
+
+	ctx := logging.NewContext(context.Background(), l)
+	ctx = logging.With(ctx, "request_id", "abc")
+	logging.Debug(ctx, "sampled", "count", 3, "odd")
+
+	fields := make(map[string]interface{})
+	require.Nil(t, json.Unmarshal(buf.Bytes(), &fields))
+	require.Equal(t, "debug", fields["level"])
+	require.Equal(t, "sampled", fields["msg"])
+	require.Equal(t, "abc", fields["request_id"])
+	require.Equal(t, float64(3), fields["count"])
+	require.Equal(t, "(missing)", fields["odd"])
+}
+
+func TestUnknownFormat(t *testing.T) {
+	_, err := logging.New(&bytes.Buffer{}, "xml", logging.LevelInfo)
+	require.NotNil(t, err)
+}
@@ -0,0 +1,48 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/pricec/vpnmux/pkg/database"
+	"github.com/pricec/vpnmux/pkg/logging"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var resourcesDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(namespace, "", "resources"),
+	"Number of resources of each type in the database.",
+	[]string{"type"}, nil,
+)
+
+// DatabaseCollector reports the number of resources of each type in the
+// database whenever it is scraped.
+type DatabaseCollector struct {
+	db *database.Database
+}
+
+func NewDatabaseCollector(db *database.Database) *DatabaseCollector {
+	return &DatabaseCollector{
+		db: db,
+	}
+}
+
+func (c *DatabaseCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- resourcesDesc
+}
+
+func (c *DatabaseCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	counts, err := c.db.Counts(ctx)
+	if err != nil {
+		logging.Error(ctx, "error counting resources", "err", err)
+		ch <- prometheus.NewInvalidMetric(resourcesDesc, err)
+		return
+	}
+
+	for table, count := range counts {
+		ch <- prometheus.MustNewConstMetric(resourcesDesc, prometheus.GaugeValue, float64(count), table)
+	}
+}
@@ -0,0 +1,102 @@
+// Package metrics defines the Prometheus metrics exported by vpnmux.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "vpnmux"
+
+// Registry holds every vpnmux metric, along with the Go runtime and
+// process collectors.
+var Registry = prometheus.NewRegistry()
+
+var (
+	NetworkUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "network_up",
+		Help:      "Whether the network's VPN tunnel is up (1) or down (0).",
+	}, []string{"network"})
+
+	NetworkReconnects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "network_reconnects_total",
+		Help:      "Number of times the network's VPN tunnel has been re-established.",
+	}, []string{"network"})
+
+	// NetworkBytes and NetworkPackets are sampled from the counters of
+	// each network's tunnel interface.
+	NetworkBytes = NewSnapshot(prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "network", "bytes_total"),
+		"Bytes carried by the network's VPN tunnel.",
+		[]string{"network", "direction"}, nil,
+	))
+	NetworkPackets = NewSnapshot(prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "network", "packets_total"),
+		"Packets carried by the network's VPN tunnel.",
+		[]string{"network", "direction"}, nil,
+	))
+
+	// ClientBytes and ClientPackets are sampled from the accounting rules
+	// on the FORWARD path.
+	ClientBytes = NewSnapshot(prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "client", "bytes_total"),
+		"Bytes forwarded between the client and the network.",
+		[]string{"client", "network", "direction"}, nil,
+	))
+	ClientPackets = NewSnapshot(prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "client", "packets_total"),
+		"Packets forwarded between the client and the network.",
+		[]string{"client", "network", "direction"}, nil,
+	))
+
+	ReconcileDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "reconcile_duration_seconds",
+		Help:      "Duration of the periodic reconciliation of each resource type.",
+	}, []string{"resource"})
+
+	ReconcileRepairs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "reconcile_repairs_total",
+		Help:      "Number of missing rules and routes reinstalled by the periodic reconciliation.",
+	}, []string{"resource"})
+
+	APIRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "api_requests_total",
+		Help:      "Number of API requests, by route template, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	APIRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "api_request_duration_seconds",
+		Help:      "Latency of API requests, by route template and method.",
+	}, []string{"route", "method"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		NetworkUp,
+		NetworkReconnects,
+		NetworkBytes,
+		NetworkPackets,
+		ClientBytes,
+		ClientPackets,
+		ReconcileDuration,
+		ReconcileRepairs,
+		APIRequests,
+		APIRequestDuration,
+	)
+}
+
+// Handler serves the metrics in Registry.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
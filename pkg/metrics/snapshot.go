@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Snapshot exports counters which are maintained elsewhere (e.g. by the
+// kernel) and sampled periodically, reporting the last sampled value of
+// each set of labels.
+type Snapshot struct {
+	desc   *prometheus.Desc
+	mu     sync.Mutex
+	values map[string]snapshotValue
+}
+
+type snapshotValue struct {
+	value  float64
+	labels []string
+}
+
+func NewSnapshot(desc *prometheus.Desc) *Snapshot {
+	return &Snapshot{
+		desc:   desc,
+		values: make(map[string]snapshotValue),
+	}
+}
+
+// Set records the sampled value of the counter with the given label values.
+func (s *Snapshot) Set(value float64, labels ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[strings.Join(labels, "\x00")] = snapshotValue{
+		value:  value,
+		labels: labels,
+	}
+}
+
+// Reset forgets every sampled value, e.g. before sampling a new set of
+// counters in which some label values may no longer appear.
+func (s *Snapshot) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values = make(map[string]snapshotValue)
+}
+
+func (s *Snapshot) Describe(ch chan<- *prometheus.Desc) {
+	ch <- s.desc
+}
+
+func (s *Snapshot) Collect(ch chan<- prometheus.Metric) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, v := range s.values {
+		ch <- prometheus.MustNewConstMetric(s.desc, prometheus.CounterValue, v.value, v.labels...)
+	}
+}
@@ -0,0 +1,31 @@
+package metrics_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pricec/vpnmux/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshot(t *testing.T) {
+	s := metrics.NewSnapshot(prometheus.NewDesc("test_bytes_total", "Test bytes.", []string{"network", "direction"}, nil))
+
+	s.Set(10, "a", "rx")
+	s.Set(20, "a", "tx")
+	s.Set(15, "a", "rx")
+	require.Equal(t, 2, testutil.CollectAndCount(s))
+
+	err := testutil.CollectAndCompare(s, strings.NewReader(`
+# HELP test_bytes_total Test bytes.
+# TYPE test_bytes_total counter
+test_bytes_total{direction="rx",network="a"} 15
+test_bytes_total{direction="tx",network="a"} 20
+`))
+	require.Nil(t, err)
+
+	s.Reset()
+	require.Equal(t, 0, testutil.CollectAndCount(s))
+}
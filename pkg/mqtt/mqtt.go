@@ -0,0 +1,444 @@
+// Package mqtt publishes the state of each network's tunnel and the network
+// of each client to an MQTT broker as retained topics, along with Home
+// Assistant discovery payloads which expose a select entity per client for
+// choosing its network. Commands from those entities are applied through
+// the reconciler.
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/pricec/vpnmux/pkg/audit"
+	"github.com/pricec/vpnmux/pkg/database"
+	"github.com/pricec/vpnmux/pkg/events"
+	"github.com/pricec/vpnmux/pkg/logging"
+)
+
+// None is the option of a client's select entity which unassigns it from
+// any network.
+const None = "none"
+
+// Payloads of the availability topic.
+const (
+	Online  = "online"
+	Offline = "offline"
+)
+
+const publishTimeout = 10 * time.Second
+
+// ClientNetworks assigns clients to networks, i.e. the reconciler's
+// ClientNetworkReconciler.
+type ClientNetworks interface {
+	Create(ctx context.Context, cn *database.ClientNetwork) (*database.ClientNetwork, error)
+	Update(ctx context.Context, cn *database.ClientNetwork) (*database.ClientNetwork, error)
+	Delete(ctx context.Context, clientID string) error
+}
+
+type Options struct {
+	// URL of the broker, e.g. tcp://localhost:1883.
+	Broker   string
+	Username string
+	Password string
+	// Client ID of the connection, which also distinguishes the entities of
+	// this instance in Home Assistant.
+	ClientID string
+	// Prefix of the state and command topics.
+	TopicPrefix string
+	// Prefix of the Home Assistant discovery topics.
+	DiscoveryPrefix string
+	// Interval at which the tunnel states are republished, if changed.
+	Interval time.Duration
+
+	DB             *database.Database
+	ClientNetworks ClientNetworks
+	// Returns the state of a network's tunnel, or the empty string if it is
+	// not known.
+	TunnelState func(networkID string) string
+	// Changes to resources trigger republishing; optional.
+	Events *events.Broker
+}
+
+// Bridge keeps the topics of the broker in step with the database.
+type Bridge struct {
+	opts   Options
+	client paho.Client
+	wake   chan struct{}
+
+	mu sync.Mutex
+	// Retained topics as last published, and whether all of them must be
+	// published again.
+	published map[string]string
+	republish bool
+	// Network ID of each option of the clients' select entities.
+	options map[string]string
+}
+
+// New returns a bridge which connects to the broker in the background,
+// reconnecting whenever the connection is lost, until ctx is done.
+func New(ctx context.Context, opts Options) (*Bridge, error) {
+	b := &Bridge{
+		opts:      opts,
+		wake:      make(chan struct{}, 1),
+		published: make(map[string]string),
+		options:   make(map[string]string),
+	}
+	ctx = logging.With(ctx, "loop", "mqtt")
+
+	var ch <-chan *database.Event
+	cancel := func() {}
+	if opts.Events != nil {
+		var err error
+		if _, ch, cancel, err = opts.Events.Subscribe(ctx, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	clientOpts := paho.NewClientOptions().
+		AddBroker(opts.Broker).
+		SetClientID(opts.ClientID).
+		SetUsername(opts.Username).
+		SetPassword(opts.Password).
+		SetWill(b.topic("status"), Offline, 1, true).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetOrderMatters(false).
+		SetOnConnectHandler(func(paho.Client) { b.connected(ctx) }).
+		SetConnectionLostHandler(func(_ paho.Client, err error) {
+			logging.Warn(ctx, "lost connection to MQTT broker", "err", err)
+		})
+	b.client = paho.NewClient(clientOpts)
+	b.client.Connect()
+
+	go b.loop(ctx, ch, cancel)
+	return b, nil
+}
+
+// topic returns a state or command topic.
+func (b *Bridge) topic(parts ...string) string {
+	return strings.Join(append([]string{b.opts.TopicPrefix}, parts...), "/")
+}
+
+// discoveryTopic returns the topic of an entity's discovery payload.
+func (b *Bridge) discoveryTopic(component, objectID string) string {
+	return strings.Join([]string{b.opts.DiscoveryPrefix, component, b.opts.ClientID, objectID, "config"}, "/")
+}
+
+// connected subscribes to the command topics, and has every topic
+// published again, since the broker may have lost them. Those of resources
+// deleted meanwhile are still cleared.
+func (b *Bridge) connected(ctx context.Context) {
+	logging.Info(ctx, "connected to MQTT broker", "broker", b.opts.Broker)
+
+	b.client.Subscribe(b.topic("client", "+", "network", "set"), 1, func(_ paho.Client, msg paho.Message) {
+		parts := strings.Split(strings.TrimPrefix(msg.Topic(), b.topic()), "/")
+		if len(parts) != 5 {
+			return
+		}
+		b.command(ctx, parts[2], string(msg.Payload()))
+	})
+
+	b.mu.Lock()
+	b.republish = true
+	b.mu.Unlock()
+	if err := b.publish(b.topic("status"), Online); err != nil {
+		logging.Error(ctx, "error publishing MQTT status", "err", err)
+	}
+	b.trigger()
+}
+
+func (b *Bridge) trigger() {
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+// loop republishes the topics which changed whenever an event is published,
+// a command is applied or the interval elapses, until ctx is done.
+func (b *Bridge) loop(ctx context.Context, ch <-chan *database.Event, cancel func()) {
+	defer cancel()
+	defer b.client.Disconnect(250)
+
+	var tick <-chan time.Time
+	if b.opts.Interval > 0 {
+		ticker := time.NewTicker(b.opts.Interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			if b.client.IsConnectionOpen() {
+				if err := b.publish(b.topic("status"), Offline); err != nil {
+					logging.Warn(ctx, "error publishing MQTT status", "err", err)
+				}
+			}
+			return
+		case _, ok := <-ch:
+			// A dropped subscription is not renewed; the interval still
+			// catches up with any changes.
+			if !ok {
+				ch = nil
+			}
+		case <-tick:
+		case <-b.wake:
+		}
+
+		if !b.client.IsConnectionOpen() {
+			continue
+		}
+		if err := b.sync(ctx); err != nil {
+			logging.Error(ctx, "error publishing MQTT topics", "err", err)
+		}
+	}
+}
+
+// device groups the entities in Home Assistant.
+type device struct {
+	Identifiers []string `json:"identifiers"`
+	Name        string   `json:"name"`
+}
+
+type selectConfig struct {
+	Name              string   `json:"name"`
+	UniqueID          string   `json:"unique_id"`
+	StateTopic        string   `json:"state_topic"`
+	CommandTopic      string   `json:"command_topic"`
+	AvailabilityTopic string   `json:"availability_topic"`
+	Options           []string `json:"options"`
+	Icon              string   `json:"icon"`
+	Device            device   `json:"device"`
+}
+
+type binarySensorConfig struct {
+	Name              string `json:"name"`
+	UniqueID          string `json:"unique_id"`
+	StateTopic        string `json:"state_topic"`
+	AvailabilityTopic string `json:"availability_topic"`
+	ValueTemplate     string `json:"value_template"`
+	DeviceClass       string `json:"device_class"`
+	Device            device `json:"device"`
+}
+
+// topics returns the payload of every retained topic, and the network ID
+// of each option of the clients' select entities.
+func (b *Bridge) topics(ctx context.Context) (map[string]string, map[string]string, error) {
+	nets, err := b.opts.DB.Networks.List(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	clients, err := b.opts.DB.Clients.List(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	cns, err := b.opts.DB.ClientNetworks.List(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dev := device{Identifiers: []string{b.opts.ClientID}, Name: b.opts.ClientID}
+	topics := make(map[string]string)
+	put := func(topic string, v interface{}) error {
+		payload, err := json.Marshal(v)
+		topics[topic] = string(payload)
+		return err
+	}
+
+	// Networks are chosen by name, unless it is ambiguous.
+	names := make(map[string]int)
+	for _, net := range nets {
+		names[net.Name] += 1
+	}
+	options := map[string]string{None: ""}
+	labels := make(map[string]string)
+	for _, net := range nets {
+		label := net.Name
+		if names[label] > 1 || label == None || label == "" {
+			label = net.ID
+		}
+		options[label] = net.ID
+		labels[net.ID] = label
+
+		state := b.opts.TunnelState(net.ID)
+		if state == "" {
+			state = "unknown"
+		}
+		stateTopic := b.topic("network", net.ID, "state")
+		topics[stateTopic] = state
+		err := put(b.discoveryTopic("binary_sensor", "network_"+net.ID), binarySensorConfig{
+			Name:              net.Name + " tunnel",
+			UniqueID:          b.opts.ClientID + "_network_" + net.ID,
+			StateTopic:        stateTopic,
+			AvailabilityTopic: b.topic("status"),
+			ValueTemplate:     "{{ 'ON' if value == 'up' else 'OFF' }}",
+			DeviceClass:       "connectivity",
+			Device:            dev,
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var optionList []string
+	for label := range options {
+		if label != None {
+			optionList = append(optionList, label)
+		}
+	}
+	sort.Strings(optionList)
+	optionList = append([]string{None}, optionList...)
+
+	assigned := make(map[string]string)
+	for _, cn := range cns {
+		assigned[cn.ClientID] = cn.NetworkID
+	}
+	for _, client := range clients {
+		option := None
+		if label, ok := labels[assigned[client.ID]]; ok {
+			option = label
+		}
+
+		stateTopic := b.topic("client", client.ID, "network")
+		topics[stateTopic] = option
+		err := put(b.discoveryTopic("select", "client_"+client.ID), selectConfig{
+			Name:              client.Name + " network",
+			UniqueID:          b.opts.ClientID + "_client_" + client.ID,
+			StateTopic:        stateTopic,
+			CommandTopic:      b.topic("client", client.ID, "network", "set"),
+			AvailabilityTopic: b.topic("status"),
+			Options:           optionList,
+			Icon:              "mdi:vpn",
+			Device:            dev,
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return topics, options, nil
+}
+
+// sync publishes the retained topics which changed since last published,
+// and clears those of deleted networks and clients, which also removes
+// their entities from Home Assistant.
+func (b *Bridge) sync(ctx context.Context) error {
+	topics, options, err := b.topics(ctx)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	b.options = options
+	republish := b.republish
+	b.republish = false
+	published := make(map[string]string, len(b.published))
+	for topic, payload := range b.published {
+		published[topic] = payload
+	}
+	b.mu.Unlock()
+
+	for topic := range published {
+		if _, ok := topics[topic]; !ok {
+			topics[topic] = ""
+		}
+	}
+
+	var errs []string
+	for topic, payload := range topics {
+		if prev, ok := published[topic]; ok && prev == payload && !republish {
+			continue
+		}
+		if err := b.publish(topic, payload); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+
+		b.mu.Lock()
+		if payload == "" {
+			delete(b.published, topic)
+		} else {
+			b.published[topic] = payload
+		}
+		b.mu.Unlock()
+	}
+	if len(errs) > 0 {
+		b.mu.Lock()
+		b.republish = b.republish || republish
+		b.mu.Unlock()
+		return fmt.Errorf("error publishing %d topics: %s", len(errs), errs[0])
+	}
+	return nil
+}
+
+// publish publishes a retained message; an empty payload clears the topic.
+func (b *Bridge) publish(topic, payload string) error {
+	token := b.client.Publish(topic, 1, true, payload)
+	if !token.WaitTimeout(publishTimeout) {
+		return fmt.Errorf("timed out publishing %s", topic)
+	}
+	return token.Error()
+}
+
+// command assigns a client to the network chosen by an option of its
+// select entity, by name or ID, or unassigns it if None is chosen.
+func (b *Bridge) command(ctx context.Context, clientID, option string) {
+	ctx = audit.NewContext(logging.With(ctx, "client", clientID, "option", option), audit.Origin{Actor: "mqtt"})
+	defer b.trigger()
+
+	b.mu.Lock()
+	networkID, ok := b.options[option]
+	b.mu.Unlock()
+	if !ok {
+		if _, err := b.opts.DB.Networks.Get(ctx, option); err != nil {
+			logging.Warn(ctx, "ignoring MQTT command for unknown network")
+			return
+		}
+		networkID = option
+	}
+
+	action, cn, err := b.assign(ctx, clientID, networkID)
+	if err != nil {
+		logging.Error(ctx, "error applying MQTT command", "err", err)
+		return
+	}
+	logging.Info(ctx, "applied MQTT command")
+	if action != "" {
+		b.opts.Events.Publish(ctx, action, "client/network", clientID, cn)
+	}
+}
+
+// assign applies an assignment, returning the type of the event of the
+// change, if any, and the resulting assignment.
+func (b *Bridge) assign(ctx context.Context, clientID, networkID string) (string, *database.ClientNetwork, error) {
+	if _, err := b.opts.DB.Clients.Get(ctx, clientID); err != nil {
+		return "", nil, err
+	}
+
+	_, err := b.opts.DB.ClientNetworks.Get(ctx, clientID)
+	exists := err == nil
+	if err != nil && !errors.Is(err, database.ErrNotFound) {
+		return "", nil, err
+	}
+
+	cn := &database.ClientNetwork{ClientID: clientID, NetworkID: networkID}
+	switch {
+	case networkID == "" && !exists:
+		return "", nil, nil
+	case networkID == "":
+		return events.TypeDelete, nil, b.opts.ClientNetworks.Delete(ctx, clientID)
+	case exists:
+		cn, err = b.opts.ClientNetworks.Update(ctx, cn)
+		return events.TypeUpdate, cn, err
+	default:
+		cn, err = b.opts.ClientNetworks.Create(ctx, cn)
+		return events.TypeCreate, cn, err
+	}
+}
@@ -0,0 +1,306 @@
+package mqtt_test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/pricec/vpnmux/pkg/database"
+	"github.com/pricec/vpnmux/pkg/events"
+	"github.com/pricec/vpnmux/pkg/mqtt"
+	"github.com/stretchr/testify/require"
+)
+
+// broker is a local MQTT broker supporting just enough of MQTT 3.1.1 for
+// the tests: retained messages, wildcard subscriptions and QoS 0 delivery.
+type broker struct {
+	ln       net.Listener
+	mu       sync.Mutex
+	retained map[string][]byte
+	subs     map[*brokerConn][]string
+}
+
+type brokerConn struct {
+	net.Conn
+	mu sync.Mutex
+}
+
+func (c *brokerConn) send(p packets.ControlPacket) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p.Write(c)
+}
+
+func newBroker(t *testing.T) *broker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	b := &broker{
+		ln:       ln,
+		retained: make(map[string][]byte),
+		subs:     make(map[*brokerConn][]string),
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(&brokerConn{Conn: conn})
+		}
+	}()
+	return b
+}
+
+func (b *broker) url() string {
+	return "tcp://" + b.ln.Addr().String()
+}
+
+// matches returns true iff a topic matches a subscription's filter.
+func matches(filter, topic string) bool {
+	f, t := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for i, part := range f {
+		switch {
+		case part == "#":
+			return true
+		case i >= len(t):
+			return false
+		case part != "+" && part != t[i]:
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
+
+func message(topic string, payload []byte, retain bool) *packets.PublishPacket {
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.TopicName = topic
+	p.Payload = payload
+	p.Retain = retain
+	return p
+}
+
+func (b *broker) serve(c *brokerConn) {
+	defer func() {
+		b.mu.Lock()
+		delete(b.subs, c)
+		b.mu.Unlock()
+		c.Close()
+	}()
+
+	for {
+		p, err := packets.ReadPacket(c)
+		if err != nil {
+			return
+		}
+
+		switch p := p.(type) {
+		case *packets.ConnectPacket:
+			c.send(packets.NewControlPacket(packets.Connack))
+		case *packets.SubscribePacket:
+			ack := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			ack.MessageID = p.MessageID
+			ack.ReturnCodes = make([]byte, len(p.Topics))
+			c.send(ack)
+
+			b.mu.Lock()
+			b.subs[c] = append(b.subs[c], p.Topics...)
+			for topic, payload := range b.retained {
+				for _, filter := range p.Topics {
+					if matches(filter, topic) {
+						c.send(message(topic, payload, true))
+						break
+					}
+				}
+			}
+			b.mu.Unlock()
+		case *packets.PublishPacket:
+			if p.Qos > 0 {
+				ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				ack.MessageID = p.MessageID
+				c.send(ack)
+			}
+
+			b.mu.Lock()
+			if p.Retain && len(p.Payload) == 0 {
+				delete(b.retained, p.TopicName)
+			} else if p.Retain {
+				b.retained[p.TopicName] = p.Payload
+			}
+			for sub, filters := range b.subs {
+				for _, filter := range filters {
+					if matches(filter, p.TopicName) {
+						sub.send(message(p.TopicName, p.Payload, false))
+						break
+					}
+				}
+			}
+			b.mu.Unlock()
+		case *packets.PingreqPacket:
+			c.send(packets.NewControlPacket(packets.Pingresp))
+		case *packets.DisconnectPacket:
+			return
+		}
+	}
+}
+
+// observer records the latest message of every topic, as Home Assistant
+// would see them.
+type observer struct {
+	client paho.Client
+	mu     sync.Mutex
+	topics map[string]string
+}
+
+func newObserver(t *testing.T, b *broker) *observer {
+	o := &observer{topics: make(map[string]string)}
+	o.client = paho.NewClient(paho.NewClientOptions().AddBroker(b.url()).SetClientID("observer"))
+	token := o.client.Connect()
+	require.True(t, token.WaitTimeout(5*time.Second))
+	require.Nil(t, token.Error())
+	t.Cleanup(func() { o.client.Disconnect(0) })
+
+	token = o.client.Subscribe("#", 0, func(_ paho.Client, msg paho.Message) {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		o.topics[msg.Topic()] = string(msg.Payload())
+	})
+	require.True(t, token.WaitTimeout(5*time.Second))
+	require.Nil(t, token.Error())
+	return o
+}
+
+// wait waits for a topic's latest message to be the given payload.
+func (o *observer) wait(t *testing.T, topic, payload string) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		v, ok := o.topics[topic]
+		return ok && v == payload
+	}, 5*time.Second, 10*time.Millisecond, "topic %s", topic)
+}
+
+func (o *observer) get(topic string) string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.topics[topic]
+}
+
+// clientNetworks assigns clients in the database only, rather than routing
+// them.
+type clientNetworks struct {
+	db *database.Database
+}
+
+func (c *clientNetworks) Create(ctx context.Context, cn *database.ClientNetwork) (*database.ClientNetwork, error) {
+	return c.db.ClientNetworks.Put(ctx, cn)
+}
+
+func (c *clientNetworks) Update(ctx context.Context, cn *database.ClientNetwork) (*database.ClientNetwork, error) {
+	return cn, c.db.ClientNetworks.Update(ctx, cn)
+}
+
+func (c *clientNetworks) Delete(ctx context.Context, clientID string) error {
+	return c.db.ClientNetworks.Delete(ctx, clientID)
+}
+
+func TestBridge(t *testing.T) {
+	f, err := os.CreateTemp("", "")
+	require.Nil(t, err)
+	f.Close()
+	defer os.Remove(f.Name())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db, err := database.New(ctx, f.Name())
+	require.Nil(t, err)
+
+	cred, err := db.Credentials.Put(ctx, "name", "value")
+	require.Nil(t, err)
+	cfg, err := db.Configs.Put(ctx, &database.Config{
+		Name:     "provider",
+		Host:     "vpn.example.com",
+		UserCred: cred.ID,
+		PassCred: cred.ID,
+		CACred:   cred.ID,
+		OVPNCred: cred.ID,
+	})
+	require.Nil(t, err)
+	net1, err := db.Networks.Put(ctx, &database.Network{Name: "nl", ConfigID: cfg.ID})
+	require.Nil(t, err)
+	net2, err := db.Networks.Put(ctx, &database.Network{Name: "se", ConfigID: cfg.ID})
+	require.Nil(t, err)
+	client, err := db.Clients.Put(ctx, &database.Client{Name: "laptop", Address: "10.0.0.2"})
+	require.Nil(t, err)
+
+	b := newBroker(t)
+	o := newObserver(t, b)
+	broker := events.NewBroker(ctx, db.Events, 100)
+	_, err = mqtt.New(ctx, mqtt.Options{
+		Broker:          b.url(),
+		ClientID:        "vpnmux",
+		TopicPrefix:     "vpnmux",
+		DiscoveryPrefix: "homeassistant",
+		DB:              db,
+		ClientNetworks:  &clientNetworks{db: db},
+		TunnelState: func(id string) string {
+			if id == net1.ID {
+				return "up"
+			}
+			return ""
+		},
+		Events: broker,
+	})
+	require.Nil(t, err)
+
+	o.wait(t, "vpnmux/status", mqtt.Online)
+	o.wait(t, "vpnmux/network/"+net1.ID+"/state", "up")
+	o.wait(t, "vpnmux/network/"+net2.ID+"/state", "unknown")
+	o.wait(t, "vpnmux/client/"+client.ID+"/network", mqtt.None)
+
+	discovery := "homeassistant/select/vpnmux/client_" + client.ID + "/config"
+	require.Eventually(t, func() bool { return o.get(discovery) != "" }, 5*time.Second, 10*time.Millisecond)
+	var config map[string]interface{}
+	require.Nil(t, json.Unmarshal([]byte(o.get(discovery)), &config))
+	require.Equal(t, "laptop network", config["name"])
+	require.Equal(t, "vpnmux/client/"+client.ID+"/network", config["state_topic"])
+	require.Equal(t, "vpnmux/client/"+client.ID+"/network/set", config["command_topic"])
+	require.Equal(t, []interface{}{"none", "nl", "se"}, config["options"])
+	require.NotEmpty(t, o.get("homeassistant/binary_sensor/vpnmux/network_"+net1.ID+"/config"))
+
+	// Choosing a network assigns the client, and then moves it.
+	command := func(option string) {
+		token := o.client.Publish("vpnmux/client/"+client.ID+"/network/set", 1, false, option)
+		require.True(t, token.WaitTimeout(5*time.Second))
+		require.Nil(t, token.Error())
+	}
+	command("nl")
+	o.wait(t, "vpnmux/client/"+client.ID+"/network", "nl")
+	cn, err := db.ClientNetworks.Get(ctx, client.ID)
+	require.Nil(t, err)
+	require.Equal(t, net1.ID, cn.NetworkID)
+
+	command(net2.ID)
+	o.wait(t, "vpnmux/client/"+client.ID+"/network", "se")
+
+	command("bogus")
+	command(mqtt.None)
+	o.wait(t, "vpnmux/client/"+client.ID+"/network", mqtt.None)
+	_, err = db.ClientNetworks.Get(ctx, client.ID)
+	require.Equal(t, database.ErrNotFound, err)
+
+	// Deleting a client removes its entity.
+	require.Nil(t, db.Clients.Delete(ctx, client.ID))
+	broker.Publish(ctx, events.TypeDelete, "client", client.ID, nil)
+	o.wait(t, discovery, "")
+	o.wait(t, "vpnmux/client/"+client.ID+"/network", "")
+}
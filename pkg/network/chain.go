@@ -0,0 +1,187 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+// Chain is an iptables chain owned by vpnmux, whose rules are replaced
+// wholesale whenever they change. The chain is reached by a jump from a
+// built-in chain, optionally restricted by additional match arguments.
+type Chain struct {
+	Table  string
+	Name   string
+	Parent string
+	Match  []string
+	// Command prefixed to every iptables invocation, e.g. to run it in a
+	// container; empty for the host's chains.
+	Prefix []string
+	// Address family of the chain; empty for IPv4.
+	Family string
+
+	// The rules last applied, and the chain's listing once they were.
+	applied string
+	listing string
+}
+
+func NewChain(ctx context.Context, table, name, parent string, match ...string) (*Chain, error) {
+	return newChain(ctx, nil, "", table, name, parent, match...)
+}
+
+// NewChain6 is like NewChain, but for an ip6tables chain.
+func NewChain6(ctx context.Context, table, name, parent string, match ...string) (*Chain, error) {
+	return newChain(ctx, nil, inet6, table, name, parent, match...)
+}
+
+func newChain(ctx context.Context, prefix []string, family, table, name, parent string, match ...string) (*Chain, error) {
+	c := &Chain{
+		Table:  table,
+		Name:   name,
+		Parent: parent,
+		Match:  match,
+		Prefix: prefix,
+		Family: family,
+	}
+
+	if err := c.Ensure(ctx); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Ensure creates the chain and the jump to it if either is missing.
+func (c *Chain) Ensure(ctx context.Context) error {
+	cmd := c.command(ctx, iptables(c.Family), "-t", c.Table, "-n", "-L", c.Name)
+	err := cmd.Run()
+	switch cmd.ProcessState.ExitCode() {
+	case 0:
+	case 1:
+		installed(ctx)
+		if err := c.command(ctx, iptables(c.Family), "-t", c.Table, "-N", c.Name).Run(); err != nil {
+			return fmt.Errorf("iptables -N %s: %w", c.Name, err)
+		}
+	default:
+		return err
+	}
+
+	cmd = c.jumpCommand(ctx, "C")
+	err = cmd.Run()
+	switch cmd.ProcessState.ExitCode() {
+	case 0:
+		return nil
+	case 1:
+	default:
+		return err
+	}
+
+	installed(ctx)
+	if err := c.jumpCommand(ctx, "I").Run(); err != nil {
+		return fmt.Errorf("iptables -I %s: %w", c.Parent, err)
+	}
+	return nil
+}
+
+func (c *Chain) jumpCommand(ctx context.Context, operation string) *cmd {
+	args := []string{"-t", c.Table, fmt.Sprintf("-%s", operation), c.Parent}
+	args = append(args, c.Match...)
+	args = append(args, "-j", c.Name)
+	return c.command(ctx, iptables(c.Family), args...)
+}
+
+// command returns a command running the given program with the chain's
+// prefix.
+func (c *Chain) command(ctx context.Context, name string, args ...string) *cmd {
+	argv := append(append(append([]string{}, c.Prefix...), name), args...)
+	return command(ctx, argv[0], argv[1:]...)
+}
+
+// list returns the rules in the chain, as listed by iptables -S.
+func (c *Chain) list(ctx context.Context) (string, error) {
+	output, err := c.command(ctx, iptables(c.Family), "-t", c.Table, "-S", c.Name).Output()
+	if err != nil {
+		return "", fmt.Errorf("iptables -S %s: %w", c.Name, err)
+	}
+	return string(output), nil
+}
+
+// Replace replaces the rules in the chain with the given rules, each of
+// which is a list of iptables rule-specification arguments. The chain is
+// only rewritten if the rules changed since they were last applied, or the
+// chain no longer holds them, and is rewritten atomically so that packets
+// never see it partially filled.
+func (c *Chain) Replace(ctx context.Context, rules [][]string) error {
+	if err := c.Ensure(ctx); err != nil {
+		return err
+	}
+
+	applied := fmt.Sprint(rules)
+	if applied == c.applied {
+		listing, err := c.list(ctx)
+		if err != nil {
+			return err
+		}
+		if listing == c.listing {
+			return nil
+		}
+	}
+
+	// Declaring the chain flushes it, even with --noflush, and the whole
+	// table is committed at once.
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "*%s\n:%s - [0:0]\n", c.Table, c.Name)
+	for _, rule := range rules {
+		b.WriteString("-A " + c.Name)
+		for _, arg := range rule {
+			b.WriteString(" " + restoreQuote(arg))
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString("COMMIT\n")
+
+	installed(ctx)
+	c.applied, c.listing = "", ""
+	cmd := c.command(ctx, iptables(c.Family)+"-restore", "--noflush")
+	cmd.Stdin = &b
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s-restore %s: %w", iptables(c.Family), c.Name, err)
+	}
+
+	listing, err := c.list(ctx)
+	if err != nil {
+		return err
+	}
+	c.applied, c.listing = applied, listing
+	return nil
+}
+
+// restoreQuote quotes an argument for iptables-restore if it contains
+// whitespace.
+func restoreQuote(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\"") {
+		return arg
+	}
+	return `"` + strings.ReplaceAll(arg, `"`, `\"`) + `"`
+}
+
+func (c *Chain) Close(ctx context.Context) error {
+	var result error
+
+	if err := c.jumpCommand(ctx, "D").Run(); err != nil {
+		result = multierror.Append(result, err)
+	}
+
+	if err := c.command(ctx, iptables(c.Family), "-t", c.Table, "-F", c.Name).Run(); err != nil {
+		result = multierror.Append(result, err)
+	}
+
+	if err := c.command(ctx, iptables(c.Family), "-t", c.Table, "-X", c.Name).Run(); err != nil {
+		result = multierror.Append(result, err)
+	}
+	c.applied, c.listing = "", ""
+
+	return result
+}
@@ -1,100 +1,227 @@
 package network
 
 import (
+	"context"
 	"fmt"
-	"os/exec"
 	"strconv"
+
+	multierror "github.com/hashicorp/go-multierror"
 )
 
+// Client is a host on the LAN. Any of the IPv4 address, IPv6 address or
+// MAC address may be empty (e.g. if a host identified by MAC address has
+// no lease yet). The addresses may also be subnets in CIDR notation,
+// covering every host in them.
 type Client struct {
 	Address      string
+	Address6     string
+	MAC          string
 	LANInterface string
 	WANInterface string
 }
 
-func NewClient(address, lanInterface, wanInterface string) (*Client, error) {
+func NewClient(ctx context.Context, address, address6, mac, lanInterface, wanInterface string) (*Client, error) {
 	c := &Client{
 		Address:      address,
+		Address6:     address6,
+		MAC:          mac,
 		LANInterface: lanInterface,
 		WANInterface: wanInterface,
 	}
 
-	if err := c.preventForwarding(); err != nil {
+	if err := c.preventForwarding(ctx); err != nil {
 		return nil, err
 	}
 	return c, nil
 }
 
-func (c *Client) Close() error {
-	return c.iptablesCommand("D").Run()
+func (c *Client) Close(ctx context.Context) error {
+	var result error
+
+	for _, family := range []string{inet, inet6} {
+		for _, match := range c.matches(family) {
+			if err := c.iptablesCommand(ctx, family, "D", match).Run(); err != nil {
+				result = multierror.Append(result, err)
+			}
+		}
+	}
+
+	if err := c.UnblockIPv6(ctx); err != nil {
+		result = multierror.Append(result, err)
+	}
+
+	return result
+}
+
+// address returns the client's address in the given family.
+func (c *Client) address(family string) string {
+	if family == inet6 {
+		return c.Address6
+	}
+	return c.Address
+}
+
+// matches returns the iptables match arguments identifying the client's
+// packets in the given family: by source address, and by source MAC
+// address so that the host stays blocked even if its address changes.
+func (c *Client) matches(family string) [][]string {
+	var result [][]string
+	if address := c.address(family); address != "" {
+		result = append(result, []string{"-s", address})
+	}
+	if c.MAC != "" {
+		result = append(result, []string{"-m", "mac", "--mac-source", c.MAC})
+	}
+	return result
 }
 
-func (c *Client) iptablesCommand(operation string) *exec.Cmd {
-	return exec.Command(
-		"iptables",
+func (c *Client) iptablesCommand(ctx context.Context, family, operation string, match []string) *cmd {
+	args := []string{
 		"-t", "filter",
 		fmt.Sprintf("-%s", operation), "FORWARD",
 		"-i", c.LANInterface,
 		"-o", c.WANInterface,
-		"-s", c.Address,
-		"-j", "DROP",
-	)
+	}
+	args = append(args, match...)
+	args = append(args, "-j", "DROP")
+	return command(ctx, iptables(family), args...)
 }
 
-func (c *Client) preventForwarding() error {
+func (c *Client) preventForwarding(ctx context.Context) error {
 	// Ensure packets are not forwarded from LAN -> WAN, since
 	// they should be routed via one of the managed VPNs.
 	// TODO: use library code instead of exec
-	cmd := c.iptablesCommand("C")
-	// Note that this command can return nonzero if the rule exists
-	err := cmd.Run()
-	switch cmd.ProcessState.ExitCode() {
-	case 0:
-		return nil
-	case 1:
-	default:
-		return err
-	}
-
-	return c.iptablesCommand("A").Run()
-}
-
-func (c *Client) SetRouteTable(id int) error {
-	routeTableIDs, err := routeTableIDsForSelector("from", c.Address)
-	if err != nil {
-		return err
-	}
+	for _, family := range []string{inet, inet6} {
+		for _, match := range c.matches(family) {
+			cmd := c.iptablesCommand(ctx, family, "C", match)
+			// Note that this command can return nonzero if the rule exists
+			err := cmd.Run()
+			switch cmd.ProcessState.ExitCode() {
+			case 0:
+				continue
+			case 1:
+			default:
+				return err
+			}
 
-	found := false
-	for _, routeTableID := range routeTableIDs {
-		if routeTableID != id {
-			err = exec.Command("ip", "rule", "del", "from", c.Address, "lookup", strconv.Itoa(routeTableID)).Run()
-			if err != nil {
+			installed(ctx)
+			if err := c.iptablesCommand(ctx, family, "A", match).Run(); err != nil {
 				return err
 			}
-		} else {
-			found = true
 		}
 	}
+	return nil
+}
 
-	if !found {
-		return exec.Command("ip", "rule", "add", "from", c.Address, "lookup", strconv.Itoa(id)).Run()
+// AllowWAN returns the rules which accept the client's packets despite its
+// kill switch, for a chain reached from FORWARD by packets from the LAN to
+// the WAN interface, in the IPv4 and IPv6 chains respectively.
+func (c *Client) AllowWAN() (rules, rules6 [][]string) {
+	for _, match := range c.matches(inet) {
+		rules = append(rules, append(match, "-j", "ACCEPT"))
 	}
+	for _, match := range c.matches(inet6) {
+		rules6 = append(rules6, append(match, "-j", "ACCEPT"))
+	}
+	return rules, rules6
+}
 
+func (c *Client) blockRules() [][]string {
+	var result [][]string
+	for _, match := range c.matches(inet6) {
+		rule := append([]string{"-i", c.LANInterface}, match...)
+		result = append(result, append(rule, "-j", "REJECT", "--reject-with", "icmp6-adm-prohibited"))
+	}
+	return result
+}
+
+// BlockIPv6 rejects every IPv6 packet forwarded from the client, e.g. while
+// it is assigned to a network without IPv6. Rejecting rather than dropping
+// lets dual-stack hosts fall back to IPv4 quickly.
+func (c *Client) BlockIPv6(ctx context.Context) error {
+	for _, rule := range c.blockRules() {
+		if err := ensureRule(ctx, inet6, "I", "filter", "FORWARD", rule...); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (c *Client) ClearRoutes() error {
-	routeTableIDs, err := routeTableIDsForSelector("from", c.Address)
-	if err != nil {
-		return err
+func (c *Client) UnblockIPv6(ctx context.Context) error {
+	var result error
+	for _, rule := range c.blockRules() {
+		if err := removeRule(ctx, inet6, "filter", "FORWARD", rule...); err != nil {
+			result = multierror.Append(result, err)
+		}
 	}
+	return result
+}
+
+func (c *Client) SetRouteTable(ctx context.Context, id int) error {
+	return c.setRouteTable(ctx, id, sourceRulePriority)
+}
+
+// SetGroupRouteTable routes the client via the given table as a member of
+// a group, at a lower priority than any table set by SetRouteTable.
+func (c *Client) SetGroupRouteTable(ctx context.Context, id int) error {
+	return c.setRouteTable(ctx, id, groupRulePriority)
+}
+
+func (c *Client) setRouteTable(ctx context.Context, id int, priority string) error {
+	for _, family := range []string{inet, inet6} {
+		address := c.address(family)
+		if address == "" {
+			continue
+		}
 
-	for _, routeTableID := range routeTableIDs {
-		err = exec.Command("ip", "rule", "del", "from", c.Address, "lookup", strconv.Itoa(routeTableID)).Run()
+		rules, err := rulesForSelector(ctx, family, "from", address)
 		if err != nil {
 			return err
 		}
+
+		// A rule of the right table at another priority, e.g. one set as
+		// a group member, is replaced so that precedence is kept.
+		found := false
+		for _, rule := range rules {
+			if rule.table != id || rule.priority != priority {
+				err = command(ctx, "ip", family, "rule", "del", "priority", rule.priority, "from", address, "lookup", strconv.Itoa(rule.table)).Run()
+				if err != nil {
+					return err
+				}
+			} else {
+				found = true
+			}
+		}
+
+		if !found {
+			installed(ctx)
+			err = command(ctx, "ip", family, "rule", "add", "from", address, "lookup", strconv.Itoa(id), "priority", priority).Run()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Client) ClearRoutes(ctx context.Context) error {
+	for _, family := range []string{inet, inet6} {
+		address := c.address(family)
+		if address == "" {
+			continue
+		}
+
+		routeTableIDs, err := routeTableIDsForSelector(ctx, family, "from", address)
+		if err != nil {
+			return err
+		}
+
+		for _, routeTableID := range routeTableIDs {
+			err = command(ctx, "ip", family, "rule", "del", "from", address, "lookup", strconv.Itoa(routeTableID)).Run()
+			if err != nil {
+				return err
+			}
+		}
 	}
 	return nil
 }
@@ -0,0 +1,29 @@
+package network_test
+
+import (
+	"testing"
+
+	"github.com/pricec/vpnmux/pkg/network"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAllowWAN(t *testing.T) {
+	c := &network.Client{
+		Address:  "192.168.0.10",
+		Address6: "fd00::10",
+		MAC:      "aa:bb:cc:dd:ee:01",
+	}
+	rules, rules6 := c.AllowWAN()
+	require.Equal(t, [][]string{
+		{"-s", "192.168.0.10", "-j", "ACCEPT"},
+		{"-m", "mac", "--mac-source", "aa:bb:cc:dd:ee:01", "-j", "ACCEPT"},
+	}, rules)
+	require.Equal(t, [][]string{
+		{"-s", "fd00::10", "-j", "ACCEPT"},
+		{"-m", "mac", "--mac-source", "aa:bb:cc:dd:ee:01", "-j", "ACCEPT"},
+	}, rules6)
+
+	rules, rules6 = (&network.Client{Address: "192.168.0.11"}).AllowWAN()
+	require.Equal(t, [][]string{{"-s", "192.168.0.11", "-j", "ACCEPT"}}, rules)
+	require.Empty(t, rules6)
+}
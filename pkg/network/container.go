@@ -1,15 +1,35 @@
 package network
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"os/exec"
 	"strconv"
+	"strings"
 
 	"github.com/hashicorp/go-multierror"
 	"github.com/pricec/vpnmux/pkg/openvpn"
 )
 
+// File in which the VPN image's up script records pushed DNS servers.
+const pushedDNSFile = "/run/vpnmux/dns"
+
+// Interface of the VPN tunnel within the container.
+const tunnelInterface = "tun0"
+
+var (
+	// ErrNoContainer is returned (wrapped) when a network has no VPN
+	// container.
+	ErrNoContainer = errors.New("no container")
+	// ErrContainerStopped is returned (wrapped) when a network's VPN
+	// container is not running.
+	ErrContainerStopped = errors.New("container is not running")
+	// ErrNoNetwork is returned (wrapped) when a network has no docker
+	// network.
+	ErrNoNetwork = errors.New("no docker network")
+)
+
 type ContainerInspectOutput struct {
 	ID    string   `json:"Id"`
 	Args  []string `json:"Args"`
@@ -31,10 +51,11 @@ type ContainerInspectOutput struct {
 	} `json:"Config"`
 	NetworkSettings struct {
 		Networks map[string]struct {
-			Gateway     string `json:"Gateway"`
-			IPAddress   string `json:"IPAddress"`
-			IPPrefixLen int    `json:"IPPrefixLen"`
-			MacAddress  string `json:"MacAddress"`
+			Gateway           string `json:"Gateway"`
+			IPAddress         string `json:"IPAddress"`
+			IPPrefixLen       int    `json:"IPPrefixLen"`
+			GlobalIPv6Address string `json:"GlobalIPv6Address"`
+			MacAddress        string `json:"MacAddress"`
 		} `json:"Networks"`
 	} `json:"NetworkSettings"`
 }
@@ -46,17 +67,16 @@ type Container struct {
 	Name         string
 	RouteTableID int
 	IPAddress    string
+	// Empty unless the container's network has IPv6.
+	IPAddress6 string
 }
 
-func NewContainer(id, image, subnet string, cfg *openvpn.Config) (*Container, error) {
+// NewContainer runs the VPN container of a network, whose default route is
+// installed in the given route table.
+func NewContainer(ctx context.Context, id, image, subnet string, routeTableID int, v6 *IPv6, cfg *openvpn.Config) (*Container, error) {
 	// TODO: use docker library instead of exec
-	routeTableID, err := unusedRouteTableID()
-	if err != nil {
-		return nil, err
-	}
-
-	output, err := exec.Command(
-		"docker", "run",
+	args := []string{
+		"run",
 		"--network", id,
 		"--restart", "unless-stopped",
 		"--cap-add", "NET_ADMIN",
@@ -69,24 +89,33 @@ func NewContainer(id, image, subnet string, cfg *openvpn.Config) (*Container, er
 		"--label", fmt.Sprintf("id=%s", id),
 		"--label", fmt.Sprintf("config-id=%s", cfg.ID),
 		"--label", fmt.Sprintf("route-table-id=%d", routeTableID),
-		"-d", image, "openvpn.conf",
-	).CombinedOutput()
+	}
+	if v6 != nil {
+		args = append(args,
+			"--sysctl", "net.ipv6.conf.all.forwarding=1",
+			"-e", fmt.Sprintf("LOCAL_SUBNET6_CIDR=%s", v6.LocalSubnet),
+		)
+	}
+	args = append(args, "-d", image, "openvpn.conf")
+
+	err := command(ctx, "docker", args...).Run()
 	if err != nil {
-		return nil, fmt.Errorf("running container: %w; %v", err, string(output))
+		return nil, fmt.Errorf("running container: %w", err)
 	}
 	// TODO: clean up if this fails?
-	return NewContainerFromID(id)
+	return NewContainerFromID(ctx, id)
 }
 
-func NewContainerFromID(id string) (*Container, error) {
-	// TODO: what if output is empty? we crash.
-	output, err := exec.Command("docker", "ps", "-q", "--filter", fmt.Sprintf("label=id=%s", id)).Output()
+func NewContainerFromID(ctx context.Context, id string) (*Container, error) {
+	output, err := command(ctx, "docker", "ps", "-q", "--filter", fmt.Sprintf("label=id=%s", id)).Output()
 	if err != nil {
 		return nil, fmt.Errorf("listing containers: %w", err)
+	} else if len(output) == 0 {
+		return nil, missingContainer(ctx, id)
 	}
 
 	dockerID := string(output[:len(output)-1])
-	output, err = exec.Command("docker", "inspect", dockerID).Output()
+	output, err = command(ctx, "docker", "inspect", dockerID).Output()
 	if err != nil {
 		return nil, fmt.Errorf("inspecting container: %w", err)
 	}
@@ -112,45 +141,218 @@ func NewContainerFromID(id string) (*Container, error) {
 		DockerID:     dockerID,
 		Name:         inspect[0].Name,
 		IPAddress:    inspect[0].NetworkSettings.Networks[id].IPAddress,
+		IPAddress6:   inspect[0].NetworkSettings.Networks[id].GlobalIPv6Address,
 		RouteTableID: routeTableID,
 	}
 
-	if err := v.configureRouting(); err != nil {
+	if err := v.configureRouting(ctx); err != nil {
 		return nil, err
 	}
 	return v, nil
 }
 
-func (v *Container) configureRouting() error {
-	exists, ip, err := defaultRouteForTable(v.RouteTableID)
+func (v *Container) configureRouting(ctx context.Context) error {
+	if err := v.configureDefaultRoute(ctx, inet, v.IPAddress); err != nil {
+		return err
+	}
+	if v.IPAddress6 != "" {
+		return v.configureDefaultRoute(ctx, inet6, v.IPAddress6)
+	}
+	return nil
+}
+
+func (v *Container) configureDefaultRoute(ctx context.Context, family, address string) error {
+	exists, ip, err := defaultRouteForTable(ctx, family, v.RouteTableID)
 	if err != nil {
 		return err
 	}
 
-	if exists && ip == v.IPAddress {
+	if exists && ip == address {
 		return nil
 	} else if exists {
-		if err := exec.Command("ip", "route", "del", "default", "table", strconv.Itoa(v.RouteTableID)).Run(); err != nil {
+		if err := command(ctx, "ip", family, "route", "del", "default", "table", strconv.Itoa(v.RouteTableID)).Run(); err != nil {
 			return fmt.Errorf("ip route del default: %w", err)
 		}
 	}
 
-	output, err := exec.Command("ip", "route", "add", "default", "via", v.IPAddress, "table", strconv.Itoa(v.RouteTableID)).CombinedOutput()
+	installed(ctx)
+	err = command(ctx, "ip", family, "route", "add", "default", "via", address, "table", strconv.Itoa(v.RouteTableID)).Run()
 	if err != nil {
-		fmt.Println(string(output))
 		return fmt.Errorf("ip route add default: %w", err)
 	}
 	return nil
 }
 
-func (v *Container) Close() error {
+func (v *Container) Close(ctx context.Context) error {
 	var result error
 
-	if err := exec.Command("docker", "rm", "-f", v.DockerID).Run(); err != nil {
+	if err := command(ctx, "docker", "rm", "-f", v.DockerID).Run(); err != nil {
 		result = multierror.Append(result, err)
 	}
 
 	// TODO: clean up routing rules?
+	if err := flushRouteTable(ctx, v.RouteTableID); err != nil {
+		result = multierror.Append(result, err)
+	}
 
 	return result
 }
+
+// flushRouteTable removes every route from the given route table.
+func flushRouteTable(ctx context.Context, id int) error {
+	if err := command(ctx, "ip", "route", "flush", "table", strconv.Itoa(id)).Run(); err != nil {
+		return err
+	}
+	// An error here most likely means IPv6 is disabled on the host.
+	_ = command(ctx, "ip", "-6", "route", "flush", "table", strconv.Itoa(id)).Run()
+	return nil
+}
+
+// missingContainer returns the error for a network without a running
+// container: ErrNoContainer if it has none, so that it may be rebuilt, or
+// ErrContainerStopped if it has a stopped one, which is left alone.
+func missingContainer(ctx context.Context, id string) error {
+	output, err := command(ctx, "docker", "ps", "-aq", "--filter", fmt.Sprintf("label=id=%s", id)).Output()
+	if err != nil {
+		return fmt.Errorf("listing containers: %w", err)
+	} else if len(output) != 0 {
+		return fmt.Errorf("network %s: %w", id, ErrContainerStopped)
+	}
+	return fmt.Errorf("network %s: %w", id, ErrNoContainer)
+}
+
+// RemoveContainers removes every VPN container of a network, running or
+// not, e.g. before it is rebuilt.
+func RemoveContainers(ctx context.Context, id string) error {
+	output, err := command(ctx, "docker", "ps", "-aq", "--filter", fmt.Sprintf("label=id=%s", id)).Output()
+	if err != nil {
+		return fmt.Errorf("listing containers: %w", err)
+	}
+
+	for _, dockerID := range strings.Fields(string(output)) {
+		if err := command(ctx, "docker", "rm", "-f", dockerID).Run(); err != nil {
+			return fmt.Errorf("removing container: %w", err)
+		}
+	}
+	return nil
+}
+
+// RouteMark ensures that packets carrying the given firewall mark are
+// routed via this container's route table, including IPv6 packets if the
+// container carries IPv6.
+func (v *Container) RouteMark(ctx context.Context, mark int) error {
+	if err := v.routeMark(ctx, inet, mark); err != nil {
+		return err
+	}
+	if v.IPAddress6 != "" {
+		return v.routeMark(ctx, inet6, mark)
+	}
+	// IPv6 may be disabled on the host, leaving no rules to clear.
+	_ = clearMark(ctx, inet6, mark)
+	return nil
+}
+
+func (v *Container) routeMark(ctx context.Context, family string, mark int) error {
+	selector := fmt.Sprintf("0x%x", mark)
+	routeTableIDs, err := routeTableIDsForSelector(ctx, family, "fwmark", selector)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for _, routeTableID := range routeTableIDs {
+		if routeTableID != v.RouteTableID {
+			err = command(ctx, "ip", family, "rule", "del", "fwmark", selector, "lookup", strconv.Itoa(routeTableID)).Run()
+			if err != nil {
+				return fmt.Errorf("ip rule del fwmark: %w", err)
+			}
+		} else {
+			found = true
+		}
+	}
+
+	if !found {
+		installed(ctx)
+		err = command(ctx, "ip", family, "rule", "add", "fwmark", selector, "lookup", strconv.Itoa(v.RouteTableID), "priority", markRulePriority).Run()
+		if err != nil {
+			return fmt.Errorf("ip rule add fwmark: %w", err)
+		}
+	}
+	return nil
+}
+
+func (v *Container) ClearMark(ctx context.Context, mark int) error {
+	return ClearMark(ctx, mark)
+}
+
+// ClearMark removes the rules routing packets carrying the given firewall
+// mark, e.g. those of a network whose container is gone.
+func ClearMark(ctx context.Context, mark int) error {
+	if err := clearMark(ctx, inet, mark); err != nil {
+		return err
+	}
+	// IPv6 may be disabled on the host, leaving no rules to clear.
+	_ = clearMark(ctx, inet6, mark)
+	return nil
+}
+
+func clearMark(ctx context.Context, family string, mark int) error {
+	selector := fmt.Sprintf("0x%x", mark)
+	routeTableIDs, err := routeTableIDsForSelector(ctx, family, "fwmark", selector)
+	if err != nil {
+		return err
+	}
+
+	for _, routeTableID := range routeTableIDs {
+		err = command(ctx, "ip", family, "rule", "del", "fwmark", selector, "lookup", strconv.Itoa(routeTableID)).Run()
+		if err != nil {
+			return fmt.Errorf("ip rule del fwmark: %w", err)
+		}
+	}
+	return nil
+}
+
+// PushedDNS returns the DNS servers pushed to the container by the
+// OpenVPN server, as recorded by the image's up script. If nothing has
+// been recorded (e.g. the tunnel is not yet up), no servers are returned.
+func (v *Container) PushedDNS(ctx context.Context) ([]string, error) {
+	cmd := command(ctx, "docker", "exec", v.DockerID, "cat", pushedDNSFile)
+	output, err := cmd.Output()
+	if err != nil {
+		if cmd.ProcessState != nil && cmd.ProcessState.ExitCode() == 1 {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("reading pushed DNS servers: %w", err)
+	}
+
+	var servers []string
+	for _, line := range strings.Split(string(output), "\n") {
+		server := strings.TrimSpace(line)
+		if server != "" {
+			servers = append(servers, server)
+		}
+	}
+	return servers, nil
+}
+
+// TunnelStats returns the counters of the container's tunnel interface, or
+// nil if the tunnel is down. The counters restart from zero whenever the
+// tunnel is re-established.
+func (v *Container) TunnelStats(ctx context.Context) (*InterfaceStats, error) {
+	output, err := command(ctx, "docker", "exec", v.DockerID, "cat", "/proc/net/dev").Output()
+	if err != nil {
+		return nil, fmt.Errorf("reading interface statistics: %w", err)
+	}
+	return ParseNetDev(tunnelInterface, output)
+}
+
+// NewChain creates a chain in the container's network namespace, e.g. to
+// rewrite packets arriving through the tunnel.
+func (v *Container) NewChain(ctx context.Context, table, name, parent string, match ...string) (*Chain, error) {
+	return newChain(ctx, []string{"docker", "exec", "-i", v.DockerID}, "", table, name, parent, match...)
+}
+
+// TunnelInterface returns the name of the container's tunnel interface.
+func (v *Container) TunnelInterface() string {
+	return tunnelInterface
+}
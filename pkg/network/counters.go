@@ -0,0 +1,102 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Counter is a packet and byte count, e.g. of an iptables rule or a
+// network interface.
+type Counter struct {
+	Packets uint64
+	Bytes   uint64
+}
+
+var reCounterRule = regexp.MustCompile(`^\[(\d+):(\d+)\] -A (\S+) .*--comment ("[^"]*"|\S+)`)
+
+// ParseCounters parses the output of iptables-save -c, returning the
+// counters of the rules in the given chain keyed by their comment. The
+// counters of rules sharing a comment are summed; rules without a comment
+// are ignored.
+func ParseCounters(chain string, output []byte) (map[string]Counter, error) {
+	result := make(map[string]Counter)
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		m := reCounterRule.FindStringSubmatch(scanner.Text())
+		if m == nil || m[3] != chain {
+			continue
+		}
+
+		packets, err := strconv.ParseUint(m[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parsing packet count: %w", err)
+		}
+		bytes, err := strconv.ParseUint(m[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parsing byte count: %w", err)
+		}
+
+		comment := strings.Trim(m[4], `"`)
+		c := result[comment]
+		c.Packets += packets
+		c.Bytes += bytes
+		result[comment] = c
+	}
+	return result, scanner.Err()
+}
+
+// Counters returns the counters of the chain's rules, keyed by the rules'
+// comments.
+func (c *Chain) Counters(ctx context.Context) (map[string]Counter, error) {
+	output, err := c.command(ctx, "iptables-save", "-c", "-t", c.Table).Output()
+	if err != nil {
+		return nil, fmt.Errorf("iptables-save: %w", err)
+	}
+	return ParseCounters(c.Name, output)
+}
+
+// InterfaceStats are the receive and transmit counters of a network
+// interface.
+type InterfaceStats struct {
+	Rx Counter
+	Tx Counter
+}
+
+// ParseNetDev parses the contents of /proc/net/dev, returning the
+// statistics of the given interface, or nil if there is no such interface.
+func ParseNetDev(iface string, output []byte) (*InterfaceStats, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) != iface {
+			continue
+		}
+
+		// Receive bytes, packets, errs, drop, fifo, frame, compressed,
+		// multicast; then transmit bytes, packets, ...
+		fields := strings.Fields(parts[1])
+		if len(fields) < 10 {
+			return nil, fmt.Errorf("unexpected statistics for %s: %q", iface, parts[1])
+		}
+
+		var values [4]uint64
+		for i, field := range []string{fields[0], fields[1], fields[8], fields[9]} {
+			value, err := strconv.ParseUint(field, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("parsing statistics for %s: %w", iface, err)
+			}
+			values[i] = value
+		}
+		return &InterfaceStats{
+			Rx: Counter{Bytes: values[0], Packets: values[1]},
+			Tx: Counter{Bytes: values[2], Packets: values[3]},
+		}, nil
+	}
+	return nil, scanner.Err()
+}
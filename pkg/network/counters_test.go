@@ -0,0 +1,53 @@
+package network_test
+
+import (
+	"testing"
+
+	"github.com/pricec/vpnmux/pkg/network"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCounters(t *testing.T) {
+	output := []byte(`# Generated by iptables-save v1.8.7 on Mon Jan  1 00:00:00 2024
+*filter
+:INPUT ACCEPT [0:0]
+:FORWARD ACCEPT [100:20000]
+:VPNMUX-ACCT - [0:0]
+[100:20000] -A FORWARD -j VPNMUX-ACCT
+[3:180] -A VPNMUX-ACCT -s 192.168.1.10/32 -o br-0123456789ab -m comment --comment "a:n:tx" -j RETURN
+[5:7000] -A VPNMUX-ACCT -d 192.168.1.10/32 -i br-0123456789ab -m comment --comment "a:n:rx" -j RETURN
+[1:60] -A VPNMUX-ACCT -s 192.168.1.11/32 -o br-0123456789ab -m comment --comment b:n:tx -j RETURN
+[2:120] -A VPNMUX-ACCT -s 192.168.1.12/32 -o br-0123456789ab -m comment --comment b:n:tx -j RETURN
+[9:900] -A VPNMUX-ACCT -s 192.168.1.13/32 -j RETURN
+[7:700] -A OTHER -m comment --comment "a:n:tx" -j RETURN
+COMMIT
+`)
+
+	counters, err := network.ParseCounters("VPNMUX-ACCT", output)
+	require.Nil(t, err)
+	require.Equal(t, map[string]network.Counter{
+		"a:n:tx": {Packets: 3, Bytes: 180},
+		"a:n:rx": {Packets: 5, Bytes: 7000},
+		"b:n:tx": {Packets: 3, Bytes: 180},
+	}, counters)
+}
+
+func TestParseNetDev(t *testing.T) {
+	output := []byte(`Inter-|   Receive                                                |  Transmit
+ face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed
+    lo:     100       2    0    0    0     0          0         0      100       2    0    0    0     0       0          0
+  eth0: 1234567    1000    0    0    0     0          0         0   765432     900    0    0    0     0       0          0
+  tun0:   50000      40    0    0    0     0          0         0    20000      30    0    0    0     0       0          0
+`)
+
+	stats, err := network.ParseNetDev("tun0", output)
+	require.Nil(t, err)
+	require.Equal(t, &network.InterfaceStats{
+		Rx: network.Counter{Bytes: 50000, Packets: 40},
+		Tx: network.Counter{Bytes: 20000, Packets: 30},
+	}, stats)
+
+	stats, err = network.ParseNetDev("tun1", output)
+	require.Nil(t, err)
+	require.Nil(t, stats)
+}
@@ -3,7 +3,6 @@ package network
 import (
 	"context"
 	"fmt"
-	"os/exec"
 	"strconv"
 
 	multierror "github.com/hashicorp/go-multierror"
@@ -17,43 +16,48 @@ type DNSRouter struct {
 }
 
 // TODO: how to prevent multiple creation? It only seems possible to use
-//       iptables -C if the mark value is known, but what if someone else
-//       instantiated us with a different mark?
+// iptables -C if the mark value is known, but what if someone else
+// instantiated us with a different mark?
 func NewDNSRouter(ctx context.Context, mark, localSubnet string) (*DNSRouter, error) {
 	r := &DNSRouter{
 		Mark:        mark,
 		LocalSubnet: localSubnet,
 	}
 
-	if err := r.ensureMark(); err != nil {
+	if err := r.ensureMark(ctx); err != nil {
 		return nil, err
 	}
 
 	return r, nil
 }
 
-func (r *DNSRouter) Close() error {
+func (r *DNSRouter) Close(ctx context.Context) error {
 	var result error
 
-	if err := r.iptablesCommand("D", "udp").Run(); err != nil {
+	if err := r.iptablesCommand(ctx, "D", "udp").Run(); err != nil {
 		result = multierror.Append(result, err)
 	}
 
-	if err := r.iptablesCommand("D", "tcp").Run(); err != nil {
+	if err := r.iptablesCommand(ctx, "D", "tcp").Run(); err != nil {
 		result = multierror.Append(result, err)
 	}
 
 	return result
 }
 
-func (r *DNSRouter) ensureMark() error {
+func (r *DNSRouter) ensureMark(ctx context.Context) error {
 	for _, proto := range []string{"tcp", "udp"} {
-		cmd := r.iptablesCommand("C", proto)
+		// Earlier versions also marked packets already carrying a mark.
+		legacy := append(append([]string{"-t", "mangle", "-D", "OUTPUT"}, r.match(proto)...), "-j", "MARK", "--set-mark", r.Mark)
+		_ = command(ctx, "iptables", legacy...).Run()
+
+		cmd := r.iptablesCommand(ctx, "C", proto)
 		err := cmd.Run()
 		switch cmd.ProcessState.ExitCode() {
 		case 0:
 		case 1:
-			if err := r.iptablesCommand("A", proto).Run(); err != nil {
+			installed(ctx)
+			if err := r.iptablesCommand(ctx, "A", proto).Run(); err != nil {
 				return err
 			}
 		default:
@@ -63,50 +67,78 @@ func (r *DNSRouter) ensureMark() error {
 	return nil
 }
 
-func (r *DNSRouter) iptablesCommand(operation, proto string) *exec.Cmd {
-	return exec.Command(
-		"iptables",
-		"-t", "mangle",
-		fmt.Sprintf("-%s", operation), "OUTPUT",
-		"-p", proto,
-		"--dport", "53",
-		"!", "-d", r.LocalSubnet,
+func (r *DNSRouter) iptablesCommand(ctx context.Context, operation, proto string) *cmd {
+	args := append([]string{"-t", "mangle", fmt.Sprintf("-%s", operation), "OUTPUT"}, r.Rule(proto)...)
+	return command(ctx, "iptables", args...)
+}
+
+func (r *DNSRouter) match(proto string) []string {
+	return []string{"-p", proto, "--dport", "53", "!", "-d", r.LocalSubnet}
+}
+
+// Rule returns the rule of the mangle OUTPUT chain which marks the host's
+// DNS queries of the given protocol. Queries already carrying a mark, e.g.
+// those of a network's forwarder, keep it.
+func (r *DNSRouter) Rule(proto string) []string {
+	return append(r.match(proto),
+		"-m", "mark", "--mark", "0",
 		"-j", "MARK",
 		"--set-mark", r.Mark,
 	)
 }
 
-func (r *DNSRouter) Route(via string) error {
-	ids, err := routeTableIDsForSelector("fwmark", r.Mark)
+// Table returns the route table which the mark currently routes to, or 0
+// if it routes to none, e.g. to keep the table of an earlier run.
+func (r *DNSRouter) Table(ctx context.Context) (int, error) {
+	ids, err := routeTableIDsForSelector(ctx, inet, "fwmark", r.Mark)
+	if err != nil || len(ids) == 0 {
+		return 0, err
+	}
+	return ids[0], nil
+}
+
+// Route routes DNS queries via the given address, using the given route
+// table; the rules of any other table are removed.
+func (r *DNSRouter) Route(ctx context.Context, via string, rtid int) error {
+	ids, err := routeTableIDsForSelector(ctx, inet, "fwmark", r.Mark)
 	if err != nil {
 		return err
 	}
 
-	if len(ids) == 0 {
-		return r.setupTable(via)
+	found := false
+	for _, id := range ids {
+		if id == rtid {
+			found = true
+			continue
+		}
+		if err := command(ctx, "ip", "rule", "del", "fwmark", r.Mark, "lookup", strconv.Itoa(id)).Run(); err != nil {
+			return fmt.Errorf("ip rule del fwmark: %w", err)
+		}
+		// The table may have been emptied already.
+		_ = command(ctx, "ip", "route", "del", "default", "table", strconv.Itoa(id)).Run()
+	}
+
+	if !found {
+		return r.setupTable(ctx, via, rtid)
 	}
 
-	exists, gateway, err := defaultRouteForTable(ids[0])
+	exists, gateway, err := defaultRouteForTable(ctx, inet, rtid)
 	if !exists {
 		// TODO: is there a better way to handle this case?
-		return fmt.Errorf("no default route for table %d: %v", ids[0], err)
+		return fmt.Errorf("no default route for table %d: %v", rtid, err)
 	}
 
-	r.RouteTableID = ids[0]
+	r.RouteTableID = rtid
 	r.Gateway = gateway
 	return nil
 }
 
-func (r *DNSRouter) setupTable(via string) error {
+func (r *DNSRouter) setupTable(ctx context.Context, via string, rtid int) error {
 	// TODO: check if we are already routing via `via`
 	// Create routing table, default via `via`
-	rtid, err := unusedRouteTableID()
-	if err != nil {
-		return err
-	}
-
-	err = exec.Command(
-		"ip", "route", "add",
+	installed(ctx)
+	err := command(ctx,
+		"ip", "route", "replace",
 		"default", "via", via, "table", strconv.Itoa(rtid),
 	).Run()
 	if err != nil {
@@ -114,7 +146,7 @@ func (r *DNSRouter) setupTable(via string) error {
 	}
 
 	// Create RPDB rule, lookup on r.Mark
-	err = exec.Command("ip", "rule", "add", "fwmark", r.Mark, "lookup", strconv.Itoa(rtid)).Run()
+	err = command(ctx, "ip", "rule", "add", "fwmark", r.Mark, "lookup", strconv.Itoa(rtid), "priority", markRulePriority).Run()
 	if err != nil {
 		// TODO: remove default route rule
 		return err
@@ -125,13 +157,13 @@ func (r *DNSRouter) setupTable(via string) error {
 	return nil
 }
 
-func (r *DNSRouter) Clear() error {
-	err := exec.Command("ip", "rule", "del", "fwmark", r.Mark).Run()
+func (r *DNSRouter) Clear(ctx context.Context) error {
+	err := command(ctx, "ip", "rule", "del", "fwmark", r.Mark).Run()
 	if err != nil {
 		return err
 	}
 
-	err = exec.Command("ip", "route", "del", "default", "table", strconv.Itoa(r.RouteTableID)).Run()
+	err = command(ctx, "ip", "route", "del", "default", "table", strconv.Itoa(r.RouteTableID)).Run()
 	if err != nil {
 		return err
 	}
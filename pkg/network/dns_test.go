@@ -0,0 +1,17 @@
+package network_test
+
+import (
+	"testing"
+
+	"github.com/pricec/vpnmux/pkg/network"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDNSRouterRule(t *testing.T) {
+	r := &network.DNSRouter{Mark: "0x1", LocalSubnet: "192.168.0.0/24"}
+	require.Equal(t, []string{
+		"-p", "udp", "--dport", "53", "!", "-d", "192.168.0.0/24",
+		"-m", "mark", "--mark", "0",
+		"-j", "MARK", "--set-mark", "0x1",
+	}, r.Rule("udp"))
+}
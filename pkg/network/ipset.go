@@ -0,0 +1,56 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// IPSet is an ipset of addresses whose entries expire individually.
+type IPSet struct {
+	Name   string
+	Family string
+}
+
+// NewIPSet creates (if necessary) the named set for the given family,
+// either "inet" or "inet6".
+func NewIPSet(ctx context.Context, name, family string) (*IPSet, error) {
+	s := &IPSet{
+		Name:   name,
+		Family: family,
+	}
+
+	err := command(ctx,
+		"ipset", "create", name, "hash:ip",
+		"family", family,
+		"timeout", "0",
+		"-exist",
+	).Run()
+	if err != nil {
+		return nil, fmt.Errorf("ipset create %s: %w", name, err)
+	}
+	return s, nil
+}
+
+// Add adds ip to the set, or refreshes its timeout if already present.
+func (s *IPSet) Add(ctx context.Context, ip net.IP, ttl time.Duration) error {
+	err := command(ctx,
+		"ipset", "add", s.Name, ip.String(),
+		"timeout", strconv.Itoa(int(ttl/time.Second)),
+		"-exist",
+	).Run()
+	if err != nil {
+		return fmt.Errorf("ipset add %s: %w", s.Name, err)
+	}
+	return nil
+}
+
+func (s *IPSet) Flush(ctx context.Context) error {
+	return command(ctx, "ipset", "flush", s.Name).Run()
+}
+
+func (s *IPSet) Close(ctx context.Context) error {
+	return command(ctx, "ipset", "destroy", s.Name).Run()
+}
@@ -0,0 +1,62 @@
+package network
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net"
+)
+
+// IPv6 configures a dual-stack network.
+type IPv6 struct {
+	// IPv6 subnet of the docker network.
+	Subnet string
+	// IPv6 subnet of the LAN, routed back from the VPN container.
+	LocalSubnet string
+}
+
+// Attempts at deriving an IPv6 subnet not in use before giving up.
+const subnet6Attempts = 64
+
+// Subnet6 returns a /64 subnet of prefix derived from id, other than the
+// used subnets, for use as the IPv6 subnet of a network. Docker does not
+// allocate IPv6 subnets itself.
+func Subnet6(prefix, id string, used []string) (string, error) {
+	_, ipNet, err := net.ParseCIDR(prefix)
+	if err != nil || ipNet.IP.To4() != nil {
+		return "", fmt.Errorf("invalid IPv6 prefix %q", prefix)
+	}
+
+	ones, _ := ipNet.Mask.Size()
+	if ones >= 64 {
+		return "", fmt.Errorf("IPv6 prefix %q must be shorter than /64", prefix)
+	}
+
+	taken := make(map[string]bool, len(used))
+	for _, s := range used {
+		if _, n, err := net.ParseCIDR(s); err == nil {
+			taken[n.String()] = true
+		}
+	}
+
+	// On a collision, the subnet is derived again from id and the attempt,
+	// so that it stays stable as long as the colliding network exists.
+	seed := id
+	for attempt := 1; attempt <= subnet6Attempts; attempt++ {
+		sum := sha256.Sum256([]byte(seed))
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, ipNet.IP)
+		for i := ones; i < 64; i += 1 {
+			bit := byte(0x80 >> (i % 8))
+			if sum[i/8]&bit != 0 {
+				ip[i/8] |= bit
+			}
+		}
+
+		subnet := net.IPNet{IP: ip, Mask: net.CIDRMask(64, 128)}
+		if !taken[subnet.String()] {
+			return subnet.String(), nil
+		}
+		seed = fmt.Sprintf("%s/%d", id, attempt)
+	}
+	return "", fmt.Errorf("no free /64 subnet of IPv6 prefix %q", prefix)
+}
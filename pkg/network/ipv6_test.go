@@ -0,0 +1,62 @@
+package network_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/pricec/vpnmux/pkg/network"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubnet6(t *testing.T) {
+	subnet, err := network.Subnet6("fd00:1:2::/48", "network-a", nil)
+	require.Nil(t, err)
+
+	_, prefix, _ := net.ParseCIDR("fd00:1:2::/48")
+	ip, ipNet, err := net.ParseCIDR(subnet)
+	require.Nil(t, err)
+	require.True(t, prefix.Contains(ip))
+	ones, _ := ipNet.Mask.Size()
+	require.Equal(t, 64, ones)
+
+	// stable for a given id, and distinct between ids
+	again, err := network.Subnet6("fd00:1:2::/48", "network-a", nil)
+	require.Nil(t, err)
+	require.Equal(t, subnet, again)
+
+	other, err := network.Subnet6("fd00:1:2::/48", "network-b", nil)
+	require.Nil(t, err)
+	require.NotEqual(t, subnet, other)
+
+	for _, prefix := range []string{"10.0.0.0/8", "fd00:1:2:3::/64", "fd00::/96", "bogus"} {
+		_, err := network.Subnet6(prefix, "network-a", nil)
+		require.NotNil(t, err, prefix)
+	}
+}
+
+func TestSubnet6Collision(t *testing.T) {
+	subnet, err := network.Subnet6("fd00:1:2::/48", "network-a", nil)
+	require.Nil(t, err)
+
+	// A subnet in use is avoided, stably.
+	other, err := network.Subnet6("fd00:1:2::/48", "network-a", []string{subnet})
+	require.Nil(t, err)
+	require.NotEqual(t, subnet, other)
+	_, prefix, _ := net.ParseCIDR("fd00:1:2::/48")
+	ip, _, err := net.ParseCIDR(other)
+	require.Nil(t, err)
+	require.True(t, prefix.Contains(ip))
+
+	again, err := network.Subnet6("fd00:1:2::/48", "network-a", []string{subnet})
+	require.Nil(t, err)
+	require.Equal(t, other, again)
+
+	// A /63 has only two subnets to choose from.
+	first, err := network.Subnet6("fd00:1:2:2::/63", "network-a", nil)
+	require.Nil(t, err)
+	second, err := network.Subnet6("fd00:1:2:2::/63", "network-a", []string{first})
+	require.Nil(t, err)
+	require.NotEqual(t, first, second)
+	_, err = network.Subnet6("fd00:1:2:2::/63", "network-a", []string{first, second})
+	require.NotNil(t, err)
+}
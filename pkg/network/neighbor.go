@@ -0,0 +1,73 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+)
+
+type Neighbor struct {
+	IP    string
+	MAC   string
+	State string
+}
+
+// Neighbors returns the IPv4 entries of the neighbor (ARP) table for the
+// given interface which have a link-layer address.
+func Neighbors(ctx context.Context, iface string) ([]Neighbor, error) {
+	output, err := command(ctx, "ip", "-4", "neigh", "show", "dev", iface).Output()
+	if err != nil {
+		return nil, fmt.Errorf("ip neigh show: %w", err)
+	}
+	return ParseNeighbors(string(output)), nil
+}
+
+// ParseNeighbors parses the output of `ip neigh show dev <iface>`, in which
+// each line has the form "<ip> lladdr <mac> [router] <state>".
+func ParseNeighbors(output string) []Neighbor {
+	var result []Neighbor
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[1] != "lladdr" {
+			continue
+		}
+
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			continue
+		}
+
+		mac, err := net.ParseMAC(fields[2])
+		if err != nil {
+			continue
+		}
+
+		result = append(result, Neighbor{
+			IP:    ip.String(),
+			MAC:   mac.String(),
+			State: fields[len(fields)-1],
+		})
+	}
+	return result
+}
+
+// FindNeighbor returns the address of the neighbor with the given MAC
+// address, preferring reachable entries over stale ones.
+func FindNeighbor(neighbors []Neighbor, mac string) (string, bool) {
+	var result *Neighbor
+	for i := range neighbors {
+		n := &neighbors[i]
+		if !strings.EqualFold(n.MAC, mac) {
+			continue
+		}
+		if result == nil || (n.State == "REACHABLE" && result.State != "REACHABLE") {
+			result = n
+		}
+	}
+
+	if result == nil {
+		return "", false
+	}
+	return result.IP, true
+}
@@ -0,0 +1,30 @@
+package network_test
+
+import (
+	"testing"
+
+	"github.com/pricec/vpnmux/pkg/network"
+	"github.com/stretchr/testify/require"
+)
+
+const neighOutput = `192.168.0.1 lladdr aa:bb:cc:dd:ee:01 router REACHABLE
+192.168.0.10 lladdr AA:BB:CC:DD:EE:02 STALE
+192.168.0.11 lladdr aa:bb:cc:dd:ee:02 REACHABLE
+192.168.0.12  FAILED
+`
+
+func TestParseNeighbors(t *testing.T) {
+	neighbors := network.ParseNeighbors(neighOutput)
+	require.Equal(t, []network.Neighbor{
+		{IP: "192.168.0.1", MAC: "aa:bb:cc:dd:ee:01", State: "REACHABLE"},
+		{IP: "192.168.0.10", MAC: "aa:bb:cc:dd:ee:02", State: "STALE"},
+		{IP: "192.168.0.11", MAC: "aa:bb:cc:dd:ee:02", State: "REACHABLE"},
+	}, neighbors)
+
+	ip, ok := network.FindNeighbor(neighbors, "aa:bb:cc:dd:ee:02")
+	require.True(t, ok)
+	require.Equal(t, "192.168.0.11", ip)
+
+	_, ok = network.FindNeighbor(neighbors, "aa:bb:cc:dd:ee:03")
+	require.False(t, ok)
+}
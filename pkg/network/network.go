@@ -1,9 +1,10 @@
 package network
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"os/exec"
+	"strings"
 
 	"github.com/hashicorp/go-multierror"
 	"github.com/pricec/vpnmux/pkg/openvpn"
@@ -29,43 +30,94 @@ type Network struct {
 	DockerID  string
 	Subnet    string
 	Gateway   string
+	Subnet6   string
+	Gateway6  string
 	Container *Container
 }
 
-func New(id, image, subnet string, cfg *openvpn.Config) (*Network, error) {
+// New creates a docker network and VPN container, routing via the given
+// route table. If v6 is not nil, the network is dual-stack.
+func New(ctx context.Context, id, image, subnet string, routeTableID int, v6 *IPv6, cfg *openvpn.Config) (*Network, error) {
 	// TODO: use docker library instead
-	err := exec.Command(
-		"docker", "network", "create",
+	args := []string{
+		"network", "create",
 		"--label", fmt.Sprintf("%s=%s", labelKey, labelValue),
 		"--label", fmt.Sprintf("id=%s", id),
-		id,
-	).Run()
-	if err != nil {
+	}
+	if v6 != nil {
+		args = append(args, "--ipv6", "--subnet", v6.Subnet)
+	}
+	args = append(args, id)
+
+	if err := command(ctx, "docker", args...).Run(); err != nil {
 		return nil, fmt.Errorf("failed creating network: %w", err)
 	}
 
-	_, err = NewContainer(id, image, subnet, cfg)
+	_, err := NewContainer(ctx, id, image, subnet, routeTableID, v6, cfg)
 	if err != nil {
 		return nil, err
 	}
 
 	// TODO: cleanup if any of these steps fail
-	return NewFromID(id)
+	return NewFromID(ctx, id)
 }
 
-func NewFromID(id string) (*Network, error) {
-	ctr, err := NewContainerFromID(id)
-	if err != nil {
+// Rebuild replaces the VPN container of an existing docker network, e.g.
+// if it was removed or was created with another route table.
+func Rebuild(ctx context.Context, id, image, subnet string, routeTableID int, v6 *IPv6, cfg *openvpn.Config) (*Network, error) {
+	if err := RemoveContainers(ctx, id); err != nil {
 		return nil, err
 	}
 
-	output, err := exec.Command("docker", "network", "ls", "-q", "--filter", fmt.Sprintf("label=id=%s", id)).Output()
+	if _, err := NewContainer(ctx, id, image, subnet, routeTableID, v6, cfg); err != nil {
+		return nil, err
+	}
+	return NewFromID(ctx, id)
+}
+
+// Remove removes a docker network and any of its containers, and flushes
+// its route table, e.g. if its VPN container is not running, so that it
+// cannot be closed.
+func Remove(ctx context.Context, id string, routeTableID int) error {
+	var result error
+
+	if err := RemoveContainers(ctx, id); err != nil {
+		result = multierror.Append(result, err)
+	}
+
+	if routeTableID != 0 {
+		if err := flushRouteTable(ctx, routeTableID); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+
+	output, err := command(ctx, "docker", "network", "ls", "-q", "--filter", fmt.Sprintf("label=id=%s", id)).Output()
+	if err != nil {
+		return multierror.Append(result, fmt.Errorf("listing networks: %w", err))
+	}
+	for _, dockerID := range strings.Fields(string(output)) {
+		if err := command(ctx, "docker", "network", "rm", dockerID).Run(); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+	return result
+}
+
+func NewFromID(ctx context.Context, id string) (*Network, error) {
+	ctr, err := NewContainerFromID(ctx, id)
 	if err != nil {
 		return nil, err
 	}
 
+	output, err := command(ctx, "docker", "network", "ls", "-q", "--filter", fmt.Sprintf("label=id=%s", id)).Output()
+	if err != nil {
+		return nil, fmt.Errorf("listing networks: %w", err)
+	} else if len(output) == 0 {
+		return nil, fmt.Errorf("network %s: %w", id, ErrNoNetwork)
+	}
+
 	dockerID := string(output[:len(output)-1])
-	output, err = exec.Command("docker", "network", "inspect", dockerID).Output()
+	output, err = command(ctx, "docker", "network", "inspect", dockerID).Output()
 	if err != nil {
 		return nil, err
 	}
@@ -75,27 +127,75 @@ func NewFromID(id string) (*Network, error) {
 		return nil, err
 	}
 
-	return &Network{
+	n := &Network{
 		ID:        id,
 		DockerID:  inspect[0].ID,
-		Subnet:    inspect[0].IPAM.Config[0].Subnet,
-		Gateway:   inspect[0].IPAM.Config[0].Gateway,
 		Container: ctr,
-	}, nil
+	}
+	for _, cfg := range inspect[0].IPAM.Config {
+		if strings.Contains(cfg.Subnet, ":") {
+			n.Subnet6 = cfg.Subnet
+			n.Gateway6 = cfg.Gateway
+		} else {
+			n.Subnet = cfg.Subnet
+			n.Gateway = cfg.Gateway
+		}
+	}
+	return n, nil
 }
 
-func (v *Network) Close() error {
+// Subnets6 returns the IPv6 subnets of the docker networks managed by
+// vpnmux, other than that of the given network.
+func Subnets6(ctx context.Context, id string) ([]string, error) {
+	output, err := command(ctx, "docker", "network", "ls", "-q", "--filter", fmt.Sprintf("label=%s=%s", labelKey, labelValue)).Output()
+	if err != nil {
+		return nil, fmt.Errorf("listing networks: %w", err)
+	}
+	dockerIDs := strings.Fields(string(output))
+	if len(dockerIDs) == 0 {
+		return nil, nil
+	}
+
+	output, err = command(ctx, "docker", append([]string{"network", "inspect"}, dockerIDs...)...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("inspecting networks: %w", err)
+	}
+	inspect := []NetworkInspectOutput{}
+	if err = json.Unmarshal(output, &inspect); err != nil {
+		return nil, err
+	}
+
+	var result []string
+	for _, n := range inspect {
+		if n.Labels["id"] == id {
+			continue
+		}
+		for _, cfg := range n.IPAM.Config {
+			if strings.Contains(cfg.Subnet, ":") {
+				result = append(result, cfg.Subnet)
+			}
+		}
+	}
+	return result, nil
+}
+
+func (v *Network) Close(ctx context.Context) error {
 	var result error
 
 	if v.Container != nil {
-		if err := v.Container.Close(); err != nil {
+		if err := v.Container.Close(ctx); err != nil {
 			result = multierror.Append(result, err)
 		}
 	}
 
-	if err := exec.Command("docker", "network", "rm", v.DockerID).Run(); err != nil {
+	if err := command(ctx, "docker", "network", "rm", v.DockerID).Run(); err != nil {
 		result = multierror.Append(result, err)
 	}
 
 	return result
 }
+
+// Bridge returns the name of the network's bridge interface on the host.
+func (v *Network) Bridge() string {
+	return "br-" + v.DockerID[:12]
+}
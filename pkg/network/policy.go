@@ -0,0 +1,123 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Match describes the packets a routing policy applies to. Empty fields
+// match anything.
+type Match struct {
+	Source      string
+	SourceMAC   string
+	Destination string
+	// One of tcp, udp or icmp.
+	Protocol string
+	// Comma-separated list of destination ports or port ranges (e.g.
+	// "80,443,8000-8100"); requires a protocol of tcp or udp.
+	Ports string
+}
+
+// Args renders the match as iptables rule-specification arguments.
+func (m Match) Args() ([]string, error) {
+	return m.args(inet)
+}
+
+// Args6 renders the match as ip6tables rule-specification arguments.
+func (m Match) Args6() ([]string, error) {
+	return m.args(inet6)
+}
+
+func (m Match) args(family string) ([]string, error) {
+	var args []string
+
+	if m.Source != "" {
+		if err := validAddress(m.Source, family); err != nil {
+			return nil, fmt.Errorf("source: %w", err)
+		}
+		args = append(args, "-s", m.Source)
+	}
+
+	if m.SourceMAC != "" {
+		if _, err := net.ParseMAC(m.SourceMAC); err != nil {
+			return nil, fmt.Errorf("source MAC: %w", err)
+		}
+		args = append(args, "-m", "mac", "--mac-source", m.SourceMAC)
+	}
+
+	if m.Destination != "" {
+		if err := validAddress(m.Destination, family); err != nil {
+			return nil, fmt.Errorf("destination: %w", err)
+		}
+		args = append(args, "-d", m.Destination)
+	}
+
+	switch m.Protocol {
+	case "":
+	case "tcp", "udp":
+		args = append(args, "-p", m.Protocol)
+	case "icmp":
+		if family == inet6 {
+			args = append(args, "-p", "ipv6-icmp")
+		} else {
+			args = append(args, "-p", "icmp")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported protocol %q", m.Protocol)
+	}
+
+	if m.Ports != "" {
+		if m.Protocol != "tcp" && m.Protocol != "udp" {
+			return nil, fmt.Errorf("ports require protocol tcp or udp")
+		}
+
+		ports, err := multiportList(m.Ports)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "-m", "multiport", "--dports", ports)
+	}
+
+	return args, nil
+}
+
+// validAddress returns nil iff s is an address or CIDR of the family.
+func validAddress(s, family string) error {
+	name := "IPv4"
+	if family == inet6 {
+		name = "IPv6"
+	}
+
+	ip := net.ParseIP(s)
+	kind := "address"
+	if strings.Contains(s, "/") {
+		ip, _, _ = net.ParseCIDR(s)
+		kind = "CIDR"
+	}
+	if ip == nil || (ip.To4() == nil) != (family == inet6) {
+		return fmt.Errorf("invalid %s %s %q", name, kind, s)
+	}
+	return nil
+}
+
+func multiportList(ports string) (string, error) {
+	parts := strings.Split(ports, ",")
+	if len(parts) > 15 {
+		return "", fmt.Errorf("at most 15 ports or port ranges may be given")
+	}
+
+	result := make([]string, 0, len(parts))
+	for _, part := range parts {
+		bounds := strings.SplitN(strings.TrimSpace(part), "-", 2)
+		for _, bound := range bounds {
+			port, err := strconv.Atoi(bound)
+			if err != nil || port < 1 || port > 65535 {
+				return "", fmt.Errorf("invalid port %q", part)
+			}
+		}
+		result = append(result, strings.Join(bounds, ":"))
+	}
+	return strings.Join(result, ","), nil
+}
@@ -0,0 +1,65 @@
+package network_test
+
+import (
+	"testing"
+
+	"github.com/pricec/vpnmux/pkg/network"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchArgs(t *testing.T) {
+	args, err := network.Match{}.Args()
+	require.Nil(t, err)
+	require.Empty(t, args)
+
+	args, err = network.Match{SourceMAC: "aa:bb:cc:dd:ee:ff"}.Args()
+	require.Nil(t, err)
+	require.Equal(t, []string{"-m", "mac", "--mac-source", "aa:bb:cc:dd:ee:ff"}, args)
+
+	args, err = network.Match{
+		Source:      "192.168.0.10",
+		Destination: "10.0.0.0/8",
+		Protocol:    "tcp",
+		Ports:       "80, 443,8000-8100",
+	}.Args()
+	require.Nil(t, err)
+	require.Equal(t, []string{
+		"-s", "192.168.0.10",
+		"-d", "10.0.0.0/8",
+		"-p", "tcp",
+		"-m", "multiport", "--dports", "80,443,8000:8100",
+	}, args)
+}
+
+func TestMatchArgsInvalid(t *testing.T) {
+	invalid := []network.Match{
+		{Source: "not-an-address"},
+		{SourceMAC: "aa:bb:cc"},
+		{Destination: "10.0.0.0/33"},
+		{Protocol: "sctp"},
+		{Ports: "443"},
+		{Protocol: "icmp", Ports: "443"},
+		{Protocol: "udp", Ports: "0"},
+		{Protocol: "udp", Ports: "1-65536"},
+	}
+
+	for _, m := range invalid {
+		_, err := m.Args()
+		require.NotNil(t, err, "expected error for %+v", m)
+	}
+}
+
+func TestMatchArgs6(t *testing.T) {
+	args, err := network.Match{
+		Source:   "fd00::10",
+		Protocol: "icmp",
+	}.Args6()
+	require.Nil(t, err)
+	require.Equal(t, []string{"-s", "fd00::10", "-p", "ipv6-icmp"}, args)
+
+	_, err = network.Match{Source: "192.168.0.10"}.Args6()
+	require.NotNil(t, err)
+
+	_, err = network.Match{Destination: "fd00::/8"}.Args()
+	require.NotNil(t, err)
+}
@@ -0,0 +1,65 @@
+package network
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// ForwardedConnmark is the bit of a connection's mark which marks
+// connections forwarded to a client from a network, e.g. by a port forward;
+// the other bits hold the fwmark of a network. Network fwmarks must not use
+// it.
+const ForwardedConnmark = 0x80000000
+
+// PoolRoute is a route across which a pool spreads connections: the
+// fwmark routing packets via a network, and its share of new connections
+// relative to the other routes of the pool.
+type PoolRoute struct {
+	Mark   string
+	Weight int
+}
+
+// PoolRules renders iptables rules for the mangle table which mark the
+// packets matching match with the fwmark of one of routes, chosen at
+// random in proportion to their weights for each new connection and kept
+// in the connection's mark, so that every packet of a connection takes the
+// same route. Established connections keep the route restored from their
+// mark, even if it is no longer among routes (e.g. the route was removed).
+// Packets which are marked are not evaluated further.
+func PoolRules(match []string, routes []PoolRoute) [][]string {
+	if len(routes) == 0 {
+		return nil
+	}
+
+	rule := func(args ...string) []string {
+		return append(append([]string{}, match...), args...)
+	}
+
+	// Only the fwmark is restored, without ForwardedConnmark.
+	fwmark := fmt.Sprintf("0x%x", ^uint32(ForwardedConnmark))
+	rules := [][]string{
+		rule("-m", "connmark", "!", "--mark", "0/"+fwmark, "-j", "CONNMARK", "--restore-mark", "--nfmask", "0xffffffff", "--ctmask", fwmark),
+		rule("-m", "mark", "!", "--mark", "0", "-j", "RETURN"),
+	}
+
+	remaining := 0
+	for _, route := range routes {
+		remaining += route.Weight
+	}
+	for i, route := range routes {
+		args := []string{"-m", "conntrack", "--ctstate", "NEW", "-m", "mark", "--mark", "0"}
+		// Each route is chosen with its share of the weight of the routes
+		// not yet passed over; the last, if reached, always is.
+		if i < len(routes)-1 {
+			p := float64(route.Weight) / float64(remaining)
+			args = append(args, "-m", "statistic", "--mode", "random", "--probability", strconv.FormatFloat(p, 'f', 5, 64))
+		}
+		rules = append(rules, rule(append(args, "-j", "MARK", "--set-mark", route.Mark)...))
+		remaining -= route.Weight
+	}
+
+	return append(rules,
+		rule("-m", "mark", "!", "--mark", "0", "-j", "CONNMARK", "--save-mark"),
+		rule("-m", "mark", "!", "--mark", "0", "-j", "RETURN"),
+	)
+}
@@ -0,0 +1,27 @@
+package network_test
+
+import (
+	"testing"
+
+	"github.com/pricec/vpnmux/pkg/network"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPoolRules(t *testing.T) {
+	require.Empty(t, network.PoolRules([]string{"-s", "192.168.0.10"}, nil))
+
+	rules := network.PoolRules([]string{"-s", "192.168.0.10"}, []network.PoolRoute{
+		{Mark: "0x101", Weight: 1},
+		{Mark: "0x102", Weight: 2},
+		{Mark: "0x103", Weight: 1},
+	})
+	require.Equal(t, [][]string{
+		{"-s", "192.168.0.10", "-m", "connmark", "!", "--mark", "0/0x7fffffff", "-j", "CONNMARK", "--restore-mark", "--nfmask", "0xffffffff", "--ctmask", "0x7fffffff"},
+		{"-s", "192.168.0.10", "-m", "mark", "!", "--mark", "0", "-j", "RETURN"},
+		{"-s", "192.168.0.10", "-m", "conntrack", "--ctstate", "NEW", "-m", "mark", "--mark", "0", "-m", "statistic", "--mode", "random", "--probability", "0.25000", "-j", "MARK", "--set-mark", "0x101"},
+		{"-s", "192.168.0.10", "-m", "conntrack", "--ctstate", "NEW", "-m", "mark", "--mark", "0", "-m", "statistic", "--mode", "random", "--probability", "0.66667", "-j", "MARK", "--set-mark", "0x102"},
+		{"-s", "192.168.0.10", "-m", "conntrack", "--ctstate", "NEW", "-m", "mark", "--mark", "0", "-j", "MARK", "--set-mark", "0x103"},
+		{"-s", "192.168.0.10", "-m", "mark", "!", "--mark", "0", "-j", "CONNMARK", "--save-mark"},
+		{"-s", "192.168.0.10", "-m", "mark", "!", "--mark", "0", "-j", "RETURN"},
+	}, rules)
+}
@@ -0,0 +1,140 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Files naming route tables, as read by iproute2.
+const (
+	rtTablesFile = "/etc/iproute2/rt_tables"
+	rtTablesDir  = "/etc/iproute2/rt_tables.d"
+)
+
+// Route tables reserved by the kernel: default, main and local.
+const (
+	minReservedRouteTable = 253
+	maxReservedRouteTable = 255
+)
+
+// ReservedRouteTable returns true iff the kernel reserves the route table.
+func ReservedRouteTable(id int) bool {
+	return id == 0 || (id >= minReservedRouteTable && id <= maxReservedRouteTable)
+}
+
+// ParseRTTables parses route table names in the format of
+// /etc/iproute2/rt_tables: an ID and a name per line, and comments
+// starting with #.
+func ParseRTTables(r io.Reader) (map[int]string, error) {
+	result := make(map[int]string)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid route table line %q", scanner.Text())
+		}
+
+		id, err := strconv.ParseUint(fields[0], 0, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route table ID %q", fields[0])
+		}
+		result[int(id)] = fields[1]
+	}
+	return result, scanner.Err()
+}
+
+// FormatRTTables renders route table names in the format of
+// /etc/iproute2/rt_tables, in order of ID.
+func FormatRTTables(names map[int]string) []byte {
+	ids := make([]int, 0, len(names))
+	for id := range names {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	var b bytes.Buffer
+	b.WriteString("# Route tables of vpnmux networks; managed by vpnmux, do not edit.\n")
+	for _, id := range ids {
+		fmt.Fprintf(&b, "%d\t%s\n", id, names[id])
+	}
+	return b.Bytes()
+}
+
+// NamedRouteTables returns the route tables named in /etc/iproute2/rt_tables
+// and the *.conf files of /etc/iproute2/rt_tables.d, except those named in
+// exclude. Missing files are ignored.
+func NamedRouteTables(exclude string) (map[int]string, error) {
+	paths, err := filepath.Glob(filepath.Join(rtTablesDir, "*.conf"))
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[int]string)
+	for _, path := range append([]string{rtTablesFile}, paths...) {
+		if exclude != "" && filepath.Clean(path) == filepath.Clean(exclude) {
+			continue
+		}
+
+		f, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		names, err := ParseRTTables(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		for id, name := range names {
+			result[id] = name
+		}
+	}
+	return result, nil
+}
+
+// WriteRTTables replaces the file at path with the given route table
+// names, so that the tables may be referred to by name and are seen to be
+// taken by other tools.
+func WriteRTTables(path string, names map[int]string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, FormatRTTables(names), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// RouteTableEmpty returns true iff the route table has no IPv4 or IPv6
+// routes.
+func RouteTableEmpty(ctx context.Context, id int) (bool, error) {
+	output, err := command(ctx, "ip", "route", "show", "table", strconv.Itoa(id)).Output()
+	if err != nil {
+		return false, fmt.Errorf("ip route show: %w", err)
+	} else if len(output) != 0 {
+		return false, nil
+	}
+
+	// An error here most likely means IPv6 is disabled on the host.
+	output, err = command(ctx, "ip", "-6", "route", "show", "table", strconv.Itoa(id)).Output()
+	return err != nil || len(output) == 0, nil
+}
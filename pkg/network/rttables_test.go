@@ -0,0 +1,65 @@
+package network_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pricec/vpnmux/pkg/network"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRTTables(t *testing.T) {
+	names, err := network.ParseRTTables(strings.NewReader(`#
+# reserved values
+#
+255	local
+254	main
+253	default
+0	unspec
+#
+# local
+#
+0x10 isp2 # second uplink
+`))
+	require.Nil(t, err)
+	require.Equal(t, map[int]string{
+		255: "local",
+		254: "main",
+		253: "default",
+		0:   "unspec",
+		16:  "isp2",
+	}, names)
+
+	for _, s := range []string{"100\n", "abc isp\n", "1 two names\n"} {
+		_, err := network.ParseRTTables(strings.NewReader(s))
+		require.NotNil(t, err, s)
+	}
+}
+
+func TestWriteRTTables(t *testing.T) {
+	names := map[int]string{
+		102: "vpnmux-b",
+		7:   "vpnmux-a",
+	}
+	require.True(t, bytes.HasSuffix(network.FormatRTTables(names), []byte("7\tvpnmux-a\n102\tvpnmux-b\n")))
+
+	path := filepath.Join(t.TempDir(), "rt_tables.d", "vpnmux.conf")
+	require.Nil(t, network.WriteRTTables(path, names))
+	b, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	parsed, err := network.ParseRTTables(bytes.NewReader(b))
+	require.Nil(t, err)
+	require.Equal(t, names, parsed)
+}
+
+func TestReservedRouteTable(t *testing.T) {
+	for _, id := range []int{0, 253, 254, 255} {
+		require.True(t, network.ReservedRouteTable(id), id)
+	}
+	for _, id := range []int{1, 252, 256, 1000} {
+		require.False(t, network.ReservedRouteTable(id), id)
+	}
+}
@@ -0,0 +1,314 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+// Rate of the root class of a direction without a limit of its own.
+const unlimitedRate = "10gbit"
+
+// ShapingClass is a node of an HTB hierarchy: a rate limit shared by the
+// packets of each of its sources and of its children. Sources are IPv4 or
+// IPv6 addresses or subnets, matched by source address when uploading and
+// by destination address when downloading.
+type ShapingClass struct {
+	// Identifies the class in status reports, e.g. a client ID.
+	ID       string
+	RateKbit int
+	Sources  []string
+	Children []*ShapingClass
+}
+
+// ShapedClass is an installed class and its counters.
+type ShapedClass struct {
+	ID          string `json:"id"`
+	ClassID     string `json:"class"`
+	RateKbit    int    `json:"rate_kbit"`
+	SentBytes   uint64 `json:"sent_bytes"`
+	SentPackets uint64 `json:"sent_packets"`
+	Dropped     uint64 `json:"dropped"`
+}
+
+type ShapingStatus struct {
+	Upload   []ShapedClass `json:"upload"`
+	Download []ShapedClass `json:"download"`
+}
+
+// Shaper limits the traffic through a network's bridge: uploads on egress
+// from the bridge to the VPN container, and downloads on an IFB device to
+// which the bridge's ingress is redirected.
+type Shaper struct {
+	Bridge string
+	IFB    string
+
+	// The commands last applied, and the classes they installed.
+	applied string
+	status  ShapingStatus
+}
+
+func NewShaper(bridge string) *Shaper {
+	return &Shaper{
+		Bridge: bridge,
+		// Interface names are limited to 15 characters, as are bridges'.
+		IFB: "ifb" + strings.TrimPrefix(bridge, "br-"),
+	}
+}
+
+func rate(kbit int) string {
+	if kbit <= 0 {
+		return unlimitedRate
+	}
+	return fmt.Sprintf("%dkbit", kbit)
+}
+
+// htb renders the commands installing the hierarchy rooted at root on dev,
+// matching sources by the given direction ("src" or "dst"). Traffic which
+// matches no source is limited only by the root's rate.
+func htb(dev, direction string, root *ShapingClass) ([][]string, []ShapedClass) {
+	r := rate(root.RateKbit)
+	cmds := [][]string{
+		{"tc", "qdisc", "add", "dev", dev, "root", "handle", "1:", "htb", "default", "2"},
+		{"tc", "class", "add", "dev", dev, "parent", "1:", "classid", "1:1", "htb", "rate", r, "ceil", r},
+		{"tc", "class", "add", "dev", dev, "parent", "1:1", "classid", "1:2", "htb", "rate", r, "ceil", r},
+		{"tc", "qdisc", "add", "dev", dev, "parent", "1:2", "fq_codel"},
+	}
+	classes := []ShapedClass{{ID: root.ID, ClassID: "1:1", RateKbit: root.RateKbit}}
+
+	next := 0x10
+	var add func(parent string, c *ShapingClass, depth int)
+	add = func(parent string, c *ShapingClass, depth int) {
+		id := fmt.Sprintf("1:%x", next)
+		next += 1
+
+		r := rate(c.RateKbit)
+		cmds = append(cmds, []string{"tc", "class", "add", "dev", dev, "parent", parent, "classid", id, "htb", "rate", r, "ceil", r})
+		classes = append(classes, ShapedClass{ID: c.ID, ClassID: id, RateKbit: c.RateKbit})
+
+		// Filters can only direct packets to leaf classes, so a class
+		// with children gets a leaf of its own for its sources.
+		leaf := id
+		if len(c.Children) > 0 {
+			leaf = ""
+			if len(c.Sources) > 0 {
+				leaf = fmt.Sprintf("1:%x", next)
+				next += 1
+				cmds = append(cmds, []string{"tc", "class", "add", "dev", dev, "parent", id, "classid", leaf, "htb", "rate", r, "ceil", r})
+			}
+			for _, child := range c.Children {
+				add(id, child, depth+1)
+			}
+		}
+		if leaf == "" {
+			return
+		}
+
+		cmds = append(cmds, []string{"tc", "qdisc", "add", "dev", dev, "parent", leaf, "fq_codel"})
+		for _, source := range c.Sources {
+			// Deeper classes take precedence, e.g. a member of a group
+			// whose subnet contains it. Each protocol needs its own
+			// priority.
+			protocol, match, prio := "ip", "ip", 10-depth
+			if strings.Contains(source, ":") {
+				protocol, match, prio = "ipv6", "ip6", 20-depth
+			}
+			cmds = append(cmds, []string{
+				"tc", "filter", "add", "dev", dev, "parent", "1:", "protocol", protocol,
+				"prio", strconv.Itoa(prio), "u32", "match", match, direction, source, "flowid", leaf,
+			})
+		}
+	}
+	for _, child := range root.Children {
+		add("1:1", child, 1)
+	}
+	return cmds, classes
+}
+
+// commands renders the commands installing the given hierarchies, either
+// of which may be nil if that direction is not limited.
+func (s *Shaper) commands(upload, download *ShapingClass) ([][]string, ShapingStatus) {
+	var cmds [][]string
+	var status ShapingStatus
+
+	if upload != nil {
+		cmds, status.Upload = htb(s.Bridge, "src", upload)
+	}
+	if download != nil {
+		cmds = append(cmds,
+			[]string{"ip", "link", "add", s.IFB, "type", "ifb"},
+			[]string{"ip", "link", "set", s.IFB, "up"},
+			[]string{"tc", "qdisc", "add", "dev", s.Bridge, "handle", "ffff:", "ingress"},
+			[]string{"tc", "filter", "add", "dev", s.Bridge, "parent", "ffff:", "protocol", "all",
+				"u32", "match", "u32", "0", "0", "action", "mirred", "egress", "redirect", "dev", s.IFB},
+		)
+		var downloadCmds [][]string
+		downloadCmds, status.Download = htb(s.IFB, "dst", download)
+		cmds = append(cmds, downloadCmds...)
+	}
+	return cmds, status
+}
+
+// installed reports whether the qdiscs of the given directions exist.
+func (s *Shaper) installed(ctx context.Context, upload, download bool) (bool, error) {
+	output, err := command(ctx, "tc", "qdisc", "show", "dev", s.Bridge).Output()
+	if err != nil {
+		return false, fmt.Errorf("tc qdisc show: %w", err)
+	}
+	if upload && !strings.Contains(string(output), "qdisc htb 1:") {
+		return false, nil
+	}
+	if download && !strings.Contains(string(output), "qdisc ingress ffff:") {
+		return false, nil
+	}
+	if download {
+		output, err := command(ctx, "tc", "qdisc", "show", "dev", s.IFB).Output()
+		if err != nil || !strings.Contains(string(output), "qdisc htb 1:") {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Apply installs the given hierarchies, either of which may be nil if that
+// direction is not limited. The qdiscs are only rebuilt if the hierarchies
+// changed since they were last applied, or are missing.
+func (s *Shaper) Apply(ctx context.Context, upload, download *ShapingClass) error {
+	cmds, status := s.commands(upload, download)
+	applied := fmt.Sprint(cmds)
+
+	if applied == s.applied {
+		ok, err := s.installed(ctx, upload != nil, download != nil)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+	}
+
+	s.clear(ctx)
+	s.applied = ""
+	s.status = ShapingStatus{}
+	if len(cmds) == 0 {
+		s.applied = applied
+		return nil
+	}
+
+	installed(ctx)
+	for _, cmd := range cmds {
+		err := command(ctx, cmd[0], cmd[1:]...).Run()
+		if err != nil {
+			return fmt.Errorf("%s: %w", strings.Join(cmd, " "), err)
+		}
+	}
+	s.applied = applied
+	s.status = status
+	return nil
+}
+
+// clear removes any qdiscs and IFB device, whether or not they exist.
+func (s *Shaper) clear(ctx context.Context) error {
+	var result error
+	for _, cmd := range [][]string{
+		{"tc", "qdisc", "del", "dev", s.Bridge, "root"},
+		{"tc", "qdisc", "del", "dev", s.Bridge, "ingress"},
+		{"ip", "link", "del", s.IFB},
+	} {
+		c := command(ctx, cmd[0], cmd[1:]...)
+		if err := c.Run(); err != nil && c.ProcessState == nil {
+			result = multierror.Append(result, err)
+		}
+	}
+	return result
+}
+
+func (s *Shaper) Close(ctx context.Context) error {
+	return s.clear(ctx)
+}
+
+// Status returns the installed classes and their counters.
+func (s *Shaper) Status(ctx context.Context) (*ShapingStatus, error) {
+	status := &ShapingStatus{
+		Upload:   append([]ShapedClass{}, s.status.Upload...),
+		Download: append([]ShapedClass{}, s.status.Download...),
+	}
+
+	for _, d := range []struct {
+		dev     string
+		classes []ShapedClass
+	}{
+		{s.Bridge, status.Upload},
+		{s.IFB, status.Download},
+	} {
+		if len(d.classes) == 0 {
+			continue
+		}
+
+		output, err := command(ctx, "tc", "-s", "class", "show", "dev", d.dev).Output()
+		if err != nil {
+			return nil, fmt.Errorf("tc class show: %w", err)
+		}
+		stats, err := ParseClassStats(output)
+		if err != nil {
+			return nil, err
+		}
+		for i := range d.classes {
+			if stat, ok := stats[d.classes[i].ClassID]; ok {
+				d.classes[i].SentBytes = stat.SentBytes
+				d.classes[i].SentPackets = stat.SentPackets
+				d.classes[i].Dropped = stat.Dropped
+			}
+		}
+	}
+	return status, nil
+}
+
+var (
+	reClass     = regexp.MustCompile(`^class \S+ (\S+) `)
+	reClassSent = regexp.MustCompile(`^\s*Sent (\d+) bytes (\d+) pkt \(dropped (\d+),`)
+)
+
+// ParseClassStats parses the output of tc -s class show, returning the
+// counters of each class keyed by class ID. Only the counters are set.
+func ParseClassStats(output []byte) (map[string]ShapedClass, error) {
+	result := make(map[string]ShapedClass)
+
+	var current string
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if m := reClass.FindStringSubmatch(line); m != nil {
+			current = m[1]
+			continue
+		}
+
+		m := reClassSent.FindStringSubmatch(line)
+		if m == nil || current == "" {
+			continue
+		}
+
+		var values [3]uint64
+		for i := range values {
+			value, err := strconv.ParseUint(m[i+1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("parsing class %s statistics: %w", current, err)
+			}
+			values[i] = value
+		}
+		result[current] = ShapedClass{
+			ClassID:     current,
+			SentBytes:   values[0],
+			SentPackets: values[1],
+			Dropped:     values[2],
+		}
+		current = ""
+	}
+	return result, scanner.Err()
+}
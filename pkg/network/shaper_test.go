@@ -0,0 +1,32 @@
+package network_test
+
+import (
+	"testing"
+
+	"github.com/pricec/vpnmux/pkg/network"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseClassStats(t *testing.T) {
+	output := []byte(`class htb 1:1 root rate 10Gbit ceil 10Gbit burst 0b cburst 0b 
+ Sent 150000 bytes 120 pkt (dropped 0, overlimits 0 requeues 0) 
+ backlog 0b 0p requeues 0
+ lended: 0 borrowed: 0 giants: 0
+ tokens: 14 ctokens: 14
+
+class htb 1:10 parent 1:1 leaf 8002: prio 0 rate 1Mbit ceil 1Mbit burst 1600b cburst 1600b 
+ Sent 50000 bytes 40 pkt (dropped 3, overlimits 12 requeues 0) 
+ backlog 0b 0p requeues 0
+
+class fq_codel 8002:1 parent 8002: 
+ (dropped 0, overlimits 0 requeues 0) 
+ backlog 0b 0p requeues 0
+`)
+
+	stats, err := network.ParseClassStats(output)
+	require.Nil(t, err)
+	require.Equal(t, map[string]network.ShapedClass{
+		"1:1":  {ClassID: "1:1", SentBytes: 150000, SentPackets: 120},
+		"1:10": {ClassID: "1:10", SentBytes: 50000, SentPackets: 40, Dropped: 3},
+	}, stats)
+}
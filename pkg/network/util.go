@@ -1,31 +1,281 @@
 package network
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"log"
 	"os/exec"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"regexp"
+
+	"github.com/pricec/vpnmux/pkg/logging"
+)
+
+// Priorities of the routing policy rules installed by vpnmux. Rules
+// matching a firewall mark take precedence over those matching a source
+// address, so that more specific policies (e.g. per-domain routes) can
+// override the network a client is assigned to. Likewise, a client's own
+// assignment overrides that of a group containing it.
+const (
+	markRulePriority   = "1000"
+	sourceRulePriority = "2000"
+	groupRulePriority  = "3000"
 )
 
+// Address families, as options to the ip command.
+const (
+	inet  = "-4"
+	inet6 = "-6"
+)
+
+type installsKey struct{}
+
+// CountInstalls returns a context counting in n the rules and routes
+// installed on its behalf because they were missing or differed when
+// checked, whether newly created or lost (e.g. flushed by another program).
+func CountInstalls(ctx context.Context, n *uint64) context.Context {
+	return context.WithValue(ctx, installsKey{}, n)
+}
+
+func installed(ctx context.Context) {
+	if n, ok := ctx.Value(installsKey{}).(*uint64); ok {
+		atomic.AddUint64(n, 1)
+	}
+}
+
+// CommandObserver is called with each command run by the package, and its
+// exit code, or -1 if it did not start.
+type CommandObserver func(ctx context.Context, args []string, exitCode int)
+
 var (
-	reDefaultRoute = regexp.MustCompile(`via [0-9.]+`)
+	observersMu      sync.Mutex
+	commandObservers []CommandObserver
+)
+
+// OnCommand registers fn to be called after each command the package runs,
+// with the context on whose behalf it ran.
+func OnCommand(fn CommandObserver) {
+	observersMu.Lock()
+	defer observersMu.Unlock()
+	commandObservers = append(commandObservers, fn)
+}
+
+// ReadOnly returns true iff the command with the given arguments only reads
+// the state of the host, e.g. iptables -S or ip rule show, as the periodic
+// checks do, rather than changing it.
+func ReadOnly(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	name, args := args[0], args[1:]
+
+	switch name {
+	case "iptables-save", "ip6tables-save", "cat":
+		return true
+	case "iptables", "ip6tables":
+		for _, arg := range args {
+			switch arg {
+			case "-L", "-S", "-C", "--list", "--list-rules", "--check":
+				return true
+			}
+		}
+		return false
+	case "ip", "tc":
+		// ip [options] object command ...
+		var words []string
+		for _, arg := range args {
+			if !strings.HasPrefix(arg, "-") {
+				words = append(words, arg)
+			}
+		}
+		if len(words) < 2 {
+			return true
+		}
+		switch words[1] {
+		case "show", "list", "ls", "get":
+			return true
+		}
+		return false
+	case "ipset":
+		return len(args) > 0 && (args[0] == "list" || args[0] == "test")
+	case "docker":
+		if len(args) == 0 {
+			return false
+		}
+		switch args[0] {
+		case "ps", "inspect":
+			return true
+		case "network":
+			return len(args) > 1 && (args[1] == "ls" || args[1] == "inspect")
+		case "exec":
+			// docker exec [-i] container command ...
+			args = args[1:]
+			if len(args) > 0 && args[0] == "-i" {
+				args = args[1:]
+			}
+			return len(args) > 1 && ReadOnly(args[1:])
+		}
+	}
+	return false
+}
+
+// cmd is an exec.Cmd which reports its completion to the command
+// observers.
+type cmd struct {
+	*exec.Cmd
+	ctx context.Context
+}
+
+func (c *cmd) done() {
+	exitCode := -1
+	if c.ProcessState != nil {
+		exitCode = c.ProcessState.ExitCode()
+	}
+
+	observersMu.Lock()
+	observers := commandObservers
+	observersMu.Unlock()
+	for _, fn := range observers {
+		fn(c.ctx, c.Args, exitCode)
+	}
+}
+
+func (c *cmd) Run() error {
+	defer c.done()
+	var stderr bytes.Buffer
+	if c.Stderr == nil {
+		c.Stderr = &stderr
+	}
+	return c.error(c.Cmd.Run(), stderr.Bytes())
+}
+
+func (c *cmd) Output() ([]byte, error) {
+	defer c.done()
+	output, err := c.Cmd.Output()
+	var stderr []byte
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		stderr = exitErr.Stderr
+	}
+	return output, c.error(err, stderr)
+}
+
+func (c *cmd) CombinedOutput() ([]byte, error) {
+	defer c.done()
+	output, err := c.Cmd.CombinedOutput()
+	return output, c.error(err, output)
+}
+
+// error wraps the error of running the command, if any, in a CommandError.
+func (c *cmd) error(err error, stderr []byte) error {
+	if err == nil {
+		return nil
+	}
+	exitCode := -1
+	if c.ProcessState != nil {
+		exitCode = c.ProcessState.ExitCode()
+	}
+	return &CommandError{
+		Args:     c.Args,
+		ExitCode: exitCode,
+		Stderr:   strings.TrimSpace(string(stderr)),
+		Err:      err,
+	}
+}
+
+var (
+	// ErrCommandFailed is matched by the errors of host commands which
+	// failed or could not be started.
+	ErrCommandFailed = errors.New("host command failed")
+	// ErrUnavailable is matched by the errors of commands which could not
+	// reach the container runtime, e.g. because docker is not installed or
+	// its daemon is not running.
+	ErrUnavailable = errors.New("container runtime unavailable")
+)
+
+// CommandError is the error of a host command; it matches
+// ErrCommandFailed, and ErrUnavailable if the command could not reach the
+// container runtime.
+type CommandError struct {
+	Args []string
+	// The exit code of the command, or -1 if it did not start.
+	ExitCode int
+	Stderr   string
+	Err      error
+}
+
+func (e *CommandError) Error() string {
+	if e.Stderr == "" {
+		return fmt.Sprintf("%s: %v", e.Args[0], e.Err)
+	}
+	return fmt.Sprintf("%s: %v: %s", e.Args[0], e.Err, e.Stderr)
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+func (e *CommandError) Is(target error) bool {
+	switch target {
+	case ErrCommandFailed:
+		return true
+	case ErrUnavailable:
+		return e.Args[0] == "docker" && (errors.Is(e.Err, exec.ErrNotFound) ||
+			strings.Contains(e.Stderr, "Cannot connect to the Docker daemon"))
+	}
+	return false
+}
+
+// command returns a command running the given program, and logs it at
+// debug level with the fields of ctx's logger, e.g. the ID of the API
+// request on whose behalf it runs.
+func command(ctx context.Context, name string, args ...string) *cmd {
+	logging.Debug(ctx, "executing command", "cmd", strings.Join(append([]string{name}, args...), " "))
+	return &cmd{Cmd: exec.Command(name, args...), ctx: ctx}
+}
+
+var (
+	reDefaultRoute = regexp.MustCompile(`via [0-9a-fA-F.:]+`)
 	reRouteTableID = regexp.MustCompile(`lookup \d+`)
 )
 
 // true iff source is currently routed to a numbered route table
 // TODO: ugly implemenation can probably be improved upon
 // TODO: use library code
-func routeTableIDsForSelector(selector ...string) ([]int, error) {
-	args := append([]string{"rule", "show"}, selector...)
-	output, err := exec.Command("ip", args...).Output()
+func routeTableIDsForSelector(ctx context.Context, family string, selector ...string) ([]int, error) {
+	rules, err := rulesForSelector(ctx, family, selector...)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]int, 0, len(rules))
+	for _, rule := range rules {
+		result = append(result, rule.table)
+	}
+	return result, nil
+}
+
+// ipRule is a rule of the routing policy database.
+type ipRule struct {
+	priority string
+	table    int
+}
+
+// rulesForSelector returns the rules matching the selector which look up a
+// numbered route table.
+func rulesForSelector(ctx context.Context, family string, selector ...string) ([]ipRule, error) {
+	args := append([]string{family, "rule", "show"}, selector...)
+	output, err := command(ctx, "ip", args...).Output()
 	if err != nil {
 		return nil, err
 	}
 
-	var result []int
+	var result []ipRule
 	parts := strings.Split(string(output), "\n")
 	for _, part := range parts {
 		if len(part) == 0 {
@@ -43,26 +293,15 @@ func routeTableIDsForSelector(selector ...string) ([]int, error) {
 			return nil, err
 		}
 
-		result = append(result, id)
+		// Each rule is listed as "<priority>:\t<selector> lookup <table>".
+		priority := strings.SplitN(part, ":", 2)[0]
+		result = append(result, ipRule{priority: priority, table: id})
 	}
 	return result, nil
 }
 
-func unusedRouteTableID() (int, error) {
-	// return an unused route table ID in the range [1,252]
-	for i := 1; i < 253; i = i + 1 {
-		output, err := exec.Command("ip", "route", "show", "table", strconv.Itoa(i)).Output()
-		if err != nil {
-			return 0, fmt.Errorf("ip route show: %w", err)
-		} else if len(output) == 0 {
-			return i, nil
-		}
-	}
-	return 0, fmt.Errorf("all routing table IDs seem to be in use")
-}
-
-func defaultRouteForTable(tableID int) (bool, string, error) {
-	output, err := exec.Command("ip", "route", "show", "table", strconv.Itoa(tableID), "default").Output()
+func defaultRouteForTable(ctx context.Context, family string, tableID int) (bool, string, error) {
+	output, err := command(ctx, "ip", family, "route", "show", "table", strconv.Itoa(tableID), "default").Output()
 	if err != nil {
 		return false, "", fmt.Errorf("ip route show table: %w", err)
 	} else if len(output) == 0 {
@@ -75,7 +314,7 @@ func defaultRouteForTable(tableID int) (bool, string, error) {
 		return false, "", nil
 	case 1:
 	default:
-		log.Panicf("found %d default routes for table %d", len(parts), tableID)
+		return false, "", fmt.Errorf("found %d default routes for table %d", len(parts), tableID)
 	}
 
 	s := reDefaultRoute.FindString(parts[0])
@@ -89,3 +328,52 @@ func defaultRouteForTable(tableID int) (bool, string, error) {
 	}
 	return true, parts[1], nil
 }
+
+// iptables returns the iptables command for the given address family.
+func iptables(family string) string {
+	if family == inet6 {
+		return "ip6tables"
+	}
+	return "iptables"
+}
+
+// ensureRule adds the given iptables rule (using operation, either "A" or
+// "I") if it does not already exist.
+func ensureRule(ctx context.Context, family, operation, table, chain string, rule ...string) error {
+	cmd := command(ctx, iptables(family), append([]string{"-t", table, "-C", chain}, rule...)...)
+	// Note that this command can return nonzero if the rule exists
+	err := cmd.Run()
+	switch cmd.ProcessState.ExitCode() {
+	case 0:
+		return nil
+	case 1:
+	default:
+		return err
+	}
+	installed(ctx)
+	return command(ctx, iptables(family), append([]string{"-t", table, "-" + operation, chain}, rule...)...).Run()
+}
+
+// removeRule deletes the given iptables rule if it exists.
+func removeRule(ctx context.Context, family, table, chain string, rule ...string) error {
+	cmd := command(ctx, iptables(family), append([]string{"-t", table, "-C", chain}, rule...)...)
+	err := cmd.Run()
+	switch cmd.ProcessState.ExitCode() {
+	case 0:
+	case 1:
+		return nil
+	default:
+		return err
+	}
+	return command(ctx, iptables(family), append([]string{"-t", table, "-D", chain}, rule...)...).Run()
+}
+
+// ParseMark parses a firewall mark given in decimal or hexadecimal
+// (e.g. 0x100) notation.
+func ParseMark(s string) (int, error) {
+	mark, err := strconv.ParseUint(s, 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid mark %q: %w", s, err)
+	}
+	return int(mark), nil
+}
@@ -0,0 +1,71 @@
+package network_test
+
+import (
+	"errors"
+	"os/exec"
+	"testing"
+
+	"github.com/pricec/vpnmux/pkg/network"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCommandError(t *testing.T) {
+	failed := &network.CommandError{
+		Args:     []string{"iptables", "-t", "nat", "-A", "vpnmux"},
+		ExitCode: 2,
+		Stderr:   "iptables: No chain/target/match by that name.",
+		Err:      errors.New("exit status 2"),
+	}
+	require.ErrorIs(t, failed, network.ErrCommandFailed)
+	require.False(t, errors.Is(failed, network.ErrUnavailable))
+	require.Equal(t, "iptables: exit status 2: iptables: No chain/target/match by that name.", failed.Error())
+
+	daemon := &network.CommandError{
+		Args:     []string{"docker", "ps"},
+		ExitCode: 1,
+		Stderr:   "Cannot connect to the Docker daemon at unix:///var/run/docker.sock. Is the docker daemon running?",
+		Err:      errors.New("exit status 1"),
+	}
+	require.ErrorIs(t, daemon, network.ErrCommandFailed)
+	require.ErrorIs(t, daemon, network.ErrUnavailable)
+
+	missing := &network.CommandError{
+		Args:     []string{"docker", "ps"},
+		ExitCode: -1,
+		Err:      &exec.Error{Name: "docker", Err: exec.ErrNotFound},
+	}
+	require.ErrorIs(t, missing, network.ErrUnavailable)
+	require.Equal(t, `docker: exec: "docker": executable file not found in $PATH`, missing.Error())
+}
+
+func TestReadOnly(t *testing.T) {
+	for _, args := range [][]string{
+		{"iptables", "-t", "mangle", "-S", "VPNMUX-POLICY"},
+		{"ip6tables", "-t", "filter", "-C", "FORWARD", "-j", "DROP"},
+		{"iptables", "-t", "nat", "-n", "-L", "VPNMUX-PF"},
+		{"iptables-save", "-c", "-t", "filter"},
+		{"ip", "-6", "rule", "show", "from", "fd00::1"},
+		{"ip", "route", "show", "table", "7", "default"},
+		{"tc", "-s", "class", "show", "dev", "br-1"},
+		{"docker", "ps", "-q"},
+		{"docker", "network", "inspect", "n1"},
+		{"docker", "exec", "c1", "cat", "/proc/net/dev"},
+		{"docker", "exec", "-i", "c1", "iptables", "-t", "nat", "-S", "VPNMUX-PF"},
+	} {
+		require.True(t, network.ReadOnly(args), args)
+	}
+
+	for _, args := range [][]string{
+		{"iptables", "-t", "mangle", "-A", "VPNMUX-POLICY", "-j", "RETURN"},
+		{"iptables-restore", "--noflush"},
+		{"ip", "rule", "add", "fwmark", "0x101", "lookup", "1"},
+		{"ip", "-6", "route", "flush", "table", "7"},
+		{"tc", "qdisc", "del", "dev", "br-1", "root"},
+		{"ipset", "flush", "s1"},
+		{"docker", "rm", "-f", "c1"},
+		{"docker", "exec", "-i", "c1", "iptables-restore", "--noflush"},
+		{"docker", "run", "-d", "image"},
+	} {
+		require.False(t, network.ReadOnly(args), args)
+	}
+}
@@ -0,0 +1,93 @@
+package network
+
+import (
+	"context"
+	"fmt"
+
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+// WANRoute routes packets carrying Mark via the main route table, and
+// permits forwarding them from the LAN to the WAN interface despite the
+// DROP rules installed for each client.
+type WANRoute struct {
+	Mark         string
+	LANInterface string
+	WANInterface string
+}
+
+func NewWANRoute(ctx context.Context, mark, lanInterface, wanInterface string) (*WANRoute, error) {
+	r := &WANRoute{
+		Mark:         mark,
+		LANInterface: lanInterface,
+		WANInterface: wanInterface,
+	}
+
+	if err := r.ensureRule(ctx); err != nil {
+		return nil, err
+	}
+	if err := r.ensureAccept(ctx); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *WANRoute) ensureRule(ctx context.Context) error {
+	output, err := command(ctx, "ip", "rule", "show", "fwmark", r.Mark, "lookup", "main").Output()
+	if err != nil {
+		return fmt.Errorf("ip rule show: %w", err)
+	} else if len(output) > 0 {
+		return nil
+	}
+
+	installed(ctx)
+	err = command(ctx, "ip", "rule", "add", "fwmark", r.Mark, "lookup", "main", "priority", markRulePriority).Run()
+	if err != nil {
+		return fmt.Errorf("ip rule add fwmark: %w", err)
+	}
+	return nil
+}
+
+func (r *WANRoute) iptablesCommand(ctx context.Context, operation string) *cmd {
+	args := []string{"-t", "filter", fmt.Sprintf("-%s", operation), "FORWARD"}
+	if operation == "I" {
+		args = append(args, "1")
+	}
+	args = append(args,
+		"-i", r.LANInterface,
+		"-o", r.WANInterface,
+		"-m", "mark", "--mark", r.Mark,
+		"-j", "ACCEPT",
+	)
+	return command(ctx, "iptables", args...)
+}
+
+func (r *WANRoute) ensureAccept(ctx context.Context) error {
+	cmd := r.iptablesCommand(ctx, "C")
+	err := cmd.Run()
+	switch cmd.ProcessState.ExitCode() {
+	case 0:
+		return nil
+	case 1:
+	default:
+		return err
+	}
+
+	// Insert rather than append, so that the rule precedes client DROPs.
+	installed(ctx)
+	return r.iptablesCommand(ctx, "I").Run()
+}
+
+func (r *WANRoute) Close(ctx context.Context) error {
+	var result error
+
+	if err := r.iptablesCommand(ctx, "D").Run(); err != nil {
+		result = multierror.Append(result, err)
+	}
+
+	if err := command(ctx, "ip", "rule", "del", "fwmark", r.Mark, "lookup", "main").Run(); err != nil {
+		result = multierror.Append(result, err)
+	}
+
+	return result
+}
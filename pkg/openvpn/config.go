@@ -1,9 +1,12 @@
 package openvpn
 
 import (
+	"context"
 	"os"
 	"path"
 	"text/template"
+
+	"github.com/pricec/vpnmux/pkg/logging"
 )
 
 // TODO: make this configutable
@@ -59,7 +62,7 @@ func NewConfigFromID(id string) (*Config, error) {
 	}, nil
 }
 
-func NewConfig(id string, opts ConfigOptions) (*Config, error) {
+func NewConfig(ctx context.Context, id string, opts ConfigOptions) (*Config, error) {
 	c := &Config{
 		ID:           id,
 		Dir:          "",
@@ -83,6 +86,7 @@ func NewConfig(id string, opts ConfigOptions) (*Config, error) {
 	}
 
 	dir := path.Join(configDir, id)
+	logging.Debug(ctx, "writing openvpn config", "dir", dir)
 
 	if err := os.MkdirAll(dir, 0700); err != nil {
 		return nil, err
@@ -130,6 +134,7 @@ func NewConfig(id string, opts ConfigOptions) (*Config, error) {
 	return c, nil
 }
 
-func (c *Config) Close() error {
+func (c *Config) Close(ctx context.Context) error {
+	logging.Debug(ctx, "removing openvpn config", "dir", c.Dir)
 	return os.RemoveAll(c.Dir)
 }
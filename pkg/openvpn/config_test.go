@@ -1,6 +1,7 @@
 package openvpn_test
 
 import (
+	"context"
 	"testing"
 
 	"github.com/google/uuid"
@@ -9,8 +10,9 @@ import (
 )
 
 func TestNewConfig(t *testing.T) {
+	ctx := context.Background()
 	id := uuid.New().String()
-	cfg, err := openvpn.NewConfig(id, openvpn.ConfigOptions{
+	cfg, err := openvpn.NewConfig(ctx, id, openvpn.ConfigOptions{
 		Host:    "host",
 		User:    "username",
 		Pass:    "password",
@@ -26,5 +28,5 @@ func TestNewConfig(t *testing.T) {
 
 	assert.Equal(t, cfg.ID, cfg2.ID)
 	assert.Equal(t, cfg.Dir, cfg2.Dir)
-	assert.Nil(t, cfg.Close())
+	assert.Nil(t, cfg.Close(ctx))
 }
@@ -0,0 +1,197 @@
+package reconciler
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/pricec/vpnmux/pkg/database"
+	"github.com/pricec/vpnmux/pkg/network"
+)
+
+const accountingChain = "VPNMUX-ACCT"
+
+// Usage identifies the traffic forwarded between a client and a network
+// in one direction: "tx" from the client, "rx" to the client.
+type Usage struct {
+	ClientID  string
+	NetworkID string
+	Direction string
+}
+
+func (u Usage) comment() string {
+	return fmt.Sprintf("%s:%s:%s", u.ClientID, u.NetworkID, u.Direction)
+}
+
+func parseUsage(comment string) (Usage, bool) {
+	parts := strings.Split(comment, ":")
+	if len(parts) != 3 {
+		return Usage{}, false
+	}
+	return Usage{
+		ClientID:  parts[0],
+		NetworkID: parts[1],
+		Direction: parts[2],
+	}, true
+}
+
+// AccountingReconciler installs a rule on the FORWARD path counting the
+// traffic between each client and each network's bridge, and accumulates
+// the rules' counters. Only IPv4 traffic of clients with a known address
+// is counted.
+type AccountingReconciler struct {
+	db       *database.Database
+	networks *NetworkReconciler
+	chain    *network.Chain
+	mu       sync.Mutex
+	// Counters of the installed rules when last read, the running totals,
+	// which survive rebuilds of the chain, and the traffic counted since
+	// the last call to Sample.
+	last    map[Usage]network.Counter
+	totals  map[Usage]network.Counter
+	pending map[Usage]network.Counter
+}
+
+func NewAccountingReconciler(ctx context.Context, db *database.Database, networks *NetworkReconciler) (*AccountingReconciler, error) {
+	chain, err := network.NewChain(ctx, "filter", accountingChain, "FORWARD")
+	if err != nil {
+		return nil, err
+	}
+
+	r := &AccountingReconciler{
+		db:       db,
+		networks: networks,
+		chain:    chain,
+		last:     make(map[Usage]network.Counter),
+		totals:   make(map[Usage]network.Counter),
+		pending:  make(map[Usage]network.Counter),
+	}
+
+	// Traffic counted by rules left by a previous run was already seen.
+	last, err := r.read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	r.last = last
+
+	if err := r.rebuild(ctx); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// rebuild replaces the accounting rules with one per direction for every
+// pair of client and network, first sampling the counters of the rules
+// being replaced.
+func (r *AccountingReconciler) rebuild(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.sample(ctx); err != nil {
+		return err
+	}
+
+	clients, err := r.db.Clients.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	nets, err := r.db.Networks.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	var rules [][]string
+	for _, net := range nets {
+		_, dockerNet, err := r.networks.check(ctx, net.ID)
+		if err != nil {
+			return err
+		}
+		bridge := dockerNet.Bridge()
+
+		for _, client := range clients {
+			if client.Address == "" {
+				continue
+			}
+
+			tx := Usage{ClientID: client.ID, NetworkID: net.ID, Direction: "tx"}
+			rx := Usage{ClientID: client.ID, NetworkID: net.ID, Direction: "rx"}
+			rules = append(rules,
+				[]string{"-s", client.Address, "-o", bridge, "-m", "comment", "--comment", tx.comment(), "-j", "RETURN"},
+				[]string{"-d", client.Address, "-i", bridge, "-m", "comment", "--comment", rx.comment(), "-j", "RETURN"},
+			)
+		}
+	}
+
+	if err := r.chain.Replace(ctx, rules); err != nil {
+		return err
+	}
+	r.last = make(map[Usage]network.Counter)
+	return nil
+}
+
+// sample reads the counters of the installed rules and adds the traffic
+// counted since they were last read to the running totals and to the
+// traffic pending the next call to Sample.
+func (r *AccountingReconciler) sample(ctx context.Context) error {
+	last, err := r.read(ctx)
+	if err != nil {
+		return err
+	}
+
+	for usage, counter := range last {
+		delta := counter
+		if prev, ok := r.last[usage]; ok && counter.Bytes >= prev.Bytes && counter.Packets >= prev.Packets {
+			delta.Bytes -= prev.Bytes
+			delta.Packets -= prev.Packets
+		}
+		r.totals[usage] = add(r.totals[usage], delta)
+		r.pending[usage] = add(r.pending[usage], delta)
+	}
+	r.last = last
+	return nil
+}
+
+// read returns the counters of the installed rules.
+func (r *AccountingReconciler) read(ctx context.Context) (map[Usage]network.Counter, error) {
+	counters, err := r.chain.Counters(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[Usage]network.Counter, len(counters))
+	for comment, counter := range counters {
+		if usage, ok := parseUsage(comment); ok {
+			result[usage] = counter
+		}
+	}
+	return result, nil
+}
+
+func add(a, b network.Counter) network.Counter {
+	return network.Counter{
+		Packets: a.Packets + b.Packets,
+		Bytes:   a.Bytes + b.Bytes,
+	}
+}
+
+// Sample returns the traffic counted since the previous call, and the
+// totals counted since vpnmux started.
+func (r *AccountingReconciler) Sample(ctx context.Context) (deltas, totals map[Usage]network.Counter, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.sample(ctx); err != nil {
+		return nil, nil, err
+	}
+
+	deltas = r.pending
+	r.pending = make(map[Usage]network.Counter)
+
+	totals = make(map[Usage]network.Counter, len(r.totals))
+	for usage, total := range r.totals {
+		totals[usage] = total
+	}
+	return deltas, totals, nil
+}
@@ -0,0 +1,363 @@
+package reconciler
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/pricec/vpnmux/pkg/database"
+	"github.com/pricec/vpnmux/pkg/network"
+)
+
+// ClientGroupReconciler installs the rules for client groups: a kill switch
+// and a routing rule for each of a group's subnets, and a routing rule for
+// each member client which is not itself assigned to a network. Group
+// routing rules have a lower priority than those of individually assigned
+// clients, so a client's own assignment always takes precedence.
+type ClientGroupReconciler struct {
+	db         *database.Database
+	forwarding ForwardingOptions
+	mu         sync.Mutex
+	observers  []func(context.Context) error
+}
+
+func NewClientGroupReconciler(ctx context.Context, db *database.Database, forwarding ForwardingOptions) (*ClientGroupReconciler, error) {
+	groups, err := db.ClientGroups.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &ClientGroupReconciler{
+		db:         db,
+		forwarding: forwarding,
+	}
+	for _, group := range groups {
+		if _, err := r.check(ctx, group.ID); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (r *ClientGroupReconciler) validate(ctx context.Context, g *database.ClientGroup) error {
+	if len(g.CIDRs) == 0 && len(g.Members) == 0 {
+		return fmt.Errorf("%w: one of cidrs or members is required", ErrInvalid)
+	}
+
+	if err := validateRateLimit(g.RateLimit); err != nil {
+		return err
+	}
+
+	for i, cidr := range g.CIDRs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("%w: invalid subnet %q", ErrInvalid, cidr)
+		}
+		g.CIDRs[i] = ipNet.String()
+	}
+
+	for _, id := range g.Members {
+		if _, err := r.db.Clients.Get(ctx, id); err != nil {
+			if err == database.ErrNotFound {
+				return fmt.Errorf("%w: unknown client %q", ErrInvalid, id)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// assigned returns the network the group is assigned to, or nil if it is
+// unassigned.
+func (r *ClientGroupReconciler) assigned(ctx context.Context, id string) (*network.Network, error) {
+	gn, err := r.db.GroupNetworks.Get(ctx, id)
+	switch {
+	case err == database.ErrNotFound:
+		return nil, nil
+	case err != nil:
+		return nil, err
+	case gn.NetworkID == "":
+		return nil, nil
+	}
+	return network.NewFromID(ctx, gn.NetworkID)
+}
+
+// routeVia routes c via dockerNet, or clears its routes if dockerNet is nil.
+func (r *ClientGroupReconciler) routeVia(ctx context.Context, c *network.Client, dockerNet *network.Network) error {
+	if dockerNet == nil {
+		if err := c.ClearRoutes(ctx); err != nil {
+			return err
+		}
+	} else {
+		if err := c.SetGroupRouteTable(ctx, dockerNet.Container.RouteTableID); err != nil {
+			return err
+		}
+	}
+	return restrictIPv6(ctx, c, dockerNet, r.forwarding)
+}
+
+// subnet returns the rules for one of a group's subnets.
+func (r *ClientGroupReconciler) subnet(cidr string) *network.Client {
+	c := &network.Client{
+		LANInterface: r.forwarding.LANInterface,
+		WANInterface: r.forwarding.WANInterface,
+	}
+	if strings.Contains(cidr, ":") {
+		c.Address6 = cidr
+	} else {
+		c.Address = cidr
+	}
+	return c
+}
+
+// host returns the routing rules for a member client, without its
+// forwarding rules which belong to the client itself.
+func (r *ClientGroupReconciler) host(client *database.Client) *network.Client {
+	return &network.Client{
+		Address:      client.Address,
+		Address6:     client.Address6,
+		MAC:          client.MAC,
+		LANInterface: r.forwarding.LANInterface,
+		WANInterface: r.forwarding.WANInterface,
+	}
+}
+
+func (r *ClientGroupReconciler) check(ctx context.Context, id string) (*database.ClientGroup, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	group, err := r.db.ClientGroups.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	dockerNet, err := r.assigned(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, cidr := range group.CIDRs {
+		subnet := r.subnet(cidr)
+		client, err := network.NewClient(ctx, subnet.Address, subnet.Address6, "", r.forwarding.LANInterface, r.forwarding.WANInterface)
+		if err != nil {
+			return nil, err
+		}
+		if err := r.routeVia(ctx, client, dockerNet); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, clientID := range group.Members {
+		if err := r.checkMember(ctx, clientID, dockerNet); err != nil {
+			return nil, err
+		}
+	}
+	return group, nil
+}
+
+// checkMember routes a member client via the group's network, unless it is
+// individually assigned to a network.
+func (r *ClientGroupReconciler) checkMember(ctx context.Context, clientID string, dockerNet *network.Network) error {
+	_, err := r.db.ClientNetworks.Get(ctx, clientID)
+	switch {
+	case err == nil:
+		return nil
+	case err != database.ErrNotFound:
+		return err
+	}
+
+	c, err := r.db.Clients.Get(ctx, clientID)
+	if err != nil {
+		return err
+	}
+	return r.routeVia(ctx, r.host(c), dockerNet)
+}
+
+// member rechecks the group (if any) of which a client is a member, e.g.
+// after the client's address or own assignment changes.
+func (r *ClientGroupReconciler) member(ctx context.Context, clientID string) error {
+	group, err := r.db.ClientGroups.GetByMember(ctx, clientID)
+	switch {
+	case err == database.ErrNotFound:
+		return nil
+	case err != nil:
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	dockerNet, err := r.assigned(ctx, group.ID)
+	if err != nil {
+		return err
+	}
+	return r.checkMember(ctx, clientID, dockerNet)
+}
+
+// release removes the rules of the given subnets and members of a group.
+func (r *ClientGroupReconciler) release(ctx context.Context, cidrs, members []string) error {
+	var result error
+
+	for _, cidr := range cidrs {
+		client := r.subnet(cidr)
+		if err := client.ClearRoutes(ctx); err != nil {
+			result = multierror.Append(result, err)
+		}
+		if err := client.Close(ctx); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+
+	for _, clientID := range members {
+		if err := r.checkMember(ctx, clientID, nil); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+	return result
+}
+
+func (r *ClientGroupReconciler) Get(ctx context.Context, id string) (*database.ClientGroup, error) {
+	return r.check(ctx, id)
+}
+
+func (r *ClientGroupReconciler) Create(ctx context.Context, g *database.ClientGroup) (*database.ClientGroup, error) {
+	if err := r.validate(ctx, g); err != nil {
+		return nil, err
+	}
+
+	group, err := r.db.ClientGroups.Put(ctx, g)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := r.check(ctx, group.ID); err != nil {
+		// TODO: clean up
+		return nil, err
+	}
+
+	if err := r.notify(ctx); err != nil {
+		return nil, err
+	}
+	return group, nil
+}
+
+func (r *ClientGroupReconciler) Update(ctx context.Context, g *database.ClientGroup) (*database.ClientGroup, error) {
+	if err := r.validate(ctx, g); err != nil {
+		return nil, err
+	}
+
+	old, err := r.db.ClientGroups.Get(ctx, g.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.db.ClientGroups.Update(ctx, g); err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	err = r.release(ctx, difference(old.CIDRs, g.CIDRs), difference(old.Members, g.Members))
+	r.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	group, err := r.check(ctx, g.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.notify(ctx); err != nil {
+		return nil, err
+	}
+	return group, nil
+}
+
+// OnChange registers fn to be called after a group is created, updated or
+// deleted, or assigned to a network or unassigned, so that rules matching
+// the group may be rewritten.
+func (r *ClientGroupReconciler) OnChange(fn func(context.Context) error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.observers = append(r.observers, fn)
+}
+
+func (r *ClientGroupReconciler) notify(ctx context.Context) error {
+	r.mu.Lock()
+	observers := r.observers
+	r.mu.Unlock()
+	return notify(ctx, observers)
+}
+
+func (r *ClientGroupReconciler) Delete(ctx context.Context, id string) error {
+	group, err := r.db.ClientGroups.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if err := r.db.ClientGroups.Delete(ctx, id); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	err = r.release(ctx, group.CIDRs, group.Members)
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return r.notify(ctx)
+}
+
+func (r *ClientGroupReconciler) GetNetwork(ctx context.Context, id string) (*database.ClientGroupNetwork, error) {
+	return r.db.GroupNetworks.Get(ctx, id)
+}
+
+func (r *ClientGroupReconciler) SetNetwork(ctx context.Context, gn *database.ClientGroupNetwork) (*database.ClientGroupNetwork, error) {
+	if _, err := r.db.ClientGroups.Get(ctx, gn.GroupID); err != nil {
+		return nil, err
+	}
+
+	gn, err := r.db.GroupNetworks.Put(ctx, gn)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := r.check(ctx, gn.GroupID); err != nil {
+		return nil, err
+	}
+
+	if err := r.notify(ctx); err != nil {
+		return nil, err
+	}
+	return gn, nil
+}
+
+func (r *ClientGroupReconciler) UnsetNetwork(ctx context.Context, id string) error {
+	if err := r.db.GroupNetworks.Delete(ctx, id); err != nil {
+		return err
+	}
+
+	if _, err := r.check(ctx, id); err != nil {
+		return err
+	}
+	return r.notify(ctx)
+}
+
+// difference returns the elements of a which are not in b.
+func difference(a, b []string) []string {
+	set := make(map[string]bool, len(b))
+	for _, s := range b {
+		set[s] = true
+	}
+
+	var result []string
+	for _, s := range a {
+		if !set[s] {
+			result = append(result, s)
+		}
+	}
+	return result
+}
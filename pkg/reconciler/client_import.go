@@ -0,0 +1,190 @@
+package reconciler
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pricec/vpnmux/pkg/database"
+	"github.com/pricec/vpnmux/pkg/inventory"
+	"github.com/pricec/vpnmux/pkg/lease"
+	"github.com/pricec/vpnmux/pkg/logging"
+	"github.com/pricec/vpnmux/pkg/network"
+)
+
+// Statuses of an imported host.
+const (
+	ImportCreated = "created"
+	ImportExists  = "exists"
+	ImportFailed  = "failed"
+)
+
+// ImportResult is the outcome of importing a host: the client created for
+// it, or the existing client which has one of its addresses, or the error
+// which prevented its import.
+type ImportResult struct {
+	// The position of the host in the import, from 0.
+	Index    int    `json:"index"`
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	ClientID string `json:"client_id,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// ImportClients creates a client for each host which is not a client yet,
+// i.e. which has neither the MAC address nor an address of an existing
+// client, and assigns it to the host's network, if any. Hosts are
+// imported independently: the failure of one does not prevent the import
+// of the others, and a client whose assignment fails is kept, with the
+// error in its result.
+func (r *Reconciler) ImportClients(ctx context.Context, hosts []inventory.Host) ([]ImportResult, error) {
+	known, err := knownClients(ctx, r.db)
+	if err != nil {
+		return nil, err
+	}
+	networks, err := r.db.Networks.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]ImportResult, 0, len(hosts))
+	for i, h := range hosts {
+		result := ImportResult{Index: i, Name: h.Name, Status: ImportFailed}
+		if id, ok := known.find(h); ok {
+			result.Status = ImportExists
+			result.ClientID = id
+			results = append(results, result)
+			continue
+		}
+
+		client, err := r.importClient(ctx, h, networks)
+		if client != nil {
+			result.ClientID = client.ID
+			known.add(h, client.ID)
+		}
+		if err == nil {
+			result.Status = ImportCreated
+		} else {
+			result.Error = err.Error()
+			logging.Error(ctx, "error importing client", "name", h.Name, "err", err)
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// importClient creates the client of a host and assigns it to the host's
+// network, if any. The client is returned if it was created, even if its
+// assignment failed.
+func (r *Reconciler) importClient(ctx context.Context, h inventory.Host, networks []*database.Network) (*database.Client, error) {
+	var networkID string
+	if h.Network != "" {
+		var err error
+		if networkID, err = findNetwork(networks, h.Network); err != nil {
+			return nil, err
+		}
+	}
+
+	client, err := r.Clients.Create(ctx, &database.Client{
+		Name:     h.Name,
+		Address:  h.Address,
+		Address6: h.Address6,
+		MAC:      h.MAC,
+	})
+	if err != nil || networkID == "" {
+		return client, err
+	}
+
+	_, err = r.ClientNetworks.Create(ctx, &database.ClientNetwork{
+		ClientID:  client.ID,
+		NetworkID: networkID,
+	})
+	if err != nil {
+		err = fmt.Errorf("assigning network: %w", err)
+	}
+	return client, err
+}
+
+// findNetwork returns the ID of the network with the given ID or name.
+func findNetwork(networks []*database.Network, network string) (string, error) {
+	var ids []string
+	for _, n := range networks {
+		if n.ID == network {
+			return n.ID, nil
+		}
+		if n.Name == network {
+			ids = append(ids, n.ID)
+		}
+	}
+	switch len(ids) {
+	case 0:
+		return "", fmt.Errorf("%w: no network %q", ErrInvalid, network)
+	case 1:
+		return ids[0], nil
+	default:
+		return "", fmt.Errorf("%w: %d networks are named %q", ErrInvalid, len(ids), network)
+	}
+}
+
+// Discover returns the hosts in the neighbor table of the LAN interface
+// which are not clients, named after the hostnames of their DHCP leases,
+// if the lease file is configured.
+func (r *ClientReconciler) Discover(ctx context.Context) ([]inventory.Host, error) {
+	neighbors, err := network.Neighbors(ctx, r.forwarding.LANInterface)
+	if err != nil {
+		return nil, err
+	}
+
+	var leases []lease.Lease
+	if r.opts.LeaseFile != "" {
+		leases, err = lease.Read(r.opts.LeaseFile)
+		if err != nil {
+			logging.Error(ctx, "error reading lease file", "err", err)
+		}
+	}
+
+	known, err := knownClients(ctx, r.db)
+	if err != nil {
+		return nil, err
+	}
+
+	hosts := make([]inventory.Host, 0)
+	for _, h := range inventory.FromNeighbors(neighbors, leases) {
+		if _, ok := known.find(h); !ok {
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts, nil
+}
+
+// clientIndex maps the MAC addresses and addresses of clients to their
+// IDs.
+type clientIndex map[string]string
+
+func knownClients(ctx context.Context, db *database.Database) (clientIndex, error) {
+	clients, err := db.Clients.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	known := make(clientIndex)
+	for _, c := range clients {
+		known.add(inventory.Host{Address: c.Address, Address6: c.Address6, MAC: c.MAC}, c.ID)
+	}
+	return known, nil
+}
+
+func (i clientIndex) add(h inventory.Host, id string) {
+	for _, key := range h.Keys() {
+		i[key] = id
+	}
+}
+
+// find returns the ID of the client which has one of the addresses of h.
+func (i clientIndex) find(h inventory.Host) (string, bool) {
+	for _, key := range h.Keys() {
+		if id, ok := i[key]; ok {
+			return id, true
+		}
+	}
+	return "", false
+}
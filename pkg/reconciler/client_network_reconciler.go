@@ -2,7 +2,7 @@ package reconciler
 
 import (
 	"context"
-	"fmt"
+	"sync"
 
 	"github.com/pricec/vpnmux/pkg/database"
 	"github.com/pricec/vpnmux/pkg/network"
@@ -11,13 +11,29 @@ import (
 type ClientNetworkReconciler struct {
 	db         *database.Database
 	forwarding ForwardingOptions
+	groups     *ClientGroupReconciler
+	mu         sync.Mutex
+	observers  []func(context.Context) error
 }
 
-func (r *ClientNetworkReconciler) Update(ctx context.Context, cfg *database.ClientNetwork) (*database.ClientNetwork, error) {
-	return nil, fmt.Errorf("TODO: implement client-network update reconciler")
+// Update moves a client to another network, or to none.
+func (r *ClientNetworkReconciler) Update(ctx context.Context, cn *database.ClientNetwork) (*database.ClientNetwork, error) {
+	if err := r.db.ClientNetworks.Update(ctx, cn); err != nil {
+		return nil, err
+	}
+
+	net, _, err := r.check(ctx, cn.ClientID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.notify(ctx); err != nil {
+		return nil, err
+	}
+	return net, nil
 }
 
-func NewClientNetworkReconciler(ctx context.Context, db *database.Database, forwarding ForwardingOptions) (*ClientNetworkReconciler, error) {
+func NewClientNetworkReconciler(ctx context.Context, db *database.Database, forwarding ForwardingOptions, groups *ClientGroupReconciler) (*ClientNetworkReconciler, error) {
 	nets, err := db.ClientNetworks.List(ctx)
 	if err != nil {
 		return nil, err
@@ -26,6 +42,7 @@ func NewClientNetworkReconciler(ctx context.Context, db *database.Database, forw
 	r := &ClientNetworkReconciler{
 		db:         db,
 		forwarding: forwarding,
+		groups:     groups,
 	}
 	for _, net := range nets {
 		if _, _, err := r.check(ctx, net.ClientID); err != nil {
@@ -46,26 +63,31 @@ func (r *ClientNetworkReconciler) check(ctx context.Context, id string) (*databa
 		return nil, nil, err
 	}
 
-	client, err := network.NewClient(c.Address, r.forwarding.LANInterface, r.forwarding.WANInterface)
+	client, err := networkClient(ctx, c, r.forwarding)
 	if err != nil {
 		return nil, nil, err
 	}
 
+	var dockerNet *network.Network
 	if net.NetworkID != "" {
-		dockerNet, err := network.NewFromID(net.NetworkID)
+		dockerNet, err = network.NewFromID(ctx, net.NetworkID)
 		if err != nil {
 			return nil, nil, err
 		}
 
-		if err := client.SetRouteTable(dockerNet.Container.RouteTableID); err != nil {
+		if err := client.SetRouteTable(ctx, dockerNet.Container.RouteTableID); err != nil {
 			return nil, nil, err
 		}
 	} else {
-		if err := client.ClearRoutes(); err != nil {
+		if err := client.ClearRoutes(ctx); err != nil {
 			return nil, nil, err
 		}
 	}
 
+	if err := restrictIPv6(ctx, client, dockerNet, r.forwarding); err != nil {
+		return nil, nil, err
+	}
+
 	// TODO: check if settings are equal?
 	return net, client, nil
 }
@@ -86,9 +108,27 @@ func (r *ClientNetworkReconciler) Create(ctx context.Context, cn *database.Clien
 
 	}
 
+	if err := r.notify(ctx); err != nil {
+		return nil, err
+	}
 	return net, nil
 }
 
+// OnChange registers fn to be called after a client is assigned to a
+// network, moved or unassigned.
+func (r *ClientNetworkReconciler) OnChange(fn func(context.Context) error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.observers = append(r.observers, fn)
+}
+
+func (r *ClientNetworkReconciler) notify(ctx context.Context) error {
+	r.mu.Lock()
+	observers := r.observers
+	r.mu.Unlock()
+	return notify(ctx, observers)
+}
+
 func (r *ClientNetworkReconciler) Delete(ctx context.Context, id string) error {
 	_, client, err := r.check(ctx, id)
 	if err != nil {
@@ -99,9 +139,16 @@ func (r *ClientNetworkReconciler) Delete(ctx context.Context, id string) error {
 		return err
 	}
 
-	if err := client.ClearRoutes(); err != nil {
+	if err := client.ClearRoutes(ctx); err != nil {
+		return err
+	}
+	if err := client.UnblockIPv6(ctx); err != nil {
 		return err
 	}
 
-	return nil
+	// Fall back to the assignment of the client's group, if any.
+	if err := r.groups.member(ctx, id); err != nil {
+		return err
+	}
+	return r.notify(ctx)
 }
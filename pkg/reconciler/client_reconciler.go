@@ -3,21 +3,66 @@ package reconciler
 import (
 	"context"
 	"fmt"
+	"net"
+	"sync"
+	"time"
 
 	"github.com/pricec/vpnmux/pkg/database"
+	"github.com/pricec/vpnmux/pkg/lease"
+	"github.com/pricec/vpnmux/pkg/logging"
 	"github.com/pricec/vpnmux/pkg/network"
 )
 
+type ClientOptions struct {
+	// (optional) dnsmasq or ISC dhcpd lease file used to resolve the
+	// addresses of clients identified by MAC address.
+	LeaseFile string
+	// Interval at which the addresses of such clients are refreshed.
+	ResolveInterval time.Duration
+}
+
 type ClientReconciler struct {
 	db         *database.Database
 	forwarding ForwardingOptions
+	opts       ClientOptions
+
+	mu        sync.Mutex
+	observers []func(context.Context, *database.Client) error
+	changes   []func(context.Context) error
+	// Serializes refreshes, which run both periodically and on Create.
+	refreshMu sync.Mutex
 }
 
-func (r *ClientReconciler) Update(ctx context.Context, cfg *database.Client) (*database.Client, error) {
-	return nil, fmt.Errorf("TODO: implement client update reconciler")
+func (r *ClientReconciler) Update(ctx context.Context, c *database.Client) (*database.Client, error) {
+	if err := validateClient(c); err != nil {
+		return nil, err
+	}
+
+	old, err := r.db.Clients.Get(ctx, c.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.MAC != "" && c.Address == "" && old.MAC == c.MAC {
+		// Keep the resolved address until the next refresh.
+		c.Address = old.Address
+	}
+
+	if err := r.db.Clients.Update(ctx, c); err != nil {
+		return nil, err
+	}
+
+	if err := r.rewrite(ctx, old, c); err != nil {
+		return nil, err
+	}
+
+	if err := r.notify(ctx); err != nil {
+		return nil, err
+	}
+	return c, nil
 }
 
-func NewClientReconciler(ctx context.Context, db *database.Database, forwarding ForwardingOptions) (*ClientReconciler, error) {
+func NewClientReconciler(ctx context.Context, db *database.Database, forwarding ForwardingOptions, opts ClientOptions) (*ClientReconciler, error) {
 	clients, err := db.Clients.List(ctx)
 	if err != nil {
 		return nil, err
@@ -26,6 +71,7 @@ func NewClientReconciler(ctx context.Context, db *database.Database, forwarding
 	r := &ClientReconciler{
 		db:         db,
 		forwarding: forwarding,
+		opts:       opts,
 	}
 	for _, client := range clients {
 		if _, _, err := r.check(ctx, client.ID); err != nil {
@@ -35,13 +81,50 @@ func NewClientReconciler(ctx context.Context, db *database.Database, forwarding
 	return r, nil
 }
 
+func validateClient(c *database.Client) error {
+	if c.Address == "" && c.Address6 == "" && c.MAC == "" {
+		return fmt.Errorf("%w: one of address, address6 or mac is required", ErrInvalid)
+	}
+
+	if err := validateRateLimit(c.RateLimit); err != nil {
+		return err
+	}
+
+	if err := validateKillSwitch(c); err != nil {
+		return err
+	}
+
+	if c.Address != "" {
+		if ip := net.ParseIP(c.Address); ip == nil || ip.To4() == nil {
+			return fmt.Errorf("%w: invalid IPv4 address %q", ErrInvalid, c.Address)
+		}
+	}
+
+	if c.Address6 != "" {
+		ip := net.ParseIP(c.Address6)
+		if ip == nil || ip.To4() != nil {
+			return fmt.Errorf("%w: invalid IPv6 address %q", ErrInvalid, c.Address6)
+		}
+		c.Address6 = ip.String()
+	}
+
+	if c.MAC != "" {
+		mac, err := net.ParseMAC(c.MAC)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalid, err)
+		}
+		c.MAC = mac.String()
+	}
+	return nil
+}
+
 func (r *ClientReconciler) check(ctx context.Context, id string) (*database.Client, *network.Client, error) {
 	client, err := r.db.Clients.Get(ctx, id)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	networkClient, err := network.NewClient(client.Address, r.forwarding.LANInterface, r.forwarding.WANInterface)
+	networkClient, err := networkClient(ctx, client, r.forwarding)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -49,19 +132,167 @@ func (r *ClientReconciler) check(ctx context.Context, id string) (*database.Clie
 	return client, networkClient, nil
 }
 
+// OnAddressChange registers fn to be called after a client's addresses or
+// MAC address change, so that rules referring to them may be rewritten.
+func (r *ClientReconciler) OnAddressChange(fn func(context.Context, *database.Client) error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.observers = append(r.observers, fn)
+}
+
+// OnChange registers fn to be called after a client is created, updated or
+// deleted.
+func (r *ClientReconciler) OnChange(fn func(context.Context) error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.changes = append(r.changes, fn)
+}
+
+func (r *ClientReconciler) notify(ctx context.Context) error {
+	r.mu.Lock()
+	changes := r.changes
+	r.mu.Unlock()
+	return notify(ctx, changes)
+}
+
+// rewrite replaces the host rules for a client whose address or MAC
+// address changed from those of old.
+func (r *ClientReconciler) rewrite(ctx context.Context, old, client *database.Client) error {
+	if old.Address == client.Address && old.Address6 == client.Address6 && old.MAC == client.MAC {
+		return nil
+	}
+
+	// Install the new rules before removing the old ones, so the host is
+	// never left without a kill switch.
+	if _, err := networkClient(ctx, client, r.forwarding); err != nil {
+		return err
+	}
+
+	stale := &network.Client{
+		LANInterface: r.forwarding.LANInterface,
+		WANInterface: r.forwarding.WANInterface,
+	}
+	if old.Address != client.Address {
+		stale.Address = old.Address
+	}
+	if old.Address6 != client.Address6 {
+		stale.Address6 = old.Address6
+	}
+	if old.MAC != client.MAC {
+		stale.MAC = old.MAC
+	}
+
+	if err := stale.ClearRoutes(ctx); err != nil {
+		return err
+	}
+	if err := stale.Close(ctx); err != nil {
+		return err
+	}
+
+	if old.Address != client.Address || old.Address6 != client.Address6 {
+		logging.Info(ctx, "client moved", "client", client.ID, "from", fmt.Sprint([]string{old.Address, old.Address6}), "to", fmt.Sprint([]string{client.Address, client.Address6}))
+	}
+
+	r.mu.Lock()
+	observers := r.observers
+	r.mu.Unlock()
+
+	for _, fn := range observers {
+		if err := fn(ctx, client); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// track periodically refreshes the addresses of clients identified by MAC
+// address until ctx is done.
+func (r *ClientReconciler) track(ctx context.Context) {
+	interval := r.opts.ResolveInterval
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := r.refresh(ctx); err != nil {
+			logging.Error(ctx, "error refreshing client addresses", "err", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// refresh resolves the current address of each client identified by MAC
+// address, first from the lease file and then from the neighbor table of
+// the LAN interface, and rewrites the rules of any client which moved.
+func (r *ClientReconciler) refresh(ctx context.Context) error {
+	r.refreshMu.Lock()
+	defer r.refreshMu.Unlock()
+
+	clients, err := r.db.Clients.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	var leases []lease.Lease
+	if r.opts.LeaseFile != "" {
+		leases, err = lease.Read(r.opts.LeaseFile)
+		if err != nil {
+			logging.Error(ctx, "error reading lease file", "err", err)
+		}
+	}
+
+	neighbors, err := network.Neighbors(ctx, r.forwarding.LANInterface)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, client := range clients {
+		if client.MAC == "" {
+			continue
+		}
+
+		address, ok := lease.Find(leases, client.MAC, now)
+		if !ok {
+			address, ok = network.FindNeighbor(neighbors, client.MAC)
+		}
+		if !ok || address == client.Address {
+			continue
+		}
+
+		// Only the address is written, so that concurrent updates of the
+		// client's other fields are kept.
+		updated, err := r.db.Clients.SetAddress(ctx, client.ID, address)
+		if err != nil {
+			return err
+		}
+
+		if err := r.rewrite(ctx, client, updated); err != nil {
+			logging.Error(ctx, "error rewriting client rules", "client", client.ID, "err", err)
+		}
+	}
+	return nil
+}
+
 func (r *ClientReconciler) Get(ctx context.Context, id string) (*database.Client, *network.Client, error) {
 	return r.check(ctx, id)
 }
 
 func (r *ClientReconciler) Create(ctx context.Context, c *database.Client) (*database.Client, error) {
-	client, err := r.db.Clients.Put(ctx, c)
-	if err != nil {
+	if err := validateClient(c); err != nil {
 		return nil, err
 	}
 
-	_, err = network.NewClient(client.Address, r.forwarding.LANInterface, r.forwarding.WANInterface)
+	client, err := r.db.Clients.Put(ctx, c)
 	if err != nil {
-		// TODO: clean up database
 		return nil, err
 	}
 
@@ -71,6 +302,18 @@ func (r *ClientReconciler) Create(ctx context.Context, c *database.Client) (*dat
 
 	}
 
+	if client.MAC != "" && client.Address == "" {
+		if err := r.refresh(ctx); err != nil {
+			logging.Error(ctx, "error resolving client address", "err", err)
+		}
+		if client, err = r.db.Clients.Get(ctx, client.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := r.notify(ctx); err != nil {
+		return nil, err
+	}
 	return client, nil
 }
 
@@ -80,12 +323,43 @@ func (r *ClientReconciler) Delete(ctx context.Context, id string) error {
 		return err
 	}
 
+	// The client's group membership is deleted with it.
+	_, err = r.db.ClientGroups.GetByMember(ctx, client.ID)
+	member := err == nil
+
 	if err := r.db.Clients.Delete(ctx, client.ID); err != nil {
 		return err
 	}
 
-	if err := networkClient.Close(); err != nil {
+	if err := r.db.Usage.DeleteClient(ctx, client.ID); err != nil {
 		return err
 	}
-	return nil
+
+	if err := networkClient.Close(ctx); err != nil {
+		return err
+	}
+	if member {
+		// Remove the route inherited from the group.
+		if err := networkClient.ClearRoutes(ctx); err != nil {
+			return err
+		}
+	}
+	return r.notify(ctx)
+}
+
+// Usage returns the traffic forwarded between a client and each network
+// from from until to, in buckets of step.
+func (r *ClientReconciler) Usage(ctx context.Context, id string, from, to time.Time, step time.Duration) ([]*database.ClientUsage, error) {
+	if _, err := r.db.Clients.Get(ctx, id); err != nil {
+		return nil, err
+	}
+
+	finest := database.UsageTiers[0].Resolution
+	switch {
+	case step <= 0 || step%finest != 0:
+		return nil, fmt.Errorf("%w: step must be a positive multiple of %s", ErrInvalid, finest)
+	case !from.Before(to):
+		return nil, fmt.Errorf("%w: from must be before to", ErrInvalid)
+	}
+	return r.db.Usage.Query(ctx, id, from, to, step)
 }
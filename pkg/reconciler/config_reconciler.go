@@ -76,7 +76,7 @@ func (r *ConfigReconciler) Create(ctx context.Context, c *database.Config) (*dat
 		return nil, err
 	}
 
-	_, err = openvpn.NewConfig(cfg.ID, openvpn.ConfigOptions{
+	_, err = openvpn.NewConfig(ctx, cfg.ID, openvpn.ConfigOptions{
 		Host:    cfg.Host,
 		User:    userCred.Value,
 		Pass:    passCred.Value,
@@ -107,7 +107,7 @@ func (r *ConfigReconciler) Delete(ctx context.Context, id string) error {
 		return err
 	}
 
-	if err := diskCfg.Close(); err != nil {
+	if err := diskCfg.Close(ctx); err != nil {
 		return err
 	}
 	return nil
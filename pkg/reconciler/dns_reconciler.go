@@ -8,24 +8,29 @@ import (
 	"github.com/pricec/vpnmux/pkg/network"
 )
 
+// dnsRouteTable names the route table reserved for DNS queries.
+const dnsRouteTable = "dns"
+
 type DNSReconciler struct {
-	db     *database.Database
-	router *network.DNSRouter
+	db       *database.Database
+	networks *NetworkReconciler
+	router   *network.DNSRouter
 }
 
 func (r *DNSReconciler) Update(ctx context.Context, cfg *database.DNSRoute) (*database.DNSRoute, error) {
 	return nil, fmt.Errorf("TODO: implement DNS update reconciler")
 }
 
-func NewDNSReconciler(ctx context.Context, db *database.Database, mark, localSubnet string) (*DNSReconciler, error) {
+func NewDNSReconciler(ctx context.Context, db *database.Database, networks *NetworkReconciler, mark, localSubnet string) (*DNSReconciler, error) {
 	router, err := network.NewDNSRouter(ctx, mark, localSubnet)
 	if err != nil {
 		return nil, err
 	}
 
 	r := &DNSReconciler{
-		db:     db,
-		router: router,
+		db:       db,
+		networks: networks,
+		router:   router,
 	}
 
 	if _, err := r.check(ctx); err != nil {
@@ -42,12 +47,22 @@ func (r *DNSReconciler) check(ctx context.Context) (*database.DNSRoute, error) {
 			return nil, err
 		}
 
-		dockerNet, err := network.NewFromID(net.ID)
+		dockerNet, err := network.NewFromID(ctx, net.ID)
 		if err != nil {
 			return nil, err
 		}
 
-		if err := r.router.Route(dockerNet.Container.IPAddress); err != nil {
+		// The route table is allocated from the range of networks'
+		// tables, keeping that of an earlier run if it is in the range.
+		current, err := r.router.Table(ctx)
+		if err != nil {
+			return nil, err
+		}
+		table, err := r.networks.reserveRouteTable(ctx, dnsRouteTable, current)
+		if err != nil {
+			return nil, err
+		}
+		if err := r.router.Route(ctx, dockerNet.Container.IPAddress, table); err != nil {
 			return nil, err
 		}
 	}
@@ -80,8 +95,9 @@ func (r *DNSReconciler) Delete(ctx context.Context) error {
 		return err
 	}
 
-	if err := r.router.Clear(); err != nil {
+	if err := r.router.Clear(ctx); err != nil {
 		return err
 	}
+	r.networks.releaseRouteTable(ctx, dnsRouteTable)
 	return nil
 }
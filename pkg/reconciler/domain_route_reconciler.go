@@ -0,0 +1,354 @@
+package reconciler
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pricec/vpnmux/pkg/database"
+	"github.com/pricec/vpnmux/pkg/dns"
+	"github.com/pricec/vpnmux/pkg/logging"
+	"github.com/pricec/vpnmux/pkg/network"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	domainChain = "VPNMUX-DOMAIN"
+	// Addresses learned from DNS answers are kept for at least this long,
+	// so that connections outliving a short TTL keep their route.
+	minDomainTTL = 5 * time.Minute
+	// Interval at which non-wildcard domains are resolved by vpnmux.
+	domainResolveInterval = 5 * time.Minute
+)
+
+type DomainRouteReconciler struct {
+	db       *database.Database
+	networks *NetworkReconciler
+	chain    *network.Chain
+	chain6   *network.Chain
+
+	mu     sync.Mutex
+	routes []*database.DomainRoute
+	sets   map[string]*network.IPSet
+	// The IPv6 sets of the routes via networks carrying IPv6.
+	sets6 map[string]*network.IPSet
+}
+
+func (r *DomainRouteReconciler) Update(ctx context.Context, route *database.DomainRoute) (*database.DomainRoute, error) {
+	if err := r.validate(ctx, route); err != nil {
+		return nil, err
+	}
+
+	route.Domain = dns.NormalizeDomain(route.Domain)
+	if err := r.db.DomainRoutes.Update(ctx, route); err != nil {
+		return nil, err
+	}
+
+	if err := r.rebuild(ctx); err != nil {
+		return nil, err
+	}
+
+	// Addresses matched by the previous domain are no longer relevant.
+	r.mu.Lock()
+	set, set6 := r.sets[route.ID], r.sets6[route.ID]
+	r.mu.Unlock()
+	if err := set.Flush(ctx); err != nil {
+		return nil, err
+	}
+	if set6 != nil {
+		if err := set6.Flush(ctx); err != nil {
+			return nil, err
+		}
+	}
+	r.resolve(ctx, route)
+
+	return route, nil
+}
+
+func NewDomainRouteReconciler(ctx context.Context, db *database.Database, networks *NetworkReconciler, forwarding ForwardingOptions) (*DomainRouteReconciler, error) {
+	chain, err := network.NewChain(ctx, "mangle", domainChain, "PREROUTING", "-i", forwarding.LANInterface)
+	if err != nil {
+		return nil, err
+	}
+	chain6, err := network.NewChain6(ctx, "mangle", domainChain, "PREROUTING", "-i", forwarding.LANInterface)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &DomainRouteReconciler{
+		db:       db,
+		networks: networks,
+		chain:    chain,
+		chain6:   chain6,
+		sets:     make(map[string]*network.IPSet),
+		sets6:    make(map[string]*network.IPSet),
+	}
+	if err := r.rebuild(ctx); err != nil {
+		return nil, err
+	}
+
+	networks.ObserveDNS(r.observe)
+	go r.resolveLoop(ctx)
+	return r, nil
+}
+
+// validate checks a domain route and that its network and source exist,
+// since rebuild skips routes which cannot be rendered.
+func (r *DomainRouteReconciler) validate(ctx context.Context, route *database.DomainRoute) error {
+	if (route.ClientID == "") == (route.GroupID == "") {
+		return fmt.Errorf("%w: exactly one of client_id or group_id is required", ErrInvalid)
+	}
+
+	if _, err := r.db.Networks.Get(ctx, route.NetworkID); err != nil {
+		return fmt.Errorf("%w: network %q: %v", ErrInvalid, route.NetworkID, err)
+	}
+	if _, err := sourceMatches(ctx, r.db, route.ClientID, route.GroupID, false); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	return nil
+}
+
+func ipSetName(id string) string {
+	return fmt.Sprintf("vpnmux-d-%s", strings.ReplaceAll(id, "-", "")[:16])
+}
+
+func ipSetName6(id string) string {
+	return fmt.Sprintf("vpnmux-d6-%s", strings.ReplaceAll(id, "-", "")[:16])
+}
+
+// rules renders the rules marking packets from a route's sources to the
+// addresses in its set with the given mark, or if v6 those marking IPv6
+// packets.
+func (r *DomainRouteReconciler) rules(ctx context.Context, route *database.DomainRoute, set *network.IPSet, mark int, v6 bool) ([][]string, error) {
+	sources, err := sourceMatches(ctx, r.db, route.ClientID, route.GroupID, v6)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules [][]string
+	for _, source := range sources {
+		args := source.Args
+		if v6 {
+			args = source.Args6
+		}
+		match, err := args()
+		if err != nil {
+			return nil, err
+		}
+		// Only mark packets not already marked by a routing policy,
+		// which take precedence over domain routes.
+		match = append(match, "-m", "mark", "--mark", "0", "-m", "set", "--match-set", set.Name, "dst")
+		rules = append(rules,
+			append(append([]string{}, match...), "-j", "MARK", "--set-mark", fmt.Sprintf("0x%x", mark)),
+			append(append([]string{}, match...), "-j", "RETURN"),
+		)
+	}
+	return rules, nil
+}
+
+// rebuild ensures an ipset exists for every domain route, and an IPv6
+// ipset for every route via a network carrying IPv6, and replaces the
+// rules marking packets from each route's client to the addresses in its
+// sets with the mark of the route's network.
+func (r *DomainRouteReconciler) rebuild(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	routes, err := r.db.DomainRoutes.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	var rules, rules6 [][]string
+	sets := make(map[string]*network.IPSet)
+	sets6 := make(map[string]*network.IPSet)
+	for _, route := range routes {
+		set, ok := r.sets[route.ID]
+		if !ok {
+			set, err = network.NewIPSet(ctx, ipSetName(route.ID), "inet")
+			if err != nil {
+				return err
+			}
+		}
+		sets[route.ID] = set
+
+		// A route which cannot be rendered, e.g. because its network is
+		// down, is skipped, keeping its set until it recovers.
+		mark, ipv6, err := r.networks.Route(ctx, route.NetworkID)
+		if err != nil {
+			logging.Warn(ctx, "skipping domain route", "route", route.ID, "err", err)
+			continue
+		}
+		rr, err := r.rules(ctx, route, set, mark, false)
+		if err != nil {
+			logging.Warn(ctx, "skipping domain route", "route", route.ID, "err", err)
+			continue
+		}
+
+		var rr6 [][]string
+		if ipv6 {
+			set6, ok := r.sets6[route.ID]
+			if !ok {
+				set6, err = network.NewIPSet(ctx, ipSetName6(route.ID), "inet6")
+				if err != nil {
+					return err
+				}
+			}
+			sets6[route.ID] = set6
+
+			rr6, err = r.rules(ctx, route, set6, mark, true)
+			if err != nil {
+				logging.Warn(ctx, "skipping domain route", "route", route.ID, "err", err)
+				continue
+			}
+		}
+		rules = append(rules, rr...)
+		rules6 = append(rules6, rr6...)
+	}
+
+	if err := r.chain.Replace(ctx, rules); err != nil {
+		return err
+	}
+	if err := r.chain6.Replace(ctx, rules6); err != nil {
+		return err
+	}
+
+	// Sets can only be destroyed once no rule references them.
+	closeUnused(ctx, r.sets, sets)
+	closeUnused(ctx, r.sets6, sets6)
+
+	r.routes = routes
+	r.sets = sets
+	r.sets6 = sets6
+	return nil
+}
+
+// closeUnused destroys the sets in old which are not in current.
+func closeUnused(ctx context.Context, old, current map[string]*network.IPSet) {
+	for id, set := range old {
+		if _, ok := current[id]; !ok {
+			if err := set.Close(ctx); err != nil {
+				logging.Error(ctx, "error destroying ipset", "ipset", set.Name, "err", err)
+			}
+		}
+	}
+}
+
+// observe adds the addresses in a DNS response to the set of each route
+// whose domain matches the query.
+func (r *DomainRouteReconciler) observe(msg *dnsmessage.Message) {
+	addrs := dns.Addresses(msg)
+	if len(addrs) == 0 {
+		return
+	}
+
+	// Responses are observed outside of any request.
+	ctx := context.Background()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, route := range r.routes {
+		for _, addr := range addrs {
+			if !dns.MatchDomain(route.Domain, addr.Name) {
+				continue
+			}
+
+			ttl := time.Duration(addr.TTL) * time.Second
+			if ttl < minDomainTTL {
+				ttl = minDomainTTL
+			}
+			r.add(ctx, route, addr.IP, ttl)
+		}
+	}
+}
+
+func (r *DomainRouteReconciler) add(ctx context.Context, route *database.DomainRoute, ip net.IP, ttl time.Duration) {
+	set, ok := r.sets[route.ID]
+	if ip.To4() == nil {
+		set, ok = r.sets6[route.ID]
+	}
+	if !ok {
+		return
+	}
+
+	if err := set.Add(ctx, ip, ttl); err != nil {
+		logging.Warn(ctx, "error adding address to domain route", "address", ip, "route", route.ID, "err", err)
+	}
+}
+
+// resolve looks up a non-wildcard domain and adds its addresses to the
+// route's set, so that the route applies even to clients which do not use
+// a vpnmux DNS forwarder.
+func (r *DomainRouteReconciler) resolve(ctx context.Context, route *database.DomainRoute) {
+	if strings.HasPrefix(route.Domain, "*.") {
+		return
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, route.Domain)
+	if err != nil {
+		logging.Warn(ctx, "error resolving domain", "domain", route.Domain, "err", err)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, addr := range addrs {
+		r.add(ctx, route, addr.IP, 2*domainResolveInterval)
+	}
+}
+
+func (r *DomainRouteReconciler) resolveLoop(ctx context.Context) {
+	ticker := time.NewTicker(domainResolveInterval)
+	defer ticker.Stop()
+
+	for {
+		r.mu.Lock()
+		routes := r.routes
+		r.mu.Unlock()
+
+		for _, route := range routes {
+			r.resolve(ctx, route)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *DomainRouteReconciler) Get(ctx context.Context, id string) (*database.DomainRoute, error) {
+	return r.db.DomainRoutes.Get(ctx, id)
+}
+
+func (r *DomainRouteReconciler) Create(ctx context.Context, route *database.DomainRoute) (*database.DomainRoute, error) {
+	if err := r.validate(ctx, route); err != nil {
+		return nil, err
+	}
+
+	route.Domain = dns.NormalizeDomain(route.Domain)
+	route, err := r.db.DomainRoutes.Put(ctx, route)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.rebuild(ctx); err != nil {
+		// TODO: clean up database
+		return nil, err
+	}
+	r.resolve(ctx, route)
+
+	return route, nil
+}
+
+func (r *DomainRouteReconciler) Delete(ctx context.Context, id string) error {
+	if err := r.db.DomainRoutes.Delete(ctx, id); err != nil {
+		return err
+	}
+	return r.rebuild(ctx)
+}
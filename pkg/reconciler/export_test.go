@@ -0,0 +1,14 @@
+package reconciler
+
+import (
+	"context"
+
+	"github.com/pricec/vpnmux/pkg/database"
+)
+
+// RenderPolicies renders the rules of the policy chains from the policies
+// and allow-lists in db, without installing them.
+func RenderPolicies(ctx context.Context, db *database.Database, localSubnet, wanMark string) ([][]string, [][]string, error) {
+	r := &PolicyReconciler{db: db, localSubnet: localSubnet, wanMark: wanMark}
+	return r.render(ctx)
+}
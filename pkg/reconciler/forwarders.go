@@ -0,0 +1,120 @@
+package reconciler
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/pricec/vpnmux/pkg/dns"
+	"github.com/pricec/vpnmux/pkg/network"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+type ForwarderOptions struct {
+	Enabled   bool
+	Port      uint16
+	CacheSize int
+	// Upstream servers used when the OpenVPN server pushes none.
+	Upstreams []string
+}
+
+type forwarder struct {
+	*dns.Forwarder
+	dockerID string
+	mark     int
+}
+
+// forwarderSet tracks the DNS forwarder running for each Network.
+type forwarderSet struct {
+	opts       ForwarderOptions
+	mu         sync.Mutex
+	forwarders map[string]*forwarder
+	observers  []func(*dnsmessage.Message)
+}
+
+func newForwarderSet(opts ForwarderOptions) *forwarderSet {
+	return &forwarderSet{
+		opts:       opts,
+		forwarders: make(map[string]*forwarder),
+	}
+}
+
+// observe registers fn to be called with every response returned by any
+// of the forwarders.
+func (s *forwarderSet) observe(fn func(*dnsmessage.Message)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.observers = append(s.observers, fn)
+}
+
+func (s *forwarderSet) notify(msg *dnsmessage.Message) {
+	s.mu.Lock()
+	observers := s.observers
+	s.mu.Unlock()
+
+	for _, fn := range observers {
+		fn(msg)
+	}
+}
+
+// ensure starts a forwarder for the network listening on its gateway
+// address, replacing any forwarder started for a previous container.
+func (s *forwarderSet) ensure(id string, dockerNet *network.Network, mark int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ctr := dockerNet.Container
+	listen := net.JoinHostPort(dockerNet.Gateway, strconv.Itoa(int(s.opts.Port)))
+	if f, ok := s.forwarders[id]; ok {
+		if f.Addr() == listen && f.dockerID == ctr.DockerID && f.mark == mark {
+			return nil
+		}
+		f.Close()
+		delete(s.forwarders, id)
+	}
+
+	f, err := dns.NewForwarder(dns.ForwarderOptions{
+		Listen:    listen,
+		Upstreams: s.opts.Upstreams,
+		Mark:      mark,
+		CacheSize: s.opts.CacheSize,
+		Refresh: func() ([]string, error) {
+			return ctr.PushedDNS(context.Background())
+		},
+		Observe: s.notify,
+	})
+	if err != nil {
+		return err
+	}
+
+	s.forwarders[id] = &forwarder{
+		Forwarder: f,
+		dockerID:  ctr.DockerID,
+		mark:      mark,
+	}
+	return nil
+}
+
+func (s *forwarderSet) get(id string) (*dns.Forwarder, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, ok := s.forwarders[id]
+	if !ok {
+		return nil, false
+	}
+	return f.Forwarder, true
+}
+
+func (s *forwarderSet) remove(id string) error {
+	s.mu.Lock()
+	f, ok := s.forwarders[id]
+	delete(s.forwarders, id)
+	s.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+	return f.Close()
+}
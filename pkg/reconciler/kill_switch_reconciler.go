@@ -0,0 +1,190 @@
+package reconciler
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/pricec/vpnmux/pkg/database"
+	"github.com/pricec/vpnmux/pkg/network"
+)
+
+const killSwitchChain = "VPNMUX-WAN"
+
+// KillSwitchReconciler lifts the kill switch of each client whose mode
+// allows it the WAN while it is not assigned to a network. A client is
+// assigned if it or its group is assigned to a network, or if it or its
+// group is in a pool, where its group is one it is a member of or whose
+// subnets contain its address. The rules precede the DROP rules installed for every
+// client, which remain the default.
+type KillSwitchReconciler struct {
+	db     *database.Database
+	chain  *network.Chain
+	chain6 *network.Chain
+	mu     sync.Mutex
+}
+
+func NewKillSwitchReconciler(ctx context.Context, db *database.Database, forwarding ForwardingOptions) (*KillSwitchReconciler, error) {
+	match := []string{"-i", forwarding.LANInterface, "-o", forwarding.WANInterface}
+	chain, err := network.NewChain(ctx, "filter", killSwitchChain, "FORWARD", match...)
+	if err != nil {
+		return nil, err
+	}
+	chain6, err := network.NewChain6(ctx, "filter", killSwitchChain, "FORWARD", match...)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &KillSwitchReconciler{
+		db:     db,
+		chain:  chain,
+		chain6: chain6,
+	}
+	if err := r.rebuild(ctx); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// validateKillSwitch checks the kill switch mode and allow-list of a
+// client, defaulting the mode to strict.
+func validateKillSwitch(c *database.Client) error {
+	switch c.KillSwitch {
+	case "":
+		c.KillSwitch = database.KillSwitchStrict
+	case database.KillSwitchStrict, database.KillSwitchUnassigned, database.KillSwitchAllowList:
+	default:
+		return fmt.Errorf("%w: unknown kill_switch %q", ErrInvalid, c.KillSwitch)
+	}
+
+	if len(c.WANAllow) > 0 && c.KillSwitch != database.KillSwitchAllowList {
+		return fmt.Errorf("%w: wan_allow requires kill_switch %q", ErrInvalid, database.KillSwitchAllowList)
+	}
+	for i, a := range c.WANAllow {
+		if a.Destination == "" {
+			return fmt.Errorf("%w: wan_allow[%d]: destination is required", ErrInvalid, i)
+		}
+		if _, err := wanAllowMatch(a).Args(); err != nil {
+			return fmt.Errorf("%w: wan_allow[%d]: %v", ErrInvalid, i, err)
+		}
+	}
+	return nil
+}
+
+func wanAllowMatch(a database.WANAllow) network.Match {
+	return network.Match{
+		Destination: a.Destination,
+		Protocol:    a.Protocol,
+		Ports:       a.Ports,
+	}
+}
+
+// assignedClients returns the IDs of the clients routed via a network,
+// directly or via their group, whether as a member or by address.
+func assignedClients(ctx context.Context, db *database.Database) (map[string]bool, error) {
+	assigned := make(map[string]bool)
+
+	nets, err := db.ClientNetworks.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, cn := range nets {
+		if cn.NetworkID != "" {
+			assigned[cn.ClientID] = true
+		}
+	}
+
+	groupNets, err := db.GroupNetworks.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pools, err := db.Pools.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	assignedGroups := make(map[string]bool)
+	for _, gn := range groupNets {
+		if gn.NetworkID != "" {
+			assignedGroups[gn.GroupID] = true
+		}
+	}
+	for _, p := range pools {
+		for _, id := range p.Clients {
+			assigned[id] = true
+		}
+		for _, id := range p.Groups {
+			assignedGroups[id] = true
+		}
+	}
+
+	groups, err := db.ClientGroups.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var subnets []*net.IPNet
+	for _, g := range groups {
+		if !assignedGroups[g.ID] {
+			continue
+		}
+		for _, id := range g.Members {
+			assigned[id] = true
+		}
+		for _, cidr := range g.CIDRs {
+			if _, ipNet, err := net.ParseCIDR(cidr); err == nil {
+				subnets = append(subnets, ipNet)
+			}
+		}
+	}
+	if len(subnets) == 0 {
+		return assigned, nil
+	}
+
+	clients, err := db.Clients.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range clients {
+		for _, address := range []string{c.Address, c.Address6} {
+			ip := net.ParseIP(address)
+			for _, subnet := range subnets {
+				if ip != nil && subnet.Contains(ip) {
+					assigned[c.ID] = true
+				}
+			}
+		}
+	}
+	return assigned, nil
+}
+
+// rebuild replaces the rules in the kill switch chains with those accepting
+// the packets of every unassigned client whose mode allows it the WAN.
+func (r *KillSwitchReconciler) rebuild(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	clients, err := r.db.Clients.List(ctx)
+	if err != nil {
+		return err
+	}
+	assigned, err := assignedClients(ctx, r.db)
+	if err != nil {
+		return err
+	}
+
+	var rules, rules6 [][]string
+	for _, c := range clients {
+		if c.KillSwitch != database.KillSwitchUnassigned || assigned[c.ID] {
+			continue
+		}
+		client := &network.Client{Address: c.Address, Address6: c.Address6, MAC: c.MAC}
+		accept, accept6 := client.AllowWAN()
+		rules = append(rules, accept...)
+		rules6 = append(rules6, accept6...)
+	}
+
+	if err := r.chain.Replace(ctx, rules); err != nil {
+		return err
+	}
+	return r.chain6.Replace(ctx, rules6)
+}
@@ -0,0 +1,304 @@
+package reconciler
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/pricec/vpnmux/pkg/database"
+	"github.com/pricec/vpnmux/pkg/events"
+	"github.com/pricec/vpnmux/pkg/logging"
+	"github.com/pricec/vpnmux/pkg/metrics"
+	"github.com/pricec/vpnmux/pkg/network"
+)
+
+// reconcileLoop periodically rechecks every resource, reinstalling any rule
+// or route which has gone missing, until ctx is done.
+func (r *Reconciler) reconcileLoop(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		r.reconcile(ctx)
+	}
+}
+
+func (r *Reconciler) reconcile(ctx context.Context) {
+	r.pass(ctx, "network", func(ctx context.Context) error {
+		nets, err := r.db.Networks.List(ctx)
+		if err != nil {
+			return err
+		}
+		// A failing network does not stop the repair of the others.
+		var result error
+		for _, net := range nets {
+			if _, _, err := r.Networks.repair(ctx, net.ID); err != nil {
+				result = multierror.Append(result, fmt.Errorf("network %s: %w", net.ID, err))
+			}
+		}
+		return result
+	})
+
+	r.pass(ctx, "client", func(ctx context.Context) error {
+		clients, err := r.db.Clients.List(ctx)
+		if err != nil {
+			return err
+		}
+		var result error
+		for _, client := range clients {
+			if _, _, err := r.Clients.check(ctx, client.ID); err != nil {
+				result = multierror.Append(result, fmt.Errorf("client %s: %w", client.ID, err))
+			}
+		}
+		return result
+	})
+
+	r.pass(ctx, "client_network", func(ctx context.Context) error {
+		cns, err := r.db.ClientNetworks.List(ctx)
+		if err != nil {
+			return err
+		}
+		var result error
+		for _, cn := range cns {
+			if _, _, err := r.ClientNetworks.check(ctx, cn.ClientID); err != nil {
+				result = multierror.Append(result, fmt.Errorf("client %s: %w", cn.ClientID, err))
+			}
+		}
+		return result
+	})
+
+	r.pass(ctx, "client_group", func(ctx context.Context) error {
+		groups, err := r.db.ClientGroups.List(ctx)
+		if err != nil {
+			return err
+		}
+		var result error
+		for _, group := range groups {
+			if _, err := r.ClientGroups.check(ctx, group.ID); err != nil {
+				result = multierror.Append(result, fmt.Errorf("group %s: %w", group.ID, err))
+			}
+		}
+		return result
+	})
+
+	r.pass(ctx, "domain_route", r.DomainRoutes.rebuild)
+	r.pass(ctx, "policy", r.Policies.rebuild)
+	r.pass(ctx, "kill_switch", r.KillSwitches.rebuild)
+	r.pass(ctx, "accounting", r.Accounting.rebuild)
+	r.pass(ctx, "shaping", r.Shaping.rebuild)
+	r.pass(ctx, "port_forward", r.PortForwards.rebuild)
+}
+
+// pass reconciles one type of resource, recording the duration of the pass
+// and the number of rules and routes it had to reinstall, which are also
+// published as an event, as are changes in whether the pass fails.
+func (r *Reconciler) pass(ctx context.Context, resource string, fn func(context.Context) error) {
+	var repairs uint64
+	ctx = network.CountInstalls(logging.With(ctx, "pass", resource), &repairs)
+	start := time.Now()
+
+	err := fn(ctx)
+
+	metrics.ReconcileDuration.WithLabelValues(resource).Observe(time.Since(start).Seconds())
+	metrics.ReconcileRepairs.WithLabelValues(resource).Add(float64(repairs))
+	if repairs > 0 {
+		r.events.Publish(ctx, events.TypeRepair, resource, "", map[string]uint64{"repairs": repairs})
+	}
+	if err != nil {
+		logging.Error(ctx, "error reconciling", "resource", resource, "err", err)
+	}
+
+	// Only changes are published, rather than every failing pass.
+	switch {
+	case err != nil && !r.failing[resource]:
+		r.events.Publish(ctx, events.TypeReconcileError, resource, "", map[string]string{"error": err.Error()})
+	case err == nil && r.failing[resource]:
+		r.events.Publish(ctx, events.TypeReconcileRecovered, resource, "", nil)
+	}
+	r.failing[resource] = err != nil
+}
+
+// States of a network's tunnel: connecting while the container runs but
+// the tunnel is not (yet) established, and down if the container cannot be
+// reached.
+const (
+	TunnelConnecting = "connecting"
+	TunnelUp         = "up"
+	TunnelDown       = "down"
+)
+
+// tunnelState is the state of a network's tunnel when last sampled.
+type tunnelState struct {
+	state string
+	rx    uint64
+}
+
+// monitorLoop periodically samples the state and counters of every tunnel
+// and the accounting counters of every client, until ctx is done.
+func (r *Reconciler) monitorLoop(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	ctx = logging.With(ctx, "loop", "monitor")
+	for {
+		r.sampleTunnels(ctx)
+		if err := r.sampleClients(ctx); err != nil {
+			logging.Error(ctx, "error sampling client counters", "err", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// TunnelState returns the state of a network's tunnel when last sampled,
+// or the empty string if it has not been sampled.
+func (r *Reconciler) TunnelState(networkID string) string {
+	r.tunnelsMu.Lock()
+	defer r.tunnelsMu.Unlock()
+	return r.tunnels[networkID].state
+}
+
+// sampleTunnels exports the state and counters of each network's tunnel,
+// and publishes the changes in its state. A tunnel which comes up again,
+// or whose counters restart, has reconnected. Pools are rebuilt whenever
+// a tunnel goes down or comes back up.
+func (r *Reconciler) sampleTunnels(ctx context.Context) {
+	containers := r.Networks.Containers()
+
+	metrics.NetworkBytes.Reset()
+	metrics.NetworkPackets.Reset()
+	// Only this loop changes the states, so reading them needs no lock.
+	rebalance := false
+	for id, prev := range r.tunnels {
+		if _, ok := containers[id]; !ok {
+			rebalance = rebalance || !tunnelHealthy(prev.state)
+			r.tunnelsMu.Lock()
+			delete(r.tunnels, id)
+			r.tunnelsMu.Unlock()
+			metrics.NetworkUp.DeleteLabelValues(id)
+			metrics.NetworkReconnects.DeleteLabelValues(id)
+		}
+	}
+
+	for id, ctr := range containers {
+		stats, err := ctr.TunnelStats(ctx)
+		if err != nil {
+			logging.Warn(ctx, "error reading tunnel statistics", "network", id, "err", err)
+		}
+
+		state := tunnelState{state: TunnelConnecting}
+		switch {
+		case err != nil:
+			state.state = TunnelDown
+		case stats != nil:
+			state.state = TunnelUp
+			state.rx = stats.Rx.Bytes
+		}
+		up := state.state == TunnelUp
+
+		reconnects := metrics.NetworkReconnects.WithLabelValues(id)
+		prev, ok := r.tunnels[id]
+		if ok && up && (prev.state != TunnelUp || state.rx < prev.rx) {
+			reconnects.Inc()
+		}
+		if tunnelHealthy(state.state) != tunnelHealthy(prev.state) {
+			rebalance = true
+		}
+		if ok && state.state != prev.state {
+			r.events.Publish(ctx, events.TypeNetworkState, "network", id, map[string]string{
+				"state":    state.state,
+				"previous": prev.state,
+			})
+		}
+		r.tunnelsMu.Lock()
+		r.tunnels[id] = state
+		r.tunnelsMu.Unlock()
+
+		if !up {
+			metrics.NetworkUp.WithLabelValues(id).Set(0)
+			continue
+		}
+		metrics.NetworkUp.WithLabelValues(id).Set(1)
+		metrics.NetworkBytes.Set(float64(stats.Rx.Bytes), id, "rx")
+		metrics.NetworkBytes.Set(float64(stats.Tx.Bytes), id, "tx")
+		metrics.NetworkPackets.Set(float64(stats.Rx.Packets), id, "rx")
+		metrics.NetworkPackets.Set(float64(stats.Tx.Packets), id, "tx")
+	}
+
+	if rebalance {
+		if err := r.Policies.rebuild(ctx); err != nil {
+			logging.Error(ctx, "error rebalancing pools", "err", err)
+		}
+	}
+}
+
+// sampleClients exports the traffic counted for each client and network,
+// and records the traffic counted since the last sample in the database.
+func (r *Reconciler) sampleClients(ctx context.Context) error {
+	now := time.Now()
+	deltas, totals, err := r.Accounting.Sample(ctx)
+	if err != nil {
+		return err
+	}
+
+	metrics.ClientBytes.Reset()
+	metrics.ClientPackets.Reset()
+	for usage, total := range totals {
+		metrics.ClientBytes.Set(float64(total.Bytes), usage.ClientID, usage.NetworkID, usage.Direction)
+		metrics.ClientPackets.Set(float64(total.Packets), usage.ClientID, usage.NetworkID, usage.Direction)
+	}
+
+	type key struct{ clientID, networkID string }
+	samples := make(map[key]*database.ClientUsage)
+	for usage, delta := range deltas {
+		if delta.Packets == 0 {
+			continue
+		}
+
+		k := key{usage.ClientID, usage.NetworkID}
+		sample, ok := samples[k]
+		if !ok {
+			sample = &database.ClientUsage{
+				ClientID:  usage.ClientID,
+				NetworkID: usage.NetworkID,
+			}
+			samples[k] = sample
+		}
+
+		switch usage.Direction {
+		case "rx":
+			sample.RxBytes += delta.Bytes
+			sample.RxPackets += delta.Packets
+		case "tx":
+			sample.TxBytes += delta.Bytes
+			sample.TxPackets += delta.Packets
+		}
+	}
+
+	usage := make([]*database.ClientUsage, 0, len(samples))
+	for _, sample := range samples {
+		usage = append(usage, sample)
+	}
+	if err := r.db.Usage.Add(ctx, now, usage); err != nil {
+		return err
+	}
+	return r.db.Usage.Prune(ctx, now)
+}
@@ -2,74 +2,473 @@ package reconciler
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sync"
 
 	"github.com/pricec/vpnmux/pkg/database"
+	"github.com/pricec/vpnmux/pkg/dns"
+	"github.com/pricec/vpnmux/pkg/logging"
 	"github.com/pricec/vpnmux/pkg/network"
 	"github.com/pricec/vpnmux/pkg/openvpn"
+	"golang.org/x/net/dns/dnsmessage"
 )
 
 type NetworkReconcilerOptions struct {
 	VPNImage        string
 	LocalSubnetCIDR string
+	// IPv6 subnet of the LAN; required for networks with IPv6.
+	LocalSubnet6CIDR string
+	// Prefix from which the IPv6 subnets of networks are allocated.
+	IPv6Prefix string
+	// Each network's fwmark is MarkBase plus its route table ID when the
+	// table is allocated.
+	MarkBase int
+	// Range from which the route tables of networks are allocated; 1 to
+	// 252 if zero.
+	RouteTableMin int
+	RouteTableMax int
+	// (optional) File in which the route tables of networks are named, in
+	// the format of /etc/iproute2/rt_tables.
+	RTTablesFile string
+	Forwarder    ForwarderOptions
 }
 
 type NetworkReconciler struct {
-	db   *database.Database
-	opts NetworkReconcilerOptions
+	db         *database.Database
+	opts       NetworkReconcilerOptions
+	forwarders *forwarderSet
+	// Held while a route table is allocated and stored.
+	allocMu sync.Mutex
+	// The route tables reserved for other uses than networks, e.g. DNS,
+	// by the name of their use.
+	reserved map[string]int
+
+	mu sync.Mutex
+	// The VPN container of each network, as of its last check.
+	containers map[string]*network.Container
+	observers  []func(context.Context) error
+}
+
+// Update changes a network's name and rate limits. Its config and IPv6
+// cannot be changed without recreating the network, and are ignored.
+func (r *NetworkReconciler) Update(ctx context.Context, n *database.Network) (*database.Network, error) {
+	if err := validateRateLimit(n.RateLimit); err != nil {
+		return nil, err
+	}
+
+	existing, err := r.db.Networks.Get(ctx, n.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	existing.Name = n.Name
+	existing.RateLimit = n.RateLimit
+	if err := r.db.Networks.Update(ctx, existing); err != nil {
+		return nil, err
+	}
+
+	if err := r.notify(ctx); err != nil {
+		return nil, err
+	}
+	return existing, nil
+}
+
+// OnChange registers fn to be called after a network is created, updated
+// or deleted.
+func (r *NetworkReconciler) OnChange(fn func(context.Context) error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.observers = append(r.observers, fn)
+}
+
+func (r *NetworkReconciler) notify(ctx context.Context) error {
+	r.mu.Lock()
+	observers := r.observers
+	r.mu.Unlock()
+	return notify(ctx, observers)
+}
+
+// routeTables returns the range of the route tables of networks.
+func (o NetworkReconcilerOptions) routeTables() (int, int) {
+	min, max := o.RouteTableMin, o.RouteTableMax
+	if min == 0 {
+		min = 1
+	}
+	if max == 0 {
+		max = 252
+	}
+	return min, max
 }
 
-func (r *NetworkReconciler) Update(ctx context.Context, cfg *database.Network) (*database.Network, error) {
-	return nil, fmt.Errorf("TODO: implement network update reconciler")
+// validateMarks checks that the fwmarks of networks, MarkBase plus each
+// table of the range, neither include the other marks nor use the bit
+// marking forwarded connections.
+func validateMarks(opts NetworkReconcilerOptions, forwarding ForwardingOptions) error {
+	min, max := opts.routeTables()
+	low, high := opts.MarkBase+min, opts.MarkBase+max
+	if opts.MarkBase < 0 || high >= network.ForwardedConnmark {
+		return fmt.Errorf("fwmarks of networks 0x%x-0x%x must be below 0x%x", low, high, network.ForwardedConnmark)
+	}
+
+	for _, m := range []struct{ name, value string }{
+		{"DNS mark", forwarding.DNSMark},
+		{"WAN mark", forwarding.WANMark},
+	} {
+		if m.value == "" {
+			continue
+		}
+		mark, err := network.ParseMark(m.value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", m.name, err)
+		}
+		if mark >= low && mark <= high {
+			return fmt.Errorf("%s 0x%x overlaps the fwmarks of networks 0x%x-0x%x", m.name, mark, low, high)
+		}
+	}
+	return nil
 }
 
 func NewNetworkReconciler(ctx context.Context, db *database.Database, opts NetworkReconcilerOptions) (*NetworkReconciler, error) {
+	opts.RouteTableMin, opts.RouteTableMax = opts.routeTables()
+	if opts.RouteTableMin < 1 || opts.RouteTableMax < opts.RouteTableMin {
+		return nil, fmt.Errorf("invalid route table range %d-%d", opts.RouteTableMin, opts.RouteTableMax)
+	}
+
 	nets, err := db.Networks.List(ctx)
 	if err != nil {
 		return nil, err
 	}
 
 	r := &NetworkReconciler{
-		db:   db,
-		opts: opts,
+		db:         db,
+		opts:       opts,
+		forwarders: newForwarderSet(opts.Forwarder),
+		reserved:   make(map[string]int),
+		containers: make(map[string]*network.Container),
 	}
 	for _, net := range nets {
-		if _, _, err := r.check(ctx, net.ID); err != nil {
+		if _, _, err := r.repair(ctx, net.ID); err != nil {
 			return nil, err
 		}
 	}
+	r.nameRouteTables(ctx)
 	return r, nil
 }
 
+// check ensures that a network's routing is installed, failing if its
+// container is missing.
 func (r *NetworkReconciler) check(ctx context.Context, id string) (*database.Network, *network.Network, error) {
+	return r.ensure(ctx, id, false)
+}
+
+// repair is like check, but rebuilds the network's container if it is
+// missing or uses another route table than the network's. Only
+// reconciliation repairs networks, lest e.g. deleting a network first
+// rebuild its container.
+func (r *NetworkReconciler) repair(ctx context.Context, id string) (*database.Network, *network.Network, error) {
+	return r.ensure(ctx, id, true)
+}
+
+func (r *NetworkReconciler) ensure(ctx context.Context, id string, rebuild bool) (*database.Network, *network.Network, error) {
 	net, err := r.db.Networks.Get(ctx, id)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	dockerNet, err := network.NewFromID(net.ID)
-	if err != nil {
+	dockerNet, err := network.NewFromID(ctx, net.ID)
+	switch {
+	case rebuild && errors.Is(err, network.ErrNoContainer):
+		logging.Warn(ctx, "rebuilding missing container", "network", net.ID)
+		if dockerNet, err = r.rebuild(ctx, net); err != nil {
+			return nil, nil, err
+		}
+	case err != nil:
+		return nil, nil, err
+	case net.RouteTableID == 0:
+		// The network was created before route tables were stored, so
+		// its table is only known to its container.
+		table := dockerNet.Container.RouteTableID
+		if err := r.db.Networks.SetRouting(ctx, net.ID, table, r.opts.MarkBase+table); err != nil {
+			return nil, nil, err
+		}
+		net.RouteTableID, net.Mark = table, r.opts.MarkBase+table
+	case rebuild && dockerNet.Container.RouteTableID != net.RouteTableID:
+		logging.Warn(ctx, "rebuilding container using another route table", "network", net.ID, "table", dockerNet.Container.RouteTableID, "expected", net.RouteTableID)
+		if dockerNet, err = r.rebuild(ctx, net); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := dockerNet.Container.RouteMark(ctx, net.Mark); err != nil {
 		return nil, nil, err
 	}
 
+	if r.opts.Forwarder.Enabled {
+		if err := r.forwarders.ensure(net.ID, dockerNet, net.Mark); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	r.mu.Lock()
+	r.containers[net.ID] = dockerNet.Container
+	r.mu.Unlock()
+
 	// TODO: check if settings are equal?
 	return net, dockerNet, nil
 }
 
+// Mark returns the fwmark which routes packets via the given network.
+func (r *NetworkReconciler) Mark(ctx context.Context, id string) (int, error) {
+	mark, _, err := r.Route(ctx, id)
+	return mark, err
+}
+
+// Route returns the fwmark which routes packets via the given network, and
+// whether the network carries IPv6.
+func (r *NetworkReconciler) Route(ctx context.Context, id string) (int, bool, error) {
+	net, dockerNet, err := r.check(ctx, id)
+	if err != nil {
+		return 0, false, err
+	}
+	return net.Mark, dockerNet.Container.IPAddress6 != "", nil
+}
+
+// rebuild replaces the VPN container of a network, reusing the network's
+// route table, or allocating one if it has none.
+func (r *NetworkReconciler) rebuild(ctx context.Context, net *database.Network) (*network.Network, error) {
+	if net.RouteTableID == 0 {
+		r.allocMu.Lock()
+		table, err := r.allocateRouteTable(ctx)
+		if err == nil {
+			err = r.db.Networks.SetRouting(ctx, net.ID, table, r.opts.MarkBase+table)
+		}
+		r.allocMu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		net.RouteTableID, net.Mark = table, r.opts.MarkBase+table
+		r.nameRouteTables(ctx)
+	}
+
+	cfg, err := openvpn.NewConfigFromID(net.ConfigID)
+	if err != nil {
+		return nil, err
+	}
+	v6, err := r.ipv6(ctx, net)
+	if err != nil {
+		return nil, err
+	}
+	return network.Rebuild(ctx, net.ID, r.opts.VPNImage, r.opts.LocalSubnetCIDR, net.RouteTableID, v6, cfg)
+}
+
+// reserveRouteTable reserves a route table of the configured range for
+// another use than a network, e.g. routing DNS queries, named name. The
+// table currently used, if any, is kept if it is in the range and not
+// allocated to anything else. The table stays reserved until released.
+func (r *NetworkReconciler) reserveRouteTable(ctx context.Context, name string, current int) (int, error) {
+	r.allocMu.Lock()
+	if id, ok := r.reserved[name]; ok {
+		r.allocMu.Unlock()
+		return id, nil
+	}
+
+	allocated, err := r.allocatedRouteTables(ctx)
+	id := current
+	if err == nil && (id < r.opts.RouteTableMin || id > r.opts.RouteTableMax || allocated[id] || network.ReservedRouteTable(id)) {
+		id, err = r.allocateRouteTable(ctx)
+	}
+	if err == nil {
+		r.reserved[name] = id
+	}
+	r.allocMu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	r.nameRouteTables(ctx)
+	return id, nil
+}
+
+// releaseRouteTable releases the route table reserved for name, if any.
+func (r *NetworkReconciler) releaseRouteTable(ctx context.Context, name string) {
+	r.allocMu.Lock()
+	_, ok := r.reserved[name]
+	delete(r.reserved, name)
+	r.allocMu.Unlock()
+
+	if ok {
+		r.nameRouteTables(ctx)
+	}
+}
+
+// allocatedRouteTables returns the route tables allocated to networks or
+// reserved for other uses. The caller holds allocMu.
+func (r *NetworkReconciler) allocatedRouteTables(ctx context.Context) (map[int]bool, error) {
+	nets, err := r.db.Networks.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	allocated := make(map[int]bool, len(nets)+len(r.reserved))
+	for _, net := range nets {
+		allocated[net.RouteTableID] = true
+	}
+	for _, id := range r.reserved {
+		allocated[id] = true
+	}
+	return allocated, nil
+}
+
+// allocateRouteTable returns the first route table of the configured range
+// which is not allocated to a network or reserved, named by another tool or
+// in use on the host. The caller holds allocMu until the table is stored.
+func (r *NetworkReconciler) allocateRouteTable(ctx context.Context) (int, error) {
+	allocated, err := r.allocatedRouteTables(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	named, err := network.NamedRouteTables(r.opts.RTTablesFile)
+	if err != nil {
+		return 0, err
+	}
+
+	for id := r.opts.RouteTableMin; id <= r.opts.RouteTableMax; id++ {
+		if _, ok := named[id]; ok || allocated[id] || network.ReservedRouteTable(id) {
+			continue
+		}
+		empty, err := network.RouteTableEmpty(ctx, id)
+		if err != nil {
+			return 0, err
+		} else if empty {
+			return id, nil
+		}
+	}
+	return 0, fmt.Errorf("no free route table between %d and %d", r.opts.RouteTableMin, r.opts.RouteTableMax)
+}
+
+// nameRouteTables names the route table of each network, and those
+// reserved for other uses, in RTTablesFile. Failures are only logged, since
+// the names are informational.
+func (r *NetworkReconciler) nameRouteTables(ctx context.Context) {
+	if r.opts.RTTablesFile == "" {
+		return
+	}
+
+	nets, err := r.db.Networks.List(ctx)
+	if err != nil {
+		logging.Warn(ctx, "error naming route tables", "err", err)
+		return
+	}
+	names := make(map[int]string, len(nets)+len(r.reserved))
+	for _, net := range nets {
+		if net.RouteTableID != 0 {
+			names[net.RouteTableID] = "vpnmux-" + net.ID
+		}
+	}
+	r.allocMu.Lock()
+	for name, id := range r.reserved {
+		names[id] = "vpnmux-" + name
+	}
+	r.allocMu.Unlock()
+	if err := network.WriteRTTables(r.opts.RTTablesFile, names); err != nil {
+		logging.Warn(ctx, "error naming route tables", "file", r.opts.RTTablesFile, "err", err)
+	}
+}
+
+// ipv6 returns the IPv6 settings of a network, or nil if it has none. Its
+// subnet is derived from its ID, avoiding those of the other networks.
+func (r *NetworkReconciler) ipv6(ctx context.Context, net *database.Network) (*network.IPv6, error) {
+	if !net.IPv6 {
+		return nil, nil
+	}
+	used, err := network.Subnets6(ctx, net.ID)
+	if err != nil {
+		return nil, err
+	}
+	subnet, err := network.Subnet6(r.opts.IPv6Prefix, net.ID, used)
+	if err != nil {
+		return nil, err
+	}
+	return &network.IPv6{
+		Subnet:      subnet,
+		LocalSubnet: r.opts.LocalSubnet6CIDR,
+	}, nil
+}
+
+// Containers returns the VPN container of each network, keyed by network
+// ID, without checking the networks.
+func (r *NetworkReconciler) Containers() map[string]*network.Container {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	result := make(map[string]*network.Container, len(r.containers))
+	for id, ctr := range r.containers {
+		result[id] = ctr
+	}
+	return result
+}
+
+// ObserveDNS registers fn to be called with every response returned by
+// any of the networks' DNS forwarders.
+func (r *NetworkReconciler) ObserveDNS(fn func(*dnsmessage.Message)) {
+	r.forwarders.observe(fn)
+}
+
+// Forwarder returns the status of the DNS forwarder for the given network.
+func (r *NetworkReconciler) Forwarder(ctx context.Context, id string) (*dns.ForwarderStatus, error) {
+	if _, _, err := r.check(ctx, id); err != nil {
+		return nil, err
+	}
+
+	f, ok := r.forwarders.get(id)
+	if !ok {
+		return nil, database.ErrNotFound
+	}
+
+	status := f.Status()
+	return &status, nil
+}
+
 func (r *NetworkReconciler) Get(ctx context.Context, id string) (*database.Network, *network.Network, error) {
 	return r.check(ctx, id)
 }
 
-func (r *NetworkReconciler) create(ctx context.Context, name string, cfg *openvpn.Config) (*database.Network, error) {
+func (r *NetworkReconciler) create(ctx context.Context, n *database.Network, cfg *openvpn.Config) (*database.Network, error) {
+	if n.IPv6 && r.opts.LocalSubnet6CIDR == "" {
+		return nil, fmt.Errorf("%w: IPv6 networks require VPNMUX_SUBNET6_CIDR", ErrInvalid)
+	}
+	if err := validateRateLimit(n.RateLimit); err != nil {
+		return nil, err
+	}
+
+	r.allocMu.Lock()
+	table, err := r.allocateRouteTable(ctx)
+	if err != nil {
+		r.allocMu.Unlock()
+		return nil, err
+	}
 	net, err := r.db.Networks.Put(ctx, &database.Network{
-		Name:     name,
-		ConfigID: cfg.ID,
+		Name:         n.Name,
+		ConfigID:     cfg.ID,
+		IPv6:         n.IPv6,
+		RateLimit:    n.RateLimit,
+		RouteTableID: table,
+		Mark:         r.opts.MarkBase + table,
 	})
+	r.allocMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	r.nameRouteTables(ctx)
+
+	v6, err := r.ipv6(ctx, net)
 	if err != nil {
+		// TODO: clean up database
 		return nil, err
 	}
 
-	_, err = network.New(net.ID, r.opts.VPNImage, r.opts.LocalSubnetCIDR, cfg)
+	_, err = network.New(ctx, net.ID, r.opts.VPNImage, r.opts.LocalSubnetCIDR, net.RouteTableID, v6, cfg)
 	if err != nil {
 		// TODO: clean up database
 		return nil, err
@@ -81,21 +480,47 @@ func (r *NetworkReconciler) create(ctx context.Context, name string, cfg *openvp
 
 	}
 
+	if err := r.notify(ctx); err != nil {
+		return nil, err
+	}
 	return net, nil
 }
 
+// Delete deletes a network, whether or not its container is running.
 func (r *NetworkReconciler) Delete(ctx context.Context, id string) error {
-	net, dockerNet, err := r.check(ctx, id)
+	net, err := r.db.Networks.Get(ctx, id)
 	if err != nil {
 		return err
 	}
+	dockerNet, err := network.NewFromID(ctx, net.ID)
+	if err != nil && !errors.Is(err, network.ErrNoContainer) && !errors.Is(err, network.ErrContainerStopped) && !errors.Is(err, network.ErrNoNetwork) {
+		return err
+	}
 
 	if err := r.db.Networks.Delete(ctx, net.ID); err != nil {
 		return err
 	}
 
-	if err := dockerNet.Close(); err != nil {
+	r.mu.Lock()
+	delete(r.containers, net.ID)
+	r.mu.Unlock()
+
+	if err := r.forwarders.remove(net.ID); err != nil {
 		return err
 	}
-	return nil
+
+	if err := network.ClearMark(ctx, net.Mark); err != nil {
+		return err
+	}
+
+	if dockerNet == nil {
+		err = network.Remove(ctx, net.ID, net.RouteTableID)
+	} else {
+		err = dockerNet.Close(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	r.nameRouteTables(ctx)
+	return r.notify(ctx)
 }
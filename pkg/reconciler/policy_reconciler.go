@@ -0,0 +1,282 @@
+package reconciler
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/pricec/vpnmux/pkg/database"
+	"github.com/pricec/vpnmux/pkg/logging"
+	"github.com/pricec/vpnmux/pkg/network"
+)
+
+const policyChain = "VPNMUX-POLICY"
+
+type PolicyReconciler struct {
+	db          *database.Database
+	networks    *NetworkReconciler
+	localSubnet string
+	wanMark     string
+	chain       *network.Chain
+	chain6      *network.Chain
+	wan         *network.WANRoute
+	pools       *PoolReconciler
+	mu          sync.Mutex
+}
+
+func NewPolicyReconciler(ctx context.Context, db *database.Database, networks *NetworkReconciler, localSubnet string, forwarding ForwardingOptions) (*PolicyReconciler, error) {
+	chain, err := network.NewChain(ctx, "mangle", policyChain, "PREROUTING", "-i", forwarding.LANInterface)
+	if err != nil {
+		return nil, err
+	}
+	chain6, err := network.NewChain6(ctx, "mangle", policyChain, "PREROUTING", "-i", forwarding.LANInterface)
+	if err != nil {
+		return nil, err
+	}
+
+	wan, err := network.NewWANRoute(ctx, forwarding.WANMark, forwarding.LANInterface, forwarding.WANInterface)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &PolicyReconciler{
+		db:          db,
+		networks:    networks,
+		localSubnet: localSubnet,
+		wanMark:     forwarding.WANMark,
+		chain:       chain,
+		chain6:      chain6,
+		wan:         wan,
+	}
+	if err := r.rebuild(ctx); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func validatePolicy(p *database.Policy) error {
+	switch p.Action {
+	case database.PolicyActionNetwork:
+		if p.NetworkID == "" {
+			return fmt.Errorf("%w: action %q requires network_id", ErrInvalid, p.Action)
+		}
+	case database.PolicyActionWAN, database.PolicyActionDrop:
+		if p.NetworkID != "" {
+			return fmt.Errorf("%w: action %q does not accept network_id", ErrInvalid, p.Action)
+		}
+	default:
+		return fmt.Errorf("%w: unknown action %q", ErrInvalid, p.Action)
+	}
+
+	if p.ClientID != "" && p.GroupID != "" {
+		return fmt.Errorf("%w: only one of client_id or group_id may be given", ErrInvalid)
+	}
+
+	match := network.Match{
+		Destination: p.Destination,
+		Protocol:    p.Protocol,
+		Ports:       p.Ports,
+	}
+	if _, err := match.Args(); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	return nil
+}
+
+// rules renders a policy as iptables rules for the policy chain, or if v6
+// as ip6tables rules. Only policies without a destination apply to IPv6,
+// and only those which drop packets or route them via a network carrying
+// IPv6, since the WAN route is IPv4 only.
+func (r *PolicyReconciler) rules(ctx context.Context, p *database.Policy, v6 bool) ([][]string, error) {
+	if v6 && (p.Destination != "" || p.Action == database.PolicyActionWAN) {
+		return nil, nil
+	}
+
+	var mark string
+	switch p.Action {
+	case database.PolicyActionWAN:
+		mark = r.wanMark
+	case database.PolicyActionNetwork:
+		id, ipv6, err := r.networks.Route(ctx, p.NetworkID)
+		if err != nil {
+			return nil, err
+		}
+		if v6 && !ipv6 {
+			return nil, nil
+		}
+		mark = fmt.Sprintf("0x%x", id)
+	}
+
+	sources, err := sourceMatches(ctx, r.db, p.ClientID, p.GroupID, v6)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules [][]string
+	for _, m := range sources {
+		m.Destination = p.Destination
+		m.Protocol = p.Protocol
+		m.Ports = p.Ports
+
+		args := m.Args
+		if v6 {
+			args = m.Args6
+		}
+		match, err := args()
+		if err != nil {
+			return nil, err
+		}
+		if p.Destination == "" && !v6 {
+			// Never reroute traffic between local hosts.
+			match = append(match, "!", "-d", r.localSubnet)
+		}
+
+		if p.Action == database.PolicyActionDrop {
+			rules = append(rules, append(match, "-j", "DROP"))
+			continue
+		}
+		rules = append(rules,
+			append(append([]string{}, match...), "-j", "MARK", "--set-mark", mark),
+			append(append([]string{}, match...), "-j", "RETURN"),
+		)
+	}
+	return rules, nil
+}
+
+// allowRules renders the allow-lists of clients whose kill switch mode is
+// allowlist, routing packets to the listed destinations via the WAN.
+func (r *PolicyReconciler) allowRules(ctx context.Context) ([][]string, error) {
+	clients, err := r.db.Clients.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules [][]string
+	for _, c := range clients {
+		if c.KillSwitch != database.KillSwitchAllowList || (c.Address == "" && c.MAC == "") {
+			// Allow-lists only apply to IPv4.
+			continue
+		}
+
+		var cr [][]string
+		for _, a := range c.WANAllow {
+			source := clientMatch(c)
+			source.Destination = a.Destination
+			source.Protocol = a.Protocol
+			source.Ports = a.Ports
+
+			match, err := source.Args()
+			if err != nil {
+				logging.Warn(ctx, "skipping allow-list of client", "client", c.ID, "err", err)
+				cr = nil
+				break
+			}
+			cr = append(cr,
+				append(append([]string{}, match...), "-j", "MARK", "--set-mark", r.wanMark),
+				append(append([]string{}, match...), "-j", "RETURN"),
+			)
+		}
+		rules = append(rules, cr...)
+	}
+	return rules, nil
+}
+
+// render renders every policy, in order of priority, followed by the
+// clients' allow-lists and every pool as rules for the policy chain, and
+// every policy as rules for the IPv6 policy chain. A policy which cannot be
+// rendered, e.g. because its network is down, is skipped.
+func (r *PolicyReconciler) render(ctx context.Context) ([][]string, [][]string, error) {
+	policies, err := r.db.Policies.List(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var rules, rules6 [][]string
+	for _, p := range policies {
+		pr, err := r.rules(ctx, p, false)
+		if err != nil {
+			logging.Warn(ctx, "skipping policy", "policy", p.ID, "err", err)
+			continue
+		}
+		pr6, err := r.rules(ctx, p, true)
+		if err != nil {
+			logging.Warn(ctx, "skipping policy", "policy", p.ID, "err", err)
+			continue
+		}
+		rules = append(rules, pr...)
+		rules6 = append(rules6, pr6...)
+	}
+
+	allow, err := r.allowRules(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	rules = append(rules, allow...)
+
+	if r.pools != nil {
+		pr, err := r.pools.rules(ctx, r.localSubnet)
+		if err != nil {
+			return nil, nil, err
+		}
+		rules = append(rules, pr...)
+	}
+	return rules, rules6, nil
+}
+
+// rebuild replaces the rules in the policy chains with those rendered.
+func (r *PolicyReconciler) rebuild(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rules, rules6, err := r.render(ctx)
+	if err != nil {
+		return err
+	}
+	if err := r.chain6.Replace(ctx, rules6); err != nil {
+		return err
+	}
+	return r.chain.Replace(ctx, rules)
+}
+
+func (r *PolicyReconciler) Get(ctx context.Context, id string) (*database.Policy, error) {
+	return r.db.Policies.Get(ctx, id)
+}
+
+func (r *PolicyReconciler) Create(ctx context.Context, p *database.Policy) (*database.Policy, error) {
+	if err := validatePolicy(p); err != nil {
+		return nil, err
+	}
+
+	policy, err := r.db.Policies.Put(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.rebuild(ctx); err != nil {
+		// TODO: clean up database
+		return nil, err
+	}
+	return policy, nil
+}
+
+func (r *PolicyReconciler) Update(ctx context.Context, p *database.Policy) (*database.Policy, error) {
+	if err := validatePolicy(p); err != nil {
+		return nil, err
+	}
+
+	if err := r.db.Policies.Update(ctx, p); err != nil {
+		return nil, err
+	}
+
+	if err := r.rebuild(ctx); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (r *PolicyReconciler) Delete(ctx context.Context, id string) error {
+	if err := r.db.Policies.Delete(ctx, id); err != nil {
+		return err
+	}
+	return r.rebuild(ctx)
+}
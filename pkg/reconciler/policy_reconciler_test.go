@@ -0,0 +1,55 @@
+package reconciler_test
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/pricec/vpnmux/pkg/database"
+	"github.com/pricec/vpnmux/pkg/reconciler"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenderPoliciesSkipsBroken(t *testing.T) {
+	ctx := context.Background()
+
+	f, err := os.CreateTemp("", "")
+	require.Nil(t, err)
+	f.Close()
+	defer os.Remove(f.Name())
+
+	db, err := database.New(ctx, f.Name())
+	require.Nil(t, err)
+
+	// Neither a policy nor an allow-list stored with an invalid destination
+	// prevents the others from being rendered.
+	_, err = db.Policies.Put(ctx, &database.Policy{Priority: 1, Destination: "not-an-address", Action: database.PolicyActionDrop})
+	require.Nil(t, err)
+	_, err = db.Policies.Put(ctx, &database.Policy{Priority: 2, Destination: "10.0.0.0/8", Action: database.PolicyActionDrop})
+	require.Nil(t, err)
+	_, err = db.Policies.Put(ctx, &database.Policy{Priority: 3, Action: database.PolicyActionDrop})
+	require.Nil(t, err)
+
+	_, err = db.Clients.Put(ctx, &database.Client{
+		Address:    "192.168.0.10",
+		KillSwitch: database.KillSwitchAllowList,
+		WANAllow:   []database.WANAllow{{Destination: "not-an-address"}},
+	})
+	require.Nil(t, err)
+	_, err = db.Clients.Put(ctx, &database.Client{
+		Address:    "192.168.0.11",
+		KillSwitch: database.KillSwitchAllowList,
+		WANAllow:   []database.WANAllow{{Destination: "1.1.1.1"}},
+	})
+	require.Nil(t, err)
+
+	rules, rules6, err := reconciler.RenderPolicies(ctx, db, "192.168.0.0/24", "0x2")
+	require.Nil(t, err)
+	require.Equal(t, [][]string{
+		{"-d", "10.0.0.0/8", "-j", "DROP"},
+		{"!", "-d", "192.168.0.0/24", "-j", "DROP"},
+		{"-s", "192.168.0.11", "-d", "1.1.1.1", "-j", "MARK", "--set-mark", "0x2"},
+		{"-s", "192.168.0.11", "-d", "1.1.1.1", "-j", "RETURN"},
+	}, rules)
+	require.Equal(t, [][]string{{"-j", "DROP"}}, rules6)
+}
@@ -0,0 +1,259 @@
+package reconciler
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/pricec/vpnmux/pkg/database"
+	"github.com/pricec/vpnmux/pkg/logging"
+	"github.com/pricec/vpnmux/pkg/network"
+)
+
+// PoolReconciler spreads the connections of the clients and groups of each
+// pool across the pool's networks whose tunnels are up. The pools are
+// rendered at the end of the policy chain, so that policies take
+// precedence over them, and like policies only route IPv4.
+type PoolReconciler struct {
+	db       *database.Database
+	networks *NetworkReconciler
+	policies *PolicyReconciler
+	// Returns the state of a network's tunnel, or the empty string if it
+	// is not known; set once the monitor which samples them exists.
+	tunnelState func(string) string
+	mu          sync.Mutex
+	observers   []func(context.Context) error
+}
+
+// PoolMemberState is the state of a network of a pool.
+type PoolMemberState struct {
+	NetworkID string `json:"network_id"`
+	Weight    int    `json:"weight"`
+	// The state of the network's tunnel, if known.
+	Tunnel  string `json:"tunnel,omitempty"`
+	Healthy bool   `json:"healthy"`
+	// The fraction of the pool's new connections the network receives.
+	Share float64 `json:"share"`
+}
+
+// maxPoolWeight is the largest weight of a network of a pool.
+const maxPoolWeight = 1000
+
+func NewPoolReconciler(ctx context.Context, db *database.Database, networks *NetworkReconciler, policies *PolicyReconciler) (*PoolReconciler, error) {
+	r := &PoolReconciler{
+		db:       db,
+		networks: networks,
+		policies: policies,
+	}
+	policies.pools = r
+	if err := policies.rebuild(ctx); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// validatePool checks a pool, giving networks without a weight a weight of 1.
+func validatePool(p *database.NetworkPool) error {
+	if len(p.Networks) == 0 {
+		return fmt.Errorf("%w: a pool needs at least one network", ErrInvalid)
+	}
+
+	seen := make(map[string]bool)
+	for i, m := range p.Networks {
+		if seen[m.NetworkID] {
+			return fmt.Errorf("%w: network %q is in the pool more than once", ErrInvalid, m.NetworkID)
+		}
+		seen[m.NetworkID] = true
+
+		switch {
+		case m.Weight == 0:
+			p.Networks[i].Weight = 1
+		case m.Weight < 0 || m.Weight > maxPoolWeight:
+			return fmt.Errorf("%w: weight of network %q must be between 1 and %d", ErrInvalid, m.NetworkID, maxPoolWeight)
+		}
+	}
+	return nil
+}
+
+// healthy returns true iff new connections may be routed via a network:
+// its tunnel is up, or its state is not known yet.
+func (r *PoolReconciler) healthy(networkID string) bool {
+	if r.tunnelState == nil {
+		return true
+	}
+	return tunnelHealthy(r.tunnelState(networkID))
+}
+
+func tunnelHealthy(state string) bool {
+	return state == "" || state == TunnelUp
+}
+
+// rules renders every pool as rules for the policy chain, excluding
+// packets to the local subnet. A pool which cannot be rendered, e.g.
+// because a member was deleted, is skipped.
+func (r *PoolReconciler) rules(ctx context.Context, localSubnet string) ([][]string, error) {
+	pools, err := r.db.Pools.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules [][]string
+	for _, p := range pools {
+		pr, err := r.poolRules(ctx, p, localSubnet)
+		if err != nil {
+			logging.Warn(ctx, "skipping pool", "pool", p.ID, "err", err)
+			continue
+		}
+		rules = append(rules, pr...)
+	}
+	return rules, nil
+}
+
+// poolRules renders a pool as rules for the policy chain, excluding
+// packets to the local subnet.
+func (r *PoolReconciler) poolRules(ctx context.Context, p *database.NetworkPool, localSubnet string) ([][]string, error) {
+	var routes []network.PoolRoute
+	for _, m := range p.Networks {
+		if !r.healthy(m.NetworkID) {
+			continue
+		}
+		mark, err := r.networks.Mark(ctx, m.NetworkID)
+		if err != nil {
+			logging.Warn(ctx, "leaving network out of pool", "pool", p.ID, "network", m.NetworkID, "err", err)
+			continue
+		}
+		routes = append(routes, network.PoolRoute{Mark: fmt.Sprintf("0x%x", mark), Weight: m.Weight})
+	}
+	if len(routes) == 0 {
+		return nil, nil
+	}
+
+	var sources []network.Match
+	for _, id := range p.Clients {
+		matches, err := sourceMatches(ctx, r.db, id, "", false)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, matches...)
+	}
+	for _, id := range p.Groups {
+		matches, err := sourceMatches(ctx, r.db, "", id, false)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, matches...)
+	}
+
+	var rules [][]string
+	for _, m := range sources {
+		match, err := m.Args()
+		if err != nil {
+			return nil, err
+		}
+		// Never reroute traffic between local hosts.
+		match = append(match, "!", "-d", localSubnet)
+		rules = append(rules, network.PoolRules(match, routes)...)
+	}
+	return rules, nil
+}
+
+func (r *PoolReconciler) Get(ctx context.Context, id string) (*database.NetworkPool, error) {
+	return r.db.Pools.Get(ctx, id)
+}
+
+// State returns the state of each network of a pool.
+func (r *PoolReconciler) State(ctx context.Context, id string) ([]PoolMemberState, error) {
+	p, err := r.db.Pools.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	total := 0
+	states := make([]PoolMemberState, 0, len(p.Networks))
+	for _, m := range p.Networks {
+		state := PoolMemberState{
+			NetworkID: m.NetworkID,
+			Weight:    m.Weight,
+			Healthy:   r.healthy(m.NetworkID),
+		}
+		if r.tunnelState != nil {
+			state.Tunnel = r.tunnelState(m.NetworkID)
+		}
+		if state.Healthy {
+			total += m.Weight
+		}
+		states = append(states, state)
+	}
+	for i := range states {
+		if states[i].Healthy {
+			states[i].Share = float64(states[i].Weight) / float64(total)
+		}
+	}
+	return states, nil
+}
+
+func (r *PoolReconciler) Create(ctx context.Context, p *database.NetworkPool) (*database.NetworkPool, error) {
+	if err := validatePool(p); err != nil {
+		return nil, err
+	}
+
+	pool, err := r.db.Pools.Put(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.policies.rebuild(ctx); err != nil {
+		// TODO: clean up database
+		return nil, err
+	}
+
+	if err := r.notify(ctx); err != nil {
+		return nil, err
+	}
+	return pool, nil
+}
+
+func (r *PoolReconciler) Update(ctx context.Context, p *database.NetworkPool) (*database.NetworkPool, error) {
+	if err := validatePool(p); err != nil {
+		return nil, err
+	}
+
+	if err := r.db.Pools.Update(ctx, p); err != nil {
+		return nil, err
+	}
+
+	if err := r.policies.rebuild(ctx); err != nil {
+		return nil, err
+	}
+
+	if err := r.notify(ctx); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (r *PoolReconciler) Delete(ctx context.Context, id string) error {
+	if err := r.db.Pools.Delete(ctx, id); err != nil {
+		return err
+	}
+
+	if err := r.policies.rebuild(ctx); err != nil {
+		return err
+	}
+	return r.notify(ctx)
+}
+
+// OnChange registers fn to be called after a pool is created, updated or
+// deleted.
+func (r *PoolReconciler) OnChange(fn func(context.Context) error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.observers = append(r.observers, fn)
+}
+
+func (r *PoolReconciler) notify(ctx context.Context) error {
+	r.mu.Lock()
+	observers := r.observers
+	r.mu.Unlock()
+	return notify(ctx, observers)
+}
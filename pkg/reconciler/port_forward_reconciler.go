@@ -0,0 +1,222 @@
+package reconciler
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/pricec/vpnmux/pkg/database"
+	"github.com/pricec/vpnmux/pkg/logging"
+	"github.com/pricec/vpnmux/pkg/network"
+)
+
+const portForwardChain = "VPNMUX-PF"
+
+// PortForwardReconciler forwards connections arriving through a network's
+// tunnel to a client. Within the network's container, the external port is
+// translated to the client's address and internal port; on the host, the
+// connections are accepted onto the LAN and marked, so that the client's
+// replies are routed back through the same network whatever the client's
+// own route. Only IPv4 is forwarded, to clients with a known address.
+// Networks whose container cannot be checked are skipped, keeping their
+// rules out of the host's chains until they recover.
+type PortForwardReconciler struct {
+	db           *database.Database
+	networks     *NetworkReconciler
+	lanInterface string
+	mangle       *network.Chain
+	filter       *network.Chain
+	// The chains within each network's container, keyed by container.
+	dnat map[string]*network.Chain
+	mu   sync.Mutex
+}
+
+func NewPortForwardReconciler(ctx context.Context, db *database.Database, networks *NetworkReconciler, forwarding ForwardingOptions) (*PortForwardReconciler, error) {
+	mangle, err := network.NewChain(ctx, "mangle", portForwardChain, "PREROUTING")
+	if err != nil {
+		return nil, err
+	}
+
+	filter, err := network.NewChain(ctx, "filter", portForwardChain, "FORWARD", "-o", forwarding.LANInterface)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &PortForwardReconciler{
+		db:           db,
+		networks:     networks,
+		lanInterface: forwarding.LANInterface,
+		mangle:       mangle,
+		filter:       filter,
+		dnat:         make(map[string]*network.Chain),
+	}
+	if err := r.rebuild(ctx); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *PortForwardReconciler) validate(ctx context.Context, f *database.PortForward) error {
+	switch f.Protocol {
+	case "tcp", "udp":
+	default:
+		return fmt.Errorf("%w: protocol must be tcp or udp", ErrInvalid)
+	}
+
+	for _, port := range []int{f.ExternalPort, f.InternalPort} {
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("%w: port %d out of range", ErrInvalid, port)
+		}
+	}
+
+	if _, err := r.db.Networks.Get(ctx, f.NetworkID); err != nil {
+		return fmt.Errorf("%w: network %q: %v", ErrInvalid, f.NetworkID, err)
+	}
+	if _, err := r.db.Clients.Get(ctx, f.ClientID); err != nil {
+		return fmt.Errorf("%w: client %q: %v", ErrInvalid, f.ClientID, err)
+	}
+
+	forwards, err := r.db.PortForwards.List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, other := range forwards {
+		if other.ID != f.ID && other.NetworkID == f.NetworkID && other.Protocol == f.Protocol && other.ExternalPort == f.ExternalPort {
+			return fmt.Errorf("%w: %s port %d of network %s is already forwarded", database.ErrConflict, f.Protocol, f.ExternalPort, f.NetworkID)
+		}
+	}
+	return nil
+}
+
+// rebuild replaces the forwarding rules in every network's container and
+// on the host with those rendered from every port forward.
+func (r *PortForwardReconciler) rebuild(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	forwards, err := r.db.PortForwards.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	clients, err := r.db.Clients.List(ctx)
+	if err != nil {
+		return err
+	}
+	addresses := make(map[string]string, len(clients))
+	for _, client := range clients {
+		addresses[client.ID] = client.Address
+	}
+
+	nets, err := r.db.Networks.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	var mangleRules, filterRules [][]string
+	dnat := make(map[string]*network.Chain, len(nets))
+	for _, net := range nets {
+		checked, dockerNet, err := r.networks.check(ctx, net.ID)
+		if err != nil {
+			logging.Warn(ctx, "skipping port forwards of network", "network", net.ID, "err", err)
+			continue
+		}
+		ctr := dockerNet.Container
+		mark := fmt.Sprintf("0x%x", checked.Mark|network.ForwardedConnmark)
+		bridge := dockerNet.Bridge()
+
+		var dnatRules [][]string
+		for _, f := range forwards {
+			address := addresses[f.ClientID]
+			if f.NetworkID != net.ID || address == "" {
+				continue
+			}
+
+			external := strconv.Itoa(f.ExternalPort)
+			internal := strconv.Itoa(f.InternalPort)
+			dnatRules = append(dnatRules, []string{
+				"-p", f.Protocol, "--dport", external,
+				"-j", "DNAT", "--to-destination", fmt.Sprintf("%s:%s", address, internal),
+			})
+
+			match := []string{"-i", bridge, "-d", address, "-p", f.Protocol, "--dport", internal, "-m", "conntrack", "--ctstate", "NEW"}
+			mangleRules = append(mangleRules, append(append([]string{}, match...), "-j", "CONNMARK", "--set-mark", mark))
+			filterRules = append(filterRules, append(append([]string{}, match...), "-j", "ACCEPT"))
+		}
+
+		chain, ok := r.dnat[ctr.DockerID]
+		if !ok {
+			chain, err = ctr.NewChain(ctx, "nat", portForwardChain, "PREROUTING", "-i", ctr.TunnelInterface())
+			if err != nil {
+				return fmt.Errorf("network %s: %w", net.ID, err)
+			}
+		}
+		dnat[ctr.DockerID] = chain
+		if err := chain.Replace(ctx, dnatRules); err != nil {
+			return fmt.Errorf("network %s: %w", net.ID, err)
+		}
+	}
+	r.dnat = dnat
+
+	// Replies to forwarded connections take the mark of their network,
+	// and skip the chains which would otherwise choose their route. Other
+	// marked connections, e.g. those of pools, are left to their chains.
+	forwarded := fmt.Sprintf("0x%x/0x%x", network.ForwardedConnmark, network.ForwardedConnmark)
+	mangleRules = append(mangleRules,
+		[]string{"-i", r.lanInterface, "-m", "connmark", "--mark", forwarded,
+			"-j", "CONNMARK", "--restore-mark", "--nfmask", "0xffffffff", "--ctmask", fmt.Sprintf("0x%x", ^uint32(network.ForwardedConnmark))},
+		[]string{"-i", r.lanInterface, "-m", "connmark", "--mark", forwarded, "-j", "ACCEPT"},
+	)
+
+	if err := r.mangle.Replace(ctx, mangleRules); err != nil {
+		return err
+	}
+	return r.filter.Replace(ctx, filterRules)
+}
+
+func (r *PortForwardReconciler) Get(ctx context.Context, id string) (*database.PortForward, error) {
+	return r.db.PortForwards.Get(ctx, id)
+}
+
+func (r *PortForwardReconciler) Create(ctx context.Context, f *database.PortForward) (*database.PortForward, error) {
+	if err := r.validate(ctx, f); err != nil {
+		return nil, err
+	}
+
+	forward, err := r.db.PortForwards.Put(ctx, f)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.rebuild(ctx); err != nil {
+		// TODO: clean up database
+		return nil, err
+	}
+	return forward, nil
+}
+
+func (r *PortForwardReconciler) Update(ctx context.Context, f *database.PortForward) (*database.PortForward, error) {
+	if _, err := r.db.PortForwards.Get(ctx, f.ID); err != nil {
+		return nil, err
+	}
+	if err := r.validate(ctx, f); err != nil {
+		return nil, err
+	}
+
+	if err := r.db.PortForwards.Update(ctx, f); err != nil {
+		return nil, err
+	}
+
+	if err := r.rebuild(ctx); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (r *PortForwardReconciler) Delete(ctx context.Context, id string) error {
+	if err := r.db.PortForwards.Delete(ctx, id); err != nil {
+		return err
+	}
+	return r.rebuild(ctx)
+}
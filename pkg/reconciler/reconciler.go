@@ -2,32 +2,71 @@ package reconciler
 
 import (
 	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/pricec/vpnmux/pkg/database"
+	"github.com/pricec/vpnmux/pkg/events"
+	"github.com/pricec/vpnmux/pkg/network"
 )
 
+// ErrInvalid is returned (wrapped) when a resource fails validation.
+var ErrInvalid = fmt.Errorf("invalid resource")
+
 type ForwardingOptions struct {
 	LANInterface string
 	WANInterface string
 	DNSMark      string
+	WANMark      string
+	// Reject IPv6 from clients assigned to a network without IPv6.
+	BlockIPv6 bool
 }
 
 type Options struct {
 	DB         *database.Database
 	Network    NetworkReconcilerOptions
 	Forwarding ForwardingOptions
+	Clients    ClientOptions
+	// Interval at which every resource is rechecked, reinstalling missing
+	// rules and routes; zero disables the periodic reconciliation.
+	ReconcileInterval time.Duration
+	// Interval at which tunnel and client counters are sampled; zero
+	// disables sampling.
+	MonitorInterval time.Duration
+	// Receives the repairs made by the periodic reconciliation and the
+	// state transitions of tunnels; optional.
+	Events *events.Broker
 }
 
 type Reconciler struct {
 	db             *database.Database
+	events         *events.Broker
+	failing        map[string]bool
+	tunnelsMu      sync.Mutex
+	tunnels        map[string]tunnelState
 	Configs        *ConfigReconciler
 	Networks       *NetworkReconciler
 	Clients        *ClientReconciler
 	ClientNetworks *ClientNetworkReconciler
 	DNS            *DNSReconciler
+	DomainRoutes   *DomainRouteReconciler
+	Policies       *PolicyReconciler
+	ClientGroups   *ClientGroupReconciler
+	Accounting     *AccountingReconciler
+	Shaping        *ShapingReconciler
+	PortForwards   *PortForwardReconciler
+	Schedules      *ScheduleReconciler
+	Pools          *PoolReconciler
+	KillSwitches   *KillSwitchReconciler
 }
 
 func New(ctx context.Context, opts Options) (*Reconciler, error) {
+	if err := validateMarks(opts.Network, opts.Forwarding); err != nil {
+		return nil, err
+	}
+
 	configs, err := NewConfigReconciler(ctx, opts.DB)
 	if err != nil {
 		return nil, err
@@ -38,29 +77,222 @@ func New(ctx context.Context, opts Options) (*Reconciler, error) {
 		return nil, err
 	}
 
-	clients, err := NewClientReconciler(ctx, opts.DB, opts.Forwarding)
+	clients, err := NewClientReconciler(ctx, opts.DB, opts.Forwarding, opts.Clients)
+	if err != nil {
+		return nil, err
+	}
+
+	groups, err := NewClientGroupReconciler(ctx, opts.DB, opts.Forwarding)
+	if err != nil {
+		return nil, err
+	}
+
+	clientNetworks, err := NewClientNetworkReconciler(ctx, opts.DB, opts.Forwarding, groups)
+	if err != nil {
+		return nil, err
+	}
+
+	dns, err := NewDNSReconciler(ctx, opts.DB, networks, opts.Forwarding.DNSMark, opts.Network.LocalSubnetCIDR)
+	if err != nil {
+		return nil, err
+	}
+
+	domainRoutes, err := NewDomainRouteReconciler(ctx, opts.DB, networks, opts.Forwarding)
 	if err != nil {
 		return nil, err
 	}
 
-	clientNetworks, err := NewClientNetworkReconciler(ctx, opts.DB, opts.Forwarding)
+	policies, err := NewPolicyReconciler(ctx, opts.DB, networks, opts.Network.LocalSubnetCIDR, opts.Forwarding)
 	if err != nil {
 		return nil, err
 	}
 
-	dns, err := NewDNSReconciler(ctx, opts.DB, opts.Forwarding.DNSMark, opts.Network.LocalSubnetCIDR)
+	pools, err := NewPoolReconciler(ctx, opts.DB, networks, policies)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Reconciler{
+	killSwitches, err := NewKillSwitchReconciler(ctx, opts.DB, opts.Forwarding)
+	if err != nil {
+		return nil, err
+	}
+
+	accounting, err := NewAccountingReconciler(ctx, opts.DB, networks)
+	if err != nil {
+		return nil, err
+	}
+
+	clients.OnAddressChange(func(ctx context.Context, c *database.Client) error {
+		_, _, err := clientNetworks.check(ctx, c.ID)
+		if err == database.ErrNotFound {
+			return nil
+		}
+		return err
+	})
+	clients.OnAddressChange(func(ctx context.Context, c *database.Client) error {
+		return groups.member(ctx, c.ID)
+	})
+	clients.OnAddressChange(func(ctx context.Context, _ *database.Client) error {
+		return domainRoutes.rebuild(ctx)
+	})
+	clients.OnAddressChange(func(ctx context.Context, _ *database.Client) error {
+		return policies.rebuild(ctx)
+	})
+	clients.OnAddressChange(func(ctx context.Context, _ *database.Client) error {
+		return killSwitches.rebuild(ctx)
+	})
+	shaping, err := NewShapingReconciler(ctx, opts.DB, networks)
+	if err != nil {
+		return nil, err
+	}
+
+	portForwards, err := NewPortForwardReconciler(ctx, opts.DB, networks, opts.Forwarding)
+	if err != nil {
+		return nil, err
+	}
+
+	clients.OnAddressChange(func(ctx context.Context, _ *database.Client) error {
+		return accounting.rebuild(ctx)
+	})
+	clients.OnAddressChange(func(ctx context.Context, _ *database.Client) error {
+		return shaping.rebuild(ctx)
+	})
+	clients.OnAddressChange(func(ctx context.Context, _ *database.Client) error {
+		return portForwards.rebuild(ctx)
+	})
+	clients.OnChange(accounting.rebuild)
+	clients.OnChange(shaping.rebuild)
+	clients.OnChange(portForwards.rebuild)
+	clients.OnChange(policies.rebuild)
+	clients.OnChange(killSwitches.rebuild)
+	clientNetworks.OnChange(killSwitches.rebuild)
+	groups.OnChange(killSwitches.rebuild)
+	pools.OnChange(killSwitches.rebuild)
+	groups.OnChange(domainRoutes.rebuild)
+	groups.OnChange(policies.rebuild)
+	groups.OnChange(shaping.rebuild)
+	networks.OnChange(accounting.rebuild)
+	networks.OnChange(shaping.rebuild)
+	networks.OnChange(portForwards.rebuild)
+	go clients.track(ctx)
+
+	schedules := NewScheduleReconciler(opts.DB, clientNetworks, opts.Events)
+	go schedules.run(ctx)
+
+	r := &Reconciler{
 		db:             opts.DB,
+		events:         opts.Events,
+		failing:        make(map[string]bool),
+		tunnels:        make(map[string]tunnelState),
 		Configs:        configs,
 		Networks:       networks,
 		Clients:        clients,
 		ClientNetworks: clientNetworks,
 		DNS:            dns,
-	}, nil
+		DomainRoutes:   domainRoutes,
+		Policies:       policies,
+		ClientGroups:   groups,
+		Accounting:     accounting,
+		Shaping:        shaping,
+		PortForwards:   portForwards,
+		Schedules:      schedules,
+		Pools:          pools,
+		KillSwitches:   killSwitches,
+	}
+	pools.tunnelState = r.TunnelState
+	go r.reconcileLoop(ctx, opts.ReconcileInterval)
+	go r.monitorLoop(ctx, opts.MonitorInterval)
+	return r, nil
+}
+
+// notify calls each of the observers of a change.
+func notify(ctx context.Context, observers []func(context.Context) error) error {
+	for _, fn := range observers {
+		if err := fn(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clientMatch identifies a client's packets by MAC address where known,
+// since it is stable across address changes, or else by address.
+func clientMatch(c *database.Client) network.Match {
+	if c.MAC != "" {
+		return network.Match{SourceMAC: c.MAC}
+	}
+	return network.Match{Source: c.Address}
+}
+
+// clientMatch6 identifies a client's IPv6 packets like clientMatch, or
+// returns false if neither its MAC nor its IPv6 address is known.
+func clientMatch6(c *database.Client) (network.Match, bool) {
+	if c.MAC != "" {
+		return network.Match{SourceMAC: c.MAC}, true
+	}
+	return network.Match{Source: c.Address6}, c.Address6 != ""
+}
+
+// networkClient installs the forwarding rules for a client.
+func networkClient(ctx context.Context, c *database.Client, forwarding ForwardingOptions) (*network.Client, error) {
+	return network.NewClient(ctx, c.Address, c.Address6, c.MAC, forwarding.LANInterface, forwarding.WANInterface)
+}
+
+// restrictIPv6 blocks IPv6 from a client routed via dockerNet unless the
+// network carries IPv6, or lifts the block if dockerNet is nil.
+func restrictIPv6(ctx context.Context, c *network.Client, dockerNet *network.Network, forwarding ForwardingOptions) error {
+	if dockerNet != nil && dockerNet.Container.IPAddress6 == "" && forwarding.BlockIPv6 {
+		return c.BlockIPv6(ctx)
+	}
+	return c.UnblockIPv6(ctx)
+}
+
+// sourceMatches identifies the IPv4 (or, if v6, the IPv6) packets of a
+// client, or of every subnet and member of a group. If neither is given, a
+// single match of any source is returned.
+func sourceMatches(ctx context.Context, db *database.Database, clientID, groupID string, v6 bool) ([]network.Match, error) {
+	var result []network.Match
+	addClient := func(id string) error {
+		client, err := db.Clients.Get(ctx, id)
+		if err != nil {
+			return err
+		}
+		if !v6 {
+			result = append(result, clientMatch(client))
+		} else if m, ok := clientMatch6(client); ok {
+			result = append(result, m)
+		}
+		return nil
+	}
+
+	switch {
+	case clientID != "" && groupID != "":
+		return nil, fmt.Errorf("%w: only one of client_id or group_id may be given", ErrInvalid)
+	case clientID != "":
+		if err := addClient(clientID); err != nil {
+			return nil, err
+		}
+		return result, nil
+	case groupID != "":
+		group, err := db.ClientGroups.Get(ctx, groupID)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, cidr := range group.CIDRs {
+			if strings.Contains(cidr, ":") == v6 {
+				result = append(result, network.Match{Source: cidr})
+			}
+		}
+		for _, id := range group.Members {
+			if err := addClient(id); err != nil {
+				return nil, err
+			}
+		}
+		return result, nil
+	default:
+		return []network.Match{{}}, nil
+	}
 }
 
 func (r *Reconciler) CreateNetwork(ctx context.Context, n *database.Network) (*database.Network, error) {
@@ -68,5 +300,5 @@ func (r *Reconciler) CreateNetwork(ctx context.Context, n *database.Network) (*d
 	if err != nil {
 		return nil, err
 	}
-	return r.Networks.create(ctx, n.Name, cfg)
+	return r.Networks.create(ctx, n, cfg)
 }
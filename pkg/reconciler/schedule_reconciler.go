@@ -0,0 +1,272 @@
+package reconciler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pricec/vpnmux/pkg/audit"
+	"github.com/pricec/vpnmux/pkg/database"
+	"github.com/pricec/vpnmux/pkg/events"
+	"github.com/pricec/vpnmux/pkg/logging"
+	"github.com/pricec/vpnmux/pkg/schedule"
+)
+
+// scheduleRecheck is the longest the scheduler sleeps, so that it notices
+// changes of the wall clock, and the delay before a failed assignment is
+// retried.
+const scheduleRecheck = time.Minute
+
+// ScheduleReconciler assigns clients to the networks of their schedules.
+// Each schedule is applied when it is created or changed, at startup, and
+// whenever one of its windows opens or closes; in between, assignments
+// made by other means are left alone.
+type ScheduleReconciler struct {
+	db             *database.Database
+	clientNetworks *ClientNetworkReconciler
+	events         *events.Broker
+
+	mu      sync.Mutex
+	changed map[string]bool
+	wake    chan struct{}
+}
+
+// ScheduleState is the assignment chosen by a schedule now.
+type ScheduleState struct {
+	NetworkID string `json:"network_id"`
+	// The index of the open window, or -1 if none is and the client is
+	// assigned to the default network.
+	Window int `json:"window"`
+	// When a window next opens or closes, if ever.
+	Next *time.Time `json:"next,omitempty"`
+}
+
+func NewScheduleReconciler(db *database.Database, clientNetworks *ClientNetworkReconciler, broker *events.Broker) *ScheduleReconciler {
+	return &ScheduleReconciler{
+		db:             db,
+		clientNetworks: clientNetworks,
+		events:         broker,
+		changed:        make(map[string]bool),
+		wake:           make(chan struct{}, 1),
+	}
+}
+
+func (r *ScheduleReconciler) validate(ctx context.Context, s *database.Schedule) (*schedule.Schedule, error) {
+	compiled, err := schedule.Compile(s)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+
+	if _, err := r.db.Clients.Get(ctx, s.ClientID); err != nil {
+		return nil, fmt.Errorf("%w: client %q: %v", ErrInvalid, s.ClientID, err)
+	}
+	networks := []string{s.DefaultNetworkID}
+	for _, w := range s.Windows {
+		networks = append(networks, w.NetworkID)
+	}
+	for _, id := range networks {
+		if id == "" {
+			continue
+		}
+		if _, err := r.db.Networks.Get(ctx, id); err != nil {
+			return nil, fmt.Errorf("%w: network %q: %v", ErrInvalid, id, err)
+		}
+	}
+	return compiled, nil
+}
+
+func (r *ScheduleReconciler) Get(ctx context.Context, id string) (*database.Schedule, error) {
+	return r.db.Schedules.Get(ctx, id)
+}
+
+// State returns the assignment chosen by a schedule now.
+func (r *ScheduleReconciler) State(ctx context.Context, id string) (*ScheduleState, error) {
+	s, err := r.db.Schedules.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	compiled, err := schedule.Compile(s)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	state := &ScheduleState{}
+	state.NetworkID, state.Window = compiled.Network(now)
+	if next := compiled.Next(now); !next.IsZero() {
+		state.Next = &next
+	}
+	return state, nil
+}
+
+func (r *ScheduleReconciler) Create(ctx context.Context, s *database.Schedule) (*database.Schedule, error) {
+	if _, err := r.validate(ctx, s); err != nil {
+		return nil, err
+	}
+
+	result, err := r.db.Schedules.Put(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	r.trigger(result.ID)
+	return result, nil
+}
+
+func (r *ScheduleReconciler) Update(ctx context.Context, s *database.Schedule) (*database.Schedule, error) {
+	if _, err := r.db.Schedules.Get(ctx, s.ID); err != nil {
+		return nil, err
+	}
+	if _, err := r.validate(ctx, s); err != nil {
+		return nil, err
+	}
+
+	if err := r.db.Schedules.Update(ctx, s); err != nil {
+		return nil, err
+	}
+	r.trigger(s.ID)
+	return s, nil
+}
+
+// Delete deletes a schedule, leaving its client assigned to the network it
+// was last assigned to.
+func (r *ScheduleReconciler) Delete(ctx context.Context, id string) error {
+	return r.db.Schedules.Delete(ctx, id)
+}
+
+// trigger makes the scheduler apply a schedule which was created or
+// changed.
+func (r *ScheduleReconciler) trigger(id string) {
+	r.mu.Lock()
+	r.changed[id] = true
+	r.mu.Unlock()
+
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run applies every schedule, and then each schedule whenever it changes
+// or one of its windows opens or closes, until ctx is done.
+func (r *ScheduleReconciler) run(ctx context.Context) {
+	ctx = audit.NewContext(logging.With(ctx, "loop", "schedule"), audit.Origin{Actor: "schedule"})
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	// When each schedule is next applied, or the zero time if only once it
+	// changes; schedules which are not in due are applied immediately.
+	due := make(map[string]time.Time)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		case <-r.wake:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		}
+
+		wait := r.applyDue(ctx, due, time.Now())
+		timer.Reset(wait)
+	}
+}
+
+// applyDue applies the schedules which changed or are due at now, updates
+// when each is next due and returns how long to wait for the next.
+func (r *ScheduleReconciler) applyDue(ctx context.Context, due map[string]time.Time, now time.Time) time.Duration {
+	r.mu.Lock()
+	changed := r.changed
+	r.changed = make(map[string]bool)
+	r.mu.Unlock()
+
+	schedules, err := r.db.Schedules.List(ctx)
+	if err != nil {
+		logging.Error(ctx, "error listing schedules", "err", err)
+		for id := range changed {
+			r.trigger(id)
+		}
+		return scheduleRecheck
+	}
+
+	seen := make(map[string]bool, len(schedules))
+	wait := scheduleRecheck
+	for _, s := range schedules {
+		seen[s.ID] = true
+		next, ok := due[s.ID]
+		if ok && !changed[s.ID] && next.IsZero() {
+			continue
+		}
+		if ok && !changed[s.ID] && now.Before(next) {
+			wait = minDuration(wait, next.Sub(now))
+			continue
+		}
+
+		next, err := r.apply(ctx, s, now)
+		if err != nil {
+			logging.Error(ctx, "error applying schedule", "schedule", s.ID, "client", s.ClientID, "err", err)
+			next = now.Add(scheduleRecheck)
+		}
+		due[s.ID] = next
+		if !next.IsZero() {
+			wait = minDuration(wait, next.Sub(now))
+		}
+	}
+
+	for id := range due {
+		if !seen[id] {
+			delete(due, id)
+		}
+	}
+	return wait
+}
+
+// apply assigns the client of a schedule to the network the schedule
+// chooses at now, if it isn't already, and returns when the schedule is
+// next due, or the zero time if never.
+func (r *ScheduleReconciler) apply(ctx context.Context, s *database.Schedule, now time.Time) (time.Time, error) {
+	compiled, err := schedule.Compile(s)
+	if err != nil {
+		return time.Time{}, err
+	}
+	networkID, window := compiled.Network(now)
+	next := compiled.Next(now)
+
+	current, err := r.db.ClientNetworks.Get(ctx, s.ClientID)
+	exists := err == nil
+	if err != nil && !errors.Is(err, database.ErrNotFound) {
+		return next, err
+	}
+
+	cn := &database.ClientNetwork{ClientID: s.ClientID, NetworkID: networkID}
+	var action string
+	switch {
+	case networkID == "" && !exists, exists && current.NetworkID == networkID:
+		return next, nil
+	case networkID == "":
+		action, cn = events.TypeDelete, nil
+		err = r.clientNetworks.Delete(ctx, s.ClientID)
+	case exists:
+		action = events.TypeUpdate
+		cn, err = r.clientNetworks.Update(ctx, cn)
+	default:
+		action = events.TypeCreate
+		cn, err = r.clientNetworks.Create(ctx, cn)
+	}
+	if err != nil {
+		return next, err
+	}
+
+	logging.Info(ctx, "applied schedule", "schedule", s.ID, "client", s.ClientID, "network", networkID, "window", window)
+	r.events.Publish(ctx, action, "client/network", s.ClientID, cn)
+	return next, nil
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
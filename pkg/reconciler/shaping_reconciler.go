@@ -0,0 +1,190 @@
+package reconciler
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/pricec/vpnmux/pkg/database"
+	"github.com/pricec/vpnmux/pkg/network"
+)
+
+// ShapingReconciler installs the rate limits of networks, client groups and
+// clients on each network's bridge. A network's limit is shared by all of
+// its traffic, a group's by all of its subnets and members, and a member's
+// own limit applies within its group's.
+type ShapingReconciler struct {
+	db       *database.Database
+	networks *NetworkReconciler
+	mu       sync.Mutex
+	shapers  map[string]*network.Shaper
+}
+
+func NewShapingReconciler(ctx context.Context, db *database.Database, networks *NetworkReconciler) (*ShapingReconciler, error) {
+	r := &ShapingReconciler{
+		db:       db,
+		networks: networks,
+		shapers:  make(map[string]*network.Shaper),
+	}
+	if err := r.rebuild(ctx); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func validateRateLimit(l database.RateLimit) error {
+	if l.UploadKbit < 0 || l.DownloadKbit < 0 {
+		return fmt.Errorf("%w: rate limits must not be negative", ErrInvalid)
+	}
+	return nil
+}
+
+// limit returns the limit of one direction.
+type limit func(database.RateLimit) int
+
+func upload(l database.RateLimit) int   { return l.UploadKbit }
+func download(l database.RateLimit) int { return l.DownloadKbit }
+
+func addresses(c *database.Client) []string {
+	var result []string
+	for _, address := range []string{c.Address, c.Address6} {
+		if address != "" {
+			result = append(result, address)
+		}
+	}
+	return result
+}
+
+// hierarchy returns the classes limiting one direction of a network's
+// traffic, or nil if nothing in that direction is limited.
+func hierarchy(net *database.Network, groups []*database.ClientGroup, clients []*database.Client, rate limit) *network.ShapingClass {
+	root := &network.ShapingClass{
+		ID:       net.ID,
+		RateKbit: rate(net.RateLimit),
+	}
+
+	byID := make(map[string]*database.Client, len(clients))
+	for _, client := range clients {
+		byID[client.ID] = client
+	}
+
+	placed := make(map[string]bool)
+	for _, group := range groups {
+		if rate(group.RateLimit) == 0 {
+			continue
+		}
+
+		class := &network.ShapingClass{
+			ID:       group.ID,
+			RateKbit: rate(group.RateLimit),
+			Sources:  append([]string{}, group.CIDRs...),
+		}
+		for _, id := range group.Members {
+			client, ok := byID[id]
+			if !ok {
+				continue
+			}
+			placed[id] = true
+
+			if rate(client.RateLimit) == 0 {
+				class.Sources = append(class.Sources, addresses(client)...)
+				continue
+			}
+			class.Children = append(class.Children, &network.ShapingClass{
+				ID:       client.ID,
+				RateKbit: rate(client.RateLimit),
+				Sources:  addresses(client),
+			})
+		}
+		root.Children = append(root.Children, class)
+	}
+
+	for _, client := range clients {
+		if placed[client.ID] || rate(client.RateLimit) == 0 {
+			continue
+		}
+		root.Children = append(root.Children, &network.ShapingClass{
+			ID:       client.ID,
+			RateKbit: rate(client.RateLimit),
+			Sources:  addresses(client),
+		})
+	}
+
+	if root.RateKbit == 0 && len(root.Children) == 0 {
+		return nil
+	}
+	return root
+}
+
+// rebuild applies the limits to the bridge of every network, and removes
+// the limits of networks which no longer exist.
+func (r *ShapingReconciler) rebuild(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	nets, err := r.db.Networks.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	groups, err := r.db.ClientGroups.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	clients, err := r.db.Clients.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	shapers := make(map[string]*network.Shaper, len(nets))
+	for _, net := range nets {
+		_, dockerNet, err := r.networks.check(ctx, net.ID)
+		if err != nil {
+			return err
+		}
+
+		shaper, ok := r.shapers[net.ID]
+		if !ok {
+			shaper = network.NewShaper(dockerNet.Bridge())
+		}
+		shapers[net.ID] = shaper
+
+		err = shaper.Apply(ctx,
+			hierarchy(net, groups, clients, upload),
+			hierarchy(net, groups, clients, download),
+		)
+		if err != nil {
+			return fmt.Errorf("shaping network %s: %w", net.ID, err)
+		}
+	}
+
+	var result error
+	for id, shaper := range r.shapers {
+		if _, ok := shapers[id]; !ok {
+			if err := shaper.Close(ctx); err != nil {
+				result = multierror.Append(result, err)
+			}
+		}
+	}
+	r.shapers = shapers
+	return result
+}
+
+// Status returns the limits installed on a network's bridge and their
+// counters.
+func (r *ShapingReconciler) Status(ctx context.Context, id string) (*network.ShapingStatus, error) {
+	if _, err := r.db.Networks.Get(ctx, id); err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	shaper, ok := r.shapers[id]
+	if !ok {
+		return &network.ShapingStatus{}, nil
+	}
+	return shaper.Status(ctx)
+}
@@ -0,0 +1,202 @@
+// Package schedule evaluates the weekly windows of a schedule: which
+// network a client is assigned to at a given time, and when that next
+// changes.
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // for gateways without a time zone database
+
+	"github.com/pricec/vpnmux/pkg/database"
+)
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// Schedule is a compiled database.Schedule.
+type Schedule struct {
+	location       *time.Location
+	windows        []window
+	defaultNetwork string
+}
+
+type window struct {
+	days [7]bool
+	// Minutes since midnight; end is at most 24 hours.
+	start, end int
+	network    string
+}
+
+// Compile parses the time zone and windows of a schedule.
+func Compile(s *database.Schedule) (*Schedule, error) {
+	location := time.Local
+	if s.TimeZone != "" {
+		var err error
+		if location, err = time.LoadLocation(s.TimeZone); err != nil {
+			return nil, fmt.Errorf("time zone %q: %v", s.TimeZone, err)
+		}
+	}
+
+	result := &Schedule{
+		location:       location,
+		defaultNetwork: s.DefaultNetworkID,
+	}
+	for i, w := range s.Windows {
+		compiled, err := compileWindow(w)
+		if err != nil {
+			return nil, fmt.Errorf("window %d: %v", i, err)
+		}
+		result.windows = append(result.windows, compiled)
+	}
+	return result, nil
+}
+
+func compileWindow(w database.ScheduleWindow) (window, error) {
+	result := window{network: w.NetworkID}
+
+	var err error
+	if result.start, err = parseTime(w.Start, false); err != nil {
+		return result, fmt.Errorf("start: %v", err)
+	}
+	if result.end, err = parseTime(w.End, true); err != nil {
+		return result, fmt.Errorf("end: %v", err)
+	}
+	if result.start == result.end {
+		return result, fmt.Errorf("window is empty")
+	}
+
+	if len(w.Days) == 0 {
+		for i := range result.days {
+			result.days[i] = true
+		}
+	}
+	for _, days := range w.Days {
+		if err := parseDays(days, &result.days); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// parseTime parses a time of day, e.g. "08:30", as minutes since midnight.
+// Midnight may be given as "24:00" at the end of a window.
+func parseTime(s string, end bool) (int, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 || len(parts[1]) != 2 {
+		return 0, fmt.Errorf("%q is not a time of day such as 08:30", s)
+	}
+	hour, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a time of day such as 08:30", s)
+	}
+	minute, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a time of day such as 08:30", s)
+	}
+
+	switch {
+	case end && hour == 24 && minute == 0:
+		return 24 * 60, nil
+	case hour < 0 || hour > 23 || minute < 0 || minute > 59:
+		return 0, fmt.Errorf("%q is out of range", s)
+	}
+	return hour*60 + minute, nil
+}
+
+// parseDays sets the days of the week named by s: a day, e.g. "mon", a
+// range of days, e.g. "mon-fri" or "fri-mon", or "*" for every day.
+func parseDays(s string, days *[7]bool) error {
+	if s == "*" {
+		for i := range days {
+			days[i] = true
+		}
+		return nil
+	}
+
+	first, last := s, s
+	if i := strings.Index(s, "-"); i >= 0 {
+		first, last = s[:i], s[i+1:]
+	}
+	from, ok := weekday(first)
+	if !ok {
+		return fmt.Errorf("unknown day %q", first)
+	}
+	to, ok := weekday(last)
+	if !ok {
+		return fmt.Errorf("unknown day %q", last)
+	}
+	for d := from; ; d = (d + 1) % 7 {
+		days[d] = true
+		if d == to {
+			return nil
+		}
+	}
+}
+
+func weekday(s string) (int, bool) {
+	s = strings.ToLower(s)
+	for i, day := range weekdays {
+		if s == day {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// Network returns the ID of the network to which the schedule assigns its
+// client at t, and the index of the window which is open, or -1 if none
+// is, in which case the network is the default one.
+func (s *Schedule) Network(t time.Time) (string, int) {
+	t = t.In(s.location)
+	day := int(t.Weekday())
+	minute := t.Hour()*60 + t.Minute()
+	for i, w := range s.windows {
+		if w.open(day, minute) {
+			return w.network, i
+		}
+	}
+	return s.defaultNetwork, -1
+}
+
+// open returns true iff the window is open at the given minute of the
+// given day.
+func (w window) open(day, minute int) bool {
+	if w.start < w.end {
+		return w.days[day] && w.start <= minute && minute < w.end
+	}
+	// The window ends on the day after it starts.
+	return (w.days[day] && minute >= w.start) || (w.days[(day+6)%7] && minute < w.end)
+}
+
+// Next returns the first time after t at which a window of the schedule
+// opens or closes, or the zero time if none ever does. Times which don't
+// exist on a day, because of a daylight saving time transition, are
+// shifted as by time.Date.
+func (s *Schedule) Next(t time.Time) time.Time {
+	local := t.In(s.location)
+	var next time.Time
+	// A week from the day before, since a window may close the day after
+	// it opens.
+	for offset := -1; offset <= 7; offset += 1 {
+		date := local.AddDate(0, 0, offset)
+		day := int(date.Weekday())
+		for _, w := range s.windows {
+			if !w.days[day] {
+				continue
+			}
+			end := w.end
+			if w.end <= w.start {
+				end += 24 * 60
+			}
+			for _, minute := range []int{w.start, end} {
+				boundary := time.Date(date.Year(), date.Month(), date.Day(), 0, minute, 0, 0, s.location)
+				if boundary.After(t) && (next.IsZero() || boundary.Before(next)) {
+					next = boundary
+				}
+			}
+		}
+	}
+	return next
+}
@@ -0,0 +1,102 @@
+package schedule_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pricec/vpnmux/pkg/database"
+	"github.com/pricec/vpnmux/pkg/schedule"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNetwork(t *testing.T) {
+	s, err := schedule.Compile(&database.Schedule{
+		TimeZone:         "Europe/Paris",
+		DefaultNetworkID: "home",
+		Windows: []database.ScheduleWindow{
+			{Days: []string{"mon-fri"}, Start: "08:00", End: "15:00", NetworkID: "filtered"},
+			{Days: []string{"Sat", "sun"}, Start: "22:00", End: "07:00", NetworkID: "night"},
+			{Start: "00:00", End: "24:00", NetworkID: ""},
+		},
+	})
+	require.Nil(t, err)
+
+	paris, err := time.LoadLocation("Europe/Paris")
+	require.Nil(t, err)
+	for _, tc := range []struct {
+		time    time.Time
+		network string
+		window  int
+	}{
+		// Monday 2026-10-19.
+		{time.Date(2026, 10, 19, 8, 0, 0, 0, paris), "filtered", 0},
+		{time.Date(2026, 10, 19, 14, 59, 59, 0, paris), "filtered", 0},
+		{time.Date(2026, 10, 19, 15, 0, 0, 0, paris), "", 2},
+		// The same instant in another zone.
+		{time.Date(2026, 10, 19, 6, 30, 0, 0, time.UTC), "filtered", 0},
+		// Saturday night, and the Monday morning it ends on.
+		{time.Date(2026, 10, 24, 23, 0, 0, 0, paris), "night", 1},
+		{time.Date(2026, 10, 26, 6, 59, 0, 0, paris), "night", 1},
+		{time.Date(2026, 10, 26, 7, 0, 0, 0, paris), "", 2},
+	} {
+		network, window := s.Network(tc.time)
+		require.Equal(t, tc.network, network, tc.time)
+		require.Equal(t, tc.window, window, tc.time)
+	}
+
+	s, err = schedule.Compile(&database.Schedule{
+		DefaultNetworkID: "home",
+		Windows: []database.ScheduleWindow{
+			{Days: []string{"wed"}, Start: "08:00", End: "09:00", NetworkID: "work"},
+		},
+	})
+	require.Nil(t, err)
+	network, window := s.Network(time.Date(2026, 10, 19, 8, 30, 0, 0, time.Local))
+	require.Equal(t, "home", network)
+	require.Equal(t, -1, window)
+}
+
+func TestNext(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	require.Nil(t, err)
+	s, err := schedule.Compile(&database.Schedule{
+		TimeZone: "Europe/Paris",
+		Windows: []database.ScheduleWindow{
+			{Days: []string{"mon-fri"}, Start: "08:00", End: "15:00", NetworkID: "filtered"},
+			{Days: []string{"sat"}, Start: "22:00", End: "02:30", NetworkID: "night"},
+		},
+	})
+	require.Nil(t, err)
+
+	for _, tc := range []struct {
+		time time.Time
+		next time.Time
+	}{
+		{time.Date(2026, 10, 19, 7, 0, 0, 0, paris), time.Date(2026, 10, 19, 8, 0, 0, 0, paris)},
+		{time.Date(2026, 10, 19, 8, 0, 0, 0, paris), time.Date(2026, 10, 19, 15, 0, 0, 0, paris)},
+		{time.Date(2026, 10, 23, 15, 0, 0, 0, paris), time.Date(2026, 10, 24, 22, 0, 0, 0, paris)},
+		// The window closes after the end of daylight saving time.
+		{time.Date(2026, 10, 24, 22, 0, 0, 0, paris), time.Date(2026, 10, 25, 2, 30, 0, 0, paris)},
+	} {
+		require.True(t, tc.next.Equal(s.Next(tc.time)), "%v: %v", tc.time, s.Next(tc.time))
+	}
+
+	s, err = schedule.Compile(&database.Schedule{})
+	require.Nil(t, err)
+	require.True(t, s.Next(time.Now()).IsZero())
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, s := range []*database.Schedule{
+		{TimeZone: "Mars/Olympus"},
+		{Windows: []database.ScheduleWindow{{Start: "8", End: "09:00"}}},
+		{Windows: []database.ScheduleWindow{{Start: "08:00", End: "25:00"}}},
+		{Windows: []database.ScheduleWindow{{Start: "24:00", End: "08:00"}}},
+		{Windows: []database.ScheduleWindow{{Start: "08:00", End: "08:00"}}},
+		{Windows: []database.ScheduleWindow{{Days: []string{"monday"}, Start: "08:00", End: "09:00"}}},
+		{Windows: []database.ScheduleWindow{{Days: []string{"mon-"}, Start: "08:00", End: "09:00"}}},
+	} {
+		_, err := schedule.Compile(s)
+		require.NotNil(t, err, s)
+	}
+}
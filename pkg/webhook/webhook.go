@@ -0,0 +1,311 @@
+// Package webhook delivers events to webhooks: each matching event is
+// POSTed as JSON, signed with the webhook's secret, and retried with
+// exponential backoff until it is accepted or too many attempts fail. Every
+// delivery is recorded in the database.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pricec/vpnmux/pkg/database"
+	"github.com/pricec/vpnmux/pkg/events"
+	"github.com/pricec/vpnmux/pkg/logging"
+)
+
+// Headers of each delivery. The signature is the hex-encoded HMAC-SHA256
+// of the body keyed with the webhook's secret, prefixed with "sha256=".
+const (
+	SignatureHeader = "X-Vpnmux-Signature"
+	EventHeader     = "X-Vpnmux-Event"
+	DeliveryHeader  = "X-Vpnmux-Delivery"
+)
+
+// ErrInvalid is returned (wrapped) when a webhook fails validation.
+var ErrInvalid = errors.New("invalid webhook")
+
+// errNoSecret fails the deliveries of webhooks without a secret, e.g. those
+// created by earlier versions, which are only sent once one is given.
+var errNoSecret = errors.New("webhook has no secret to sign deliveries with")
+
+// Validate checks that a webhook's URL is absolute HTTP(S) and that it
+// filters on known event types.
+func Validate(w *database.Webhook) error {
+	u, err := url.Parse(w.URL)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w: url must be an absolute http or https URL", ErrInvalid)
+	}
+
+	for _, typ := range w.Events {
+		known := false
+		for _, t := range events.Types {
+			known = known || t == typ
+		}
+		if !known {
+			return fmt.Errorf("%w: unknown event type %q", ErrInvalid, typ)
+		}
+	}
+	return nil
+}
+
+// ValidateNew checks a webhook like Validate, and that it has a secret with
+// which its deliveries are signed.
+func ValidateNew(w *database.Webhook) error {
+	if w.Secret == "" {
+		return fmt.Errorf("%w: secret is required", ErrInvalid)
+	}
+	return Validate(w)
+}
+
+// Sign returns the signature of a payload.
+func Sign(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+type Options struct {
+	// Timeout of each attempt.
+	Timeout time.Duration
+	// Deliveries fail once attempted this many times.
+	MaxAttempts int
+	// Delay before the first retry, doubled after each further attempt up
+	// to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// How long finished deliveries are kept; zero keeps them forever.
+	Retention time.Duration
+	// Interval at which due retries are checked for.
+	PollInterval time.Duration
+}
+
+// Dispatcher subscribes to events and delivers them to the webhooks they
+// match.
+type Dispatcher struct {
+	db     *database.WebhookDatabase
+	broker *events.Broker
+	opts   Options
+	client *http.Client
+	wake   chan struct{}
+}
+
+// NewDispatcher returns a dispatcher of the events published from now on,
+// which runs until ctx is done. Deliveries still pending then are attempted
+// once it runs again.
+func NewDispatcher(ctx context.Context, db *database.WebhookDatabase, broker *events.Broker, opts Options) (*Dispatcher, error) {
+	_, ch, cancel, err := broker.Subscribe(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Dispatcher{
+		db:     db,
+		broker: broker,
+		opts:   opts,
+		client: &http.Client{Timeout: opts.Timeout},
+		wake:   make(chan struct{}, 1),
+	}
+	ctx = logging.With(ctx, "loop", "webhook")
+	go d.subscribe(ctx, ch, cancel)
+	go d.deliverLoop(ctx)
+	return d, nil
+}
+
+// subscribe queues deliveries of events as they are published, resuming
+// from the last event seen if the subscription is dropped.
+func (d *Dispatcher) subscribe(ctx context.Context, ch <-chan *database.Event, cancel func()) {
+	var lastID int64
+	for {
+		for e := range ch {
+			d.queue(ctx, e)
+			lastID = e.ID
+		}
+		cancel()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(d.opts.PollInterval):
+			}
+
+			var missed []*database.Event
+			var err error
+			missed, ch, cancel, err = d.broker.Subscribe(ctx, lastID)
+			if errors.Is(err, events.ErrClosed) {
+				return
+			}
+			if err != nil {
+				logging.Error(ctx, "error subscribing to events", "err", err)
+				continue
+			}
+			for _, e := range missed {
+				d.queue(ctx, e)
+				lastID = e.ID
+			}
+			break
+		}
+	}
+}
+
+// queue adds a delivery of an event to each webhook it matches.
+func (d *Dispatcher) queue(ctx context.Context, e *database.Event) {
+	if e.Type == events.TypeReset {
+		return
+	}
+
+	webhooks, err := d.db.List(ctx)
+	if err != nil {
+		logging.Error(ctx, "error listing webhooks", "err", err)
+		return
+	}
+
+	payload, err := json.Marshal(e)
+	if err != nil {
+		logging.Error(ctx, "error encoding event", "event_id", e.ID, "err", err)
+		return
+	}
+
+	now := time.Now()
+	for _, w := range webhooks {
+		if !w.Matches(e.Type, e.Resource) {
+			continue
+		}
+		err := d.db.AddDelivery(ctx, &database.WebhookDelivery{
+			WebhookID:   w.ID,
+			EventID:     e.ID,
+			EventType:   e.Type,
+			Payload:     payload,
+			Status:      database.DeliveryPending,
+			Created:     now,
+			Updated:     now,
+			NextAttempt: now,
+		})
+		if err != nil {
+			logging.Error(ctx, "error queueing webhook delivery", "webhook", w.ID, "event_id", e.ID, "err", err)
+		}
+	}
+
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// deliverLoop attempts deliveries as they fall due, and prunes those
+// finished before the retention.
+func (d *Dispatcher) deliverLoop(ctx context.Context) {
+	ticker := time.NewTicker(d.opts.PollInterval)
+	defer ticker.Stop()
+
+	var pruned time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-d.wake:
+		}
+
+		now := time.Now()
+		deliveries, err := d.db.DueDeliveries(ctx, now)
+		if err != nil {
+			logging.Error(ctx, "error listing webhook deliveries", "err", err)
+			continue
+		}
+		for _, delivery := range deliveries {
+			d.attempt(ctx, delivery)
+		}
+
+		if d.opts.Retention > 0 && now.Sub(pruned) > time.Hour {
+			if err := d.db.PruneDeliveries(ctx, now.Add(-d.opts.Retention)); err != nil {
+				logging.Error(ctx, "error pruning webhook deliveries", "err", err)
+			}
+			pruned = now
+		}
+	}
+}
+
+// attempt makes one attempt of a delivery and records its outcome.
+func (d *Dispatcher) attempt(ctx context.Context, delivery *database.WebhookDelivery) {
+	w, err := d.db.Get(ctx, delivery.WebhookID)
+	if err != nil {
+		logging.Error(ctx, "error reading webhook", "webhook", delivery.WebhookID, "err", err)
+		return
+	}
+
+	delivery.Attempts += 1
+	delivery.ResponseCode, err = d.post(ctx, w, delivery)
+	delivery.Updated = time.Now()
+	delivery.Error = ""
+
+	switch {
+	case err == nil:
+		delivery.Status = database.DeliveryDelivered
+	case delivery.Attempts >= d.opts.MaxAttempts:
+		delivery.Status = database.DeliveryFailed
+		delivery.Error = err.Error()
+		logging.Warn(ctx, "webhook delivery failed", "webhook", w.ID, "delivery", delivery.ID, "attempts", delivery.Attempts, "err", err)
+	default:
+		delivery.Error = err.Error()
+		delivery.NextAttempt = delivery.Updated.Add(d.backoff(delivery.Attempts))
+	}
+
+	if err := d.db.UpdateDelivery(ctx, delivery); err != nil {
+		logging.Error(ctx, "error recording webhook delivery", "delivery", delivery.ID, "err", err)
+	}
+}
+
+// backoff returns the delay after the given number of failed attempts.
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	delay := d.opts.Backoff
+	for i := 1; i < attempts && delay < d.opts.MaxBackoff; i += 1 {
+		delay *= 2
+	}
+	if delay > d.opts.MaxBackoff {
+		delay = d.opts.MaxBackoff
+	}
+	return delay
+}
+
+// post sends a delivery, returning the response code; only 2xx responses
+// are successful.
+func (d *Dispatcher) post(ctx context.Context, w *database.Webhook, delivery *database.WebhookDelivery) (int, error) {
+	if w.Secret == "" {
+		return 0, errNoSecret
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, delivery.EventType)
+	req.Header.Set(DeliveryHeader, fmt.Sprint(delivery.ID))
+	req.Header.Set(SignatureHeader, Sign(w.Secret, delivery.Payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
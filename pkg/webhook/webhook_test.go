@@ -0,0 +1,194 @@
+package webhook_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pricec/vpnmux/pkg/database"
+	"github.com/pricec/vpnmux/pkg/events"
+	"github.com/pricec/vpnmux/pkg/webhook"
+	"github.com/stretchr/testify/require"
+)
+
+var testOptions = webhook.Options{
+	Timeout:      time.Second,
+	MaxAttempts:  3,
+	Backoff:      10 * time.Millisecond,
+	MaxBackoff:   20 * time.Millisecond,
+	PollInterval: 5 * time.Millisecond,
+}
+
+// receiver is a local webhook endpoint which fails the first failures
+// requests.
+type receiver struct {
+	mu       sync.Mutex
+	failures int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (rcv *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	rcv.requests = append(rcv.requests, r)
+	rcv.bodies = append(rcv.bodies, body)
+	if rcv.failures > 0 {
+		rcv.failures -= 1
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (rcv *receiver) count() int {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	return len(rcv.requests)
+}
+
+type harness struct {
+	db     *database.Database
+	broker *events.Broker
+	ctx    context.Context
+}
+
+func newHarness(t *testing.T) *harness {
+	f, err := os.CreateTemp("", "")
+	require.Nil(t, err)
+	f.Close()
+	t.Cleanup(func() { os.Remove(f.Name()) })
+
+	db, err := database.New(context.Background(), f.Name())
+	require.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	broker := events.NewBroker(ctx, db.Events, 100)
+	_, err = webhook.NewDispatcher(ctx, db.Webhooks, broker, testOptions)
+	require.Nil(t, err)
+	return &harness{db: db, broker: broker, ctx: ctx}
+}
+
+// deliveries waits for the deliveries to a webhook to finish, and returns
+// them.
+func (h *harness) deliveries(t *testing.T, id string, n int) []*database.WebhookDelivery {
+	var deliveries []*database.WebhookDelivery
+	require.Eventually(t, func() bool {
+		var err error
+		deliveries, err = h.db.Webhooks.Deliveries(context.Background(), id, 100)
+		require.Nil(t, err)
+		if len(deliveries) != n {
+			return false
+		}
+		for _, d := range deliveries {
+			if d.Status == database.DeliveryPending {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+	return deliveries
+}
+
+func TestDelivery(t *testing.T) {
+	h := newHarness(t)
+	rcv := &receiver{failures: 1}
+	srv := httptest.NewServer(rcv)
+	defer srv.Close()
+
+	w, err := h.db.Webhooks.Put(h.ctx, &database.Webhook{
+		Name:      "credentials",
+		URL:       srv.URL,
+		Secret:    "s3cret",
+		Events:    []string{events.TypeCreate, events.TypeUpdate, events.TypeDelete},
+		Resources: []string{"credential"},
+	})
+	require.Nil(t, err)
+
+	h.broker.Publish(h.ctx, events.TypeUpdate, "client", "c1", nil)
+	h.broker.Publish(h.ctx, events.TypeUpdate, "credential", "cred1", map[string]string{"value": "REDACTED"})
+
+	deliveries := h.deliveries(t, w.ID, 1)
+	d := deliveries[0]
+	require.Equal(t, database.DeliveryDelivered, d.Status)
+	require.Equal(t, 2, d.Attempts)
+	require.Equal(t, http.StatusNoContent, d.ResponseCode)
+
+	// The first attempt failed and was retried.
+	require.Equal(t, 2, rcv.count())
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	req, body := rcv.requests[1], rcv.bodies[1]
+	require.Equal(t, webhook.Sign("s3cret", body), req.Header.Get(webhook.SignatureHeader))
+	require.Equal(t, events.TypeUpdate, req.Header.Get(webhook.EventHeader))
+	require.Equal(t, "application/json", req.Header.Get("Content-Type"))
+
+	var e database.Event
+	require.Nil(t, json.Unmarshal(body, &e))
+	require.Equal(t, "credential", e.Resource)
+	require.Equal(t, "cred1", e.ResourceID)
+}
+
+func TestDeliveryFailure(t *testing.T) {
+	h := newHarness(t)
+	rcv := &receiver{failures: 100}
+	srv := httptest.NewServer(rcv)
+	defer srv.Close()
+
+	w, err := h.db.Webhooks.Put(h.ctx, &database.Webhook{
+		Name:   "outages",
+		URL:    srv.URL,
+		Secret: "s3cret",
+		Events: []string{events.TypeNetworkState},
+	})
+	require.Nil(t, err)
+
+	h.broker.Publish(h.ctx, events.TypeNetworkState, "network", "n1", map[string]string{"state": "down", "previous": "up"})
+
+	deliveries := h.deliveries(t, w.ID, 1)
+	require.Equal(t, database.DeliveryFailed, deliveries[0].Status)
+	require.Equal(t, testOptions.MaxAttempts, deliveries[0].Attempts)
+	require.Equal(t, http.StatusInternalServerError, deliveries[0].ResponseCode)
+	require.NotEmpty(t, deliveries[0].Error)
+	require.Equal(t, testOptions.MaxAttempts, rcv.count())
+}
+
+func TestDeliveryWithoutSecret(t *testing.T) {
+	h := newHarness(t)
+	rcv := &receiver{}
+	srv := httptest.NewServer(rcv)
+	defer srv.Close()
+
+	// Webhooks stored without a secret are never sent unsigned deliveries.
+	w, err := h.db.Webhooks.Put(h.ctx, &database.Webhook{
+		Name:   "legacy",
+		URL:    srv.URL,
+		Events: []string{events.TypeNetworkState},
+	})
+	require.Nil(t, err)
+
+	h.broker.Publish(h.ctx, events.TypeNetworkState, "network", "n1", map[string]string{"state": "down", "previous": "up"})
+
+	deliveries := h.deliveries(t, w.ID, 1)
+	require.Equal(t, database.DeliveryFailed, deliveries[0].Status)
+	require.Contains(t, deliveries[0].Error, "secret")
+	require.Equal(t, 0, rcv.count())
+}
+
+func TestValidate(t *testing.T) {
+	require.Nil(t, webhook.Validate(&database.Webhook{URL: "https://example.com/hook", Events: []string{events.TypeNetworkState}}))
+	require.Nil(t, webhook.ValidateNew(&database.Webhook{URL: "https://example.com/hook", Secret: "s3cret"}))
+	require.ErrorIs(t, webhook.ValidateNew(&database.Webhook{URL: "https://example.com/hook"}), webhook.ErrInvalid)
+	require.ErrorIs(t, webhook.Validate(&database.Webhook{URL: "example.com/hook"}), webhook.ErrInvalid)
+	require.ErrorIs(t, webhook.Validate(&database.Webhook{URL: "ftp://example.com"}), webhook.ErrInvalid)
+	require.ErrorIs(t, webhook.Validate(&database.Webhook{URL: "http://example.com", Events: []string{"bogus"}}), webhook.ErrInvalid)
+}